@@ -0,0 +1,217 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"washboard/auth"
+	"washboard/db"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+type createAccountRequest struct {
+	UserName string `json:"userName" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+}
+
+// updateAccountRequest changes the role and/or resets the password of an account
+type updateAccountRequest struct {
+	Role     string `json:"role"`
+	Password string `json:"password"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" binding:"required"`
+	NewPassword     string `json:"newPassword" binding:"required"`
+}
+
+// getAccountOrAbort loads an account and writes 404 or 500 if that fails
+func getAccountOrAbort(c *gin.Context, userName string) (*types.Account, bool) {
+	account, err := db.GetAccount(userName)
+	target := &werrors.DoesNotExistError{}
+	if errors.As(err, &target) {
+		handleError(c, err, "No result", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		handleError(c, err, "Failed to get account", http.StatusInternalServerError)
+		return nil, false
+	}
+	return account, true
+}
+
+// GetAccounts returns all accounts
+func GetAccounts(c *gin.Context) {
+	accounts, err := db.GetAllAccounts()
+	if err != nil {
+		handleError(c, err, "Failed to get accounts", http.StatusInternalServerError)
+		return
+	}
+	dtos := make([]types.AccountDto, 0, len(accounts))
+	for _, account := range accounts {
+		dtos = append(dtos, account.Dto())
+	}
+	c.JSON(http.StatusOK, gin.H{"accounts": dtos})
+}
+
+// GetAccount returns the account with the user name of the path
+func GetAccount(c *gin.Context) {
+	account, ok := getAccountOrAbort(c, c.Param("name"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, account.Dto())
+}
+
+// GetOwnAccount returns the account of the authenticated user
+func GetOwnAccount(c *gin.Context) {
+	account, ok := getAccountOrAbort(c, currentUserName(c))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, account.Dto())
+}
+
+// CreateAccount creates an account.
+//
+// Request Body:
+//   - userName, password (at least 8 characters), role (viewer, operator or admin)
+//
+// Responses:
+//   - 201 Created: the account
+//   - 400 Bad Request: invalid values
+//   - 409 Conflict: the user name is taken
+func CreateAccount(c *gin.Context) {
+	var request createAccountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	account, err := auth.NewAccount(request.UserName, request.Password, request.Role)
+	if err != nil {
+		handleError(c, err, "Invalid account", http.StatusBadRequest)
+		return
+	}
+	if err := db.CreateAccount(account); err != nil {
+		target := &werrors.CannotInsertError{}
+		if errors.As(err, &target) {
+			handleError(c, err, "Account already exists", http.StatusConflict)
+			return
+		}
+		handleError(c, err, "Failed to create account", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s created account %s with role %s", currentUserName(c), account.UserName, account.Role)
+	c.JSON(http.StatusCreated, account.Dto())
+}
+
+// UpdateAccount changes the role of an account and resets its password if one is given, which
+// logs out all sessions of the account. The last admin can not be demoted.
+func UpdateAccount(c *gin.Context) {
+	var request updateAccountRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	account, ok := getAccountOrAbort(c, c.Param("name"))
+	if !ok {
+		return
+	}
+
+	if request.Role != "" && request.Role != account.Role {
+		if !auth.ValidRole(request.Role) {
+			handleError(c, errors.New(request.Role), "Unknown role", http.StatusBadRequest)
+			return
+		}
+		if account.Role == types.RoleAdmin {
+			if err := auth.CheckAdminRemains(account.UserName, request.Role); err != nil {
+				handleError(c, err, "Cannot change role", http.StatusConflict)
+				return
+			}
+		}
+		account.Role = request.Role
+		account.UpdatedAt = time.Now().Unix()
+	}
+	if request.Password != "" {
+		if account.Provider != "" {
+			handleError(c, errors.New(account.Provider), "Accounts of single sign-on users have no password", http.StatusBadRequest)
+			return
+		}
+		if err := auth.SetPassword(account, request.Password); err != nil {
+			handleError(c, err, "Invalid password", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	if request.Password != "" {
+		if _, err := auth.RevokeSessions(account.UserName, ""); err != nil {
+			glg.Errorf("Failed to revoke sessions of %s after the password reset: %s", account.UserName, err)
+		}
+	}
+	glg.Infof("%s updated account %s", currentUserName(c), account.UserName)
+	c.JSON(http.StatusOK, account.Dto())
+}
+
+// DeleteAccount deletes an account. The last admin can not be deleted.
+func DeleteAccount(c *gin.Context) {
+	account, ok := getAccountOrAbort(c, c.Param("name"))
+	if !ok {
+		return
+	}
+	if account.Role == types.RoleAdmin {
+		if err := auth.CheckAdminRemains(account.UserName, ""); err != nil {
+			handleError(c, err, "Cannot delete account", http.StatusConflict)
+			return
+		}
+	}
+	if err := db.DeleteAccount(account.UserName); err != nil {
+		handleError(c, err, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+	if _, err := auth.RevokeSessions(account.UserName, ""); err != nil {
+		glg.Errorf("Failed to revoke sessions of deleted account %s: %s", account.UserName, err)
+	}
+	glg.Infof("%s deleted account %s", currentUserName(c), account.UserName)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted successfully."})
+}
+
+// ChangeOwnPassword changes the password of the authenticated user after checking the current one
+// and logs out all other sessions of the user
+func ChangeOwnPassword(c *gin.Context) {
+	var request changePasswordRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	account, ok := getAccountOrAbort(c, currentUserName(c))
+	if !ok {
+		return
+	}
+	if !auth.ComparePasswords(account.PasswordHash, []byte(request.CurrentPassword)) {
+		handleError(c, errors.New("wrong password"), "Current password is wrong", http.StatusForbidden)
+		return
+	}
+	if err := auth.SetPassword(account, request.NewPassword); err != nil {
+		handleError(c, err, "Invalid password", http.StatusBadRequest)
+		return
+	}
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	// other logins may have been made with the old password
+	if _, err := auth.RevokeSessions(account.UserName, currentUser(c).SessionId); err != nil {
+		glg.Errorf("Failed to revoke other sessions of %s: %s", account.UserName, err)
+	}
+	glg.Infof("%s changed their password", account.UserName)
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully."})
+}
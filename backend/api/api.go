@@ -1,7 +1,13 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
 	"washboard/state"
+	"washboard/types"
+	"washboard/werrors"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kpango/glg"
@@ -16,3 +22,48 @@ func handleError(c *gin.Context, err error, context string, statusCode int) {
 		"error":   err.Error(),
 	})
 }
+
+// portainerErrorStatus returns the status to answer a failed portainer request with: not found and
+// conflict answers of the docker proxy are passed on, everything else is a bad gateway
+func portainerErrorStatus(err error) int {
+	var portainerErr *werrors.PortainerError
+	if errors.As(err, &portainerErr) && (portainerErr.StatusCode == http.StatusNotFound || portainerErr.StatusCode == http.StatusConflict) {
+		return portainerErr.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+// queryEndpointId parses the endpointId query parameter. If it is missing, the first managed
+// endpoint is used. Endpoints washboard does not manage are rejected.
+func queryEndpointId(c *gin.Context) (int, error) {
+	managed := appState.Config.EndpointIds()
+	endpoint := c.Query("endpointId")
+	if endpoint == "" {
+		return managed[0], nil
+	}
+	endpointId, err := strconv.Atoi(endpoint)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert endpointId \"%s\" to int", endpoint)
+	}
+	for _, managedId := range managed {
+		if managedId == endpointId {
+			return endpointId, nil
+		}
+	}
+	return 0, fmt.Errorf("endpoint %d is not managed by washboard", endpointId)
+}
+
+// currentUser returns the identity of the request
+func currentUser(c *gin.Context) *types.User {
+	if identity, ok := c.Get(types.IdentityKey); ok {
+		if user, ok := identity.(*types.User); ok {
+			return user
+		}
+	}
+	return &types.User{}
+}
+
+// currentUserName returns the name of the authenticated user of the request
+func currentUserName(c *gin.Context) string {
+	return currentUser(c).UserName
+}
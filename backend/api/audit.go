@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"washboard/db"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+var auditCsvHeader = []string{"id", "timestamp", "userName", "apiTokenId", "action", "target", "params", "result", "statusCode", "error", "clientIp"}
+
+// GetAudit returns the audit log, newest first.
+//
+// Query Parameters:
+//   - user, action, target, result (optional): only return entries matching all given values,
+//     action also matches its sub actions, e.g. "stack" matches "stack.start"
+//   - from, to (optional): unix timestamps limiting the time of the action
+//   - page (optional, default 1), pageSize (optional, default 50, max 500)
+//   - export (optional): csv or json returns all matching entries as a file download, ignoring paging.
+//     At most the configured audit export limit of entries are exported.
+//
+// Responses:
+//   - 200 OK: {"entries": [...], "total": n, "page": page, "pageSize": pageSize}
+//   - 400 Bad Request: a parameter could not be parsed, or more entries match than can be
+//     exported, narrow the filter or the time range
+func GetAudit(c *gin.Context) {
+	filter := &types.AuditFilter{
+		UserName: c.Query("user"),
+		Action:   c.Query("action"),
+		Target:   c.Query("target"),
+		Result:   c.Query("result"),
+	}
+	from, err := queryInt(c, "from", 0)
+	if err != nil {
+		handleError(c, err, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	to, err := queryInt(c, "to", 0)
+	if err != nil {
+		handleError(c, err, "Invalid to", http.StatusBadRequest)
+		return
+	}
+	filter.From, filter.To = int64(from), int64(to)
+
+	export := c.Query("export")
+	if export != "" {
+		if export != "csv" && export != "json" {
+			handleError(c, fmt.Errorf("export must be csv or json"), "Invalid export", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = appState.Config.AuditExportLimit
+		entries, total, err := db.ListAudit(filter)
+		if err != nil {
+			handleError(c, err, "Failed to get audit log", http.StatusInternalServerError)
+			return
+		}
+		if total > filter.Limit {
+			handleError(c, fmt.Errorf("%d entries match, at most %d can be exported", total, filter.Limit), "Too many entries to export", http.StatusBadRequest)
+			return
+		}
+		exportAudit(c, entries, export)
+		return
+	}
+
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		handleError(c, fmt.Errorf("page must be a positive int"), "Invalid page", http.StatusBadRequest)
+		return
+	}
+	pageSize, err := queryInt(c, "pageSize", defaultAuditPageSize)
+	if err != nil || pageSize < 1 {
+		handleError(c, fmt.Errorf("pageSize must be a positive int"), "Invalid pageSize", http.StatusBadRequest)
+		return
+	}
+	if pageSize > maxAuditPageSize {
+		pageSize = maxAuditPageSize
+	}
+	filter.Offset = (page - 1) * pageSize
+	filter.Limit = pageSize
+
+	entries, total, err := db.ListAudit(filter)
+	if err != nil {
+		handleError(c, err, "Failed to get audit log", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"entries":  entries,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// exportAudit writes entries as attachment in format csv or json
+func exportAudit(c *gin.Context, entries []types.AuditEntry, format string) {
+	fileName := fmt.Sprintf("washboard-audit-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	if format == "json" {
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(auditCsvHeader)
+	for _, entry := range entries {
+		params := ""
+		if len(entry.Params) > 0 {
+			encoded, _ := json.Marshal(entry.Params)
+			params = string(encoded)
+		}
+		writer.Write([]string{
+			entry.Id,
+			time.Unix(entry.Timestamp, 0).UTC().Format(time.RFC3339),
+			entry.UserName,
+			entry.ApiTokenId,
+			entry.Action,
+			entry.Target,
+			params,
+			entry.Result,
+			strconv.Itoa(entry.StatusCode),
+			entry.Error,
+			entry.ClientIp,
+		})
+	}
+	writer.Flush()
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
+	"washboard/control"
 	"washboard/db"
 	"washboard/portainer"
 	"washboard/types"
@@ -45,6 +47,22 @@ func CreateStackSettings(c *gin.Context) {
 		handleError(c, err, errorMessage, http.StatusBadRequest)
 		return
 	}
+	if stackSettings.EndpointId == 0 {
+		endpointId, err := queryEndpointId(c)
+		if err != nil {
+			handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+			return
+		}
+		stackSettings.EndpointId = endpointId
+	}
+	if err := control.ValidateUpdatePolicy(stackSettings); err != nil {
+		handleError(c, err, "Invalid update policy", http.StatusBadRequest)
+		return
+	}
+	if err := control.ValidateDependencies(stackSettings, ""); err != nil {
+		handleError(c, err, "Invalid dependencies", http.StatusBadRequest)
+		return
+	}
 	glg.Infof("Creating stack settings: %+v", stackSettings)
 	err := db.CreateStackSettings(stackSettings)
 	if err != nil {
@@ -70,7 +88,18 @@ func GetStackSettings(c *gin.Context) {
 	name := c.Param("name")
 
 	if name == "" {
-		stacks, err := db.GetAllStackSettings()
+		var stacks []types.StackSettings
+		var err error
+		if endpoint := c.Query("endpointId"); endpoint != "" {
+			endpointId, convErr := queryEndpointId(c)
+			if convErr != nil {
+				handleError(c, convErr, "Invalid endpointId", http.StatusBadRequest)
+				return
+			}
+			stacks, err = db.GetEndpointStackSettings(endpointId)
+		} else {
+			stacks, err = db.GetAllStackSettings()
+		}
 		if err != nil {
 			handleError(c, err, "Failed to get stack settings", http.StatusInternalServerError)
 			return
@@ -81,7 +110,12 @@ func GetStackSettings(c *gin.Context) {
 		})
 		return
 	}
-	stack, err := db.GetStackSettings(name)
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+	stack, err := db.GetStackSettings(endpointId, name)
 	target := &werrors.DoesNotExistError{}
 	if errors.As(err, &target) {
 		handleError(c, err, "No result", http.StatusNotFound)
@@ -109,20 +143,49 @@ func UpdateStackSettings(c *gin.Context) {
 		return
 	}
 
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+
+	// fields missing in the body keep their stored value, so clients that only know
+	// priority and autoStart do not reset the update policy
 	var stackSettings *types.StackSettings = &types.StackSettings{}
+	if stored, err := db.GetStackSettings(endpointId, name); err == nil {
+		stackSettings = stored
+	}
 	if err := c.ShouldBindJSON(&stackSettings); err != nil {
 		errorMessage := "Failed to bind json. Check the request body and ensure that the correct fields are present."
 		handleError(c, err, errorMessage, http.StatusBadRequest)
 		return
 	}
-	var err error
+	if stackSettings.EndpointId == 0 {
+		stackSettings.EndpointId = endpointId
+	}
+	if err := control.ValidateUpdatePolicy(stackSettings); err != nil {
+		handleError(c, err, "Invalid update policy", http.StatusBadRequest)
+		return
+	}
+	if err := control.ValidateDependencies(stackSettings, name); err != nil {
+		handleError(c, err, "Invalid dependencies", http.StatusBadRequest)
+		return
+	}
+	if stackSettings.StackName != name && !checkStackRemovable(c, endpointId, name) {
+		return
+	}
 	if updatePriority == "true" {
 		err = db.UpdateStackPriority(stackSettings)
 	} else {
-		err = db.UpdateStackSettings(stackSettings, name)
+		err = db.UpdateStackSettings(stackSettings, endpointId, name)
 	}
 
 
+	conflict := &werrors.CannotInsertError{}
+	if errors.As(err, &conflict) {
+		handleError(c, err, "Stack settings already exist", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"message": "Failed to update stack settings",
@@ -147,7 +210,16 @@ func DeleteStackSettings(c *gin.Context) {
 		return
 	}
 
-	err := db.DeleteStackSettings(name)
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+
+	if !checkStackRemovable(c, endpointId, name) {
+		return
+	}
+	err = db.DeleteStackSettings(endpointId, name)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -160,3 +232,27 @@ func DeleteStackSettings(c *gin.Context) {
 		"message": "Stack settings deleted successfully.",
 	})
 }
+
+// checkStackRemovable answers the request with 400 if the settings of a stack can not be renamed
+// or deleted because a group or the dependencies of other stacks refer to them by name
+func checkStackRemovable(c *gin.Context, endpointId int, name string) bool {
+	group, err := control.StackGroup(endpointId, name)
+	if err != nil {
+		handleError(c, err, "Failed to get group settings", http.StatusInternalServerError)
+		return false
+	}
+	if group != "" {
+		handleError(c, fmt.Errorf("stack %s belongs to group %s, remove it from the group first", name, group), "Stack settings are in use", http.StatusBadRequest)
+		return false
+	}
+	dependents, err := control.Dependents(endpointId, name)
+	if err != nil {
+		handleError(c, err, "Failed to get stack settings", http.StatusInternalServerError)
+		return false
+	}
+	if len(dependents) > 0 {
+		handleError(c, fmt.Errorf("stacks %s depend on stack %s, remove the dependencies first", strings.Join(dependents, ", "), name), "Stack settings are in use", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -417,7 +417,7 @@ func PortainerUpdateStack(c *gin.Context) {
 	}
 
 
-	res, err := portainer.EnqueueUpdateStack(endpointId, stackId, prune, pullImage)
+	res, err := portainer.EnqueueUpdateStack(endpointId, stackId, prune, pullImage, currentUserName(c))
 
 	if res == -2 {
 		glg.Errorf("Endpoint: %d, Stack: %d, %s", endpointId, stackId, err)
@@ -441,3 +441,58 @@ func PortainerUpdateStack(c *gin.Context) {
 	})
 }
 
+
+// PortainerRollbackStack redeploys the snapshot a stack had before an earlier update, pinned to the
+// image digests that were running at that time. The rollback is queued like an update and reported
+// over the stacks-update websocket.
+//
+// JSON Request Body Fields:
+// - endpointId (required, int): The Portainer endpoint where the stack is deployed.
+// - jobId (optional, string): The update job whose snapshot is redeployed. Defaults to the latest
+//   successful update of the stack that was not a rollback itself.
+//
+// Responses:
+// - 200 OK: The rollback was queued.
+// - 202 Accepted: An update of the stack is already queued, nothing was done.
+// - 400 Bad Request: The request body is missing required fields.
+// - 404 Not Found: There is no snapshot to roll back to or the stack could not be read from Portainer.
+func PortainerRollbackStack(c *gin.Context) {
+	stackId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		glg.Warn("stackId in path is not an int")
+		c.JSON(http.StatusBadRequest, gin.H{"message": "stackId in path is not an int"})
+		return
+	}
+
+	var reqBody struct {
+		EndpointId *int   `json:"endpointId"`
+		JobId      string `json:"jobId"`
+	}
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body.", http.StatusBadRequest)
+		return
+	}
+	if reqBody.EndpointId == nil {
+		glg.Warn("endpointId field is missing")
+		c.JSON(http.StatusBadRequest, gin.H{"message": "endpointId field is missing"})
+		return
+	}
+
+	res, err := portainer.EnqueueRollbackStack(*reqBody.EndpointId, stackId, reqBody.JobId, currentUserName(c))
+	if res == -2 {
+		glg.Errorf("Endpoint: %d, Stack: %d, %s", *reqBody.EndpointId, stackId, err)
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "Failed to roll back stack",
+			"error":   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		handleError(c, err, "Failed to roll back stack", http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": res,
+	})
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"washboard/audit"
+	"washboard/metrics"
+	"washboard/portainer"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/kpango/glg"
+)
+
+const defaultExecCmd = "/bin/sh"
+
+// WsContainerExec runs a command in a container and attaches a websocket to its TTY. The query
+// selects the endpointId, cmd (default /bin/sh), the user to run it as and the initial rows and
+// cols of the terminal. The output is sent as binary messages. The client sends its input as
+// binary messages or types.ExecMessage text messages, which can also resize the terminal. The
+// connection is closed with the exit code once the command ends. Every attempt is audited.
+func WsContainerExec(c *gin.Context) {
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+	cmd := strings.Fields(c.DefaultQuery("cmd", defaultExecCmd))
+	if len(cmd) == 0 {
+		handleError(c, errors.New("cmd must not be empty"), "Invalid command", http.StatusBadRequest)
+		return
+	}
+	rows, err := queryInt(c, "rows", 0)
+	if err != nil {
+		handleError(c, err, "Invalid terminal size", http.StatusBadRequest)
+		return
+	}
+	cols, err := queryInt(c, "cols", 0)
+	if err != nil {
+		handleError(c, err, "Invalid terminal size", http.StatusBadRequest)
+		return
+	}
+	containerId := c.Param("id")
+	user := currentUser(c)
+	entry := &types.AuditEntry{
+		UserName:   user.UserName,
+		ApiTokenId: user.ApiTokenId,
+		Action:     "container.exec",
+		Target:     "container:" + containerId,
+		Params:     map[string]interface{}{"endpointId": endpointId, "cmd": strings.Join(cmd, " ")},
+		ClientIp:   c.ClientIP(),
+	}
+	if execUser := c.Query("user"); execUser != "" {
+		entry.Params["user"] = execUser
+	}
+
+	// the session outlives the request, it ends with the websocket
+	session, err := portainer.StartExecSession(context.Background(), endpointId, containerId, cmd, c.Query("user"))
+	if err != nil {
+		status := portainerErrorStatus(err)
+		entry.Result, entry.StatusCode, entry.Error = types.AuditFailure, status, err.Error()
+		audit.Record(entry)
+		handleError(c, err, "Failed to start exec", status)
+		return
+	}
+	entry.Params["execId"] = session.Id
+
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		session.Close()
+		entry.Result, entry.StatusCode, entry.Error = types.AuditFailure, http.StatusBadRequest, err.Error()
+		audit.Record(entry)
+		glg.Errorf("error while upgrading to websocket: %s", err)
+		return
+	}
+	entry.Result, entry.StatusCode = types.AuditSuccess, http.StatusSwitchingProtocols
+	audit.Record(entry)
+	glg.Infof("%s runs %q in container %s as exec %s", entry.UserName, entry.Params["cmd"], containerId, session.Id)
+	metrics.WebsocketClients.Inc()
+
+	if rows > 0 && cols > 0 {
+		if err := session.Resize(rows, cols); err != nil {
+			glg.Warnf("failed to resize exec %s: %s", session.Id, err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go readExecInput(cancel, ws, session)
+	go pushExecOutput(ctx, cancel, ws, session)
+}
+
+// readExecInput passes the messages of the client to the process until the client is gone, then
+// detaches from the process
+func readExecInput(cancel context.CancelFunc, ws *websocket.Conn, session *portainer.ExecSession) {
+	defer session.Close()
+	// cancel before closing so the output pump knows the client detached
+	defer cancel()
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			if _, err := session.Write(data); err != nil {
+				return
+			}
+			continue
+		}
+		var message types.ExecMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			glg.Warnf("invalid message for exec %s: %s", session.Id, err)
+			continue
+		}
+		switch message.Type {
+		case types.ExecInput:
+			if _, err := session.Write([]byte(message.Data)); err != nil {
+				return
+			}
+		case types.ExecResize:
+			if err := session.Resize(message.Rows, message.Cols); err != nil {
+				glg.Warnf("failed to resize exec %s: %s", session.Id, err)
+			}
+		default:
+			glg.Warnf("unknown message type %q for exec %s", message.Type, session.Id)
+		}
+	}
+}
+
+// pushExecOutput sends the output of the process to the client and closes the websocket with the
+// exit code once the process ended
+func pushExecOutput(ctx context.Context, cancel context.CancelFunc, ws *websocket.Conn, session *portainer.ExecSession) {
+	defer metrics.WebsocketClients.Dec()
+	defer ws.Close()
+	defer cancel()
+	go keepAlive(ctx, ws)
+
+	buf := make([]byte, 32*1024)
+	var err error
+	for {
+		var n int
+		n, err = session.Read(buf)
+		if n > 0 {
+			if writeErr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); writeErr != nil {
+				return
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		glg.Debugf("client detached from exec %s", session.Id)
+		return
+	}
+	if !errors.Is(err, io.EOF) {
+		glg.Warnf("failed to read the output of exec %s: %s", session.Id, err)
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, closeReason(err)), time.Now().Add(time.Second))
+		return
+	}
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "process ended")
+	if exitCode, err := session.ExitCode(); err != nil {
+		glg.Warnf("failed to get the exit code of exec %s: %s", session.Id, err)
+	} else {
+		closeMessage = websocket.FormatCloseMessage(websocket.CloseNormalClosure, fmt.Sprintf("exited with code %d", exitCode))
+	}
+	ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"washboard/control"
+	"washboard/db"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+type groupActionRequest struct {
+	EndpointId int `json:"endpointId" binding:"required"`
+}
+
+type groupUpdateRequest struct {
+	EndpointId int   `json:"endpointId" binding:"required"`
+	PullImage  *bool `json:"pullImage" binding:"required"`
+	Prune      *bool `json:"prune" binding:"required"`
+}
+
+// groupStatus maps the errors of the group functions to response codes
+func groupStatus(err error) int {
+	notFound := &werrors.DoesNotExistError{}
+	conflict := &werrors.CannotInsertError{}
+	inProgress := &werrors.AlreadyInProgressError{}
+	switch {
+	case errors.As(err, &notFound):
+		return http.StatusNotFound
+	case errors.As(err, &conflict), errors.As(err, &inProgress):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// CreateGroupSettings creates a group of stacks.
+//
+// Request Body:
+//   - groupName: unique per endpoint
+//   - endpointId: defaults to the endpointId query parameter
+//   - globalPriority: position of the group among the ungrouped stacks of the endpoint
+//   - stacks: names of the stacks in the group, each needs stack settings and may only be in one group
+//
+// Responses:
+//   - 201 Created: the group
+//   - 400 Bad Request: invalid group or stacks
+//   - 409 Conflict: a group with the name already exists
+func CreateGroupSettings(c *gin.Context) {
+	group := &types.GroupSettings{}
+	if err := c.ShouldBindJSON(group); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	if group.EndpointId == 0 {
+		endpointId, err := queryEndpointId(c)
+		if err != nil {
+			handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+			return
+		}
+		group.EndpointId = endpointId
+	}
+	if err := control.ValidateGroupSettings(group, ""); err != nil {
+		handleError(c, err, "Invalid group", http.StatusBadRequest)
+		return
+	}
+	if err := db.CreateGroupSettings(group); err != nil {
+		handleError(c, err, "Failed to create group", groupStatus(err))
+		return
+	}
+	glg.Infof("%s created group %s in endpoint %d with stacks %v", currentUserName(c), group.GroupName, group.EndpointId, group.Stacks)
+	c.JSON(http.StatusCreated, gin.H{
+		"message":       "Group created successfully.",
+		"groupSettings": group,
+	})
+}
+
+// GetGroupSettings returns a group, or all groups (optionally filtered by the endpointId query
+// parameter) if no name is given
+func GetGroupSettings(c *gin.Context) {
+	name := c.Param("name")
+	if name == "" {
+		var groups []types.GroupSettings
+		var err error
+		if c.Query("endpointId") != "" {
+			endpointId, convErr := queryEndpointId(c)
+			if convErr != nil {
+				handleError(c, convErr, "Invalid endpointId", http.StatusBadRequest)
+				return
+			}
+			groups, err = db.GetEndpointGroupSettings(endpointId)
+		} else {
+			groups, err = db.GetAllGroupSettings()
+		}
+		if err != nil {
+			handleError(c, err, "Failed to get groups", http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "ok",
+			"groupSettings": groups,
+		})
+		return
+	}
+	group, ok := getGroupOrAbort(c, name)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "ok",
+		"groupSettings": group,
+	})
+}
+
+// UpdateGroupSettings replaces a group. Fields missing in the body keep their stored value, a new
+// groupName renames the group.
+func UpdateGroupSettings(c *gin.Context) {
+	name := c.Param("name")
+	group, ok := getGroupOrAbort(c, name)
+	if !ok {
+		return
+	}
+	endpointId := group.EndpointId
+	if err := c.ShouldBindJSON(group); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	// groups can not move between endpoints, their stacks are per endpoint
+	group.EndpointId = endpointId
+	saveGroup(c, group, name)
+}
+
+// DeleteGroupSettings deletes a group, its stacks become ungrouped
+func DeleteGroupSettings(c *gin.Context) {
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+	if err := db.DeleteGroupSettings(endpointId, c.Param("name")); err != nil {
+		handleError(c, err, "Failed to delete group", groupStatus(err))
+		return
+	}
+	glg.Infof("%s deleted group %s in endpoint %d", currentUserName(c), c.Param("name"), endpointId)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Group deleted successfully.",
+	})
+}
+
+// AddGroupStack adds the stack of the path to a group
+func AddGroupStack(c *gin.Context) {
+	name := c.Param("name")
+	group, ok := getGroupOrAbort(c, name)
+	if !ok {
+		return
+	}
+	stackName := c.Param("stack")
+	for _, member := range group.Stacks {
+		if member == stackName {
+			c.JSON(http.StatusOK, gin.H{"message": "ok", "groupSettings": group})
+			return
+		}
+	}
+	group.Stacks = append(group.Stacks, stackName)
+	saveGroup(c, group, name)
+}
+
+// RemoveGroupStack removes the stack of the path from a group
+func RemoveGroupStack(c *gin.Context) {
+	name := c.Param("name")
+	group, ok := getGroupOrAbort(c, name)
+	if !ok {
+		return
+	}
+	stackName := c.Param("stack")
+	members := make([]string, 0, len(group.Stacks))
+	for _, member := range group.Stacks {
+		if member != stackName {
+			members = append(members, member)
+		}
+	}
+	if len(members) == len(group.Stacks) {
+		handleError(c, errors.New(stackName), "Stack is not in the group", http.StatusNotFound)
+		return
+	}
+	group.Stacks = members
+	saveGroup(c, group, name)
+}
+
+// getGroupOrAbort loads the group name of the endpoint of the request or answers with 404
+func getGroupOrAbort(c *gin.Context, name string) (*types.GroupSettings, bool) {
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return nil, false
+	}
+	group, err := db.GetGroupSettings(endpointId, name)
+	if err != nil {
+		handleError(c, err, "Failed to get group", groupStatus(err))
+		return nil, false
+	}
+	return group, true
+}
+
+// saveGroup validates and stores a changed group that was stored as oldName
+func saveGroup(c *gin.Context, group *types.GroupSettings, oldName string) {
+	if err := control.ValidateGroupSettings(group, oldName); err != nil {
+		handleError(c, err, "Invalid group", http.StatusBadRequest)
+		return
+	}
+	if err := db.UpdateGroupSettings(group, group.EndpointId, oldName); err != nil {
+		handleError(c, err, "Failed to update group", groupStatus(err))
+		return
+	}
+	glg.Infof("%s updated group %s in endpoint %d with stacks %v", currentUserName(c), group.GroupName, group.EndpointId, group.Stacks)
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Group updated successfully.",
+		"groupSettings": group,
+	})
+}
+
+// PortainerStartGroup starts the stacks of a group in start order.
+//
+// Responses:
+//   - 200 OK: {"groupName": ..., "results": per stack result}
+//   - 404 Not Found: no such group in the endpoint
+//   - 409 Conflict: an action of the group is already running
+func PortainerStartGroup(c *gin.Context) {
+	portainerStartOrStopGroup(c, control.StartGroup)
+}
+
+// PortainerStopGroup stops the stacks of a group in reverse start order, responses as PortainerStartGroup
+func PortainerStopGroup(c *gin.Context) {
+	portainerStartOrStopGroup(c, control.StopGroup)
+}
+
+func portainerStartOrStopGroup(c *gin.Context, action func(endpointId int, groupName string) ([]types.GroupStackResult, error)) {
+	var request groupActionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the endpointId field is present.", http.StatusBadRequest)
+		return
+	}
+	results, err := action(request.EndpointId, c.Param("name"))
+	if err != nil {
+		handleError(c, err, "Failed to run group action", groupStatus(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"groupName": c.Param("name"),
+		"results":   results,
+	})
+}
+
+// PortainerUpdateGroup queues updates of the stacks of a group like PortainerUpdateStack, responses
+// as PortainerStartGroup
+func PortainerUpdateGroup(c *gin.Context) {
+	var request groupUpdateRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the endpointId, pullImage and prune fields are present.", http.StatusBadRequest)
+		return
+	}
+	results, err := control.UpdateGroup(request.EndpointId, c.Param("name"), *request.Prune, *request.PullImage, currentUserName(c))
+	if err != nil {
+		handleError(c, err, "Failed to update group", groupStatus(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"groupName": c.Param("name"),
+		"results":   results,
+	})
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"washboard/db"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultJobsPageSize = 50
+	maxJobsPageSize     = 500
+)
+
+// queryInt parses an optional integer query parameter, returning fallback if it is missing
+func queryInt(c *gin.Context, key string, fallback int) (int, error) {
+	raw := c.Query(key)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert %s \"%s\" to int", key, raw)
+	}
+	return value, nil
+}
+
+// GetJobs returns the stack update job history, newest first.
+//
+// Query Parameters:
+//   - endpointId, stackName, status (optional): only return jobs matching all given values
+//   - from, to (optional): unix timestamps limiting the time the job was queued at
+//   - page (optional, default 1), pageSize (optional, default 50, max 500)
+//
+// Responses:
+//   - 200 OK: {"jobs": [...], "total": n, "page": page, "pageSize": pageSize}
+//   - 400 Bad Request: a numeric parameter could not be parsed
+func GetJobs(c *gin.Context) {
+	filter := &types.JobFilter{
+		StackName: c.Query("stackName"),
+		Status:    c.Query("status"),
+	}
+	var err error
+	if filter.EndpointId, err = queryInt(c, "endpointId", 0); err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+	from, err := queryInt(c, "from", 0)
+	if err != nil {
+		handleError(c, err, "Invalid from", http.StatusBadRequest)
+		return
+	}
+	to, err := queryInt(c, "to", 0)
+	if err != nil {
+		handleError(c, err, "Invalid to", http.StatusBadRequest)
+		return
+	}
+	filter.From, filter.To = int64(from), int64(to)
+
+	page, err := queryInt(c, "page", 1)
+	if err != nil || page < 1 {
+		handleError(c, fmt.Errorf("page must be a positive int"), "Invalid page", http.StatusBadRequest)
+		return
+	}
+	pageSize, err := queryInt(c, "pageSize", defaultJobsPageSize)
+	if err != nil || pageSize < 1 {
+		handleError(c, fmt.Errorf("pageSize must be a positive int"), "Invalid pageSize", http.StatusBadRequest)
+		return
+	}
+	if pageSize > maxJobsPageSize {
+		pageSize = maxJobsPageSize
+	}
+	filter.Offset = (page - 1) * pageSize
+	filter.Limit = pageSize
+
+	jobs, total, err := db.ListJobs(filter)
+	if err != nil {
+		handleError(c, err, "Failed to get jobs", http.StatusInternalServerError)
+		return
+	}
+	dtos := make([]types.StackUpdateJobDto, 0, len(jobs))
+	for i := range jobs {
+		dtos = append(dtos, jobs[i].Dto())
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":     dtos,
+		"total":    total,
+		"page":     page,
+		"pageSize": pageSize,
+	})
+}
+
+// GetJob returns a single stack update job by id
+func GetJob(c *gin.Context) {
+	job, err := db.GetJob(c.Param("id"))
+	target := &werrors.DoesNotExistError{}
+	if errors.As(err, &target) {
+		handleError(c, err, "No result", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(c, err, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, job.Dto())
+}
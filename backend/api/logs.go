@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"washboard/metrics"
+	"washboard/portainer"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/kpango/glg"
+)
+
+const defaultLogTail = "100"
+
+// WsContainerLogs streams the logs of a container over a websocket, one types.LogLine per message.
+// The query selects the endpointId, follow (default true), tail (lines from the end or "all",
+// default 100), since (unix timestamp or a duration like 15m), timestamps, stdout and stderr
+// (default true) and filter, a regular expression the lines have to match. The connection is
+// closed once the logs end.
+func WsContainerLogs(c *gin.Context) {
+	endpointId, err := queryEndpointId(c)
+	if err != nil {
+		handleError(c, err, "Invalid endpointId", http.StatusBadRequest)
+		return
+	}
+	options, filter, err := logsOptions(c)
+	if err != nil {
+		handleError(c, err, "Invalid log options", http.StatusBadRequest)
+		return
+	}
+	containerId := c.Param("id")
+	// answer unknown containers before upgrading, the websocket can only report errors on close
+	container, err := portainer.GetClient().InspectContainer(c.Request.Context(), endpointId, containerId)
+	if err != nil {
+		handleError(c, err, "Failed to get container", portainerErrorStatus(err))
+		return
+	}
+
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		glg.Errorf("error while upgrading to websocket: %s", err)
+		return
+	}
+	glg.Infof("client %s follows the logs of container %s", c.ClientIP(), containerId)
+	metrics.WebsocketClients.Inc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// the client only sends close messages, stop streaming once it is gone
+		defer cancel()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	go pushLogs(ctx, cancel, ws, endpointId, container, options, filter)
+}
+
+func pushLogs(ctx context.Context, cancel context.CancelFunc, ws *websocket.Conn, endpointId int, container *portainer.ContainerDetails, options portainer.ContainerLogsOptions, filter *regexp.Regexp) {
+	defer metrics.WebsocketClients.Dec()
+	defer ws.Close()
+	defer cancel()
+	go keepAlive(ctx, ws)
+
+	err := portainer.FollowContainerLogs(ctx, endpointId, container, options, filter, func(line types.LogLine) error {
+		out, err := encodeJson(line)
+		if err != nil {
+			return err
+		}
+		return ws.WriteMessage(websocket.TextMessage, out)
+	})
+	if ctx.Err() != nil {
+		glg.Debugf("client stopped following the logs of container %s", container.Id)
+		return
+	}
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "end of logs")
+	if err != nil {
+		glg.Warnf("failed to stream the logs of container %s: %s", container.Id, err)
+		closeMessage = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, closeReason(err))
+	}
+	ws.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+}
+
+// keepAlive pings the client until ctx is done. Pings may be sent while another goroutine writes.
+func keepAlive(ctx context.Context, ws *websocket.Conn) {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// closeReason shortens err to the 123 bytes a close message has room for
+func closeReason(err error) string {
+	reason := err.Error()
+	if len(reason) > 123 {
+		reason = reason[:120] + "..."
+	}
+	return reason
+}
+
+func logsOptions(c *gin.Context) (portainer.ContainerLogsOptions, *regexp.Regexp, error) {
+	options := portainer.ContainerLogsOptions{Tail: c.DefaultQuery("tail", defaultLogTail)}
+	var err error
+	if options.Follow, err = queryBool(c, "follow", true); err != nil {
+		return options, nil, err
+	}
+	if options.Timestamps, err = queryBool(c, "timestamps", false); err != nil {
+		return options, nil, err
+	}
+	if options.Stdout, err = queryBool(c, "stdout", true); err != nil {
+		return options, nil, err
+	}
+	if options.Stderr, err = queryBool(c, "stderr", true); err != nil {
+		return options, nil, err
+	}
+	if !options.Stdout && !options.Stderr {
+		return options, nil, fmt.Errorf("at least one of stdout and stderr is required")
+	}
+	if options.Tail != "all" {
+		if tail, err := strconv.Atoi(options.Tail); err != nil || tail < 0 {
+			return options, nil, fmt.Errorf("tail %q is neither a number of lines nor all", options.Tail)
+		}
+	}
+	if since := c.Query("since"); since != "" {
+		if options.Since, err = strconv.ParseInt(since, 10, 64); err != nil {
+			duration, durationErr := time.ParseDuration(since)
+			if durationErr != nil || duration <= 0 {
+				return options, nil, fmt.Errorf("since %q is neither a unix timestamp nor a duration", since)
+			}
+			options.Since = time.Now().Add(-duration).Unix()
+		}
+	}
+	var filter *regexp.Regexp
+	if pattern := c.Query("filter"); pattern != "" {
+		if filter, err = regexp.Compile(pattern); err != nil {
+			return options, nil, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	return options, filter, nil
+}
+
+// queryBool parses an optional boolean query parameter
+func queryBool(c *gin.Context, name string, defaultValue bool) (bool, error) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s %q is not a boolean", name, value)
+	}
+	return parsed, nil
+}
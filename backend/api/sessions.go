@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"washboard/auth"
+	"washboard/db"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+// GetSessions returns the active logins of the authenticated user, or of all users for admins
+// passing all=true. The session of the request is marked as current.
+func GetSessions(c *gin.Context) {
+	user := currentUser(c)
+	userName := user.UserName
+	if c.Query("all") == "true" && user.Role == types.RoleAdmin {
+		userName = ""
+	}
+	sessions, err := db.ListSessions(userName)
+	if err != nil {
+		handleError(c, err, "Failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().Unix()
+	dtos := make([]types.SessionDto, 0, len(sessions))
+	for _, session := range sessions {
+		if session.Active(now) {
+			dtos = append(dtos, types.SessionDto{Session: session, Current: session.Id == user.SessionId})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": dtos})
+}
+
+// RevokeSession logs out a session of the authenticated user. Admins can revoke every session.
+func RevokeSession(c *gin.Context) {
+	user := currentUser(c)
+	session, err := db.GetSession(c.Param("id"))
+	target := &werrors.DoesNotExistError{}
+	if errors.As(err, &target) || (err == nil && session.UserName != user.UserName && user.Role != types.RoleAdmin) {
+		handleError(c, errors.New(c.Param("id")), "No result", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(c, err, "Failed to get session", http.StatusInternalServerError)
+		return
+	}
+	if err := auth.RevokeSession(session); err != nil {
+		handleError(c, err, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s revoked session %s of %s", user.UserName, session.Id, session.UserName)
+	c.JSON(http.StatusOK, session)
+}
+
+// RevokeOwnSessions logs the authenticated user out everywhere, including the current session
+func RevokeOwnSessions(c *gin.Context) {
+	revokeSessionsOf(c, currentUserName(c))
+}
+
+// RevokeAccountSessions logs out every session of the account with the user name of the path
+func RevokeAccountSessions(c *gin.Context) {
+	if _, ok := getAccountOrAbort(c, c.Param("name")); !ok {
+		return
+	}
+	revokeSessionsOf(c, c.Param("name"))
+}
+
+func revokeSessionsOf(c *gin.Context, userName string) {
+	revoked, err := auth.RevokeSessions(userName, "")
+	if err != nil {
+		handleError(c, err, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s revoked %d sessions of %s", currentUserName(c), revoked, userName)
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
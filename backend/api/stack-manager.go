@@ -172,8 +172,10 @@ func SyncAutoStartState(c *gin.Context) {
 		return
 	}
 
+	startup, _ := control.Startup.Get(endpointId)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Auto start state synced successfully",
+		"stacks":  startup.Stacks,
 	})
 }
 
@@ -203,16 +205,18 @@ func StopAllStacks(c *gin.Context) {
 		endpointId = int(endpointIdFloat)
 	}
 
-	if err := control.StopAllStacks(endpointId); err != nil {
-		glg.Errorf("Failed to sync auto start state: %s", err)
+	results, err := control.StopAllStacks(endpointId)
+	if err != nil {
+		glg.Errorf("Failed to stop all stacks: %s", err)
 		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Failed to sync auto start state",
+			"message": "Failed to stop all stacks",
 			"error":  err.Error(),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Auto start state synced successfully",
+		"message": "All stacks stopped",
+		"results": results,
 	})
 }
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"washboard/portainer"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultStatsRange = time.Hour
+
+// PortainerGetStackStats returns the resource usage history of a stack and its containers.
+//
+// Query Parameters:
+//   - range (optional, default 1h): how far back to go, a duration like 30m or 6h. Samples are
+//     only kept for the configured retention.
+func PortainerGetStackStats(c *gin.Context) {
+	stackId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		handleError(c, fmt.Errorf("stack id %q is not a number", c.Param("id")), "Invalid stack id", http.StatusBadRequest)
+		return
+	}
+	statsRange := defaultStatsRange
+	if value := c.Query("range"); value != "" {
+		statsRange, err = time.ParseDuration(value)
+		if err != nil || statsRange <= 0 {
+			handleError(c, fmt.Errorf("range %q is not a positive duration", value), "Invalid range", http.StatusBadRequest)
+			return
+		}
+	}
+	stack, err := portainer.GetClient().GetStack(c.Request.Context(), stackId)
+	if err != nil {
+		handleError(c, err, "Failed to get stack", portainerErrorStatus(err))
+		return
+	}
+
+	stats := portainer.Stats.Stack(stack.EndpointId, stack.Name, time.Now().Add(-statsRange))
+	stats.StackId = stack.Id
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"washboard/auth"
+	"washboard/db"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+type createApiTokenRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Scopes []string `json:"scopes" binding:"required"`
+	Stacks []string `json:"stacks" binding:"required"`
+	// ExpiresInDays is optional, tokens without it do not expire
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+// GetApiTokens returns the api tokens of the authenticated user, or of all users for admins
+// passing all=true
+func GetApiTokens(c *gin.Context) {
+	user := currentUser(c)
+	owner := user.UserName
+	if c.Query("all") == "true" && user.Role == types.RoleAdmin {
+		owner = ""
+	}
+	tokens, err := db.ListApiTokens(owner)
+	if err != nil {
+		handleError(c, err, "Failed to get api tokens", http.StatusInternalServerError)
+		return
+	}
+	dtos := make([]types.ApiTokenDto, 0, len(tokens))
+	for _, token := range tokens {
+		dtos = append(dtos, token.Dto())
+	}
+	c.JSON(http.StatusOK, gin.H{"tokens": dtos})
+}
+
+// CreateApiToken creates an api token of the authenticated user.
+//
+// Request Body:
+//   - name: shown in the token list
+//   - scopes: stack:update, stack:start, stack:stop, stack:rollback and/or job:read
+//   - stacks: stack name patterns like "web-*", "*" for all stacks
+//   - expiresInDays (optional): the token does not expire if it is missing
+//
+// Responses:
+//   - 201 Created: {"token": secret, "apiToken": {...}}. The secret is only returned once.
+//   - 400 Bad Request: invalid values
+func CreateApiToken(c *gin.Context) {
+	var request createApiTokenRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	if request.ExpiresInDays < 0 {
+		handleError(c, errors.New("expiresInDays must not be negative"), "Invalid api token", http.StatusBadRequest)
+		return
+	}
+	var expiresAt int64
+	if request.ExpiresInDays > 0 {
+		expiresAt = time.Now().AddDate(0, 0, request.ExpiresInDays).Unix()
+	}
+
+	token, secret, err := auth.NewApiToken(currentUserName(c), request.Name, request.Scopes, request.Stacks, expiresAt)
+	if err != nil {
+		handleError(c, err, "Invalid api token", http.StatusBadRequest)
+		return
+	}
+	if err := db.CreateApiToken(token); err != nil {
+		handleError(c, err, "Failed to create api token", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s created api token %s (%s) with scopes %v for stacks %v", token.Owner, token.Id, token.Name, token.Scopes, token.Stacks)
+	c.JSON(http.StatusCreated, gin.H{
+		"token":    auth.FormatApiToken(token.Id, secret),
+		"apiToken": token.Dto(),
+	})
+}
+
+// RevokeApiToken revokes an api token of the authenticated user. Admins can revoke every token.
+func RevokeApiToken(c *gin.Context) {
+	user := currentUser(c)
+	token, err := db.GetApiToken(c.Param("id"))
+	target := &werrors.DoesNotExistError{}
+	if errors.As(err, &target) || (err == nil && token.Owner != user.UserName && user.Role != types.RoleAdmin) {
+		handleError(c, errors.New(c.Param("id")), "No result", http.StatusNotFound)
+		return
+	} else if err != nil {
+		handleError(c, err, "Failed to get api token", http.StatusInternalServerError)
+		return
+	}
+	if token.RevokedAt == 0 {
+		token.RevokedAt = time.Now().Unix()
+		if err := db.UpdateApiToken(token); err != nil {
+			handleError(c, err, "Failed to revoke api token", http.StatusInternalServerError)
+			return
+		}
+		glg.Infof("%s revoked api token %s (%s) of %s", user.UserName, token.Id, token.Name, token.Owner)
+	}
+	c.JSON(http.StatusOK, token.Dto())
+}
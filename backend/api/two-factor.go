@@ -0,0 +1,233 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"washboard/auth"
+	"washboard/db"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type disableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type securityPolicyRequest struct {
+	RequireTwoFactorRoles []string `json:"requireTwoFactorRoles"`
+}
+
+// twoFactorStatus maps the errors of the auth two-factor functions to response codes
+func twoFactorStatus(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrTwoFactorEnabled):
+		return http.StatusConflict
+	case errors.Is(err, auth.ErrInvalidTwoFactor):
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// EnrollTwoFactor starts the two-factor enrollment of the authenticated user.
+//
+// Responses:
+//   - 200 OK: {"secret": base32 secret, "provisioningUri": otpauth uri to show as QR code}
+//   - 400 Bad Request: single sign-on account
+//   - 409 Conflict: two-factor authentication is already enabled
+func EnrollTwoFactor(c *gin.Context) {
+	account, ok := getAccountOrAbort(c, currentUserName(c))
+	if !ok {
+		return
+	}
+	secret, err := auth.EnrollTotp(account)
+	if err != nil {
+		handleError(c, err, "Cannot enroll two-factor authentication", twoFactorStatus(err))
+		return
+	}
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":          secret,
+		"provisioningUri": auth.ProvisioningUri(account.UserName, secret),
+	})
+}
+
+// ConfirmTwoFactor enables two-factor authentication with the first code of the authenticator app.
+//
+// Responses:
+//   - 200 OK: {"recoveryCodes": [...]}. The codes are only returned once.
+//   - 403 Forbidden: wrong code
+func ConfirmTwoFactor(c *gin.Context) {
+	var request twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	account, ok := getAccountOrAbort(c, currentUserName(c))
+	if !ok {
+		return
+	}
+	codes, err := auth.ConfirmTotp(account, request.Code)
+	if err != nil {
+		handleError(c, err, "Cannot enable two-factor authentication", twoFactorStatus(err))
+		return
+	}
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s enabled two-factor authentication", account.UserName)
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the authenticated user after checking a
+// current code
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var request twoFactorCodeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	account, ok := getAccountOrAbort(c, currentUserName(c))
+	if !ok {
+		return
+	}
+	if account.TotpSecret == "" {
+		handleError(c, auth.ErrNoTwoFactor, "Cannot create recovery codes", http.StatusBadRequest)
+		return
+	}
+	if used, err := auth.ConsumeSecondFactor(account, request.Code); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	} else if !used {
+		handleError(c, auth.ErrInvalidTwoFactor, "Cannot create recovery codes", http.StatusForbidden)
+		return
+	}
+	codes, err := auth.NewRecoveryCodes(account)
+	if err != nil {
+		handleError(c, err, "Failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// DisableOwnTwoFactor disables two-factor authentication of the authenticated user, which needs
+// the password and a current code. It is refused while the security policy requires it for the role.
+func DisableOwnTwoFactor(c *gin.Context) {
+	var request disableTwoFactorRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	account, ok := getAccountOrAbort(c, currentUserName(c))
+	if !ok {
+		return
+	}
+	if account.TotpSecret == "" {
+		handleError(c, auth.ErrNoTwoFactor, "Cannot disable two-factor authentication", http.StatusBadRequest)
+		return
+	}
+	if !auth.ComparePasswords(account.PasswordHash, []byte(request.Password)) {
+		handleError(c, errors.New("wrong password or code"), "Cannot disable two-factor authentication", http.StatusForbidden)
+		return
+	}
+	if used, err := auth.ConsumeSecondFactor(account, request.Code); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	} else if !used {
+		handleError(c, errors.New("wrong password or code"), "Cannot disable two-factor authentication", http.StatusForbidden)
+		return
+	}
+	auth.DisableTotp(account)
+	if required, err := auth.TwoFactorRequired(account); err != nil {
+		handleError(c, err, "Failed to load security policy", http.StatusInternalServerError)
+		return
+	} else if required {
+		handleError(c, errors.New(account.Role), "Two-factor authentication is required for your role", http.StatusConflict)
+		return
+	}
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s disabled two-factor authentication", account.UserName)
+	c.JSON(http.StatusOK, account.Dto())
+}
+
+// ResetTwoFactor disables two-factor authentication of another account, e.g. after its device
+// was lost. The user has to enroll again if the security policy requires it.
+func ResetTwoFactor(c *gin.Context) {
+	account, ok := getAccountOrAbort(c, c.Param("name"))
+	if !ok {
+		return
+	}
+	auth.DisableTotp(account)
+	if err := db.UpdateAccount(account); err != nil {
+		handleError(c, err, "Failed to update account", http.StatusInternalServerError)
+		return
+	}
+	glg.Infof("%s reset two-factor authentication of %s", currentUserName(c), account.UserName)
+	c.JSON(http.StatusOK, account.Dto())
+}
+
+// GetSecurityPolicy returns the security policy
+func GetSecurityPolicy(c *gin.Context) {
+	policy, err := auth.SecurityPolicy()
+	if err != nil {
+		handleError(c, err, "Failed to get security policy", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+// UpdateSecurityPolicy replaces the security policy.
+//
+// Request Body:
+//   - requireTwoFactorRoles: roles whose accounts have to use two-factor authentication, only
+//     roles that can run control actions are allowed
+//
+// Responses:
+//   - 200 OK: the policy
+//   - 400 Bad Request: a role is unknown or can not run control actions
+func UpdateSecurityPolicy(c *gin.Context) {
+	var request securityPolicyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		handleError(c, err, "Failed to bind json. Check the request body and ensure that the correct fields are present.", http.StatusBadRequest)
+		return
+	}
+	policy := &types.SecurityPolicy{
+		RequireTwoFactorRoles: request.RequireTwoFactorRoles,
+		UpdatedBy:             currentUserName(c),
+		UpdatedAt:             time.Now().Unix(),
+	}
+	if policy.RequireTwoFactorRoles == nil {
+		policy.RequireTwoFactorRoles = []string{}
+	}
+	if err := auth.ValidateSecurityPolicy(policy); err != nil {
+		handleError(c, err, "Invalid security policy", http.StatusBadRequest)
+		return
+	}
+	if err := db.UpdateSecurityPolicy(policy); err != nil {
+		handleError(c, err, "Failed to update security policy", http.StatusInternalServerError)
+		return
+	}
+	auth.ResetSecurityPolicy()
+	glg.Infof("%s required two-factor authentication for roles %v", policy.UpdatedBy, policy.RequireTwoFactorRoles)
+	c.JSON(http.StatusOK, policy)
+}
@@ -5,7 +5,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+	"washboard/control"
+	"washboard/hub"
+	"washboard/metrics"
 	"washboard/portainer"
 	"washboard/types"
 
@@ -30,8 +35,22 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// wsPingInterval keeps idle connections open through proxies
+const wsPingInterval = 30 * time.Second
+
+// WsHandler streams the events of the hub. Clients pass the last epoch and seq they received as
+// ?epoch= and ?since= to resume, otherwise they get a snapshot of every topic first. ?topics= limits the stream to a
+// comma separated list of topics.
 func WsHandler(c *gin.Context) {
 	glg.Debugf("ws connection request from %s", c.ClientIP())
+	since, _ := strconv.ParseUint(c.Query("since"), 10, 64)
+	epoch := c.Query("epoch")
+	var topics []string
+	for _, topic := range strings.Split(c.Query("topics"), ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
 	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	glg.Debugf("Upgraded to websocket")
 	if err != nil {
@@ -39,10 +58,17 @@ func WsHandler(c *gin.Context) {
 		return
 	}
 	glg.Infof("client %s connected to status websocket", c.ClientIP())
+	metrics.WebsocketClients.Inc()
 
-	oniiChan := make(chan string)
+	subscription, replay, seq, resumed := hub.Subscribe(topics, epoch, since)
+	initial := replay
+	if !resumed {
+		initial = snapshot(subscription, seq)
+	}
+
+	oniiChan := make(chan string, 1)
 	go readData(ws, oniiChan)
-	go pushData(ws, oniiChan)
+	go pushData(ws, oniiChan, subscription, initial)
 }
 
 func readData(ws *websocket.Conn, oniiChan chan string) {
@@ -61,11 +87,19 @@ func readData(ws *websocket.Conn, oniiChan chan string) {
 	}
 }
 
-func pushData(ws *websocket.Conn, oniiChan chan string) {
+func pushData(ws *websocket.Conn, oniiChan chan string, subscription *hub.Subscription, initial []types.WsEnvelope) {
+	defer metrics.WebsocketClients.Dec()
 	defer ws.Close()
-	// Force the first refresh-state push so reconnecting clients sync immediately.
-	const firstPush = ^uint64(0)
-	lastRefreshVersion := firstPush
+	defer subscription.Close()
+	for _, envelope := range initial {
+		if err := writeEnvelope(ws, envelope); err != nil {
+			glg.Errorf("error writing %s envelope: %s", envelope.Type, err)
+			return
+		}
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
 	for {
 		select {
 		case msg := <-oniiChan:
@@ -73,10 +107,32 @@ func pushData(ws *websocket.Conn, oniiChan chan string) {
 				glg.Debugf("stopping websocket push")
 				return
 			}
-		default:
+		case envelope, ok := <-subscription.Events:
+			if !ok {
+				// the client lagged behind, it reconnects and resumes with the last seq it received
+				glg.Warnf("client %s lagged behind, closing websocket", ws.RemoteAddr())
+				ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "lagged behind"))
+				return
+			}
+			if err := writeEnvelope(ws, envelope); err != nil {
+				glg.Errorf("error writing %s envelope: %s", envelope.Type, err)
+				return
+			}
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				glg.Infof("client %s did not accept a ping: %s", ws.RemoteAddr(), err)
+				return
+			}
 		}
+	}
+}
 
-		// Always push the stack-update queue (cheap, and the frontend reconciles).
+// snapshot returns the current state of the topics of subscription, current with seq
+func snapshot(subscription *hub.Subscription, seq uint64) []types.WsEnvelope {
+	envelopes := make([]types.WsEnvelope, 0)
+	now := time.Now().Unix()
+	epoch := hub.Epoch()
+	if subscription.Wants(types.WsTopicStackUpdates) {
 		items := appState.StackUpdateQueue.Items()
 		groupedItems := make(map[string]map[string]types.StackUpdateStatus)
 		for _, item := range items {
@@ -87,27 +143,25 @@ func pushData(ws *websocket.Conn, oniiChan chan string) {
 			}
 			groupedItems[status][stackUpdateStatus.StackName] = stackUpdateStatus
 		}
-		if err := writeEnvelope(ws, types.WsMsgStackUpdateQueue, groupedItems); err != nil {
-			glg.Errorf("error writing stack-update-queue envelope: %s", err)
-			return
-		}
-
-		// Push image-refresh state only on first connection or when it has changed.
-		currentVersion := portainer.Refresh.Version()
-		if currentVersion != lastRefreshVersion {
-			if err := writeEnvelope(ws, types.WsMsgImageRefreshState, portainer.Refresh.Snapshot()); err != nil {
-				glg.Errorf("error writing image-refresh-state envelope: %s", err)
-				return
-			}
-			lastRefreshVersion = currentVersion
-		}
-
-		time.Sleep(1 * time.Second)
+		envelopes = append(envelopes, types.WsEnvelope{Epoch: epoch, Seq: seq, Topic: types.WsTopicStackUpdates, Type: types.WsMsgStackUpdateQueue, Time: now, Data: groupedItems})
+	}
+	if subscription.Wants(types.WsTopicImageRefresh) {
+		envelopes = append(envelopes, types.WsEnvelope{Epoch: epoch, Seq: seq, Topic: types.WsTopicImageRefresh, Type: types.WsMsgImageRefreshState, Time: now, Data: portainer.Refresh.Snapshot()})
+	}
+	if subscription.Wants(types.WsTopicStartup) {
+		envelopes = append(envelopes, types.WsEnvelope{Epoch: epoch, Seq: seq, Topic: types.WsTopicStartup, Type: types.WsMsgStartupProgress, Time: now, Data: control.Startup.Snapshot()})
+	}
+	if subscription.Wants(types.WsTopicContainers) {
+		envelopes = append(envelopes, types.WsEnvelope{Epoch: epoch, Seq: seq, Topic: types.WsTopicContainers, Type: types.WsMsgContainerStates, Time: now, Data: portainer.Live.Snapshot()})
+	}
+	if subscription.Wants(types.WsTopicStats) {
+		envelopes = append(envelopes, types.WsEnvelope{Epoch: epoch, Seq: seq, Topic: types.WsTopicStats, Type: types.WsMsgStackStats, Time: now, Data: portainer.Stats.Snapshot()})
 	}
+	return envelopes
 }
 
-func writeEnvelope(ws *websocket.Conn, msgType string, data interface{}) error {
-	out, err := encodeJson(types.WsEnvelope{Type: msgType, Data: data})
+func writeEnvelope(ws *websocket.Conn, envelope types.WsEnvelope) error {
+	out, err := encodeJson(envelope)
 	if err != nil {
 		glg.Warnf("error while marshaling envelope to json: %s", err)
 		return err
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"math/rand"
 	"net/http"
 	"path/filepath"
@@ -8,8 +9,10 @@ import (
 	"time"
 
 	"washboard/api"
+	"washboard/audit"
 	"washboard/auth"
 	"washboard/control"
+	"washboard/metrics"
 	"washboard/portainer"
 	"washboard/state"
 	"washboard/types"
@@ -56,6 +59,49 @@ func main() {
 	glg.Info("server control panel backend started")
 	defer log.Close()
 
+	router, err := setupRouter()
+	if err != nil {
+		glg.Fatalf("Error creating JWT middleware: %s", err)
+	}
+
+	if err := auth.EnsureAdminAccount(); err != nil {
+		glg.Errorf("Failed to create admin account: %s", err)
+	}
+
+	if err := portainer.RecoverInterruptedJobs(); err != nil {
+		glg.Errorf("Failed to recover interrupted update jobs: %s", err)
+	}
+
+	endpointIds := &types.SyncOptions{EndpointIds: appState.Config.EndpointIds()}
+
+	err = portainer.PerformSync(endpointIds)
+	if err != nil {
+		glg.Errorf("Failed to sync on launch: %s", err)
+	} else if appState.Config.StartStacksOnLaunch {
+		for _, endpointId := range endpointIds.EndpointIds {
+			err = control.SyncAutoStartState(endpointId)
+			if err != nil {
+				glg.Errorf("Failed to sync autostart state of endpoint %d on launch: %s", endpointId, err)
+			}
+		}
+	}
+
+	portainer.StartBackgroundUpdateCheck(endpointIds.EndpointIds)
+	portainer.StartEventWatcher(context.Background(), endpointIds.EndpointIds)
+	portainer.StartStatsSampler(context.Background(), endpointIds.EndpointIds, time.Duration(appState.Config.StatsInterval)*time.Second, time.Duration(appState.Config.StatsRetention)*time.Hour)
+	control.StartUpdateScheduler(endpointIds.EndpointIds)
+	auth.StartSessionCleanup()
+
+	ret := router.Run()
+	if ret != nil {
+		panic(ret)
+	}
+}
+
+// setupRouter creates the gin engine with the JWT middleware and all api routes registered
+func setupRouter() (*gin.Engine, error) {
+	appState := state.Instance()
+
 	// TODO: add to config because we need this when we deploy it!
 	router := gin.Default()
 	//router.SetTrustedProxies([]string{"localhost"})
@@ -80,14 +126,18 @@ func main() {
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
 		Realm:           "walzen",
 		Key:             []byte(appState.Config.JwtSecret),
-		Timeout:         time.Hour * 24 * 7,
-		MaxRefresh:      time.Hour * 24 * 30,
+		Timeout:         auth.TokenTimeout,
+		MaxRefresh:      auth.SessionMaxRefresh,
 		IdentityKey:     types.IdentityKey,
 		PayloadFunc:     auth.PayloadFunc,
 		IdentityHandler: auth.IdentityHandler,
 		Authenticator:   auth.Authenticator,
 		Authorizator:    auth.Authorizator,
 		Unauthorized:    auth.Unauthorized,
+
+		// explains rejections like a missing second factor instead of the generic error
+		HTTPStatusMessageFunc: auth.StatusMessage,
+
 		// TokenLookup is a string in the form of "<source>:<name>" that is used
 		// to extract token from the request.
 		// Optional. Default value "header:Authorization".
@@ -115,13 +165,17 @@ func main() {
 	})
 
 	if err != nil {
-		glg.Fatalf("Error creating JWT middleware: %s", err)
+		return nil, err
 	}
 
-	apiRoute := router.Group("/api")
+	// accepts api tokens on the routes they are scoped to and the session JWT everywhere
+	authRequired := auth.Middleware(authMiddleware)
+
+	// every mutating request below is recorded in the audit log
+	apiRoute := router.Group("/api", audit.Middleware())
 
 	// portainer api routes
-	portainerRoute := apiRoute.Group("/portainer", authMiddleware.MiddlewareFunc())
+	portainerRoute := apiRoute.Group("/portainer", authRequired)
 	portainerRoute.GET("/endpoint", api.PortainerGetEndpoint)
 	portainerRoute.GET("/containers", api.PortainerGetContainers)
 	portainerRoute.GET("/image-status", api.PortainerGetImageStatus)
@@ -129,44 +183,114 @@ func main() {
 	portainerRoute.POST("/update-container", api.PortainerUpdateContainer)
 
 	// portainer container routes
-	prtContainersRoute := portainerRoute.Group("/containers", authMiddleware.MiddlewareFunc())
+	prtContainersRoute := portainerRoute.Group("/containers", authRequired)
 	prtContainersRoute.POST("/:containerId/:action", api.PortainerContainerAction) // valid actions are types.ContainerAction
 
 	// portainer stack routes
-	prtStackRoute := portainerRoute.Group("/stacks", authMiddleware.MiddlewareFunc())
+	prtStackRoute := portainerRoute.Group("/stacks", authRequired)
 	prtStackRoute.GET("", api.PortainerGetStacks)
 	prtStackRoute.POST("/:id/stop", api.PortainerStopStack)
 	prtStackRoute.POST("/:id/start", api.PortainerStartStack)
 	prtStackRoute.PUT("/:id/update", api.PortainerUpdateStack)
+	prtStackRoute.POST("/:id/rollback", api.PortainerRollbackStack)
+	prtStackRoute.GET("/:id/stats", api.PortainerGetStackStats)
+
+	// portainer group routes
+	prtGroupRoute := portainerRoute.Group("/groups", authRequired)
+	prtGroupRoute.POST("/:name/start", api.PortainerStartGroup)
+	prtGroupRoute.POST("/:name/stop", api.PortainerStopGroup)
+	prtGroupRoute.PUT("/:name/update", api.PortainerUpdateGroup)
 
 	// websocket stuff
-	websocketRoute := apiRoute.Group("/ws", authMiddleware.MiddlewareFunc())
+	websocketRoute := apiRoute.Group("/ws", authRequired)
 	websocketRoute.GET("/stacks-update", api.WsHandler)
+	websocketRoute.GET("/containers/:id/logs", api.WsContainerLogs)
+	websocketRoute.GET("/containers/:id/exec", api.WsContainerExec) // admin only, see auth.RequiredRole
 
 	// db CRUD
 
 	// db stack routes
-	dbStackRoute := apiRoute.Group("/db/stacks", authMiddleware.MiddlewareFunc())
+	dbStackRoute := apiRoute.Group("/db/stacks", authRequired)
 	dbStackRoute.POST("", api.CreateStackSettings)
 	dbStackRoute.GET("/:name", api.GetStackSettings)
 	dbStackRoute.GET("", api.GetStackSettings)
 	dbStackRoute.PUT("/:name", api.UpdateStackSettings)
 	dbStackRoute.DELETE("/:name", api.DeleteStackSettings)
 
-	apiRoute.POST("/db/sync", authMiddleware.MiddlewareFunc(), api.SyncWithPortainer)
+	// db group routes
+	dbGroupRoute := apiRoute.Group("/db/groups", authRequired)
+	dbGroupRoute.POST("", api.CreateGroupSettings)
+	dbGroupRoute.GET("/:name", api.GetGroupSettings)
+	dbGroupRoute.GET("", api.GetGroupSettings)
+	dbGroupRoute.PUT("/:name", api.UpdateGroupSettings)
+	dbGroupRoute.DELETE("/:name", api.DeleteGroupSettings)
+	dbGroupRoute.PUT("/:name/stacks/:stack", api.AddGroupStack)
+	dbGroupRoute.DELETE("/:name/stacks/:stack", api.RemoveGroupStack)
+
+	apiRoute.POST("/db/sync", authRequired, api.SyncWithPortainer)
+
+	// stack update job history
+	jobsRoute := apiRoute.Group("/jobs", authRequired)
+	jobsRoute.GET("", api.GetJobs)
+	jobsRoute.GET("/:id", api.GetJob)
+
+	// accounts, managed by admins except for the own account
+	accountsRoute := apiRoute.Group("/accounts", authRequired)
+	accountsRoute.GET("", api.GetAccounts)
+	accountsRoute.POST("", api.CreateAccount)
+	accountsRoute.GET("/me", api.GetOwnAccount)
+	accountsRoute.PUT("/me/password", api.ChangeOwnPassword)
+	accountsRoute.POST("/me/2fa", api.EnrollTwoFactor)
+	accountsRoute.POST("/me/2fa/confirm", api.ConfirmTwoFactor)
+	accountsRoute.POST("/me/2fa/recovery-codes", api.RegenerateRecoveryCodes)
+	accountsRoute.DELETE("/me/2fa", api.DisableOwnTwoFactor)
+	accountsRoute.GET("/:name", api.GetAccount)
+	accountsRoute.PUT("/:name", api.UpdateAccount)
+	accountsRoute.DELETE("/:name", api.DeleteAccount)
+	accountsRoute.DELETE("/:name/2fa", api.ResetTwoFactor)
+	accountsRoute.DELETE("/:name/sessions", api.RevokeAccountSessions)
+
+	// sessions of the own account
+	sessionsRoute := apiRoute.Group("/sessions", authRequired)
+	sessionsRoute.GET("", api.GetSessions)
+	sessionsRoute.DELETE("", api.RevokeOwnSessions)
+	sessionsRoute.DELETE("/:id", api.RevokeSession)
+
+	// security policy, admins only
+	securityRoute := apiRoute.Group("/security", authRequired)
+	securityRoute.GET("/policy", api.GetSecurityPolicy)
+	securityRoute.PUT("/policy", api.UpdateSecurityPolicy)
+
+	// api tokens of the own account
+	tokensRoute := apiRoute.Group("/tokens", authRequired)
+	tokensRoute.GET("", api.GetApiTokens)
+	tokensRoute.POST("", api.CreateApiToken)
+	tokensRoute.DELETE("/:id", api.RevokeApiToken)
+
+	// audit log, admins only
+	apiRoute.GET("/audit", authRequired, api.GetAudit)
 
 	// authy
 	authGroup := apiRoute.Group("/auth")
-	authGroup.POST("/login", authMiddleware.LoginHandler)
-	authGroup.POST("/logout", authMiddleware.LogoutHandler)
-	authGroup.POST("/refresh_token", authMiddleware.RefreshHandler)
+	loginThrottle := auth.NewLoginThrottle(appState.Config.LoginThrottle)
+	authGroup.POST("/login", loginThrottle.Middleware(), authMiddleware.LoginHandler)
+	authGroup.POST("/logout", auth.LogoutHandler(authMiddleware))
+	authGroup.POST("/refresh_token", auth.RefreshHandler(authMiddleware))
+	if appState.Config.Oidc.Issuer != "" {
+		oidcLogin := auth.NewOidc(appState.Config.Oidc)
+		authGroup.GET("/oidc/login", oidcLogin.LoginHandler)
+		authGroup.GET("/oidc/callback", oidcLogin.CallbackHandler(authMiddleware))
+	}
 
 	// control
-	controlGroup := apiRoute.Group("/control", authMiddleware.MiddlewareFunc())
+	controlGroup := apiRoute.Group("/control", authRequired)
 	controlGroup.POST("/sync-autostart", api.SyncAutoStartState)
 	controlGroup.POST("/stop-all", api.StopAllStacks)
 
-	router.GET("/api", authMiddleware.MiddlewareFunc(), func(c *gin.Context) {
+	// prometheus metrics, protected by the metrics token instead of a login if one is configured
+	router.GET("/metrics", metrics.Handler(appState.Config.MetricsToken))
+
+	router.GET("/api", authRequired, func(c *gin.Context) {
 		c.JSON(200, gin.H{"code": "OK", "message": "nothing to see here"})
 	})
 
@@ -195,31 +319,7 @@ func main() {
 		c.JSON(404, gin.H{"code": "PAGE_NOT_FOUND", "message": "Pagenius nicht gefunden!"})
 	})
 
-	endpointIds := &types.SyncOptions{EndpointIds: []int{appState.Config.StartEndpointId}}
-
-	if appState.Config.StartStacksOnLaunch {
-		err := portainer.PerformSync(endpointIds)
-		if err != nil {
-			glg.Errorf("Failed to sync on launch: %s", err)
-		} else {
-			err = control.SyncAutoStartState(appState.Config.StartEndpointId)
-			if err != nil {
-				glg.Errorf("Failed to sync autostart state on launch: %s", err)
-			}
-		}
-	} else {
-		err := portainer.PerformSync(endpointIds)
-		if err != nil {
-			glg.Errorf("Failed to sync on launch: %s", err)
-		}
-	}
-
-	portainer.StartBackgroundUpdateCheck(appState.Config.StartEndpointId)
-
-	ret := router.Run()
-	if ret != nil {
-		panic(ret)
-	}
+	return router, nil
 }
 
 var src = rand.NewSource(time.Now().UnixNano())
@@ -1,8 +1,1888 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/cookiejar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"washboard/auth"
+	"washboard/auth/oidctest"
+	"washboard/control"
+	"washboard/db"
+	"washboard/notify"
+	"washboard/portainer"
+	"washboard/portainer/portainertest"
+	"washboard/state"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	testUser     = "washer"
+	testPassword = "hunter2"
+	testApiKey   = "ptr_test"
 )
 
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
 func TestTest (t *testing.T) {
 }
+
+type testEnv struct {
+	portainer *portainertest.Server
+	server    *httptest.Server
+	token     string
+}
+
+// newTestEnv wires the router from setupRouter against a fresh fake Portainer with one
+// endpoint, a "web" stack with two containers and a "db" stack with one container
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	fake := portainertest.NewServer(testApiKey)
+	t.Cleanup(fake.Close)
+	fake.AddEndpoint(1, "Quasar")
+	fake.AddStack(1, 10, "web", "services:\n  web:\n    image: \"nginx:latest\"\n")
+	fake.AddContainer(1, "web", "c-web-1", "web-nginx-1", "nginx:latest")
+	fake.AddContainer(1, "web", "c-web-2", "web-redis-1", "redis:7")
+	fake.AddStack(1, 11, "db", "services:\n  db:\n    image: postgres:16\n")
+	fake.AddContainer(1, "db", "c-db-1", "db-postgres-1", "postgres:16")
+	fake.AddEndpoint(2, "Nova")
+	fake.AddStack(2, 20, "db", "services:\n  db:\n    image: mariadb:11\n")
+	fake.AddContainer(2, "db", "c-db-2", "db-mariadb-1", "mariadb:11")
+	portainer.SetClient(fake.Client())
+	// cached image statuses and live states of earlier tests would otherwise leak into this one
+	portainer.ResetState()
+
+	store, err := db.OpenBolt(filepath.Join(t.TempDir(), "washboard.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	db.SetStore(store)
+
+	// update statuses of earlier tests would otherwise be reported over the websocket
+	state.Instance().StackUpdateQueue.Flush()
+
+	auth.ResetSecurityPolicy()
+	config := &state.Instance().Config
+	config.User = testUser
+	config.Password = testPassword
+	config.JwtSecret = "integration-test-secret"
+	if err := auth.EnsureAdminAccount(); err != nil {
+		t.Fatalf("failed to create admin account: %s", err)
+	}
+
+	router, err := setupRouter()
+	if err != nil {
+		t.Fatalf("failed to set up router: %s", err)
+	}
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	env := &testEnv{portainer: fake, server: server}
+	env.token = env.login(t, testUser, testPassword)
+	return env
+}
+
+func (env *testEnv) login(t *testing.T, user string, password string) string {
+	t.Helper()
+	resp, body := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": user, "password": password})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login returned %d: %s", resp.StatusCode, body)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &login); err != nil || login.Token == "" {
+		t.Fatalf("login response has no token: %s", body)
+	}
+	return login.Token
+}
+
+func (env *testEnv) request(t *testing.T, method string, path string, reqBody interface{}) (*http.Response, []byte) {
+	t.Helper()
+	var bodyReader io.Reader
+	if reqBody != nil {
+		encoded, err := json.Marshal(reqBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyReader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, env.server.URL+path, bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if env.token != "" {
+		req.Header.Set("Authorization", "Bearer "+env.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, respBody
+}
+
+func TestLoginRejectsWrongPassword(t *testing.T) {
+	env := newTestEnv(t)
+	env.token = ""
+	resp, body := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": testUser, "password": "wrong"})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, _ = env.request(t, http.MethodGet, "/api/portainer/stacks", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", resp.StatusCode)
+	}
+}
+
+func TestListStacks(t *testing.T) {
+	env := newTestEnv(t)
+	resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var stacks []types.StackDto
+	if err := json.Unmarshal(body, &stacks); err != nil {
+		t.Fatal(err)
+	}
+	containerCount := map[string]int{}
+	for _, stack := range stacks {
+		containerCount[stack.Name] = len(stack.Containers)
+		for _, container := range stack.Containers {
+			if container.UpToDate != types.Updated {
+				t.Errorf("container %s: expected %s, got %q", container.Name, types.Updated, container.UpToDate)
+			}
+		}
+	}
+	if containerCount["web"] != 2 || containerCount["db"] != 1 {
+		t.Fatalf("unexpected stacks: %s", body)
+	}
+}
+
+func TestEndpointSelection(t *testing.T) {
+	env := newTestEnv(t)
+	config := &state.Instance().Config
+	config.ManagedEndpointIds = []int{2, 1}
+	t.Cleanup(func() { config.ManagedEndpointIds = nil })
+	if resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1, 2}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	// without endpointId the first managed endpoint is used, not the start endpoint
+	resp, body := env.request(t, http.MethodGet, "/api/db/stacks/db", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"endpointId":2`) {
+		t.Fatalf("expected the settings of endpoint 2, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodGet, "/api/db/stacks/db?endpointId=3", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an endpoint washboard does not manage, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestContainerAction(t *testing.T) {
+	env := newTestEnv(t)
+	resp, body := env.request(t, http.MethodPost, "/api/portainer/containers/c-db-1/stop", gin.H{"endpointId": 1})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if state := env.portainer.ContainerState("c-db-1"); state != "exited" {
+		t.Fatalf("expected container to be exited, got %q", state)
+	}
+}
+
+func TestStartStackConflict(t *testing.T) {
+	env := newTestEnv(t)
+	resp, body := env.request(t, http.MethodPost, "/api/portainer/stacks/10/start", gin.H{"endpointId": 1})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for an already active stack, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestEnqueueUpdateReportedOverWebsocket(t *testing.T) {
+	env := newTestEnv(t)
+
+	ws := env.dialWebsocket(t, "")
+	defer ws.Close()
+	// the snapshot comes first, so the update is only reported as deltas
+	if envelope := readEnvelope(t, ws); envelope.Type != types.WsMsgStackUpdateQueue || envelope.Topic != types.WsTopicStackUpdates {
+		t.Fatalf("expected the snapshot of the update queue first, got %+v", envelope)
+	}
+
+	resp, body := env.request(t, http.MethodPut, "/api/portainer/stacks/10/update", gin.H{"endpointId": 1, "prune": false, "pullImage": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	var queuedSeq, doneSeq uint64
+	var epoch string
+	for doneSeq == 0 {
+		envelope := readEnvelope(t, ws)
+		epoch = envelope.Epoch
+		if envelope.Type != types.WsMsgStackUpdate {
+			continue
+		}
+		var status types.StackUpdateStatus
+		if err := json.Unmarshal(envelope.Data, &status); err != nil || status.StackName != "web" || status.StackId != 10 {
+			t.Fatalf("unexpected update status %s", envelope.Data)
+		}
+		switch status.Status {
+		case types.Queued:
+			queuedSeq = envelope.Seq
+		case types.Done:
+			doneSeq = envelope.Seq
+		case types.Error:
+			t.Fatalf("update failed: %s", status.Details)
+		}
+	}
+	if queuedSeq == 0 || doneSeq <= queuedSeq || epoch == "" {
+		t.Fatalf("expected increasing sequence numbers of an epoch, got queued %d and done %d in %q", queuedSeq, doneSeq, epoch)
+	}
+
+	// a reconnecting client resumes after the last event it received instead of getting a snapshot
+	resumed := env.dialWebsocket(t, fmt.Sprintf("&epoch=%s&since=%d&topics=%s", epoch, queuedSeq, types.WsTopicStackUpdates))
+	defer resumed.Close()
+	if envelope := readEnvelope(t, resumed); envelope.Type != types.WsMsgStackUpdate || envelope.Seq != doneSeq {
+		t.Fatalf("expected the done status to be replayed, got %+v", envelope)
+	}
+	// the sequence numbers of another epoch, e.g. before a restart, get a snapshot
+	restarted := env.dialWebsocket(t, fmt.Sprintf("&epoch=other&since=%d&topics=%s", queuedSeq, types.WsTopicStackUpdates))
+	defer restarted.Close()
+	if envelope := readEnvelope(t, restarted); envelope.Type != types.WsMsgStackUpdateQueue || envelope.Epoch != epoch {
+		t.Fatalf("expected a snapshot of the current epoch, got %+v", envelope)
+	}
+	filtered := env.dialWebsocket(t, "&topics="+types.WsTopicImageRefresh)
+	defer filtered.Close()
+	if envelope := readEnvelope(t, filtered); envelope.Topic != types.WsTopicImageRefresh || envelope.Seq < doneSeq {
+		t.Fatalf("expected only the image refresh snapshot, got %+v", envelope)
+	}
+
+	var update *portainertest.Call
+	for _, call := range env.portainer.Calls() {
+		if call.Method == http.MethodPut && call.Path == "/stacks/10" {
+			update = &call
+		}
+	}
+	if update == nil {
+		t.Fatalf("portainer did not receive a stack update")
+	}
+	var request portainer.UpdateStackRequest
+	if err := json.Unmarshal([]byte(update.Body), &request); err != nil {
+		t.Fatal(err)
+	}
+	if !request.PullImage || !strings.Contains(request.StackFileContent, `image: "nginx:latest"`) {
+		t.Fatalf("unexpected update request: %+v", request)
+	}
+
+	job := env.waitForLatestJob(t, "web")
+	if job.Status != types.Done || job.TriggeredBy != testUser || len(job.ImagesBefore) != 2 {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+}
+
+func TestSyncWithPortainer(t *testing.T) {
+	env := newTestEnv(t)
+	resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1, 2}})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = env.request(t, http.MethodGet, "/api/db/stacks", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	var settings struct {
+		StackSettings []types.StackSettings `json:"stackSettings"`
+	}
+	if err := json.Unmarshal(body, &settings); err != nil {
+		t.Fatal(err)
+	}
+	priorities := map[string]int{}
+	for _, stackSettings := range settings.StackSettings {
+		priorities[fmt.Sprintf("%d/%s", stackSettings.EndpointId, stackSettings.StackName)] = stackSettings.Priority
+	}
+	if len(priorities) != 3 || priorities["1/db"] != 0 || priorities["1/web"] != 1 || priorities["2/db"] != 0 {
+		t.Fatalf("unexpected stack settings after sync: %s", body)
+	}
+
+	resp, body = env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=2", nil)
+	var stacks []types.StackDto
+	if err := json.Unmarshal(body, &stacks); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to list stacks of endpoint 2: %d %s", resp.StatusCode, body)
+	}
+	if len(stacks) != 1 || stacks[0].EndpointId != 2 || stacks[0].Containers[0].Image != "mariadb:11" {
+		t.Fatalf("unexpected stacks in endpoint 2: %s", body)
+	}
+}
+
+// waitForLatestJob polls the job history until the newest job of stackName has finished
+func (env *testEnv) waitForLatestJob(t *testing.T, stackName string) types.StackUpdateJob {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		_, body := env.request(t, http.MethodGet, "/api/jobs?pageSize=1&stackName="+stackName, nil)
+		var history struct {
+			Jobs []types.StackUpdateJob `json:"jobs"`
+		}
+		if err := json.Unmarshal(body, &history); err != nil {
+			t.Fatal(err)
+		}
+		if len(history.Jobs) > 0 && history.Jobs[0].Status != types.Queued {
+			return history.Jobs[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no finished job for stack %s", stackName)
+	return types.StackUpdateJob{}
+}
+
+// lastStackUpdate returns the body of the last PUT /stacks/{id} the fake received
+func (env *testEnv) lastStackUpdate(t *testing.T, stackId int) portainer.UpdateStackRequest {
+	t.Helper()
+	var request portainer.UpdateStackRequest
+	for _, call := range env.portainer.Calls() {
+		if call.Method == http.MethodPut && call.Path == fmt.Sprintf("/stacks/%d", stackId) {
+			if err := json.Unmarshal([]byte(call.Body), &request); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return request
+}
+
+func TestRollbackStack(t *testing.T) {
+	env := newTestEnv(t)
+	env.portainer.AddStack(1, 12, "app", "services:\n  api:\n    image: ghcr.io/acme/api:1\n  cache:\n    image: redis:7\n")
+	env.portainer.AddContainer(1, "app", "c-app-1", "app-api-1", "ghcr.io/acme/api:1")
+	env.portainer.AddContainer(1, "app", "c-app-2", "app-cache-1", "redis:7")
+
+	resp, body := env.request(t, http.MethodPost, "/api/portainer/stacks/12/rollback", gin.H{"endpointId": 1})
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 without a snapshot, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = env.request(t, http.MethodPut, "/api/portainer/stacks/12/update", gin.H{"endpointId": 1, "prune": false, "pullImage": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	update := env.waitForLatestJob(t, "app")
+	if update.Status != types.Done || len(update.ImagesBefore) != 2 || update.ImagesBefore[0].Digest == "" {
+		t.Fatalf("unexpected update job: %+v", update)
+	}
+
+	resp, body = env.request(t, http.MethodPost, "/api/portainer/stacks/12/rollback", gin.H{"endpointId": 1})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	rollback := env.waitForLatestJob(t, "app")
+	if rollback.Status != types.Done || rollback.RollbackOf != update.Id || rollback.TriggeredBy != testUser {
+		t.Fatalf("unexpected rollback job: %+v", rollback)
+	}
+	pinned := env.lastStackUpdate(t, 12).StackFileContent
+	for _, image := range []string{"ghcr.io/acme/api:1", "redis:7"} {
+		if !strings.Contains(pinned, "image: "+portainertest.ImageDigest(image)) {
+			t.Fatalf("expected %s to be pinned, got:\n%s", image, pinned)
+		}
+	}
+
+	// the next update deploys the compose file from before the rollback again
+	resp, body = env.request(t, http.MethodPut, "/api/portainer/stacks/12/update", gin.H{"endpointId": 1, "prune": false, "pullImage": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.waitForLatestJob(t, "app")
+	if unpinned := env.lastStackUpdate(t, 12).StackFileContent; !strings.Contains(unpinned, "image: ghcr.io/acme/api:1") {
+		t.Fatalf("expected images to be unpinned, got:\n%s", unpinned)
+	}
+}
+
+func TestJobsHideSnapshot(t *testing.T) {
+	env := newTestEnv(t)
+	env.portainer.SetStackEnv(10, portainer.EnvVar{Name: "DB_PASSWORD", Value: "hunter2"})
+	if resp, body := env.request(t, http.MethodPut, "/api/portainer/stacks/10/update", gin.H{"endpointId": 1, "prune": false, "pullImage": true}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	job := env.waitForLatestJob(t, "web")
+
+	// the snapshot of the stack is only used for rollbacks, not even admins read it
+	env.token = env.loginAs(t, "vera", types.RoleViewer)
+	for _, path := range []string{"/api/jobs", "/api/jobs/" + job.Id} {
+		resp, body := env.request(t, http.MethodGet, path, nil)
+		if resp.StatusCode != http.StatusOK || strings.Contains(string(body), "hunter2") || strings.Contains(string(body), `"env"`) || strings.Contains(string(body), "stackFile") {
+			t.Fatalf("expected %s without the snapshot, got %d: %s", path, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestScheduledUpdates(t *testing.T) {
+	env := newTestEnv(t)
+	env.portainer.AddStack(1, 13, "queue", "services:\n  worker:\n    image: rabbitmq:3\n")
+	env.portainer.AddContainer(1, "queue", "c-queue-1", "queue-worker-1", "rabbitmq:3")
+	env.portainer.SetStackImagesStatus(13, types.Outdated)
+	env.portainer.SetContainerImageStatus("c-queue-1", types.Outdated)
+
+	if resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("sync failed: %d %s", resp.StatusCode, body)
+	}
+	// fills the image status cache the scheduler decides on
+	if resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to list stacks: %d %s", resp.StatusCode, body)
+	}
+
+	resp, body := env.request(t, http.MethodPut, "/api/db/stacks/queue?endpointId=1", gin.H{"updatePolicy": types.UpdatePolicyAuto, "updateWindow": "* 25 * * *"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid window, got %d: %s", resp.StatusCode, body)
+	}
+	for _, name := range []string{"queue", "web"} {
+		resp, body = env.request(t, http.MethodPut, "/api/db/stacks/"+name+"?endpointId=1", gin.H{"updatePolicy": types.UpdatePolicyAuto, "updateWindow": "* * * * *"})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+		}
+	}
+	// clients that only send autoStart keep the policy
+	env.request(t, http.MethodPut, "/api/db/stacks/queue?endpointId=1", gin.H{"stackName": "queue", "autoStart": false})
+
+	control.RunScheduledUpdates(1, time.Now())
+	control.RunScheduledUpdates(1, time.Now())
+	// the update was queued after the pass, e.g. by a clock that went back
+	control.RunScheduledUpdates(1, time.Now().Add(-time.Hour))
+
+	_, body = env.request(t, http.MethodGet, "/api/jobs", nil)
+	var history struct {
+		Jobs []types.StackUpdateJob `json:"jobs"`
+	}
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Jobs) != 1 || history.Jobs[0].StackName != "queue" || history.Jobs[0].TriggeredBy != control.SchedulerIdentity {
+		t.Fatalf("expected exactly one scheduled update of the outdated stack, got %s", body)
+	}
+
+	// a window that never closes opens again after a day
+	env.portainer.SetStackImagesStatus(13, types.Outdated)
+	env.portainer.SetContainerImageStatus("c-queue-1", types.Outdated)
+	env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil)
+	control.RunScheduledUpdates(1, time.Now().Add(25*time.Hour))
+	_, body = env.request(t, http.MethodGet, "/api/jobs", nil)
+	if err := json.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Jobs) != 2 || history.Jobs[0].StackName != "queue" || history.Jobs[0].TriggeredBy != control.SchedulerIdentity {
+		t.Fatalf("expected a second scheduled update a day later, got %s", body)
+	}
+}
+
+type recordingNotifier struct {
+	events chan notify.Event
+}
+
+func (n *recordingNotifier) Name() string {
+	return "recorder"
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, event notify.Event) error {
+	n.events <- event
+	return nil
+}
+
+func (n *recordingNotifier) next(t *testing.T) notify.Event {
+	t.Helper()
+	select {
+	case event := <-n.events:
+		return event
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no notification received")
+		return notify.Event{}
+	}
+}
+
+// failingNotifier never delivers an event
+type failingNotifier struct{}
+
+func (failingNotifier) Name() string {
+	return "failing"
+}
+
+func (failingNotifier) Notify(ctx context.Context, event notify.Event) error {
+	return fmt.Errorf("notifier unreachable")
+}
+
+// refreshImageStatus runs a background image status check of endpoint 1 and waits for it
+func (env *testEnv) refreshImageStatus(t *testing.T) {
+	t.Helper()
+	resp, body := env.request(t, http.MethodPost, "/api/portainer/refresh-image-status?endpointId=1", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", resp.StatusCode, body)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for portainer.Refresh.Snapshot().Running {
+		if time.Now().After(deadline) {
+			t.Fatalf("image refresh did not finish")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	env := newTestEnv(t)
+	t.Cleanup(func() { notify.SetNotifiers() })
+
+	env.portainer.AddStack(1, 14, "proxy", "services:\n  traefik:\n    image: traefik:3\n")
+	env.portainer.AddContainer(1, "proxy", "c-proxy-1", "proxy-traefik-1", "traefik:3")
+	env.portainer.SetStackImagesStatus(14, types.Outdated)
+	env.portainer.SetContainerImageStatus("c-proxy-1", types.Outdated)
+
+	// images are not counted as reported without a notifier or while no notifier delivers them
+	notify.SetNotifiers()
+	env.refreshImageStatus(t)
+	notify.SetNotifiers(failingNotifier{})
+	env.refreshImageStatus(t)
+
+	recorder := &recordingNotifier{events: make(chan notify.Event, 10)}
+	notify.SetNotifiers(recorder)
+	env.refreshImageStatus(t)
+	event := recorder.next(t)
+	if event.Kind != notify.EventImageOutdated || event.StackName != "proxy" || len(event.Images) != 1 || event.Images[0].Digest == "" {
+		t.Fatalf("unexpected notification: %+v", event)
+	}
+
+	// the same digest is not reported twice, a new one is
+	env.refreshImageStatus(t)
+	env.portainer.SetRemoteDigest("traefik:3", "sha256:new")
+	env.refreshImageStatus(t)
+	if event = recorder.next(t); event.Images[0].Digest != "sha256:new" {
+		t.Fatalf("expected notification for the new digest, got %+v", event)
+	}
+
+	env.portainer.FailRequests("PUT /stacks/14", http.StatusInternalServerError, "Failed to deploy", "pull access denied")
+	resp, body := env.request(t, http.MethodPut, "/api/portainer/stacks/14/update", gin.H{"endpointId": 1, "prune": false, "pullImage": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	event = recorder.next(t)
+	if event.Kind != notify.EventUpdateFailed || !strings.Contains(event.Message, "pull access denied") || event.JobId == "" {
+		t.Fatalf("unexpected notification: %+v", event)
+	}
+}
+
+// scrapeMetrics fetches /metrics with the given bearer token
+func (env *testEnv) scrapeMetrics(t *testing.T, token string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, env.server.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	state.Instance().Config.MetricsToken = "scrape"
+	t.Cleanup(func() { state.Instance().Config.MetricsToken = "" })
+	env := newTestEnv(t)
+
+	env.portainer.AddStack(1, 15, "mon", "services:\n  grafana:\n    image: grafana/grafana:11\n")
+	env.portainer.AddContainer(1, "mon", "c-mon-1", "mon-grafana-1", "grafana/grafana:11")
+	env.portainer.SetStackImagesStatus(15, types.Outdated)
+	env.portainer.SetContainerImageStatus("c-mon-1", types.Outdated)
+	if resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.portainer.FailRequests("POST /endpoints/1/docker/containers/c-mon-1/stop", http.StatusInternalServerError, "Failed to stop", "")
+	env.request(t, http.MethodPost, "/api/portainer/containers/c-mon-1/stop", gin.H{"endpointId": 1})
+
+	if status, _ := env.scrapeMetrics(t, ""); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the metrics token, got %d", status)
+	}
+	status, body := env.scrapeMetrics(t, "scrape")
+	if status != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", status, body)
+	}
+	for _, expected := range []string{
+		`washboard_stack_containers{endpoint="1",stack="mon",status="outdated"} 1`,
+		`washboard_stack_containers{endpoint="1",stack="web",status="updated"} 2`,
+		`washboard_portainer_request_duration_seconds_count{method="GET",route="/endpoints/{id}/docker/containers/json"}`,
+		`washboard_portainer_request_errors_total{code="500",method="POST",route="/endpoints/{id}/docker/containers/{id}/stop"}`,
+		`washboard_cache_requests_total{cache="portainer",result="miss"}`,
+		`washboard_websocket_clients`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics do not contain %s", expected)
+		}
+	}
+}
+
+// loginAs creates an account with the given role and returns a session token for it
+func (env *testEnv) loginAs(t *testing.T, userName string, role string) string {
+	t.Helper()
+	resp, body := env.request(t, http.MethodPost, "/api/accounts", gin.H{"userName": userName, "password": "password-" + userName, "role": role})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	return env.login(t, userName, "password-"+userName)
+}
+
+func TestAccountRoles(t *testing.T) {
+	env := newTestEnv(t)
+	adminToken := env.token
+	viewerToken := env.loginAs(t, "vera", types.RoleViewer)
+	operatorToken := env.loginAs(t, "otto", types.RoleOperator)
+
+	cases := []struct {
+		token  string
+		method string
+		path   string
+		status int
+	}{
+		{viewerToken, http.MethodGet, "/api/portainer/stacks?endpointId=1", http.StatusOK},
+		{viewerToken, http.MethodPost, "/api/portainer/stacks/10/stop", http.StatusForbidden},
+		{viewerToken, http.MethodGet, "/api/accounts", http.StatusForbidden},
+		{operatorToken, http.MethodPost, "/api/portainer/stacks/10/stop", http.StatusOK},
+		{operatorToken, http.MethodPost, "/api/accounts", http.StatusForbidden},
+		{adminToken, http.MethodGet, "/api/accounts", http.StatusOK},
+	}
+	for _, c := range cases {
+		env.token = c.token
+		if resp, body := env.request(t, c.method, c.path, gin.H{"endpointId": 1}); resp.StatusCode != c.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", c.method, c.path, c.status, resp.StatusCode, body)
+		}
+	}
+
+	// viewers change their own password, the old one stops working
+	env.token = viewerToken
+	resp, body := env.request(t, http.MethodPut, "/api/accounts/me/password", gin.H{"currentPassword": "password-vera", "newPassword": "correct horse"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.token = ""
+	if resp, _ := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "vera", "password": "password-vera"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the old password to be rejected, got %d", resp.StatusCode)
+	}
+	env.login(t, "vera", "correct horse")
+
+	// role changes and deletions apply to issued tokens, the last admin stays
+	env.token = adminToken
+	if resp, body := env.request(t, http.MethodPut, "/api/accounts/otto", gin.H{"role": types.RoleViewer}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodDelete, "/api/accounts/vera", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/accounts/"+testUser, gin.H{"role": types.RoleOperator}); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected the last admin to keep the role, got %d: %s", resp.StatusCode, body)
+	}
+	env.token = operatorToken
+	if resp, _ := env.request(t, http.MethodPost, "/api/portainer/stacks/10/stop", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the demoted operator to be rejected, got %d", resp.StatusCode)
+	}
+	env.token = viewerToken
+	if resp, _ := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the session of the deleted account to be revoked, got %d", resp.StatusCode)
+	}
+}
+
+// oidcLogin runs the authorization code flow against the stand-in provider with a browser-like
+// client and returns the answer of the callback
+func (env *testEnv) oidcLogin(t *testing.T, browser *http.Client) *http.Response {
+	t.Helper()
+	resp, err := browser.Get(env.server.URL + "/api/auth/oidc/login")
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect to the provider: %v %v", resp, err)
+	}
+	resp, err = browser.Get(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the provider to redirect back: %v %v", resp, err)
+	}
+	// the redirect url is the public one, the test server listens elsewhere
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = browser.Get(env.server.URL + callback.Path + "?" + callback.RawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// browserAccount returns the account of the session browser is logged in with
+func browserAccount(t *testing.T, env *testEnv, browser *http.Client) types.AccountDto {
+	t.Helper()
+	resp, err := browser.Get(env.server.URL + "/api/accounts/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var account types.AccountDto
+	if err := json.NewDecoder(resp.Body).Decode(&account); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to get the account of the session (%d): %v", resp.StatusCode, err)
+	}
+	return account
+}
+
+func TestOidcLogin(t *testing.T) {
+	idp := oidctest.NewServer("washboard", "client-secret")
+	t.Cleanup(idp.Close)
+	config := &state.Instance().Config
+	config.Oidc = state.OidcConfig{
+		Issuer:         idp.URL,
+		ClientId:       "washboard",
+		ClientSecret:   "client-secret",
+		RedirectUrl:    "http://washboard.example.com/api/auth/oidc/callback",
+		AdminGroups:    []string{"washboard-admins"},
+		OperatorGroups: []string{"washboard-ops", "sre"},
+	}
+	t.Cleanup(func() { config.Oidc = state.OidcConfig{} })
+	env := newTestEnv(t)
+
+	jar, _ := cookiejar.New(nil)
+	browser := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	idp.SetUser("ines", "staff", "washboard-ops")
+	if resp := env.oidcLogin(t, browser); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("expected a redirect to the frontend, got %d", resp.StatusCode)
+	}
+
+	// the session cookie is accepted like the one of the password login
+	resp, err := browser.Get(env.server.URL + "/api/accounts/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var account types.AccountDto
+	json.NewDecoder(resp.Body).Decode(&account)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || account.DisplayName != "ines" || !strings.HasPrefix(account.UserName, "oidc-") || account.Role != types.RoleOperator || account.Provider != types.AccountProviderOidc {
+		t.Fatalf("unexpected account %+v (%d)", account, resp.StatusCode)
+	}
+	accountName := account.UserName
+	adminToken := env.token
+	env.token = ""
+	if resp, _ := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "ines", "password": "any password"}); resp.StatusCode == http.StatusOK {
+		t.Fatalf("single sign-on accounts must not log in with a password")
+	}
+
+	// accounts follow the subject, not the user name: a reassigned name gets an account of its own
+	// and a renamed user keeps its account
+	idp.SetSubjectUser("sub-other", "ines", "washboard-admins")
+	if resp := env.oidcLogin(t, browser); resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the login of another subject, got %d", resp.StatusCode)
+	}
+	if other := browserAccount(t, env, browser); other.UserName == accountName || other.Role != types.RoleAdmin {
+		t.Fatalf("expected a separate account for another subject, got %+v", other)
+	}
+	idp.SetSubjectUser("sub-ines", "ines.renamed", "washboard-ops")
+	if resp := env.oidcLogin(t, browser); resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the login of the renamed user, got %d", resp.StatusCode)
+	}
+	if renamed := browserAccount(t, env, browser); renamed.UserName != accountName || renamed.DisplayName != "ines.renamed" {
+		t.Fatalf("expected the renamed user to keep its account, got %+v", renamed)
+	}
+
+	// a local account is never linked, even if it has the name of a single sign-on account
+	env.token = adminToken
+	if resp, body := env.request(t, http.MethodDelete, "/api/accounts/"+accountName, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPost, "/api/accounts", gin.H{"userName": accountName, "password": "local-password", "role": types.RoleViewer}); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	if resp := env.oidcLogin(t, browser); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the local account not to be taken over, got %d", resp.StatusCode)
+	}
+
+	// users without a mapped group are rejected, and so are callbacks without the state cookie
+	idp.SetUser("mallory", "staff")
+	if resp := env.oidcLogin(t, browser); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a user without role, got %d", resp.StatusCode)
+	}
+	jar, _ = cookiejar.New(nil)
+	stranger := &http.Client{Jar: jar, CheckRedirect: browser.CheckRedirect}
+	resp, err = stranger.Get(env.server.URL + "/api/auth/oidc/callback?code=stolen&state=guessed")
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown state: %v %v", resp, err)
+	}
+}
+
+// createApiToken creates an api token with the session in env.token and returns its secret
+func (env *testEnv) createApiToken(t *testing.T, scopes []string, stacks []string) string {
+	t.Helper()
+	resp, body := env.request(t, http.MethodPost, "/api/tokens", gin.H{"name": "ci", "scopes": scopes, "stacks": stacks})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	var created struct {
+		Token    string            `json:"token"`
+		ApiToken types.ApiTokenDto `json:"apiToken"`
+	}
+	if err := json.Unmarshal(body, &created); err != nil || !strings.HasPrefix(created.Token, auth.ApiTokenPrefix+created.ApiToken.Id) {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	return created.Token
+}
+
+func TestApiTokens(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.token
+	ciToken := env.createApiToken(t, []string{auth.ScopeStackUpdate, auth.ScopeJobRead}, []string{"we?"})
+	// tokens never grant more than the current role of their owner
+	env.token = env.loginAs(t, "vince", types.RoleOperator)
+	demotedToken := env.createApiToken(t, []string{auth.ScopeStackUpdate}, []string{"*"})
+	env.token = session
+	if resp, body := env.request(t, http.MethodPut, "/api/accounts/vince", gin.H{"role": types.RoleViewer}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	update := gin.H{"endpointId": 1, "prune": false, "pullImage": true}
+	cases := []struct {
+		token  string
+		method string
+		path   string
+		status int
+	}{
+		{ciToken, http.MethodPut, "/api/portainer/stacks/10/update", http.StatusOK},
+		{ciToken, http.MethodPost, "/api/portainer/stacks/10/stop", http.StatusForbidden},
+		{ciToken, http.MethodPut, "/api/portainer/stacks/11/update", http.StatusForbidden},
+		{ciToken, http.MethodGet, "/api/portainer/stacks?endpointId=1", http.StatusForbidden},
+		{ciToken, http.MethodPost, "/api/tokens", http.StatusForbidden},
+		{ciToken + "x", http.MethodPut, "/api/portainer/stacks/10/update", http.StatusUnauthorized},
+		{demotedToken, http.MethodPut, "/api/portainer/stacks/10/update", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		env.token = c.token
+		if resp, body := env.request(t, c.method, c.path, update); resp.StatusCode != c.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", c.method, c.path, c.status, resp.StatusCode, body)
+		}
+	}
+
+	env.token = session
+	job := env.waitForLatestJob(t, "web")
+	if job.TriggeredBy != testUser {
+		t.Errorf("expected the job to be triggered by the owner of the token, got %q", job.TriggeredBy)
+	}
+	env.token = ciToken
+	if resp, body := env.request(t, http.MethodGet, "/api/jobs/"+job.Id, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the token to read the job, got %d: %s", resp.StatusCode, body)
+	}
+
+	env.token = session
+	_, body := env.request(t, http.MethodGet, "/api/tokens", nil)
+	var listed struct {
+		Tokens []types.ApiTokenDto `json:"tokens"`
+	}
+	if err := json.Unmarshal(body, &listed); err != nil || len(listed.Tokens) != 1 || listed.Tokens[0].LastUsedAt == 0 || strings.Contains(string(body), "hash") {
+		t.Fatalf("unexpected token list: %s", body)
+	}
+	if resp, body := env.request(t, http.MethodDelete, "/api/tokens/"+listed.Tokens[0].Id, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.token = ciToken
+	if resp, _ := env.request(t, http.MethodPut, "/api/portainer/stacks/10/update", update); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked token to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.token
+	env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "olga", "password": "wrong"})
+	env.token = env.loginAs(t, "olga", types.RoleOperator)
+	env.request(t, http.MethodPost, "/api/portainer/containers/c-db-1/stop", gin.H{"endpointId": 1})
+	env.request(t, http.MethodPost, "/api/portainer/stacks/10/start", gin.H{"endpointId": 1})
+	env.request(t, http.MethodPut, "/api/accounts/me/password", gin.H{"currentPassword": "password-olga", "newPassword": "correct horse"})
+	if resp, _ := env.request(t, http.MethodGet, "/api/audit", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected operators to be denied the audit log, got %d", resp.StatusCode)
+	}
+
+	env.token = session
+	resp, body := env.request(t, http.MethodGet, "/api/audit?user=olga", nil)
+	var page struct {
+		Entries []types.AuditEntry `json:"entries"`
+		Total   int                `json:"total"`
+	}
+	if err := json.Unmarshal(body, &page); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+	expected := []struct {
+		action string
+		target string
+		result string
+	}{
+		{"account.change-password", "", types.AuditSuccess},
+		{"stack.start", "stack:10", types.AuditFailure},
+		{"container.stop", "container:c-db-1", types.AuditSuccess},
+		{"auth.login", "", types.AuditSuccess},
+		{"auth.login", "", types.AuditFailure},
+	}
+	if page.Total != len(expected) {
+		t.Fatalf("expected %d entries of olga, got %s", len(expected), body)
+	}
+	for i, e := range expected {
+		entry := page.Entries[i]
+		if entry.Action != e.action || entry.Target != e.target || entry.Result != e.result || entry.ClientIp == "" {
+			t.Errorf("entry %d: expected %s %s %s, got %+v", i, e.action, e.target, e.result, entry)
+		}
+	}
+	if page.Entries[1].StatusCode != http.StatusConflict || page.Entries[1].Error == "" {
+		t.Errorf("expected the failed start to record the error, got %+v", page.Entries[1])
+	}
+	if strings.Contains(string(body), "correct horse") || strings.Contains(string(body), "password-olga") {
+		t.Errorf("passwords must not be recorded: %s", body)
+	}
+
+	resp, body = env.request(t, http.MethodGet, "/api/audit?action=account&export=csv", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), "attachment") {
+		t.Fatalf("expected a csv download, got %d %v", resp.StatusCode, resp.Header)
+	}
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id,timestamp,userName") || !strings.Contains(lines[1], "account.change-password") || !strings.Contains(lines[2], "account.create") {
+		t.Fatalf("unexpected csv export: %s", body)
+	}
+	resp, body = env.request(t, http.MethodGet, "/api/audit?result=failure&export=json", nil)
+	var exported []types.AuditEntry
+	if err := json.Unmarshal(body, &exported); resp.StatusCode != http.StatusOK || err != nil || len(exported) != 2 {
+		t.Fatalf("unexpected json export %d: %s", resp.StatusCode, body)
+	}
+
+	// exports are bounded, a filter matching more entries has to be narrowed
+	config := &state.Instance().Config
+	limit := config.AuditExportLimit
+	config.AuditExportLimit = 1
+	t.Cleanup(func() { config.AuditExportLimit = limit })
+	if resp, body = env.request(t, http.MethodGet, "/api/audit?result=failure&export=json", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an export above the limit, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	config := &state.Instance().Config
+	config.LoginThrottle = state.LoginThrottleConfig{FreeAttempts: 2, BaseDelaySeconds: 30}
+	t.Cleanup(func() { config.LoginThrottle = state.LoginThrottleConfig{} })
+	env := newTestEnv(t)
+
+	for i := 0; i < 3; i++ {
+		if resp, _ := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": testUser, "password": "wrong"}); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+	resp, body := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": testUser, "password": testPassword})
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "30" {
+		t.Fatalf("expected the correct password to be throttled as well, got %d %v: %s", resp.StatusCode, resp.Header, body)
+	}
+
+	resp, body = env.request(t, http.MethodGet, "/api/audit?action=auth.login&result=failure", nil)
+	var page struct {
+		Entries []types.AuditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &page); resp.StatusCode != http.StatusOK || err != nil || len(page.Entries) != 4 || page.Entries[0].StatusCode != http.StatusTooManyRequests || page.Entries[0].UserName != testUser {
+		t.Fatalf("expected the failed and throttled logins in the audit log: %s", body)
+	}
+}
+
+func TestParallelLoginsAreThrottled(t *testing.T) {
+	config := &state.Instance().Config
+	config.LoginThrottle = state.LoginThrottleConfig{FreeAttempts: 2, BaseDelaySeconds: 30, LockoutAttempts: 5}
+	t.Cleanup(func() { config.LoginThrottle = state.LoginThrottleConfig{} })
+	env := newTestEnv(t)
+
+	const attempts = 20
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(env.server.URL+"/api/auth/login", "application/json", strings.NewReader(`{"username": "`+testUser+`", "password": "wrong"}`))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	// the free attempts and at most one more before the delay kicks in reach the password check
+	if counts[http.StatusUnauthorized] > 3 || counts[http.StatusTooManyRequests] < attempts-3 {
+		t.Fatalf("expected parallel logins to be throttled, got %v", counts)
+	}
+}
+
+func TestParallelLoginsUseRecoveryCodeOnce(t *testing.T) {
+	env := newTestEnv(t)
+	account, err := db.GetAccount(testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.TotpSecret = "JBSWY3DPEHPK3PXP"
+	codes, err := auth.NewRecoveryCodes(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+
+	const attempts = 3
+	statuses := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(env.server.URL+"/api/auth/login", "application/json", strings.NewReader(`{"username": "`+testUser+`", "password": "`+testPassword+`", "otp": "`+codes[0]+`"}`))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	counts := make(map[int]int)
+	for status := range statuses {
+		counts[status]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusUnauthorized] != attempts-1 {
+		t.Fatalf("expected the recovery code to be accepted once, got %v", counts)
+	}
+	if stored, err := db.GetAccount(testUser); err != nil || len(stored.RecoveryCodes) != len(codes)-1 {
+		t.Fatalf("expected the recovery code to be used up, got %+v, %v", stored, err)
+	}
+}
+
+func TestTwoFactorAuthentication(t *testing.T) {
+	env := newTestEnv(t)
+	session := env.token
+	operatorToken := env.loginAs(t, "tara", types.RoleOperator)
+
+	if resp, body := env.request(t, http.MethodPut, "/api/security/policy", gin.H{"requireTwoFactorRoles": []string{types.RoleViewer}}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected viewers to be rejected, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/security/policy", gin.H{"requireTwoFactorRoles": []string{types.RoleOperator}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	// until tara enrolls, only the own account is accessible
+	env.token = operatorToken
+	if resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil); resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "two-factor") {
+		t.Fatalf("expected 403 before the enrollment, got %d: %s", resp.StatusCode, body)
+	}
+	resp, body := env.request(t, http.MethodPost, "/api/accounts/me/2fa", nil)
+	var enrollment struct {
+		Secret          string `json:"secret"`
+		ProvisioningUri string `json:"provisioningUri"`
+	}
+	if err := json.Unmarshal(body, &enrollment); resp.StatusCode != http.StatusOK || err != nil || !strings.HasPrefix(enrollment.ProvisioningUri, "otpauth://totp/Washboard:tara?") {
+		t.Fatalf("unexpected enrollment %d: %s", resp.StatusCode, body)
+	}
+	code, _ := auth.GenerateTotp(enrollment.Secret, time.Now())
+	resp, body = env.request(t, http.MethodPost, "/api/accounts/me/2fa/confirm", gin.H{"code": code})
+	var confirmed struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	if err := json.Unmarshal(body, &confirmed); resp.StatusCode != http.StatusOK || err != nil || len(confirmed.RecoveryCodes) != 10 {
+		t.Fatalf("unexpected confirmation %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after the enrollment, got %d: %s", resp.StatusCode, body)
+	}
+
+	env.token = ""
+	resp, body = env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "tara", "password": "password-tara"})
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(body), `"twoFactorRequired":true`) {
+		t.Fatalf("expected the second factor to be requested, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "tara", "password": "password-tara", "otp": code}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the used code to be rejected, got %d", resp.StatusCode)
+	}
+	next, _ := auth.GenerateTotp(enrollment.Secret, time.Now().Add(30*time.Second))
+	if resp, body := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "tara", "password": "password-tara", "otp": next}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the login with the next code to succeed, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "tara", "password": "password-tara", "otp": confirmed.RecoveryCodes[0]}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the login with a recovery code to succeed, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := env.request(t, http.MethodPost, "/api/auth/login", gin.H{"username": "tara", "password": "password-tara", "otp": confirmed.RecoveryCodes[0]}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the used recovery code to be rejected, got %d", resp.StatusCode)
+	}
+
+	// an admin resets the lost device, tara has to enroll again
+	env.token = session
+	if resp, body := env.request(t, http.MethodDelete, "/api/accounts/tara/2fa", nil); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"twoFactorEnabled":false`) {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.token = operatorToken
+	if resp, _ := env.request(t, http.MethodPost, "/api/control/stop-all", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 after the reset, got %d", resp.StatusCode)
+	}
+}
+
+// sessionsOf lists the sessions visible to the token of env
+func (env *testEnv) sessionsOf(t *testing.T) []types.SessionDto {
+	t.Helper()
+	resp, body := env.request(t, http.MethodGet, "/api/sessions", nil)
+	var list struct {
+		Sessions []types.SessionDto `json:"sessions"`
+	}
+	if err := json.Unmarshal(body, &list); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("unexpected sessions %d: %s", resp.StatusCode, body)
+	}
+	return list.Sessions
+}
+
+func TestSessions(t *testing.T) {
+	env := newTestEnv(t)
+	adminToken := env.token
+	laptop := env.loginAs(t, "sam", types.RoleViewer)
+	phone := env.login(t, "sam", "password-sam")
+	tablet := env.login(t, "sam", "password-sam")
+
+	env.token = laptop
+	sessions := env.sessionsOf(t)
+	if len(sessions) != 3 || !sessions[0].Current || sessions[1].Current {
+		t.Fatalf("expected three sessions with the first one current, got %+v", sessions)
+	}
+	if resp, body := env.request(t, http.MethodDelete, "/api/sessions/"+sessions[1].Id, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.token = phone
+	if resp, _ := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session to be rejected, got %d", resp.StatusCode)
+	}
+	if resp, _ := env.request(t, http.MethodPost, "/api/auth/refresh_token", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session not to be refreshed, got %d", resp.StatusCode)
+	}
+
+	// sessions of other users are hidden from viewers
+	env.token = adminToken
+	adminSession := env.sessionsOf(t)[0].Id
+	env.token = laptop
+	if resp, _ := env.request(t, http.MethodDelete, "/api/sessions/"+adminSession, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for the session of another user, got %d", resp.StatusCode)
+	}
+
+	env.token = tablet
+	if resp, body := env.request(t, http.MethodPost, "/api/auth/refresh_token", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the refresh to succeed, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPost, "/api/auth/logout", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := env.request(t, http.MethodGet, "/api/sessions", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the logged out session to be rejected, got %d", resp.StatusCode)
+	}
+
+	// log out everywhere
+	env.login(t, "sam", "password-sam")
+	env.token = laptop
+	if resp, body := env.request(t, http.MethodDelete, "/api/sessions", nil); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"revoked":2`) {
+		t.Fatalf("expected two revoked sessions, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := env.request(t, http.MethodGet, "/api/sessions", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the current session to be revoked too, got %d", resp.StatusCode)
+	}
+
+	env.token = adminToken
+	if resp, body := env.request(t, http.MethodGet, "/api/sessions?all=true", nil); resp.StatusCode != http.StatusOK || strings.Contains(string(body), `"sam"`) {
+		t.Fatalf("expected no active session of sam, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+// dialWebsocket connects to the event stream, query is appended to the url
+func (env *testEnv) dialWebsocket(t *testing.T, query string) *websocket.Conn {
+	t.Helper()
+	return env.dialWebsocketPath(t, "/api/ws/stacks-update?token="+env.token+query)
+}
+
+// dialWebsocketPath connects to a websocket route, path carries the token in its query
+func (env *testEnv) dialWebsocketPath(t *testing.T, path string) *websocket.Conn {
+	t.Helper()
+	ws, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.server.URL, "http")+path, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("failed to dial websocket: %s (%d)", err, status)
+	}
+	return ws
+}
+
+type testEnvelope struct {
+	Epoch string          `json:"epoch"`
+	Seq   uint64          `json:"seq"`
+	Topic string          `json:"topic"`
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// readEnvelope reads the next websocket message, waiting up to 10 seconds
+func readEnvelope(t *testing.T, ws *websocket.Conn) testEnvelope {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("did not receive a websocket message: %s", err)
+	}
+	var envelope testEnvelope
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		t.Fatalf("invalid envelope %s: %s", message, err)
+	}
+	return envelope
+}
+
+// stackActions returns the stack starts and stops Portainer received after the first skip calls,
+// e.g. "stop 11"
+func (env *testEnv) stackActions(skip int) []string {
+	actions := make([]string, 0)
+	for _, call := range env.portainer.Calls()[skip:] {
+		var stackId int
+		var action string
+		if _, err := fmt.Sscanf(strings.ReplaceAll(call.Path, "/", " "), " stacks %d %s", &stackId, &action); err == nil {
+			actions = append(actions, fmt.Sprintf("%s %d", action, stackId))
+		}
+	}
+	return actions
+}
+
+func TestStackGroups(t *testing.T) {
+	env := newTestEnv(t)
+	env.portainer.AddStack(1, 12, "cache", "services:\n  cache:\n    image: redis:7\n")
+	env.portainer.AddContainer(1, "cache", "c-cache-1", "cache-redis-1", "redis:7")
+	env.portainer.AddStack(1, 13, "api", "services:\n  api:\n    image: node:20\n")
+	env.portainer.AddContainer(1, "api", "c-api-1", "api-node-1", "node:20")
+	// priorities by name: api 0, cache 1, db 2, web 3
+	if resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	// the group starts after web and keeps the order of its stacks
+	if resp, body := env.request(t, http.MethodPost, "/api/db/groups?endpointId=1", gin.H{"groupName": "backend", "globalPriority": 5, "stacks": []string{"db", "cache"}}); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", resp.StatusCode, body)
+	}
+	// independent stacks run in parallel, a chain of dependencies in start order keeps the actions comparable
+	for stackName, dependency := range map[string]string{"web": "api", "cache": "web", "db": "cache"} {
+		if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/"+stackName+"?endpointId=1", gin.H{"dependsOn": []string{dependency}}); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+		}
+	}
+	invalid := []gin.H{
+		{"groupName": "backend", "stacks": []string{}},
+		{"groupName": "other", "stacks": []string{"db"}},
+		{"groupName": "other", "stacks": []string{"mail"}},
+		{"groupName": " ", "stacks": []string{}},
+	}
+	for i, group := range invalid {
+		if resp, body := env.request(t, http.MethodPost, "/api/db/groups?endpointId=1", group); resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusConflict {
+			t.Fatalf("expected group %d to be rejected, got %d: %s", i, resp.StatusCode, body)
+		}
+	}
+	// the group refers to its stacks by name
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/db?endpointId=1", gin.H{"stackName": "database"}); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "group backend") {
+		t.Fatalf("expected the rename of a grouped stack to be rejected, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodDelete, "/api/db/stacks/db?endpointId=1", nil); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "group backend") {
+		t.Fatalf("expected the deletion of a grouped stack to be rejected, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil)
+	var stacks []types.StackDto
+	if err := json.Unmarshal(body, &stacks); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to list stacks: %d %s", resp.StatusCode, body)
+	}
+	for _, stack := range stacks {
+		if expected := map[string]string{"db": "backend", "cache": "backend"}[stack.Name]; stack.Group != expected {
+			t.Fatalf("expected stack %s in group %q, got %q", stack.Name, expected, stack.Group)
+		}
+	}
+
+	calls := len(env.portainer.Calls())
+	if resp, body := env.request(t, http.MethodPost, "/api/portainer/groups/backend/stop", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK || strings.Contains(string(body), `"error"`) {
+		t.Fatalf("expected the group to stop, got %d: %s", resp.StatusCode, body)
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 11 stop 12]" {
+		t.Fatalf("expected the group to stop in reverse order, got %v", actions)
+	}
+	calls = len(env.portainer.Calls())
+	if resp, body := env.request(t, http.MethodPost, "/api/portainer/groups/backend/start", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[start 12 start 11]" {
+		t.Fatalf("expected the group to start in order, got %v", actions)
+	}
+	if resp, body := env.request(t, http.MethodPost, "/api/portainer/groups/backend/start", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK || strings.Count(string(body), `"result":"skipped"`) != 2 {
+		t.Fatalf("expected running stacks to be skipped, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := env.request(t, http.MethodPost, "/api/portainer/groups/frontend/start", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown group, got %d", resp.StatusCode)
+	}
+
+	calls = len(env.portainer.Calls())
+	if resp, body := env.request(t, http.MethodPost, "/api/control/stop-all", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 11 stop 12 stop 10 stop 13]" {
+		t.Fatalf("expected stop-all to stop the group first, got %v", actions)
+	}
+	calls = len(env.portainer.Calls())
+	if resp, body := env.request(t, http.MethodPost, "/api/control/sync-autostart", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 13 start 13 stop 10 start 10 stop 12 start 12 stop 11 start 11]" {
+		t.Fatalf("expected autostart to start the group last, got %v", actions)
+	}
+
+	if resp, body := env.request(t, http.MethodPut, "/api/portainer/groups/backend/update", gin.H{"endpointId": 1, "pullImage": true, "prune": false}); resp.StatusCode != http.StatusOK || strings.Count(string(body), `"result":"queued"`) != 2 {
+		t.Fatalf("expected both updates to be queued, got %d: %s", resp.StatusCode, body)
+	}
+	for _, stackName := range []string{"cache", "db"} {
+		if job := env.waitForLatestJob(t, stackName); job.Status != types.Done || job.TriggeredBy != testUser {
+			t.Fatalf("unexpected update of %s: %+v", stackName, job)
+		}
+	}
+	// the group stays locked until the waves of the update finished
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, body := env.request(t, http.MethodPost, "/api/portainer/groups/backend/start", gin.H{"endpointId": 1})
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if resp.StatusCode != http.StatusConflict || time.Now().After(deadline) {
+			t.Fatalf("expected the group to be unlocked after the update, got %d: %s", resp.StatusCode, body)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// membership
+	if resp, body := env.request(t, http.MethodDelete, "/api/db/groups/backend/stacks/cache?endpointId=1", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/db/groups/backend/stacks/api?endpointId=1", nil); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"stacks":["db","api"]`) {
+		t.Fatalf("expected api to join the group, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/db/groups/backend?endpointId=1", gin.H{"groupName": "core"}); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"stacks":["db","api"]`) {
+		t.Fatalf("expected the rename to keep the stacks, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodDelete, "/api/db/groups/core?endpointId=1", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodGet, "/api/db/groups?endpointId=1", nil); resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"groupSettings":[]`) {
+		t.Fatalf("expected no groups, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestStackDependencies(t *testing.T) {
+	env := newTestEnv(t)
+	if resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/web?endpointId=1", gin.H{"dependsOn": []string{"db"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	invalid := map[string][]string{
+		"db":  {"web"},
+		"web": {"web"},
+	}
+	for stackName, dependsOn := range invalid {
+		if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/"+stackName+"?endpointId=1", gin.H{"dependsOn": dependsOn}); resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected dependencies %v of %s to be rejected, got %d: %s", dependsOn, stackName, resp.StatusCode, body)
+		}
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/db?endpointId=1", gin.H{"dependsOn": []string{"mail"}}); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "mail has no settings") {
+		t.Fatalf("expected an unknown dependency to be rejected, got %d: %s", resp.StatusCode, body)
+	}
+	// web refers to db by name
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/db?endpointId=1", gin.H{"stackName": "database"}); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "stacks web depend on stack db") {
+		t.Fatalf("expected the rename of a dependency to be rejected, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodDelete, "/api/db/stacks/db?endpointId=1", nil); resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "stacks web depend on stack db") {
+		t.Fatalf("expected the deletion of a dependency to be rejected, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks?endpointId=1", nil)
+	var stacks []types.StackDto
+	if err := json.Unmarshal(body, &stacks); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to list stacks: %d %s", resp.StatusCode, body)
+	}
+	for _, stack := range stacks {
+		if expected := map[string]string{"web": "[db]", "db": "[]"}[stack.Name]; fmt.Sprint(stack.DependsOn) != expected {
+			t.Fatalf("expected stack %s to depend on %s, got %v", stack.Name, expected, stack.DependsOn)
+		}
+	}
+
+	// web has the lower priority but depends on db
+	calls := len(env.portainer.Calls())
+	if resp, body := env.request(t, http.MethodPost, "/api/control/stop-all", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 10 stop 11]" {
+		t.Fatalf("expected web to stop before db, got %v", actions)
+	}
+	calls = len(env.portainer.Calls())
+	if resp, body := env.request(t, http.MethodPost, "/api/control/sync-autostart", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 11 start 11 stop 10 start 10]" {
+		t.Fatalf("expected db to start before web, got %v", actions)
+	}
+}
+
+func TestHealthGatedStartup(t *testing.T) {
+	env := newTestEnv(t)
+	if resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/web?endpointId=1", gin.H{"dependsOn": []string{"db"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPost, "/api/control/stop-all", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.portainer.SetContainerHealth("c-db-1", types.HealthStarting)
+
+	ws := env.dialWebsocket(t, "&topics="+types.WsTopicStartup)
+	defer ws.Close()
+	if envelope := readEnvelope(t, ws); envelope.Type != types.WsMsgStartupProgress {
+		t.Fatalf("expected the startup snapshot first, got %+v", envelope)
+	}
+
+	calls := len(env.portainer.Calls())
+	done := make(chan []byte, 1)
+	go func() {
+		_, body := env.request(t, http.MethodPost, "/api/control/sync-autostart", gin.H{"endpointId": 1})
+		done <- body
+	}()
+
+	// db is reported as waiting for its healthcheck while web is not started yet
+	for waiting := false; !waiting; {
+		envelope := readEnvelope(t, ws)
+		if envelope.Type != types.WsMsgStartupStack {
+			continue
+		}
+		var progress types.StartupStackEvent
+		if err := json.Unmarshal(envelope.Data, &progress); err != nil {
+			t.Fatal(err)
+		}
+		if progress.EndpointId == 1 && progress.StackName == "db" && progress.Status == types.StartWaiting {
+			if progress.Running != 1 || progress.Healthchecks != 1 || progress.Healthy != 0 || progress.Wave != 0 {
+				t.Fatalf("unexpected progress of db: %+v", progress)
+			}
+			waiting = true
+		}
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 11 start 11]" {
+		t.Fatalf("expected web to wait for db to become healthy, got %v", actions)
+	}
+	env.portainer.SetContainerHealth("c-db-1", types.HealthHealthy)
+
+	var body []byte
+	select {
+	case body = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("startup did not finish after db became healthy")
+	}
+	if actions := env.stackActions(calls); fmt.Sprint(actions) != "[stop 11 start 11 stop 10 start 10]" {
+		t.Fatalf("expected web to start after db, got %v", actions)
+	}
+	var result struct {
+		Stacks []types.StackStartProgress `json:"stacks"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || len(result.Stacks) != 2 {
+		t.Fatalf("unexpected startup result: %s", body)
+	}
+	for _, progress := range result.Stacks {
+		if progress.Status != types.StartReady || progress.Wave != map[string]int{"db": 0, "web": 1}[progress.StackName] {
+			t.Fatalf("unexpected progress: %+v", progress)
+		}
+	}
+
+	// an unhealthy stack holds the startup back until its timeout
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/web?endpointId=1", gin.H{"startTimeout": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.portainer.SetContainerHealth("c-web-1", types.HealthUnhealthy)
+	if resp, body := env.request(t, http.MethodPost, "/api/control/stop-all", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	resp, body := env.request(t, http.MethodPost, "/api/control/sync-autostart", gin.H{"endpointId": 1})
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"status":"timeout"`) || !strings.Contains(string(body), "0 of 1 healthy") {
+		t.Fatalf("expected web to time out, got %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestStopAllReport(t *testing.T) {
+	env := newTestEnv(t)
+	config := &state.Instance().Config
+	gracePeriod := config.StopGracePeriod
+	config.StopGracePeriod = 1
+	t.Cleanup(func() { config.StopGracePeriod = gracePeriod })
+	if resp, body := env.request(t, http.MethodPost, "/api/db/sync", gin.H{"endpointIds": []int{1}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodPut, "/api/db/stacks/web?endpointId=1", gin.H{"dependsOn": []string{"db"}}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.portainer.IgnoreStop("c-web-2")
+
+	stopAll := func() []types.GroupStackResult {
+		t.Helper()
+		resp, body := env.request(t, http.MethodPost, "/api/control/stop-all", gin.H{"endpointId": 1})
+		var response struct {
+			Results []types.GroupStackResult `json:"results"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil || resp.StatusCode != http.StatusOK || len(response.Results) != 2 {
+			t.Fatalf("unexpected stop-all answer %d: %s", resp.StatusCode, body)
+		}
+		return response.Results
+	}
+
+	// web of the second start wave is stopped first and its stuck container killed after the grace period
+	calls := len(env.portainer.Calls())
+	results := stopAll()
+	if results[0].StackName != "web" || results[0].Wave != 1 || results[0].Result != types.Done || fmt.Sprint(results[0].Killed) != "[web-redis-1]" {
+		t.Fatalf("expected the container of web to be killed, got %+v", results[0])
+	}
+	if results[1].StackName != "db" || results[1].Wave != 0 || results[1].Result != types.Done || len(results[1].Killed) != 0 {
+		t.Fatalf("expected db to stop, got %+v", results[1])
+	}
+	var killed bool
+	for _, call := range env.portainer.Calls()[calls:] {
+		killed = killed || call.Path == "/endpoints/1/docker/containers/c-web-2/kill"
+	}
+	if !killed || env.portainer.ContainerState("c-web-2") != "exited" {
+		t.Fatalf("expected c-web-2 to be killed, got state %q", env.portainer.ContainerState("c-web-2"))
+	}
+
+	// stopped stacks are skipped
+	for _, result := range stopAll() {
+		if result.Result != types.Skipped {
+			t.Fatalf("expected stopped stacks to be skipped, got %+v", result)
+		}
+	}
+
+	// a container surviving the kill is reported
+	if resp, body := env.request(t, http.MethodPost, "/api/control/sync-autostart", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	env.portainer.FailRequests(`^POST /endpoints/1/docker/containers/c-web-2/kill$`, http.StatusInternalServerError, "Cannot kill container", "")
+	results = stopAll()
+	if results[0].Result != types.Error || !strings.Contains(results[0].Error, "containers still running after kill: web-redis-1") {
+		t.Fatalf("expected web to fail, got %+v", results[0])
+	}
+	if results[1].Result != types.Done {
+		t.Fatalf("expected db to stop anyway, got %+v", results[1])
+	}
+}
+
+func TestContainerEventsOverWebsocket(t *testing.T) {
+	env := newTestEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	portainer.StartEventWatcher(ctx, []int{1})
+
+	ws := env.dialWebsocket(t, "&topics="+types.WsTopicContainers)
+	defer ws.Close()
+	// the snapshot may be sent before the event stream connected
+	for connected := false; !connected; {
+		envelope := readEnvelope(t, ws)
+		if envelope.Type != types.WsMsgContainerStates {
+			t.Fatalf("expected container states, got %+v", envelope)
+		}
+		var states []types.EndpointContainerStates
+		if err := json.Unmarshal(envelope.Data, &states); err != nil {
+			t.Fatal(err)
+		}
+		for _, endpoint := range states {
+			if endpoint.EndpointId == 1 && endpoint.Connected {
+				if len(endpoint.Containers) != 3 || endpoint.Containers[0].Name != "db-postgres-1" || endpoint.Containers[0].StackName != "db" {
+					t.Fatalf("unexpected container states %+v", endpoint.Containers)
+				}
+				connected = true
+			}
+		}
+	}
+
+	// readChange returns the next change of a container, which has to arrive within a second
+	readChange := func(containerId string) types.ContainerStateEvent {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			envelope := readEnvelope(t, ws)
+			if time.Now().After(deadline) {
+				t.Fatalf("change of %s took longer than a second", containerId)
+			}
+			var changed types.ContainerStateEvent
+			if envelope.Type != types.WsMsgContainerState {
+				continue
+			}
+			if err := json.Unmarshal(envelope.Data, &changed); err != nil {
+				t.Fatal(err)
+			}
+			if changed.Container.ContainerId == containerId {
+				return changed
+			}
+		}
+	}
+
+	if resp, body := env.request(t, http.MethodPost, "/api/portainer/stacks/11/stop", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if changed := readChange("c-db-1"); changed.Action != "die" || changed.Container.Status != "exited" || changed.Stack == nil || changed.Stack.Running != 0 || changed.Stack.Containers != 1 {
+		t.Fatalf("unexpected change of the stopped container: %+v %+v", changed, changed.Stack)
+	}
+
+	env.portainer.SetContainerHealth("c-web-1", types.HealthHealthy)
+	if changed := readChange("c-web-1"); changed.Action != "health_status" || changed.Container.Health != types.HealthHealthy || changed.Stack.Running != 2 || changed.Stack.Healthy != 1 {
+		t.Fatalf("unexpected health change: %+v %+v", changed, changed.Stack)
+	}
+
+	if resp, body := env.request(t, http.MethodPost, "/api/portainer/stacks/11/start", gin.H{"endpointId": 1}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if changed := readChange("c-db-1"); changed.Action != "start" || changed.Container.Status != types.ContainerRunning {
+		t.Fatalf("unexpected change of the started container: %+v", changed)
+	}
+	if stack, ok := portainer.Live.Stack(1, "db"); !ok || stack.Running != 1 {
+		t.Fatalf("expected the live state of db to be running, got %+v", stack)
+	}
+}
+
+func TestContainerLogsOverWebsocket(t *testing.T) {
+	env := newTestEnv(t)
+	env.portainer.AddContainerLogs("c-web-1", types.LogStdout, "GET /index.html 200", "GET /missing 404")
+	env.portainer.AddContainerLogs("c-web-1", types.LogStderr, "error: upstream timed out")
+
+	for query, expected := range map[string]int{
+		"?endpointId=1&filter=(":                  http.StatusBadRequest,
+		"?endpointId=1&tail=some":                 http.StatusBadRequest,
+		"?endpointId=1&stdout=false&stderr=false": http.StatusBadRequest,
+		"?endpointId=1&since=yesterday":           http.StatusBadRequest,
+	} {
+		if resp, body := env.request(t, http.MethodGet, "/api/ws/containers/c-web-1/logs"+query, nil); resp.StatusCode != expected {
+			t.Fatalf("%s: expected %d, got %d: %s", query, expected, resp.StatusCode, body)
+		}
+	}
+	if resp, body := env.request(t, http.MethodGet, "/api/ws/containers/c-unknown/logs?endpointId=1", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown container, got %d: %s", resp.StatusCode, body)
+	}
+
+	readLine := func(ws *websocket.Conn) types.LogLine {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("did not receive a log line: %s", err)
+		}
+		var line types.LogLine
+		if err := json.Unmarshal(message, &line); err != nil {
+			t.Fatalf("invalid log line %s: %s", message, err)
+		}
+		return line
+	}
+
+	// the filter applies to the line without the timestamp and new lines are followed
+	ws := env.dialWebsocketPath(t, "/api/ws/containers/c-web-1/logs?token="+env.token+"&endpointId=1&timestamps=true&filter="+url.QueryEscape(`404|^error`))
+	defer ws.Close()
+	if line := readLine(ws); line.Stream != types.LogStdout || line.Line != "GET /missing 404" || line.Timestamp == "" {
+		t.Fatalf("unexpected first line %+v", line)
+	}
+	if line := readLine(ws); line.Stream != types.LogStderr || line.Line != "error: upstream timed out" {
+		t.Fatalf("unexpected second line %+v", line)
+	}
+	env.portainer.AddContainerLogs("c-web-1", types.LogStdout, "GET /index.html 200", "GET /gone 404")
+	if line := readLine(ws); line.Line != "GET /gone 404" {
+		t.Fatalf("expected the followed line, got %+v", line)
+	}
+
+	// without follow the logs end after the tail
+	ws = env.dialWebsocketPath(t, "/api/ws/containers/c-web-1/logs?token="+env.token+"&endpointId=1&follow=false&stderr=false&tail=1")
+	defer ws.Close()
+	if line := readLine(ws); line.Line != "GET /gone 404" || line.Timestamp != "" {
+		t.Fatalf("expected the last stdout line, got %+v", line)
+	}
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the logs to end, got %v", err)
+	}
+}
+
+func TestContainerExecOverWebsocket(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.token
+	env.token = env.loginAs(t, "omar", types.RoleOperator)
+	if resp, body := env.request(t, http.MethodGet, "/api/ws/containers/c-web-1/exec?endpointId=1", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected operators to be denied exec, got %d: %s", resp.StatusCode, body)
+	}
+	env.token = admin
+	if resp, body := env.request(t, http.MethodGet, "/api/ws/containers/c-web-1/exec?endpointId=1&cmd=+", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty command, got %d: %s", resp.StatusCode, body)
+	}
+	env.request(t, http.MethodPost, "/api/portainer/containers/c-db-1/stop", gin.H{"endpointId": 1})
+	if resp, body := env.request(t, http.MethodGet, "/api/ws/containers/c-db-1/exec?endpointId=1", nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409 for a stopped container, got %d: %s", resp.StatusCode, body)
+	}
+
+	ws := env.dialWebsocketPath(t, "/api/ws/containers/c-web-1/exec?token="+env.token+"&endpointId=1&cmd="+url.QueryEscape("/bin/bash -l")+"&rows=24&cols=80")
+	defer ws.Close()
+	output := ""
+	readUntil := func(expected string) {
+		t.Helper()
+		for !strings.Contains(output, expected) {
+			ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+			messageType, message, err := ws.ReadMessage()
+			if err != nil || messageType != websocket.BinaryMessage {
+				t.Fatalf("expected %q in the output %q, got %v", expected, output, err)
+			}
+			output += string(message)
+		}
+	}
+	readUntil("$ ")
+	ws.WriteJSON(types.ExecMessage{Type: types.ExecInput, Data: "uptime\r"})
+	readUntil("> uptime")
+	ws.WriteMessage(websocket.BinaryMessage, []byte("whoami\n"))
+	readUntil("> whoami")
+	ws.WriteJSON(types.ExecMessage{Type: types.ExecResize, Rows: 40, Cols: 120})
+	ws.WriteJSON(types.ExecMessage{Type: types.ExecInput, Data: "exit 3\r"})
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "exited with code 3" {
+				t.Fatalf("expected the exit code on close, got %v", err)
+			}
+			break
+		}
+	}
+
+	execs := env.portainer.Execs()
+	if len(execs) != 1 || execs[0].ContainerId != "c-web-1" || strings.Join(execs[0].Cmd, " ") != "/bin/bash -l" || execs[0].Rows != 40 || execs[0].Cols != 120 {
+		t.Fatalf("unexpected exec instances %+v", execs)
+	}
+
+	resp, body := env.request(t, http.MethodGet, "/api/audit?action=container.exec", nil)
+	var page struct {
+		Entries []types.AuditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &page); resp.StatusCode != http.StatusOK || err != nil || len(page.Entries) != 2 {
+		t.Fatalf("expected the failed and the started exec to be audited, got %d: %s", resp.StatusCode, body)
+	}
+	started, failed := page.Entries[0], page.Entries[1]
+	if started.UserName != testUser || started.Target != "container:c-web-1" || started.Result != types.AuditSuccess || started.Params["cmd"] != "/bin/bash -l" || started.Params["execId"] != execs[0].Id {
+		t.Errorf("unexpected audit entry of the started exec %+v", started)
+	}
+	if failed.Target != "container:c-db-1" || failed.Result != types.AuditFailure || failed.StatusCode != http.StatusConflict {
+		t.Errorf("unexpected audit entry of the failed exec %+v", failed)
+	}
+}
+
+func TestStackStats(t *testing.T) {
+	env := newTestEnv(t)
+	portainer.Stats.Configure(10*time.Second, time.Hour)
+	t.Cleanup(func() { portainer.Stats.Configure(15*time.Second, 6*time.Hour) })
+
+	ws := env.dialWebsocket(t, "&topics="+types.WsTopicStats)
+	defer ws.Close()
+	if envelope := readEnvelope(t, ws); envelope.Type != types.WsMsgStackStats || string(envelope.Data) != "[]" {
+		t.Fatalf("expected an empty stats snapshot, got %s %s", envelope.Type, envelope.Data)
+	}
+
+	read := time.Now()
+	setStats := func(containerId string, cpu uint64, system uint64, rx uint64) {
+		stats := portainer.ContainerStats{
+			Read:        read,
+			MemoryStats: portainer.MemoryStats{Usage: 64 << 20, Limit: 1 << 30},
+			Networks:    map[string]portainer.NetworkStats{"eth0": {RxBytes: rx, TxBytes: rx / 2}},
+		}
+		stats.CpuStats.CpuUsage.TotalUsage = cpu
+		stats.CpuStats.SystemCpuUsage = system
+		stats.CpuStats.OnlineCpus = 2
+		env.portainer.SetContainerStats(containerId, stats)
+	}
+	sample := func() []types.StackStats {
+		t.Helper()
+		if err := portainer.Stats.Sample(context.Background(), 1); err != nil {
+			t.Fatalf("failed to sample: %s", err)
+		}
+		envelope := readEnvelope(t, ws)
+		var latest []types.StackStats
+		if err := json.Unmarshal(envelope.Data, &latest); envelope.Type != types.WsMsgStackStats || err != nil {
+			t.Fatalf("expected the latest stack stats, got %s %s", envelope.Type, envelope.Data)
+		}
+		return latest
+	}
+
+	setStats("c-web-1", 1e9, 100e9, 1000)
+	setStats("c-web-2", 2e9, 100e9, 0)
+	sample()
+	read = read.Add(10 * time.Second)
+	setStats("c-web-1", 3e9, 110e9, 11000)
+	setStats("c-web-2", 2.5e9, 110e9, 500)
+	latest := sample()
+	if len(latest) != 2 || latest[0].StackName != "db" || latest[1].StackName != "web" {
+		t.Fatalf("expected the stacks db and web, got %+v", latest)
+	}
+	web := latest[1].Samples[0]
+	if web.Containers != 2 || web.CpuPercent != 50 || web.MemoryUsage != 128<<20 || web.NetworkRx != 1050 || len(latest[1].Containers) != 2 {
+		t.Fatalf("unexpected sum of stack web %+v", latest[1])
+	}
+
+	resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks/10/stats?range=30m", nil)
+	var stats types.StackStats
+	if err := json.Unmarshal(body, &stats); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response %d: %s", resp.StatusCode, body)
+	}
+	if stats.StackId != 10 || stats.StackName != "web" || stats.Interval != 10 || len(stats.Samples) != 2 || stats.Samples[1] != web {
+		t.Fatalf("unexpected history of stack web %+v", stats)
+	}
+	if len(stats.Containers) != 2 || stats.Containers[0].Name != "web-nginx-1" || len(stats.Containers[0].Samples) != 2 || stats.Containers[0].Samples[1].CpuPercent != 40 || stats.Containers[0].Samples[1].MemoryLimit != 1<<30 {
+		t.Fatalf("unexpected container histories %+v", stats.Containers)
+	}
+
+	if resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks/10/stats?range=soon", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid range, got %d: %s", resp.StatusCode, body)
+	}
+	if resp, body := env.request(t, http.MethodGet, "/api/portainer/stacks/99/stats", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown stack, got %d: %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,219 @@
+// Package audit records every action changing stacks, containers, settings or accounts in the
+// append-only audit log of the database.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"washboard/db"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+// maxBodySize limits how much of request and response bodies is kept for the audit entry
+const maxBodySize = 64 << 10
+
+// route describes how a request is recorded. The target is targetKind:value, the value is taken
+// from the path parameter or, if there is none of that name, the request body field targetKey.
+type route struct {
+	action     string
+	targetKind string
+	targetKey  string
+}
+
+// routes maps "METHOD fullpath" to the action it performs. Mutating requests to routes missing
+// here are recorded with the method and path as action, routes with an empty action are skipped.
+var routes = map[string]route{
+	"POST /api/portainer/refresh-image-status":            {"image-status.refresh", "endpoint", "endpointId"},
+	"POST /api/portainer/update-container":                {"container.update", "container", "containerId"},
+	"POST /api/portainer/containers/:containerId/:action": {"container.", "container", "containerId"},
+	"POST /api/portainer/stacks/:id/stop":                 {"stack.stop", "stack", "id"},
+	"POST /api/portainer/stacks/:id/start":                {"stack.start", "stack", "id"},
+	"PUT /api/portainer/stacks/:id/update":                {"stack.update", "stack", "id"},
+	"POST /api/portainer/stacks/:id/rollback":             {"stack.rollback", "stack", "id"},
+	"POST /api/db/stacks":                                 {"stack-settings.create", "stack-settings", "stackName"},
+	"PUT /api/db/stacks/:name":                            {"stack-settings.update", "stack-settings", "name"},
+	"DELETE /api/db/stacks/:name":                         {"stack-settings.delete", "stack-settings", "name"},
+	"POST /api/portainer/groups/:name/start":              {"group.start", "group", "name"},
+	"POST /api/portainer/groups/:name/stop":               {"group.stop", "group", "name"},
+	"PUT /api/portainer/groups/:name/update":              {"group.update", "group", "name"},
+	"POST /api/db/groups":                                 {"group-settings.create", "group-settings", "groupName"},
+	"PUT /api/db/groups/:name":                            {"group-settings.update", "group-settings", "name"},
+	"DELETE /api/db/groups/:name":                         {"group-settings.delete", "group-settings", "name"},
+	"PUT /api/db/groups/:name/stacks/:stack":              {"group-settings.add-stack", "group-settings", "name"},
+	"DELETE /api/db/groups/:name/stacks/:stack":           {"group-settings.remove-stack", "group-settings", "name"},
+	"POST /api/db/sync":                                   {"stack-settings.sync", "endpoint", "endpointId"},
+	"POST /api/accounts":                                  {"account.create", "account", "userName"},
+	"PUT /api/accounts/me/password":                       {"account.change-password", "", ""},
+	"POST /api/accounts/me/2fa":                           {"account.2fa-enroll", "", ""},
+	"POST /api/accounts/me/2fa/confirm":                   {"account.2fa-enable", "", ""},
+	"POST /api/accounts/me/2fa/recovery-codes":            {"account.2fa-recovery-codes", "", ""},
+	"DELETE /api/accounts/me/2fa":                         {"account.2fa-disable", "", ""},
+	"DELETE /api/accounts/:name/2fa":                      {"account.2fa-reset", "account", "name"},
+	"DELETE /api/accounts/:name/sessions":                 {"session.revoke-all", "account", "name"},
+	"DELETE /api/sessions":                                {"session.revoke-all", "", ""},
+	"DELETE /api/sessions/:id":                            {"session.revoke", "session", "id"},
+	"PUT /api/security/policy":                            {"security-policy.update", "", ""},
+	"PUT /api/accounts/:name":                             {"account.update", "account", "name"},
+	"DELETE /api/accounts/:name":                          {"account.delete", "account", "name"},
+	"POST /api/tokens":                                    {"api-token.create", "", ""},
+	"DELETE /api/tokens/:id":                              {"api-token.revoke", "api-token", "id"},
+	"POST /api/auth/login":                                {"auth.login", "", ""},
+	"POST /api/auth/logout":                               {"auth.logout", "", ""},
+	"POST /api/auth/refresh_token":                        {"", "", ""},
+	"POST /api/control/sync-autostart":                    {"control.sync-autostart", "endpoint", "endpointId"},
+	"POST /api/control/stop-all":                          {"control.stop-all", "endpoint", "endpointId"},
+}
+
+// sensitiveKeys are parts of request body field names whose values are never stored
+var sensitiveKeys = []string{"password", "secret", "token", "code", "otp"}
+
+// Record appends entry to the audit log. Failures are logged, they never fail the action itself.
+func Record(entry *types.AuditEntry) {
+	if err := db.AppendAudit(entry); err != nil {
+		glg.Errorf("Failed to write audit entry %s %s of %s: %s", entry.Action, entry.Target, entry.UserName, err)
+	}
+}
+
+// ResultOf returns AuditSuccess if err is nil and AuditFailure otherwise
+func ResultOf(err error) string {
+	if err != nil {
+		return types.AuditFailure
+	}
+	return types.AuditSuccess
+}
+
+// Middleware records every request that is not a GET or HEAD after it was handled. The identity is
+// the one set by the auth middleware, the result is taken from the response status.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(c.Request.Body, maxBodySize))
+			c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+		}
+		writer := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		// the router answers unknown paths without a full path, there is nothing to record
+		if c.FullPath() == "" {
+			return
+		}
+		auditRoute, known := routes[c.Request.Method+" "+c.FullPath()]
+		if known && auditRoute.action == "" {
+			return
+		}
+		if !known {
+			auditRoute = route{action: c.Request.Method + " " + c.Request.URL.Path}
+		}
+
+		params := requestParams(body)
+		entry := &types.AuditEntry{
+			Action:     auditRoute.action,
+			Params:     params,
+			StatusCode: writer.Status(),
+			ClientIp:   c.ClientIP(),
+		}
+		if auditRoute.action == "container." {
+			entry.Action += c.Param("action")
+		}
+		if auditRoute.targetKind != "" {
+			value := c.Param(auditRoute.targetKey)
+			if value == "" && params[auditRoute.targetKey] != nil {
+				value = fmt.Sprint(params[auditRoute.targetKey])
+			}
+			if value != "" {
+				entry.Target = auditRoute.targetKind + ":" + value
+			}
+		}
+
+		if identity, ok := c.Get(types.IdentityKey); ok {
+			if user, ok := identity.(*types.User); ok {
+				entry.UserName = user.UserName
+				entry.ApiTokenId = user.ApiTokenId
+			}
+		}
+		if entry.UserName == "" {
+			// the login is not authenticated yet, it is recorded for the user it was attempted for
+			if userName, ok := params["username"].(string); ok {
+				entry.UserName = userName
+			}
+		}
+
+		entry.Result = types.AuditSuccess
+		if writer.Status() >= http.StatusBadRequest {
+			entry.Result = types.AuditFailure
+			entry.Error = errorMessage(writer.body.Bytes(), writer.Status())
+		}
+		Record(entry)
+	}
+}
+
+// requestParams decodes a JSON object request body and removes sensitive values
+func requestParams(body []byte) map[string]interface{} {
+	var params map[string]interface{}
+	if len(body) == 0 || json.Unmarshal(body, &params) != nil {
+		return nil
+	}
+	for key := range params {
+		lower := strings.ToLower(key)
+		for _, sensitive := range sensitiveKeys {
+			if strings.Contains(lower, sensitive) {
+				params[key] = "[redacted]"
+				break
+			}
+		}
+	}
+	return params
+}
+
+// errorMessage extracts the message and error of the JSON error responses written by the handlers
+func errorMessage(body []byte, status int) string {
+	var response map[string]interface{}
+	if json.Unmarshal(body, &response) == nil {
+		parts := make([]string, 0, 2)
+		for _, key := range []string{"message", "error"} {
+			if value, ok := response[key].(string); ok && value != "" {
+				parts = append(parts, value)
+			}
+		}
+		if len(parts) > 0 {
+			return strings.Join(parts, ": ")
+		}
+	}
+	return http.StatusText(status)
+}
+
+// capturingWriter keeps the beginning of the response body to extract error messages
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	if remaining := maxBodySize - w.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		w.body.Write(data[:remaining])
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
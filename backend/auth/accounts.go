@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"washboard/db"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+const minPasswordLength = 8
+
+// ErrLastAdmin is returned when a change would leave washboard without an admin account
+var ErrLastAdmin = errors.New("at least one admin account is required")
+
+// NewAccount validates the given values and returns an account with the password hashed
+func NewAccount(userName string, password string, role string) (*types.Account, error) {
+	userName = strings.TrimSpace(userName)
+	if userName == "" {
+		return nil, errors.New("user name must not be empty")
+	}
+	if !ValidRole(role) {
+		return nil, fmt.Errorf("unknown role %q", role)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	return &types.Account{
+		UserName:     userName,
+		PasswordHash: hash,
+		Role:         role,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}, nil
+}
+
+// SetPassword replaces the password of account
+func SetPassword(account *types.Account, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	account.PasswordHash = hash
+	account.UpdatedAt = time.Now().Unix()
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	return HashAndSalt([]byte(password))
+}
+
+// CheckAdminRemains returns ErrLastAdmin if userName is the only admin and would lose the role
+// by being deleted or assigned newRole
+func CheckAdminRemains(userName string, newRole string) error {
+	if newRole == types.RoleAdmin {
+		return nil
+	}
+	accounts, err := db.GetAllAccounts()
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		if account.Role == types.RoleAdmin && account.UserName != userName {
+			return nil
+		}
+	}
+	return ErrLastAdmin
+}
+
+// EnsureAdminAccount creates an admin account from the user and password in the config if no
+// account exists yet. The password may be given in plain text or as bcrypt hash.
+func EnsureAdminAccount() error {
+	accounts, err := db.GetAllAccounts()
+	if err != nil {
+		return err
+	}
+	if len(accounts) > 0 || appState.Config.User == "" {
+		return nil
+	}
+
+	password := appState.Config.Password
+	hash := password
+	if !isBcryptHash(password) {
+		if hash, err = HashAndSalt([]byte(password)); err != nil {
+			return err
+		}
+	}
+	now := time.Now().Unix()
+	err = db.CreateAccount(&types.Account{
+		UserName:     appState.Config.User,
+		PasswordHash: hash,
+		Role:         types.RoleAdmin,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	})
+	if err != nil {
+		return err
+	}
+	glg.Infof("created admin account %s from config", appState.Config.User)
+	return nil
+}
+
+func isBcryptHash(value string) bool {
+	return len(value) == 60 && (strings.HasPrefix(value, "$2a$") || strings.HasPrefix(value, "$2b$") || strings.HasPrefix(value, "$2y$"))
+}
@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"fmt"
+	"net/http"
+
+	"washboard/db"
 	"washboard/state"
 	"washboard/types"
 
@@ -12,6 +16,17 @@ import (
 
 var appState *state.Data = state.Instance()
 
+// context keys the authenticator and authorizator use to explain a rejection in Unauthorized
+const (
+	twoFactorPendingKey = "twoFactorPending"
+	rejectionMessageKey = "rejectionMessage"
+	sessionRevokedKey   = "sessionRevoked"
+)
+
+// dummyPasswordHash is a bcrypt hash with the cost of HashAndSalt. Logins of unknown users are
+// compared against it, so they take as long as a wrong password and do not reveal which users exist.
+const dummyPasswordHash = "$2a$11$x23FzmEDmGGhL5Cy7BXzvOBiTRoRR47tGyXIh3ynOlr5CKVbFCtNu"
+
 
 func HashAndSalt(pwd []byte) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword(pwd, 11)
@@ -37,6 +52,7 @@ func PayloadFunc(data interface{}) jwt.MapClaims {
 	if v, ok := data.(*types.User); ok {
 		return jwt.MapClaims{
 			types.IdentityKey: v.UserName,
+			sessionClaim:      v.SessionId,
 		}
 	}
 	return jwt.MapClaims{}
@@ -47,41 +63,99 @@ func Authenticator(c *gin.Context) (interface{}, error) {
 	if err := c.ShouldBind(&loginVals); err != nil {
 		return "", jwt.ErrMissingLoginValues
 	}
-	userID := loginVals.Username
-	password := loginVals.Password
 
-	// eheheheheheh segur
-	hashed, err := HashAndSalt([]byte(appState.Config.Password))
+	account, err := db.GetAccount(loginVals.Username)
 	if err != nil {
+		glg.Infof("login of unknown user %s: %s", loginVals.Username, err)
+		ComparePasswords(dummyPasswordHash, []byte(loginVals.Password))
 		return nil, jwt.ErrFailedAuthentication
 	}
-
-	if (userID == appState.Config.User && ComparePasswords(hashed, []byte(password))) {
-		return &types.User{
-			UserName: userID,
-		}, nil
+	if !ComparePasswords(account.PasswordHash, []byte(loginVals.Password)) {
+		return nil, jwt.ErrFailedAuthentication
+	}
+	if account.TotpSecret != "" {
+		if loginVals.Otp == "" {
+			c.Set(twoFactorPendingKey, true)
+			return nil, ErrTwoFactorRequired
+		}
+		if used, err := ConsumeSecondFactor(account, loginVals.Otp); err != nil {
+			glg.Errorf("Failed to store used two-factor code of %s: %s", account.UserName, err)
+			return nil, jwt.ErrFailedAuthentication
+		} else if !used {
+			return nil, ErrInvalidTwoFactor
+		}
 	}
 
-	return nil, jwt.ErrFailedAuthentication
+	user, err := startSession(c, account)
+	if err != nil {
+		glg.Errorf("Failed to start session of %s: %s", account.UserName, err)
+		return nil, jwt.ErrFailedAuthentication
+	}
+	return user, nil
 }
 
 func IdentityHandler(c *gin.Context) interface{} {
 	claims := jwt.ExtractClaims(c)
+	sessionId, _ := claims[sessionClaim].(string)
 	return &types.User{
-		UserName: claims[types.IdentityKey].(string),
+		UserName:  claims[types.IdentityKey].(string),
+		SessionId: sessionId,
 	}
 }
 
+// Authorizator checks that the session of the token was not revoked and loads its account so
+// deleted accounts and role changes take effect immediately, then checks the role against
+// RequiredRole of the requested route
 func Authorizator(data interface{}, c *gin.Context) bool {
-	if v, ok := data.(*types.User); ok && v.UserName == appState.Config.User {
-		return true
+	user, ok := data.(*types.User)
+	if !ok {
+		return false
+	}
+	session, err := activeSession(user)
+	if err != nil {
+		glg.Infof("rejecting token of %s: %s", user.UserName, err)
+		c.Set(rejectionMessageKey, ErrSessionRevoked.Error())
+		c.Set(sessionRevokedKey, true)
+		return false
+	}
+	touchSession(session)
+	account, err := db.GetAccount(user.UserName)
+	if err != nil {
+		glg.Infof("rejecting token of %s: %s", user.UserName, err)
+		return false
+	}
+	user.Role = account.Role
+	route := c.Request.Method + " " + c.FullPath()
+	if required, err := TwoFactorRequired(account); err != nil {
+		glg.Errorf("Failed to load security policy: %s", err)
+		return false
+	} else if required && !twoFactorEnrollmentRoutes[route] {
+		c.Set(rejectionMessageKey, fmt.Sprintf("two-factor authentication is required for role %s, enroll it first", account.Role))
+		return false
+	}
+	return RoleAllows(user.Role, RequiredRole(c.Request.Method, c.FullPath()))
+}
+
+// StatusMessage returns the message of a rejected request, preferring the reason the
+// authorizator left in the context over the generic error
+func StatusMessage(err error, c *gin.Context) string {
+	if message := c.GetString(rejectionMessageKey); message != "" {
+		return message
 	}
-	return false
+	return err.Error()
 }
 
 func Unauthorized(c *gin.Context, code int, message string) {
-	c.JSON(code, gin.H{
+	// the authorizator can only forbid, a revoked session needs a new login instead
+	if c.GetBool(sessionRevokedKey) {
+		code = http.StatusUnauthorized
+	}
+	response := gin.H{
 		"code":    code,
 		"message": message,
-	})
+	}
+	if c.GetBool(twoFactorPendingKey) {
+		response["twoFactorRequired"] = true
+	}
+	c.JSON(code, response)
 }
@@ -0,0 +1,19 @@
+package auth
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestDummyPasswordHash(t *testing.T) {
+	// logins of unknown users only take as long as wrong passwords with the same cost
+	hash, err := HashAndSalt([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := bcrypt.Cost([]byte(hash))
+	if cost, err := bcrypt.Cost([]byte(dummyPasswordHash)); err != nil || cost != expected {
+		t.Fatalf("expected a bcrypt hash of cost %d, got %d %v", expected, cost, err)
+	}
+}
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"washboard/db"
+	"washboard/state"
+	"washboard/types"
+	"washboard/werrors"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie  = "oidc_state"
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// oidcLogin is a started authorization code flow waiting for the callback, keyed by its state
+type oidcLogin struct {
+	nonce    string
+	verifier string
+}
+
+// Oidc logs users in with the authorization code flow of an OpenID Connect provider
+type Oidc struct {
+	config state.OidcConfig
+	logins *cache.Cache
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOidc returns the single sign-on login for config. The provider is discovered on the first login.
+func NewOidc(config state.OidcConfig) *Oidc {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{oidc.ScopeOpenID, "profile", "email", "groups"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.SuccessUrl == "" {
+		config.SuccessUrl = "/"
+	}
+	return &Oidc{
+		config: config,
+		logins: cache.New(oidcLoginTimeout, oidcLoginTimeout),
+	}
+}
+
+// discover fetches the configuration of the provider. Failures are retried on the next login.
+func (o *Oidc) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.oauth2 != nil {
+		return o.oauth2, o.verifier, nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to discover OIDC provider %s: %w", o.config.Issuer, err)
+	}
+	o.oauth2 = &oauth2.Config{
+		ClientID:     o.config.ClientId,
+		ClientSecret: o.config.ClientSecret,
+		RedirectURL:  o.config.RedirectUrl,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       o.config.Scopes,
+	}
+	o.verifier = provider.Verifier(&oidc.Config{ClientID: o.config.ClientId})
+	return o.oauth2, o.verifier, nil
+}
+
+// LoginHandler redirects to the provider. The state is bound to the browser with a cookie, the
+// nonce and PKCE verifier are kept server side until the callback.
+func (o *Oidc) LoginHandler(c *gin.Context) {
+	config, _, err := o.discover(c.Request.Context())
+	if err != nil {
+		glg.Error(err)
+		Unauthorized(c, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	login := oidcLogin{nonce: randomToken(), verifier: oauth2.GenerateVerifier()}
+	loginState := randomToken()
+	o.logins.Set(loginState, login, cache.DefaultExpiration)
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, loginState, int(oidcLoginTimeout.Seconds()), "/api/auth/oidc", "", o.secureCookies(), true)
+	c.Redirect(http.StatusFound, config.AuthCodeURL(loginState, oidc.Nonce(login.nonce), oauth2.S256ChallengeOption(login.verifier)))
+}
+
+// CallbackHandler completes the flow started by LoginHandler, stores the account with the role
+// mapped from the groups of the user and issues the same session cookie as the password login
+func (o *Oidc) CallbackHandler(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		loginState := c.Query("state")
+		cookieState, _ := c.Cookie(oidcStateCookie)
+		c.SetCookie(oidcStateCookie, "", -1, "/api/auth/oidc", "", o.secureCookies(), true)
+		cached, found := o.logins.Get(loginState)
+		if loginState == "" || !found || cookieState != loginState {
+			Unauthorized(c, http.StatusBadRequest, "unknown or expired login, please start again")
+			return
+		}
+		o.logins.Delete(loginState)
+		login := cached.(oidcLogin)
+		if errorCode := c.Query("error"); errorCode != "" {
+			Unauthorized(c, http.StatusUnauthorized, fmt.Sprintf("identity provider denied the login: %s %s", errorCode, c.Query("error_description")))
+			return
+		}
+
+		account, err := o.exchange(c.Request.Context(), c.Query("code"), login)
+		if err != nil {
+			glg.Warnf("OIDC login failed: %s", err)
+			Unauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		user, err := startSession(c, account)
+		if err != nil {
+			glg.Errorf("Failed to start session of %s: %s", account.UserName, err)
+			Unauthorized(c, http.StatusInternalServerError, jwt.ErrFailedTokenCreation.Error())
+			return
+		}
+		token, _, err := mw.TokenGenerator(user)
+		if err != nil {
+			Unauthorized(c, http.StatusInternalServerError, jwt.ErrFailedTokenCreation.Error())
+			return
+		}
+		c.SetSameSite(mw.CookieSameSite)
+		c.SetCookie(mw.CookieName, token, int(mw.CookieMaxAge.Seconds()), "/", mw.CookieDomain, mw.SecureCookie, mw.CookieHTTPOnly)
+		glg.Infof("%s (%s) logged in via OIDC with role %s", account.DisplayName, account.UserName, account.Role)
+		c.Redirect(http.StatusFound, o.config.SuccessUrl)
+	}
+}
+
+// exchange redeems code, verifies the ID token and returns the stored account of its subject
+func (o *Oidc) exchange(ctx context.Context, code string, login oidcLogin) (*types.Account, error) {
+	config, verifier, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := config.Exchange(ctx, code, oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response contains no id_token")
+	}
+	idToken, err := verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if idToken.Nonce != login.nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	if idToken.Subject == "" {
+		return nil, errors.New("id_token has no sub claim")
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	userName, _ := claims[o.config.UsernameClaim].(string)
+	if userName == "" {
+		return nil, fmt.Errorf("id_token has no %s claim", o.config.UsernameClaim)
+	}
+	role := o.RoleForGroups(stringList(claims[o.config.GroupsClaim]))
+	if role == "" {
+		return nil, fmt.Errorf("%s is in none of the groups allowed to use washboard", userName)
+	}
+	return storeOidcAccount(oidcAccountName(idToken.Issuer, idToken.Subject), userName, role)
+}
+
+// oidcAccountName derives the account name of a single sign-on user from the issuer and subject
+// of its ID token, which unlike the user name claim never change or get reassigned
+func oidcAccountName(issuer string, subject string) string {
+	sum := sha256.Sum256([]byte(issuer + "\x00" + subject))
+	return fmt.Sprintf("oidc-%x", sum[:12])
+}
+
+// RoleForGroups returns the highest role mapped to one of groups, or the default role
+func (o *Oidc) RoleForGroups(groups []string) string {
+	mappings := []struct {
+		role   string
+		groups []string
+	}{
+		{types.RoleAdmin, o.config.AdminGroups},
+		{types.RoleOperator, o.config.OperatorGroups},
+		{types.RoleViewer, o.config.ViewerGroups},
+	}
+	for _, mapping := range mappings {
+		for _, group := range groups {
+			for _, mapped := range mapping.groups {
+				if group == mapped {
+					return mapping.role
+				}
+			}
+		}
+	}
+	if ValidRole(o.config.DefaultRole) {
+		return o.config.DefaultRole
+	}
+	return ""
+}
+
+// storeOidcAccount creates the account of a single sign-on user or updates its role and display
+// name, the provider is authoritative. Accounts logging in with a password are never taken over.
+func storeOidcAccount(userName string, displayName string, role string) (*types.Account, error) {
+	now := time.Now().Unix()
+	account, err := db.GetAccount(userName)
+	target := &werrors.DoesNotExistError{}
+	if errors.As(err, &target) {
+		account = &types.Account{UserName: userName, DisplayName: displayName, Role: role, Provider: types.AccountProviderOidc, CreatedAt: now, UpdatedAt: now}
+		return account, db.CreateAccount(account)
+	} else if err != nil {
+		return nil, err
+	}
+	if account.Provider != types.AccountProviderOidc {
+		return nil, fmt.Errorf("a local account named %s already exists", userName)
+	}
+	if account.Role != role || account.DisplayName != displayName {
+		account.Role = role
+		account.DisplayName = displayName
+		account.UpdatedAt = now
+		if err := db.UpdateAccount(account); err != nil {
+			return nil, err
+		}
+	}
+	return account, nil
+}
+
+// stringList converts a claim holding a list of strings or a single string
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (o *Oidc) secureCookies() bool {
+	return strings.HasPrefix(o.config.RedirectUrl, "https://")
+}
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
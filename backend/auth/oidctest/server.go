@@ -0,0 +1,203 @@
+// Package oidctest provides an in-process OpenID Connect provider for tests. It approves every
+// authorization request for the scripted user without a login page and issues RS256 signed ID
+// tokens, checking client credentials, redirect uri and the PKCE verifier like a real provider.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const keyId = "oidctest"
+
+// authRequest is an issued authorization code waiting to be redeemed
+type authRequest struct {
+	redirectUri   string
+	nonce         string
+	codeChallenge string
+	subject       string
+	userName      string
+	groups        []string
+}
+
+type Server struct {
+	*httptest.Server
+	ClientId     string
+	ClientSecret string
+
+	key     *rsa.PrivateKey
+	mu      sync.Mutex
+	subject string
+	user    string
+	groups  []string
+	codes   map[string]authRequest
+}
+
+// NewServer starts a provider with one registered client
+func NewServer(clientId string, clientSecret string) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s := &Server{
+		ClientId:     clientId,
+		ClientSecret: clientSecret,
+		key:          key,
+		codes:        make(map[string]authRequest),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("GET /keys", s.handleKeys)
+	mux.HandleFunc("GET /authorize", s.handleAuthorize)
+	mux.HandleFunc("POST /token", s.handleToken)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetUser sets the user the next authorization requests are approved for, its subject is derived
+// from userName
+func (s *Server) SetUser(userName string, groups ...string) {
+	s.SetSubjectUser("sub-"+userName, userName, groups...)
+}
+
+// SetSubjectUser is SetUser with an explicit subject, e.g. for a user name that was reassigned
+func (s *Server) SetSubjectUser(subject string, userName string, groups ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subject = subject
+	s.user = userName
+	s.groups = groups
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &s.key.PublicKey, KeyID: keyId, Algorithm: string(jose.RS256), Use: "sig"},
+	}})
+}
+
+// handleAuthorize approves the request immediately and redirects back with a code
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientId || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authRequest{
+		redirectUri:   q.Get("redirect_uri"),
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		subject:       s.subject,
+		userName:      s.user,
+		groups:        s.groups,
+	}
+	s.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientId != s.ClientId || clientSecret != s.ClientSecret {
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	request, found := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != request.redirectUri ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != request.codeChallenge {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := s.sign(map[string]interface{}{
+		"iss":                s.URL,
+		"sub":                request.subject,
+		"aud":                s.ClientId,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              request.nonce,
+		"preferred_username": request.userName,
+		"groups":             request.groups,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) sign(claims map[string]interface{}) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: s.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyId))
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return signed.CompactSerialize()
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"washboard/types"
+)
+
+// roleRanks orders the roles, every role may do everything the roles below it may do
+var roleRanks = map[string]int{
+	types.RoleViewer:   1,
+	types.RoleOperator: 2,
+	types.RoleAdmin:    3,
+}
+
+// routeRoles lists the routes whose required role differs from the default of RequiredRole
+var routeRoles = map[string]string{
+	"POST /api/portainer/refresh-image-status": types.RoleViewer,
+	"GET /api/accounts/me":                     types.RoleViewer,
+	"POST /api/accounts/me/2fa":                types.RoleViewer,
+	"POST /api/accounts/me/2fa/confirm":        types.RoleViewer,
+	"POST /api/accounts/me/2fa/recovery-codes": types.RoleViewer,
+	"DELETE /api/accounts/me/2fa":              types.RoleViewer,
+	"DELETE /api/sessions":                     types.RoleViewer,
+	"DELETE /api/sessions/:id":                 types.RoleViewer,
+	"PUT /api/accounts/me/password":            types.RoleViewer,
+	"GET /api/ws/containers/:id/exec":          types.RoleAdmin,
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAllows reports whether role grants at least the permissions of required
+func RoleAllows(role string, required string) bool {
+	return ValidRole(role) && roleRanks[role] >= roleRanks[required]
+}
+
+// RequiredRole returns the role needed for a request to route, the path template gin matched.
+// Reading is open to viewers, changing anything needs an operator and managing accounts,
+// the security policy, reading the audit log or running commands in containers an admin.
+func RequiredRole(method string, route string) string {
+	if role, ok := routeRoles[method+" "+route]; ok {
+		return role
+	}
+	if strings.HasPrefix(route, "/api/accounts") || strings.HasPrefix(route, "/api/audit") || strings.HasPrefix(route, "/api/security") {
+		return types.RoleAdmin
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return types.RoleViewer
+	}
+	return types.RoleOperator
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"washboard/db"
+	"washboard/types"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+	"github.com/patrickmn/go-cache"
+)
+
+const (
+	// TokenTimeout is the lifetime of a session token, SessionMaxRefresh how long after it was
+	// issued it can be refreshed. A session lasts SessionMaxRefresh after the last refresh.
+	TokenTimeout      = 7 * 24 * time.Hour
+	SessionMaxRefresh = 30 * 24 * time.Hour
+
+	sessionClaim = "jti"
+	// sessionCacheTtl limits how long a session is not read again from the database. Revocations
+	// on this instance take effect immediately, those of other instances after this delay.
+	sessionCacheTtl       = 30 * time.Second
+	sessionTouchInterval  = time.Minute
+	sessionPruneInterval  = time.Hour
+	sessionUserAgentLimit = 256
+)
+
+var (
+	ErrSessionRevoked = errors.New("session expired or revoked, please log in again")
+
+	sessionCache = cache.New(sessionCacheTtl, 2*sessionCacheTtl)
+)
+
+// startSession stores a new session of account for the login request c and returns the identity
+// to issue the token for
+func startSession(c *gin.Context, account *types.Account) (*types.User, error) {
+	now := time.Now()
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > sessionUserAgentLimit {
+		userAgent = userAgent[:sessionUserAgentLimit]
+	}
+	session := &types.Session{
+		UserName:   account.UserName,
+		Provider:   account.Provider,
+		ClientIp:   c.ClientIP(),
+		UserAgent:  userAgent,
+		CreatedAt:  now.Unix(),
+		LastSeenAt: now.Unix(),
+		ExpiresAt:  now.Add(SessionMaxRefresh).Unix(),
+	}
+	if err := db.CreateSession(session); err != nil {
+		return nil, err
+	}
+	return &types.User{UserName: account.UserName, Role: account.Role, SessionId: session.Id}, nil
+}
+
+// activeSession returns the session of user if its tokens are still accepted
+func activeSession(user *types.User) (*types.Session, error) {
+	if user.SessionId == "" {
+		return nil, ErrSessionRevoked
+	}
+	var session *types.Session
+	if cached, found := sessionCache.Get(user.SessionId); found {
+		session = cached.(*types.Session)
+	} else {
+		loaded, err := db.GetSession(user.SessionId)
+		if err != nil {
+			return nil, err
+		}
+		session = loaded
+		sessionCache.SetDefault(session.Id, session)
+	}
+	if session.UserName != user.UserName || !session.Active(time.Now().Unix()) {
+		return nil, ErrSessionRevoked
+	}
+	return session, nil
+}
+
+// touchSession records the use of session, at most once per sessionTouchInterval. Only the time
+// of the last use is written, so a revocation is never undone. The cached copy is dropped and the
+// session read again on its next use.
+func touchSession(session *types.Session) {
+	now := time.Now()
+	if now.Unix()-session.LastSeenAt < int64(sessionTouchInterval.Seconds()) {
+		return
+	}
+	if _, err := db.TouchSession(session.Id, now.Unix(), 0); err != nil {
+		glg.Warnf("Failed to update last use of session %s: %s", session.Id, err)
+	}
+	sessionCache.Delete(session.Id)
+}
+
+// RevokeSession ends a session, its tokens are rejected from now on
+func RevokeSession(session *types.Session) error {
+	if session.RevokedAt != 0 {
+		return nil
+	}
+	session.RevokedAt = time.Now().Unix()
+	// the cache is cleared after the write as well, a request in between may have cached the
+	// session before it was revoked
+	sessionCache.Delete(session.Id)
+	defer sessionCache.Delete(session.Id)
+	return db.UpdateSession(session)
+}
+
+// RevokeSessions ends all active sessions of userName except the one with id keep and returns
+// how many were ended
+func RevokeSessions(userName string, keep string) (int, error) {
+	sessions, err := db.ListSessions(userName)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	revoked := 0
+	for i := range sessions {
+		if sessions[i].Id == keep || !sessions[i].Active(now) {
+			continue
+		}
+		if err := RevokeSession(&sessions[i]); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// sessionIdOf returns the session of the token sent with c, also if the token expired but can
+// still be refreshed
+func sessionIdOf(mw *jwt.GinJWTMiddleware, c *gin.Context) string {
+	claims, err := mw.CheckIfTokenExpire(c)
+	if err != nil {
+		return ""
+	}
+	id, _ := claims[sessionClaim].(string)
+	return id
+}
+
+// LogoutHandler revokes the session of the token before clearing the cookie like the handler of mw
+func LogoutHandler(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id := sessionIdOf(mw, c); id != "" {
+			if session, err := db.GetSession(id); err == nil {
+				c.Set(types.IdentityKey, &types.User{UserName: session.UserName, SessionId: session.Id})
+				if err := RevokeSession(session); err != nil {
+					glg.Errorf("Failed to revoke session %s: %s", id, err)
+				}
+			}
+		}
+		mw.LogoutHandler(c)
+	}
+}
+
+// RefreshHandler only refreshes tokens of active sessions and extends the session, the handler
+// of mw only checks the signature and age of the token
+func RefreshHandler(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := mw.CheckIfTokenExpire(c)
+		if err != nil {
+			Unauthorized(c, http.StatusUnauthorized, mw.HTTPStatusMessageFunc(err, c))
+			return
+		}
+		userName, _ := claims[types.IdentityKey].(string)
+		sessionId, _ := claims[sessionClaim].(string)
+		session, err := activeSession(&types.User{UserName: userName, SessionId: sessionId})
+		if err != nil {
+			Unauthorized(c, http.StatusUnauthorized, ErrSessionRevoked.Error())
+			return
+		}
+		now := time.Now()
+		extended, err := db.TouchSession(session.Id, now.Unix(), now.Add(SessionMaxRefresh).Unix())
+		sessionCache.Delete(session.Id)
+		if err != nil {
+			Unauthorized(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !extended {
+			Unauthorized(c, http.StatusUnauthorized, ErrSessionRevoked.Error())
+			return
+		}
+		mw.RefreshHandler(c)
+	}
+}
+
+// StartSessionCleanup deletes expired sessions now and then every sessionPruneInterval
+func StartSessionCleanup() {
+	prune := func() {
+		deleted, err := db.DeleteSessionsExpiredBefore(time.Now().Unix())
+		if err != nil {
+			glg.Errorf("Failed to delete expired sessions: %s", err)
+		} else if deleted > 0 {
+			glg.Infof("deleted %d expired sessions", deleted)
+		}
+	}
+	prune()
+	go func() {
+		for range time.Tick(sessionPruneInterval) {
+			prune()
+		}
+	}()
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"washboard/audit"
+	"washboard/state"
+	"washboard/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+// failures counts the failed logins of one user name or client ip and the attempts still being
+// checked
+type failures struct {
+	count        int
+	pending      int
+	last         time.Time
+	blockedUntil time.Time
+}
+
+// LoginThrottle slows down password guessing with an exponential delay between failed logins
+// and locks user names and client ips out after too many of them
+type LoginThrottle struct {
+	config state.LoginThrottleConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*failures
+}
+
+// NewLoginThrottle returns the throttle for config, using defaults for all zero values
+func NewLoginThrottle(config state.LoginThrottleConfig) *LoginThrottle {
+	defaults := []struct {
+		value    *int
+		fallback int
+	}{
+		{&config.FreeAttempts, 3},
+		{&config.BaseDelaySeconds, 1},
+		{&config.MaxDelaySeconds, 60},
+		{&config.LockoutAttempts, 10},
+		{&config.IpLockoutAttempts, 50},
+		{&config.LockoutMinutes, 15},
+		{&config.ResetMinutes, 15},
+	}
+	for _, d := range defaults {
+		if *d.value <= 0 {
+			*d.value = d.fallback
+		}
+	}
+	return &LoginThrottle{config: config, now: time.Now, entries: make(map[string]*failures)}
+}
+
+func userKey(userName string) string {
+	return "user:" + userName
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns how long the login of userName from ip has to wait, 0 if it may be attempted now
+func (t *LoginThrottle) Check(userName string, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var wait time.Duration
+	for _, key := range []string{userKey(userName), ipKey(ip)} {
+		if entry := t.current(key, now); entry != nil && entry.blockedUntil.After(now) {
+			if remaining := entry.blockedUntil.Sub(now); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return wait
+}
+
+// Reserve is Check for an attempt that is about to be made: if it may be attempted now, it is
+// counted as pending until Failure or Release. Once the free attempts may be used up by the
+// pending ones, only one attempt at a time is let through, so parallel attempts can not skip
+// the delay or the lockout.
+func (t *LoginThrottle) Reserve(userName string, ip string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	keys := []string{userKey(userName), ipKey(ip)}
+	var wait time.Duration
+	for _, key := range keys {
+		entry := t.current(key, now)
+		if entry == nil {
+			continue
+		}
+		if entry.blockedUntil.After(now) {
+			wait = max(wait, entry.blockedUntil.Sub(now))
+		} else if entry.pending > 0 && entry.count+entry.pending >= t.config.FreeAttempts {
+			wait = max(wait, time.Second)
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, key := range keys {
+		entry := t.current(key, now)
+		if entry == nil {
+			entry = &failures{}
+			t.entries[key] = entry
+		}
+		entry.pending++
+	}
+	return 0
+}
+
+// Release ends a reserved attempt that did not fail
+func (t *LoginThrottle) Release(userName string, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range []string{userKey(userName), ipKey(ip)} {
+		if entry, ok := t.entries[key]; ok && entry.pending > 0 {
+			entry.pending--
+		}
+	}
+}
+
+// Failure counts a failed login, ending its reservation if any, and returns the keys that were
+// locked out by it
+func (t *LoginThrottle) Failure(userName string, ip string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	locked := make([]string, 0)
+	for _, key := range []string{userKey(userName), ipKey(ip)} {
+		entry := t.current(key, now)
+		if entry == nil {
+			entry = &failures{}
+			t.entries[key] = entry
+		}
+		if entry.pending > 0 {
+			entry.pending--
+		}
+		entry.count++
+		entry.last = now
+
+		lockoutAttempts := t.config.LockoutAttempts
+		if key == ipKey(ip) {
+			lockoutAttempts = t.config.IpLockoutAttempts
+		}
+		if entry.count >= lockoutAttempts {
+			entry.blockedUntil = now.Add(time.Duration(t.config.LockoutMinutes) * time.Minute)
+			locked = append(locked, key)
+		} else if entry.count > t.config.FreeAttempts {
+			entry.blockedUntil = now.Add(t.delay(entry.count))
+		}
+	}
+	t.sweep(now)
+	return locked
+}
+
+// Success forgets the failures of userName. Those of the ip are kept, a valid account of an
+// attacker must not reset the guessing of other passwords.
+func (t *LoginThrottle) Success(userName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, userKey(userName))
+}
+
+// delay returns the wait after the count-th failure
+func (t *LoginThrottle) delay(count int) time.Duration {
+	exponent := float64(count - t.config.FreeAttempts - 1)
+	seconds := math.Min(float64(t.config.BaseDelaySeconds)*math.Pow(2, exponent), float64(t.config.MaxDelaySeconds))
+	return time.Duration(seconds) * time.Second
+}
+
+// current returns the failures of key unless they were reset
+func (t *LoginThrottle) current(key string, now time.Time) *failures {
+	entry, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	if t.expired(entry, now) {
+		delete(t.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (t *LoginThrottle) expired(entry *failures, now time.Time) bool {
+	return entry.pending == 0 && entry.blockedUntil.Before(now) && now.Sub(entry.last) > time.Duration(t.config.ResetMinutes)*time.Minute
+}
+
+// sweep drops reset entries so guessed user names do not pile up
+func (t *LoginThrottle) sweep(now time.Time) {
+	for key, entry := range t.entries {
+		if t.expired(entry, now) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Middleware guards the login handler. Throttled attempts are answered with 429 and Retry-After
+// before the password is checked, the others are reserved and counted once they were rejected
+// or accepted.
+func (t *LoginThrottle) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t.config.Disabled {
+			c.Next()
+			return
+		}
+		userName := loginUserName(c)
+		ip := c.ClientIP()
+		if wait := t.Reserve(userName, ip); wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			glg.Warnf("throttled login of %s from %s for %ds", userName, ip, seconds)
+			c.Header("Retry-After", strconv.Itoa(seconds))
+			Unauthorized(c, http.StatusTooManyRequests, fmt.Sprintf("too many failed logins, retry in %d seconds", seconds))
+			c.Abort()
+			return
+		}
+
+		// a panicking handler must not leave the attempt pending forever
+		settled := false
+		defer func() {
+			if !settled {
+				t.Release(userName, ip)
+			}
+		}()
+		c.Next()
+		settled = true
+
+		switch c.Writer.Status() {
+		case http.StatusOK:
+			t.Release(userName, ip)
+			t.Success(userName)
+		case http.StatusUnauthorized:
+			// the password was right, the client is asked for the second factor
+			if c.GetBool(twoFactorPendingKey) {
+				t.Release(userName, ip)
+				break
+			}
+			for _, key := range t.Failure(userName, ip) {
+				glg.Warnf("locked out %s for %d minutes after failed logins from %s", key, t.config.LockoutMinutes, ip)
+				audit.Record(&types.AuditEntry{
+					UserName: userName,
+					Action:   "auth.lockout",
+					Target:   key,
+					Params:   map[string]interface{}{"minutes": t.config.LockoutMinutes},
+					Result:   types.AuditSuccess,
+					ClientIp: ip,
+				})
+			}
+		default:
+			t.Release(userName, ip)
+		}
+	}
+}
+
+// loginUserName reads the user name of a login request and restores the body for the login handler
+func loginUserName(c *gin.Context) string {
+	if c.Request.Body == nil {
+		return ""
+	}
+	body, _ := io.ReadAll(io.LimitReader(c.Request.Body, 64<<10))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+	var login struct {
+		Username string `json:"username"`
+	}
+	if json.Unmarshal(body, &login) != nil {
+		return c.PostForm("username")
+	}
+	return login.Username
+}
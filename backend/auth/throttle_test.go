@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"washboard/state"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	throttle := NewLoginThrottle(state.LoginThrottleConfig{FreeAttempts: 2, BaseDelaySeconds: 1, MaxDelaySeconds: 4, LockoutAttempts: 6, IpLockoutAttempts: 8, LockoutMinutes: 10, ResetMinutes: 30})
+	now := time.Unix(1700000000, 0)
+	throttle.now = func() time.Time { return now }
+
+	// the free attempts are not delayed, then the delay doubles up to the maximum
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i, delay := range expected {
+		if locked := throttle.Failure("vera", "10.0.0.1"); len(locked) != 0 {
+			t.Fatalf("failure %d locked %v", i+1, locked)
+		}
+		if wait := throttle.Check("vera", "10.0.0.1"); wait != delay {
+			t.Fatalf("after failure %d: expected a wait of %s, got %s", i+1, delay, wait)
+		}
+		now = now.Add(delay)
+	}
+	if wait := throttle.Check("otto", "10.0.0.2"); wait != 0 {
+		t.Fatalf("other users and ips must not be throttled, got %s", wait)
+	}
+
+	if locked := throttle.Failure("vera", "10.0.0.1"); len(locked) != 1 || locked[0] != "user:vera" {
+		t.Fatalf("expected the user to be locked out, got %v", locked)
+	}
+	if wait := throttle.Check("vera", "10.0.0.3"); wait != 10*time.Minute {
+		t.Fatalf("expected the lockout to apply from every ip, got %s", wait)
+	}
+	now = now.Add(10 * time.Minute)
+	if wait := throttle.Check("vera", "10.0.0.1"); wait != 0 {
+		t.Fatalf("expected the lockout to end, got %s", wait)
+	}
+
+	// the ip reaches its own lockout with guesses for other users
+	throttle.Failure("otto", "10.0.0.1")
+	if locked := throttle.Failure("ines", "10.0.0.1"); len(locked) != 1 || locked[0] != "ip:10.0.0.1" {
+		t.Fatalf("expected the ip to be locked out, got %v", locked)
+	}
+	if wait := throttle.Check("max", "10.0.0.1"); wait != 10*time.Minute {
+		t.Fatalf("expected the ip to be locked for every user, got %s", wait)
+	}
+
+	// a successful login resets the user but not the ip, failures are forgotten after ResetMinutes
+	throttle.Success("vera")
+	now = now.Add(10 * time.Minute)
+	if wait := throttle.Check("vera", "10.0.0.2"); wait != 0 {
+		t.Fatalf("expected vera to be reset, got %s", wait)
+	}
+	throttle.Failure("max", "10.0.0.1")
+	if wait := throttle.Check("max", "10.0.0.1"); wait != 10*time.Minute {
+		t.Fatalf("expected the ip failures to be kept, got %s", wait)
+	}
+	now = now.Add(41 * time.Minute)
+	if wait := throttle.Check("max", "10.0.0.1"); wait != 0 {
+		t.Fatalf("expected the failures to be reset, got %s", wait)
+	}
+}
+
+func TestLoginThrottleReservesParallelAttempts(t *testing.T) {
+	throttle := NewLoginThrottle(state.LoginThrottleConfig{FreeAttempts: 2, BaseDelaySeconds: 1, LockoutAttempts: 3})
+	now := time.Unix(1700000000, 0)
+	throttle.now = func() time.Time { return now }
+
+	// attempts in flight use up the free attempts before any of them failed
+	for i := 0; i < 2; i++ {
+		if wait := throttle.Reserve("vera", "10.0.0.1"); wait != 0 {
+			t.Fatalf("attempt %d: expected no wait, got %s", i+1, wait)
+		}
+	}
+	if wait := throttle.Reserve("vera", "10.0.0.2"); wait == 0 {
+		t.Fatal("expected a third parallel attempt to wait")
+	}
+	throttle.Failure("vera", "10.0.0.1")
+	throttle.Release("vera", "10.0.0.1")
+
+	// the next attempt is let through, but none beside it while it could use up the free attempts
+	if wait := throttle.Reserve("vera", "10.0.0.1"); wait != 0 {
+		t.Fatalf("expected the next attempt to be let through, got %s", wait)
+	}
+	if wait := throttle.Reserve("vera", "10.0.0.1"); wait == 0 {
+		t.Fatal("expected only one attempt at a time after the free attempts")
+	}
+	if locked := throttle.Failure("vera", "10.0.0.1"); len(locked) != 0 {
+		t.Fatalf("expected no lockout after two failures, got %v", locked)
+	}
+}
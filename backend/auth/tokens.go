@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"washboard/db"
+	"washboard/portainer"
+	"washboard/types"
+
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/kpango/glg"
+)
+
+// ApiTokenPrefix starts every api token, followed by the token id and the secret: wbt_<id>_<secret>
+const ApiTokenPrefix = "wbt_"
+
+const (
+	ScopeStackUpdate   = "stack:update"
+	ScopeStackStart    = "stack:start"
+	ScopeStackStop     = "stack:stop"
+	ScopeStackRollback = "stack:rollback"
+	ScopeJobRead       = "job:read"
+)
+
+// tokenRoute is a route api tokens may be used for. stackName resolves the stack the request is about.
+type tokenRoute struct {
+	scope     string
+	stackName func(c *gin.Context) (string, error)
+}
+
+var tokenRoutes = map[string]tokenRoute{
+	"PUT /api/portainer/stacks/:id/update":    {ScopeStackUpdate, stackNameOfPath},
+	"POST /api/portainer/stacks/:id/start":    {ScopeStackStart, stackNameOfPath},
+	"POST /api/portainer/stacks/:id/stop":     {ScopeStackStop, stackNameOfPath},
+	"POST /api/portainer/stacks/:id/rollback": {ScopeStackRollback, stackNameOfPath},
+	"GET /api/jobs/:id":                       {ScopeJobRead, jobStackName},
+}
+
+// apiTokenTouchInterval limits how often LastUsedAt is written
+const apiTokenTouchInterval = time.Minute
+
+// ValidScope reports whether scope is one of the scopes an api token can have
+func ValidScope(scope string) bool {
+	for _, route := range tokenRoutes {
+		if route.scope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// NewApiToken validates the given values and returns a token of owner together with its secret.
+// The token gets its id when it is stored, see FormatApiToken.
+func NewApiToken(owner string, name string, scopes []string, stacks []string, expiresAt int64) (*types.ApiToken, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, "", errors.New("name must not be empty")
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !ValidScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if len(stacks) == 0 {
+		return nil, "", errors.New("at least one stack pattern is required, use * for all stacks")
+	}
+	for _, pattern := range stacks {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, "", fmt.Errorf("invalid stack pattern %q: %w", pattern, err)
+		}
+	}
+	secret := randomToken()
+	return &types.ApiToken{
+		Name:      strings.TrimSpace(name),
+		Owner:     owner,
+		Hash:      hashSecret(secret),
+		Scopes:    scopes,
+		Stacks:    stacks,
+		CreatedAt: time.Now().Unix(),
+		ExpiresAt: expiresAt,
+	}, secret, nil
+}
+
+// FormatApiToken returns the token a client sends for the stored token id and its secret
+func FormatApiToken(id string, secret string) string {
+	return ApiTokenPrefix + id + "_" + secret
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Middleware authenticates requests carrying an api token as bearer token and passes all other
+// requests to the JWT middleware of the login
+func Middleware(mw *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	jwtMiddleware := mw.MiddlewareFunc()
+	return func(c *gin.Context) {
+		raw := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), mw.TokenHeadName))
+		if !strings.HasPrefix(raw, ApiTokenPrefix) {
+			jwtMiddleware(c)
+			return
+		}
+		// nested route groups run the middleware more than once
+		if identity, ok := c.Get(types.IdentityKey); ok {
+			if user, ok := identity.(*types.User); ok && user.ApiTokenId != "" {
+				c.Next()
+				return
+			}
+		}
+
+		user, status, err := authorizeApiToken(c, raw)
+		if err != nil {
+			glg.Infof("rejecting api token request %s %s: %s", c.Request.Method, c.Request.URL.Path, err)
+			c.Abort()
+			Unauthorized(c, status, err.Error())
+			return
+		}
+		c.Set(types.IdentityKey, user)
+		c.Next()
+	}
+}
+
+// authorizeApiToken checks the token, the role of its owner, its scopes and stack patterns for
+// the request and returns the identity to use for it
+func authorizeApiToken(c *gin.Context, raw string) (*types.User, int, error) {
+	id, secret, _ := strings.Cut(strings.TrimPrefix(raw, ApiTokenPrefix), "_")
+	token, err := db.GetApiToken(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(token.Hash)) != 1 {
+		return nil, http.StatusUnauthorized, errors.New("invalid api token")
+	}
+	now := time.Now().Unix()
+	if token.RevokedAt != 0 {
+		return nil, http.StatusUnauthorized, errors.New("api token has been revoked")
+	}
+	if token.ExpiresAt != 0 && token.ExpiresAt < now {
+		return nil, http.StatusUnauthorized, errors.New("api token has expired")
+	}
+	owner, err := db.GetAccount(token.Owner)
+	if err != nil {
+		return nil, http.StatusUnauthorized, errors.New("owner of the api token does not exist")
+	}
+
+	route, ok := tokenRoutes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		return nil, http.StatusForbidden, errors.New("api tokens can not be used for this route")
+	}
+	if !RoleAllows(owner.Role, RequiredRole(c.Request.Method, c.FullPath())) {
+		return nil, http.StatusForbidden, fmt.Errorf("role %s of %s does not allow this route", owner.Role, owner.UserName)
+	}
+	if !containsString(token.Scopes, route.scope) {
+		return nil, http.StatusForbidden, fmt.Errorf("api token lacks scope %s", route.scope)
+	}
+	stackName, err := route.stackName(c)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	if !matchesAny(token.Stacks, stackName) {
+		return nil, http.StatusForbidden, fmt.Errorf("api token is not valid for stack %s", stackName)
+	}
+
+	if now-token.LastUsedAt >= int64(apiTokenTouchInterval.Seconds()) {
+		token.LastUsedAt = now
+		if err := db.UpdateApiToken(token); err != nil {
+			glg.Warnf("Failed to update last use of api token %s: %s", token.Id, err)
+		}
+	}
+	return &types.User{UserName: owner.UserName, Role: owner.Role, ApiTokenId: token.Id}, 0, nil
+}
+
+func stackNameOfPath(c *gin.Context) (string, error) {
+	stackId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return "", fmt.Errorf("stack id %q is not an int", c.Param("id"))
+	}
+	stack, err := portainer.GetClient().GetStack(context.Background(), stackId)
+	if err != nil {
+		return "", fmt.Errorf("stack %d not found: %w", stackId, err)
+	}
+	return stack.Name, nil
+}
+
+func jobStackName(c *gin.Context) (string, error) {
+	job, err := db.GetJob(c.Param("id"))
+	if err != nil {
+		return "", fmt.Errorf("job %s not found", c.Param("id"))
+	}
+	return job.StackName, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"washboard/db"
+	"washboard/types"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app supports
+const (
+	totpIssuer        = "Washboard"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrTwoFactorRequired = errors.New("two-factor code required")
+	ErrInvalidTwoFactor  = errors.New("invalid two-factor code")
+	ErrTwoFactorEnabled  = errors.New("two-factor authentication is already enabled")
+	ErrNoTwoFactor       = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorSso      = errors.New("accounts of single sign-on users use the two-factor authentication of the identity provider")
+
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// twoFactorEnrollmentRoutes stay usable for accounts that have to enroll two-factor
+// authentication before they can do anything else
+var twoFactorEnrollmentRoutes = map[string]bool{
+	"GET /api/accounts/me":                     true,
+	"PUT /api/accounts/me/password":            true,
+	"POST /api/accounts/me/2fa":                true,
+	"POST /api/accounts/me/2fa/confirm":        true,
+	"POST /api/accounts/me/2fa/recovery-codes": true,
+}
+
+// totpCode returns the code of secret for the time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// GenerateTotp returns the code an authenticator app shows for the base32 encoded secret at time at
+func GenerateTotp(secret string, at time.Time) (string, error) {
+	decoded, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(decoded, at.Unix()/totpPeriod), nil
+}
+
+// verifyTotp checks code against the steps around now and returns the matching step. Steps up
+// to lastStep were used before and are rejected.
+func verifyTotp(encodedSecret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(encodedSecret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningUri returns the otpauth uri authenticator apps scan as QR code
+func ProvisioningUri(userName string, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + userName,
+		RawQuery: params.Encode(),
+	}).String()
+}
+
+// EnrollTotp starts the enrollment of account with a new secret, which is only used for logins
+// after ConfirmTotp. It returns the secret.
+func EnrollTotp(account *types.Account) (string, error) {
+	if account.Provider != "" {
+		return "", ErrTwoFactorSso
+	}
+	if account.TotpSecret != "" {
+		return "", ErrTwoFactorEnabled
+	}
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	account.TotpPendingSecret = totpEncoding.EncodeToString(buf)
+	account.UpdatedAt = time.Now().Unix()
+	return account.TotpPendingSecret, nil
+}
+
+// ConfirmTotp enables two-factor authentication of account if code matches the secret of the
+// started enrollment and returns the new recovery codes
+func ConfirmTotp(account *types.Account, code string) ([]string, error) {
+	if account.TotpSecret != "" {
+		return nil, ErrTwoFactorEnabled
+	}
+	if account.TotpPendingSecret == "" {
+		return nil, errors.New("no two-factor enrollment was started")
+	}
+	step, ok := verifyTotp(account.TotpPendingSecret, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidTwoFactor
+	}
+	account.TotpSecret = account.TotpPendingSecret
+	account.TotpPendingSecret = ""
+	account.TotpLastStep = step
+	return NewRecoveryCodes(account)
+}
+
+// DisableTotp removes the two-factor authentication of account
+func DisableTotp(account *types.Account) {
+	account.TotpSecret = ""
+	account.TotpPendingSecret = ""
+	account.TotpLastStep = 0
+	account.RecoveryCodes = nil
+	account.UpdatedAt = time.Now().Unix()
+}
+
+// NewRecoveryCodes replaces the recovery codes of account and returns them. Only their hashes are stored.
+func NewRecoveryCodes(account *types.Account) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(buf))
+		code := encoded[:4] + "-" + encoded[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	account.RecoveryCodes = hashes
+	account.UpdatedAt = time.Now().Unix()
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchSecondFactor returns the time step of code if it is a TOTP code of account, otherwise the
+// stored hash if it is one of its recovery codes
+func matchSecondFactor(account *types.Account, code string) (step int64, recoveryCode string, ok bool) {
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTotp(account.TotpSecret, code, time.Now(), account.TotpLastStep); ok {
+		return step, "", true
+	}
+	hash := hashRecoveryCode(code)
+	for _, stored := range account.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			return 0, stored, true
+		}
+	}
+	return 0, "", false
+}
+
+// useSecondFactor marks the step or recovery code returned by matchSecondFactor as used in account
+func useSecondFactor(account *types.Account, step int64, recoveryCode string) {
+	if recoveryCode == "" {
+		account.TotpLastStep = step
+		return
+	}
+	for i, stored := range account.RecoveryCodes {
+		if stored == recoveryCode {
+			account.RecoveryCodes = append(account.RecoveryCodes[:i:i], account.RecoveryCodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// ConsumeSecondFactor checks a TOTP or recovery code of account and uses it up in the database
+// with a conditional write, so parallel requests can not use the same code twice. It reports
+// false if the code is invalid or was used in the meantime, account is updated if it reports true.
+func ConsumeSecondFactor(account *types.Account, code string) (bool, error) {
+	step, recoveryCode, ok := matchSecondFactor(account, code)
+	if !ok {
+		return false, nil
+	}
+	var used bool
+	var err error
+	if recoveryCode == "" {
+		used, err = db.UseTotpStep(account.UserName, step)
+	} else {
+		used, err = db.UseRecoveryCode(account.UserName, recoveryCode)
+	}
+	if used {
+		useSecondFactor(account, step, recoveryCode)
+	}
+	return used, err
+}
+
+var (
+	policyMu sync.RWMutex
+	policy   *types.SecurityPolicy
+)
+
+// SecurityPolicy returns the security policy, loading it from the database on first use
+func SecurityPolicy() (*types.SecurityPolicy, error) {
+	policyMu.RLock()
+	current := policy
+	policyMu.RUnlock()
+	if current != nil {
+		return current, nil
+	}
+	loaded, err := db.GetSecurityPolicy()
+	if err != nil {
+		return nil, err
+	}
+	policyMu.Lock()
+	policy = loaded
+	policyMu.Unlock()
+	return loaded, nil
+}
+
+// ValidateSecurityPolicy checks the roles of policy. Two-factor authentication can only be
+// required for roles that may run control actions.
+func ValidateSecurityPolicy(updated *types.SecurityPolicy) error {
+	controlRole := RequiredRole(http.MethodPost, "/api/control/stop-all")
+	for _, role := range updated.RequireTwoFactorRoles {
+		if !ValidRole(role) {
+			return fmt.Errorf("unknown role %q", role)
+		}
+		if !RoleAllows(role, controlRole) {
+			return fmt.Errorf("role %s can not run control actions, two-factor authentication can only be required for roles that can", role)
+		}
+	}
+	return nil
+}
+
+// ResetSecurityPolicy drops the cached policy after it was changed, it is loaded again on next use
+func ResetSecurityPolicy() {
+	policyMu.Lock()
+	policy = nil
+	policyMu.Unlock()
+}
+
+// TwoFactorRequired reports whether account has to use two-factor authentication but did not
+// enroll it yet. Single sign-on accounts are left to the identity provider.
+func TwoFactorRequired(account *types.Account) (bool, error) {
+	if account.Provider != "" || account.TotpSecret != "" {
+		return false, nil
+	}
+	current, err := SecurityPolicy()
+	if err != nil {
+		return false, err
+	}
+	for _, role := range current.RequireTwoFactorRoles {
+		if role == account.Role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
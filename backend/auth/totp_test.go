@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"washboard/types"
+)
+
+func TestTotpRfc6238(t *testing.T) {
+	// the SHA1 test vectors of RFC 6238, truncated to six digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, expected := range vectors {
+		if code, err := GenerateTotp(secret, time.Unix(unix, 0)); err != nil || code != expected {
+			t.Errorf("at %d: expected %s, got %s (%v)", unix, expected, code, err)
+		}
+	}
+}
+
+func TestMatchSecondFactor(t *testing.T) {
+	account := &types.Account{UserName: "tara"}
+	// verify uses up accepted codes in account, as ConsumeSecondFactor does after storing them
+	verify := func(code string) bool {
+		step, recoveryCode, ok := matchSecondFactor(account, code)
+		if ok {
+			useSecondFactor(account, step, recoveryCode)
+		}
+		return ok
+	}
+	secret, err := EnrollTotp(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := GenerateTotp(secret, time.Now())
+	if _, err := ConfirmTotp(account, "12345"); err != ErrInvalidTwoFactor {
+		t.Fatalf("expected a wrong code to be rejected, got %v", err)
+	}
+	recoveryCodes, err := ConfirmTotp(account, code)
+	if err != nil || len(recoveryCodes) != recoveryCodeCount || account.TotpPendingSecret != "" {
+		t.Fatalf("expected two-factor authentication to be enabled: %v %+v", err, account)
+	}
+
+	if verify(code) {
+		t.Error("a code must not be accepted twice")
+	}
+	next, _ := GenerateTotp(secret, time.Now().Add(totpPeriod*time.Second))
+	if !verify(next) {
+		t.Error("expected the code of the next step to be accepted")
+	}
+	if !verify(" "+strings.ToUpper(recoveryCodes[3])+" ") || len(account.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("expected the recovery code to be accepted once, %d left", len(account.RecoveryCodes))
+	}
+	if verify(recoveryCodes[3]) {
+		t.Error("a recovery code must not be accepted twice")
+	}
+}
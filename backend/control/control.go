@@ -2,9 +2,9 @@ package control
 
 import (
 	"errors"
-	"sort"
+	"fmt"
+	"net/http"
 	"time"
-	"washboard/db"
 	"washboard/portainer"
 	"washboard/types"
 	"washboard/werrors"
@@ -21,24 +21,27 @@ func declareControlCache() (*cache.Cache) {
 }
 
 
-func StopAllStacks(endpointId int) error {
-	if _, found := controlCache.Get("stopAllStacks"); found {
-		glg.Infof("stopAllStacks already in progress")
-		return werrors.NewAlreadyInProgressError(errors.New("Operation can only be performed once"), "A stop operation is already in progress.")
+// StopAllStacks stops the stacks of an endpoint wave by wave in reverse start order, see StartWaves.
+// Every stack is verified to have exited, containers still running after the grace period are
+// killed, see stopStack. The results report the outcome per stack.
+func StopAllStacks(endpointId int) ([]types.GroupStackResult, error) {
+	operationKey := fmt.Sprintf("stopAllStacks-%d", endpointId)
+	// the key does not expire, stopping waits for grace periods and may take longer than the cache expiration
+	if err := controlCache.Add(operationKey, true, cache.NoExpiration); err != nil {
+		glg.Infof("stopAllStacks already in progress for endpoint %d", endpointId)
+		return nil, werrors.NewAlreadyInProgressError(errors.New("Operation can only be performed once"), "A stop operation is already in progress.")
 	}
-	controlCache.Set("stopAllStacks", true, cache.DefaultExpiration)
+	defer controlCache.Delete(operationKey)
 
 	portainer.PerformSync(&types.SyncOptions{EndpointIds: []int{endpointId}})
-	settings, err := db.GetAllStackSettings()
+	waves, err := StartWaves(endpointId)
 	if err != nil {
-		controlCache.Delete("stopAllStacks")
-		return err
+		return nil, err
 	}
 
 	stacks, err := portainer.GetStacks(endpointId, true)
 	if err != nil {
-		controlCache.Delete("stopAllStacks")
-		return err
+		return nil, err
 	}
 
 	stackMap := make(map[string]types.StackDto)
@@ -46,41 +49,44 @@ func StopAllStacks(endpointId int) error {
 		stackMap[stack.Name] = stack
 	}
 
-	sort.Slice(settings, func(i, j int) bool {
-		return settings[i].Priority > settings[j].Priority
-	})
-
-	for _, setting := range settings {
-		if stack, ok := stackMap[setting.StackName]; ok {
-			if types.CheckWashbImage(stack) {
-				glg.Infof("not modifying stack containing a washboard image")
-				continue
-			}
-			portainer.StartOrStopStack(endpointId, setting.StackId, "stop")
-			glg.Infof("stopped %s", setting.StackName)
+	gracePeriod := stopGracePeriod()
+	results := runWaves(waves, true, func(wave int, setting types.StackSettings) types.GroupStackResult {
+		result := types.GroupStackResult{StackId: setting.StackId, StackName: setting.StackName, Result: types.Skipped}
+		if stack, ok := stackMap[setting.StackName]; !ok {
+			result.Error = "stack not found in Portainer"
+		} else if types.CheckWashbImage(stack) {
+			glg.Infof("not modifying stack containing a washboard image")
+			result.Error = "stack contains a washboard image"
+		} else {
+			result = stopStack(endpointId, setting, gracePeriod)
+			glg.Infof("stopped %s: %s", setting.StackName, result.Result)
 		}
-	}
-	controlCache.Delete("stopAllStacks")
-	return nil
+		result.Wave = wave
+		return result
+	})
+	return results, nil
 }
 
+// SyncAutoStartState starts the autostart stacks of an endpoint wave by wave, see StartWaves. A wave
+// only starts once every autostart stack of the wave before is ready or timed out, see
+// waitForStackReady. The progress is kept in Startup.
 func SyncAutoStartState(endpointId int) error {
-	if _, found := controlCache.Get("syncAutoStartState"); found {
-		glg.Infof("syncAutoStartState already in progress")
+	operationKey := fmt.Sprintf("syncAutoStartState-%d", endpointId)
+	// the key does not expire, waiting for the stacks to be ready may take longer than the cache expiration
+	if err := controlCache.Add(operationKey, true, cache.NoExpiration); err != nil {
+		glg.Infof("syncAutoStartState already in progress for endpoint %d", endpointId)
 		return werrors.NewAlreadyInProgressError(errors.New("Operation can only be performed once"), "A container state sync operation is already in progress.")
 	}
-	controlCache.Set("syncAutoStartState", true, cache.DefaultExpiration)
+	defer controlCache.Delete(operationKey)
 
 	portainer.PerformSync(&types.SyncOptions{EndpointIds: []int{endpointId}})
-	settings, err := db.GetAllStackSettings()
+	waves, err := StartWaves(endpointId)
 	if err != nil {
-		controlCache.Delete("syncAutoStartState")
 		return err
 	}
 
 	stacks, err := portainer.GetStacks(endpointId, true)
 	if err != nil {
-		controlCache.Delete("syncAutoStartState")
 		return err
 	}
 
@@ -89,19 +95,22 @@ func SyncAutoStartState(endpointId int) error {
 		stackMap[stack.Name] = stack
 	}
 
-	sort.Slice(settings, func(i, j int) bool {
-		return settings[i].Priority < settings[j].Priority
-	})
-
-	for _, setting := range settings {
+	Startup.begin(endpointId, waves)
+	defer Startup.finish(endpointId)
+	forEachWave(waves, false, func(setting types.StackSettings) {
 		if setting.AutoStart {
+			progress := types.StackStartProgress{StackId: setting.StackId, StackName: setting.StackName, Status: types.Skipped}
 			if stack, ok := stackMap[setting.StackName]; ok {
 
 				if types.CheckWashbImage(stack) {
 					glg.Infof("not modifying stack containing a washboard image")
-					continue
+					progress.Error = "stack contains a washboard image"
+					Startup.report(endpointId, progress)
+					return
 				}
 
+				var err error
+				var status int
 				if len(stack.Containers) > 0 {
 					// check if all containers are stopped. This is an indicator that it probably got stopped by the user
 					// It's unlikely that all containers crashed at once
@@ -115,20 +124,29 @@ func SyncAutoStartState(endpointId int) error {
 					}
 					if allStopped {
 						portainer.StartOrStopStack(endpointId, setting.StackId, "stop")
-						portainer.StartOrStopStack(endpointId, setting.StackId, "start")
+						_, status, err = portainer.StartOrStopStack(endpointId, setting.StackId, "start")
 						glg.Infof("synced autostart state for %s (restore state)", setting.StackName)
 					}
 				} else {
 					// starts those that are not running but have the autostart flag
-					portainer.StartOrStopStack(endpointId, setting.StackId, "start")
+					_, status, err = portainer.StartOrStopStack(endpointId, setting.StackId, "start")
 					glg.Infof("synced autostart state for %s (start)", setting.StackName)
 				}
+				if err != nil && status != http.StatusConflict {
+					progress.Status = types.Error
+					progress.Error = err.Error()
+					Startup.report(endpointId, progress)
+					return
+				}
+				// the next wave only starts once the stacks it depends on are ready
+				waitForStackReady(endpointId, setting)
 			} else {
 				glg.Infof("synced autostart state for %s (no action)", setting.StackName)
+				progress.Error = "stack not found in Portainer"
+				Startup.report(endpointId, progress)
 			}
 		}
-	}
-	controlCache.Delete("syncAutoStartState")
+	})
 	return nil
 }
 
@@ -0,0 +1,209 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"washboard/db"
+	"washboard/types"
+)
+
+// ValidateDependencies checks the dependencies of stack settings before they are stored as oldName,
+// empty for new settings. Every dependency needs stack settings in the same endpoint and the
+// dependencies of the endpoint must not form a cycle.
+func ValidateDependencies(settings *types.StackSettings, oldName string) error {
+	if settings.DependsOn == nil {
+		settings.DependsOn = []string{}
+	}
+	stored, err := db.GetEndpointStackSettings(settings.EndpointId)
+	if err != nil {
+		return err
+	}
+	all := make([]types.StackSettings, 0, len(stored)+1)
+	known := make(map[string]bool, len(stored))
+	for _, setting := range stored {
+		if setting.StackName == oldName || setting.StackName == settings.StackName {
+			continue
+		}
+		all = append(all, setting)
+		known[setting.StackName] = true
+	}
+	all = append(all, *settings)
+
+	seen := make(map[string]bool, len(settings.DependsOn))
+	for _, dependency := range settings.DependsOn {
+		if dependency == settings.StackName {
+			return fmt.Errorf("stack %s can not depend on itself", dependency)
+		}
+		if seen[dependency] {
+			return fmt.Errorf("dependency %s is listed twice", dependency)
+		}
+		seen[dependency] = true
+		if !known[dependency] {
+			return fmt.Errorf("dependency %s has no settings in endpoint %d", dependency, settings.EndpointId)
+		}
+	}
+	if cycle := findCycle(all); cycle != nil {
+		return fmt.Errorf("dependency cycle %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// Dependents returns the names of the stacks of an endpoint that depend on the stack
+func Dependents(endpointId int, stackName string) ([]string, error) {
+	stored, err := db.GetEndpointStackSettings(endpointId)
+	if err != nil {
+		return nil, err
+	}
+	dependents := make([]string, 0)
+	for _, setting := range stored {
+		for _, dependency := range setting.DependsOn {
+			if dependency == stackName {
+				dependents = append(dependents, setting.StackName)
+				break
+			}
+		}
+	}
+	return dependents, nil
+}
+
+// findCycle returns the stack names of a dependency cycle in settings, starting and ending with
+// the same stack, or nil if there is none. Dependencies on stacks missing in settings are ignored.
+func findCycle(settings []types.StackSettings) []string {
+	dependencies := make(map[string][]string, len(settings))
+	for _, setting := range settings {
+		dependencies[setting.StackName] = setting.DependsOn
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[string]int, len(settings))
+	path := make([]string, 0)
+	var visit func(stackName string) []string
+	visit = func(stackName string) []string {
+		switch marks[stackName] {
+		case visiting:
+			for i, onPath := range path {
+				if onPath == stackName {
+					return append(append([]string{}, path[i:]...), stackName)
+				}
+			}
+		case visited:
+			return nil
+		}
+		marks[stackName] = visiting
+		path = append(path, stackName)
+		for _, dependency := range dependencies[stackName] {
+			if _, ok := dependencies[dependency]; !ok {
+				continue
+			}
+			if cycle := visit(dependency); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		marks[stackName] = visited
+		return nil
+	}
+	for _, setting := range settings {
+		if cycle := visit(setting.StackName); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// dependencyWaves splits ordered into waves of stacks that only depend on stacks of earlier waves.
+// Consecutive stacks of ordered with the same priority form a step of the start order. A wave
+// holds the stacks of the first step that still has stacks whose dependencies have run, so a
+// step starts after the ones before it unless a dependency on a later step requires otherwise.
+// The stacks of a wave do not depend on each other and keep their order in ordered. Dependencies
+// on stacks missing in ordered are ignored.
+func dependencyWaves(ordered []types.StackSettings) ([][]types.StackSettings, error) {
+	if cycle := findCycle(ordered); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle %s", strings.Join(cycle, " -> "))
+	}
+	steps := make([]int, len(ordered))
+	for i := 1; i < len(ordered); i++ {
+		steps[i] = steps[i-1]
+		if ordered[i].Priority != ordered[i-1].Priority {
+			steps[i]++
+		}
+	}
+	pending := make(map[string]bool, len(ordered))
+	for _, setting := range ordered {
+		pending[setting.StackName] = true
+	}
+	ready := func(setting types.StackSettings) bool {
+		for _, dependency := range setting.DependsOn {
+			if pending[dependency] {
+				return false
+			}
+		}
+		return true
+	}
+
+	waves := make([][]types.StackSettings, 0)
+	for len(pending) > 0 {
+		wave := make([]types.StackSettings, 0)
+		step := -1
+		for i, setting := range ordered {
+			if !pending[setting.StackName] || (step >= 0 && steps[i] != step) || !ready(setting) {
+				continue
+			}
+			step = steps[i]
+			wave = append(wave, setting)
+		}
+		for _, setting := range wave {
+			delete(pending, setting.StackName)
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
+
+// StartWaves returns the stack settings of an endpoint in the waves they are started in. A stack
+// is started after the stacks it depends on, the stacks of a wave are started in parallel and
+// ordered as in StartOrder. Stacks are stopped wave by wave in reverse order.
+func StartWaves(endpointId int) ([][]types.StackSettings, error) {
+	ordered, err := StartOrder(endpointId)
+	if err != nil {
+		return nil, err
+	}
+	return dependencyWaves(ordered)
+}
+
+// runWaves runs action for every stack, the stacks of a wave in parallel, and waits for a wave to
+// finish before the next one starts. Waves run in reverse order if reverse is set. The results
+// are returned in the order the stacks were processed.
+func runWaves[T any](waves [][]types.StackSettings, reverse bool, action func(wave int, setting types.StackSettings) T) []T {
+	results := make([]T, 0)
+	for i := range waves {
+		wave := i
+		if reverse {
+			wave = len(waves) - 1 - i
+		}
+		waveResults := make([]T, len(waves[wave]))
+		var wg sync.WaitGroup
+		for j, setting := range waves[wave] {
+			wg.Add(1)
+			go func(j int, setting types.StackSettings) {
+				defer wg.Done()
+				waveResults[j] = action(wave, setting)
+			}(j, setting)
+		}
+		wg.Wait()
+		results = append(results, waveResults...)
+	}
+	return results
+}
+
+// forEachWave is runWaves for actions without a result
+func forEachWave(waves [][]types.StackSettings, reverse bool, action func(setting types.StackSettings)) {
+	runWaves(waves, reverse, func(wave int, setting types.StackSettings) struct{} {
+		action(setting)
+		return struct{}{}
+	})
+}
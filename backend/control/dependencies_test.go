@@ -0,0 +1,88 @@
+package control
+
+import (
+	"fmt"
+	"testing"
+
+	"washboard/types"
+)
+
+func TestDependencyWaves(t *testing.T) {
+	settings := []types.StackSettings{
+		{StackName: "proxy", DependsOn: []string{"web", "api"}},
+		{StackName: "web", DependsOn: []string{"db"}},
+		{StackName: "db"},
+		{StackName: "api", DependsOn: []string{"db", "cache", "removed"}},
+		{StackName: "cache"},
+		{StackName: "mail"},
+	}
+	waves, err := dependencyWaves(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([][]string, 0, len(waves))
+	for _, wave := range waves {
+		waveNames := make([]string, 0, len(wave))
+		for _, setting := range wave {
+			waveNames = append(waveNames, setting.StackName)
+		}
+		names = append(names, waveNames)
+	}
+	if fmt.Sprint(names) != "[[db cache mail] [web api] [proxy]]" {
+		t.Fatalf("unexpected waves %v", names)
+	}
+
+	// results keep the order of the stacks in their wave although the stacks run in parallel
+	results := runWaves(waves, true, func(wave int, setting types.StackSettings) string {
+		return fmt.Sprintf("%d %s", wave, setting.StackName)
+	})
+	if fmt.Sprint(results) != "[2 proxy 1 web 1 api 0 db 0 cache 0 mail]" {
+		t.Fatalf("unexpected reverse results %v", results)
+	}
+}
+
+func TestDependencyWavesFollowPriorities(t *testing.T) {
+	settings := []types.StackSettings{
+		{StackName: "db", Priority: 1},
+		{StackName: "cache", Priority: 1},
+		{StackName: "web", Priority: 2},
+		{StackName: "proxy", Priority: 3, DependsOn: []string{"api"}},
+		{StackName: "mail", Priority: 3},
+		{StackName: "api", Priority: 4},
+	}
+	waves, err := dependencyWaves(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([][]string, 0, len(waves))
+	for _, wave := range waves {
+		waveNames := make([]string, 0, len(wave))
+		for _, setting := range wave {
+			waveNames = append(waveNames, setting.StackName)
+		}
+		names = append(names, waveNames)
+	}
+	// proxy waits for api of a later priority, mail does not
+	if fmt.Sprint(names) != "[[db cache] [web] [mail] [api] [proxy]]" {
+		t.Fatalf("unexpected waves %v", names)
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	settings := []types.StackSettings{
+		{StackName: "web", DependsOn: []string{"api"}},
+		{StackName: "api", DependsOn: []string{"db"}},
+		{StackName: "db", DependsOn: []string{"web"}},
+		{StackName: "cache"},
+	}
+	if cycle := findCycle(settings); fmt.Sprint(cycle) != "[web api db web]" {
+		t.Fatalf("unexpected cycle %v", cycle)
+	}
+	if _, err := dependencyWaves(settings); err == nil {
+		t.Fatal("expected the cycle to be rejected")
+	}
+	settings[2].DependsOn = []string{"cache"}
+	if cycle := findCycle(settings); cycle != nil {
+		t.Fatalf("expected no cycle, got %v", cycle)
+	}
+}
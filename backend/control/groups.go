@@ -0,0 +1,282 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"washboard/db"
+	"washboard/portainer"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/kpango/glg"
+	"github.com/patrickmn/go-cache"
+)
+
+// ValidateGroupSettings checks a group before it is stored as oldName, empty for new groups. Every
+// stack of the group needs stack settings in the endpoint and must not be in another group.
+func ValidateGroupSettings(group *types.GroupSettings, oldName string) error {
+	group.GroupName = strings.TrimSpace(group.GroupName)
+	if group.GroupName == "" {
+		return errors.New("groupName must not be empty")
+	}
+	if group.Stacks == nil {
+		group.Stacks = []string{}
+	}
+	settings, err := db.GetEndpointStackSettings(group.EndpointId)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(settings))
+	for _, setting := range settings {
+		known[setting.StackName] = true
+	}
+	groups, err := db.GetEndpointGroupSettings(group.EndpointId)
+	if err != nil {
+		return err
+	}
+	memberOf := make(map[string]string)
+	for _, other := range groups {
+		if other.GroupName == oldName {
+			continue
+		}
+		for _, stackName := range other.Stacks {
+			memberOf[stackName] = other.GroupName
+		}
+	}
+	seen := make(map[string]bool, len(group.Stacks))
+	for _, stackName := range group.Stacks {
+		if seen[stackName] {
+			return fmt.Errorf("stack %s is listed twice", stackName)
+		}
+		seen[stackName] = true
+		if !known[stackName] {
+			return fmt.Errorf("stack %s has no settings in endpoint %d", stackName, group.EndpointId)
+		}
+		if other, ok := memberOf[stackName]; ok {
+			return fmt.Errorf("stack %s already belongs to group %s", stackName, other)
+		}
+	}
+	return nil
+}
+
+// orderStackSettings sorts settings into the start order of an endpoint. Ungrouped stacks are
+// ordered by their priority and groups by their global priority, the stacks of a group follow
+// each other in the order of their own priorities. On equal priorities ungrouped stacks go first.
+func orderStackSettings(settings []types.StackSettings, groups []types.GroupSettings) []types.StackSettings {
+	groupOf := make(map[string]*types.GroupSettings)
+	for i := range groups {
+		for _, stackName := range groups[i].Stacks {
+			groupOf[stackName] = &groups[i]
+		}
+	}
+	// unit returns the priority and group name a stack is ordered by, ungrouped stacks have no group name
+	unit := func(setting types.StackSettings) (int, string) {
+		if group, ok := groupOf[setting.StackName]; ok {
+			return group.GlobalPriority, group.GroupName
+		}
+		return setting.Priority, ""
+	}
+	ordered := append([]types.StackSettings(nil), settings...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		priorityI, groupI := unit(ordered[i])
+		priorityJ, groupJ := unit(ordered[j])
+		if priorityI != priorityJ {
+			return priorityI < priorityJ
+		}
+		// on equal priorities ungrouped stacks go first and groups stay together
+		if groupI != groupJ {
+			return groupI < groupJ
+		}
+		return ordered[i].Priority < ordered[j].Priority
+	})
+	return ordered
+}
+
+// StartOrder returns the stack settings of an endpoint in the order stacks are started, stacks
+// are stopped in reverse order
+func StartOrder(endpointId int) ([]types.StackSettings, error) {
+	settings, err := db.GetEndpointStackSettings(endpointId)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := db.GetEndpointGroupSettings(endpointId)
+	if err != nil {
+		return nil, err
+	}
+	return orderStackSettings(settings, groups), nil
+}
+
+// StackGroup returns the name of the group of an endpoint the stack belongs to, empty if it is
+// not in a group
+func StackGroup(endpointId int, stackName string) (string, error) {
+	groups, err := db.GetEndpointGroupSettings(endpointId)
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups {
+		for _, member := range group.Stacks {
+			if member == stackName {
+				return group.GroupName, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// groupStacks returns the stack settings of the stacks of a group in start order
+func groupStacks(endpointId int, groupName string) ([]types.StackSettings, error) {
+	group, err := db.GetGroupSettings(endpointId, groupName)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := StartOrder(endpointId)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]bool, len(group.Stacks))
+	for _, stackName := range group.Stacks {
+		members[stackName] = true
+	}
+	stacks := make([]types.StackSettings, 0, len(group.Stacks))
+	for _, setting := range ordered {
+		if members[setting.StackName] {
+			stacks = append(stacks, setting)
+		}
+	}
+	return stacks, nil
+}
+
+// lockGroup marks an action of a group as running, only one action per group runs at a time.
+// The returned function releases the lock.
+func lockGroup(endpointId int, groupName string) (func(), error) {
+	operationKey := fmt.Sprintf("group-%d-%s", endpointId, groupName)
+	// the lock does not expire, it is held until the action is done however long it takes
+	if err := controlCache.Add(operationKey, true, cache.NoExpiration); err != nil {
+		glg.Infof("action of group %s already in progress for endpoint %d", groupName, endpointId)
+		return nil, werrors.NewAlreadyInProgressError(errors.New("Operation can only be performed once"), "An action of this group is already in progress.")
+	}
+	return func() { controlCache.Delete(operationKey) }, nil
+}
+
+// groupWaves returns the stacks of a group in the waves of the start order. Dependencies on stacks
+// outside of the group are ignored.
+func groupWaves(endpointId int, groupName string) ([][]types.StackSettings, error) {
+	stacks, err := groupStacks(endpointId, groupName)
+	if err != nil {
+		return nil, err
+	}
+	return dependencyWaves(stacks)
+}
+
+// runGroup runs action for every stack of a group wave by wave, see runWaves
+func runGroup(endpointId int, groupName string, reverse bool, action func(setting types.StackSettings) types.GroupStackResult) ([]types.GroupStackResult, error) {
+	unlock, err := lockGroup(endpointId, groupName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	waves, err := groupWaves(endpointId, groupName)
+	if err != nil {
+		return nil, err
+	}
+	return runWaves(waves, reverse, func(wave int, setting types.StackSettings) types.GroupStackResult {
+		result := action(setting)
+		result.Wave = wave
+		return result
+	}), nil
+}
+
+// StartGroup starts the stacks of a group wave by wave
+func StartGroup(endpointId int, groupName string) ([]types.GroupStackResult, error) {
+	return startOrStopGroup(endpointId, groupName, "start")
+}
+
+// StopGroup stops the stacks of a group wave by wave in reverse order
+func StopGroup(endpointId int, groupName string) ([]types.GroupStackResult, error) {
+	return startOrStopGroup(endpointId, groupName, "stop")
+}
+
+func startOrStopGroup(endpointId int, groupName string, startOrStop string) ([]types.GroupStackResult, error) {
+	stacks, err := portainer.GetStacks(endpointId, true)
+	if err != nil {
+		return nil, err
+	}
+	stackMap := make(map[string]types.StackDto)
+	for _, stack := range stacks {
+		stackMap[stack.Name] = stack
+	}
+
+	return runGroup(endpointId, groupName, startOrStop == "stop", func(setting types.StackSettings) types.GroupStackResult {
+		result := types.GroupStackResult{StackId: setting.StackId, StackName: setting.StackName, Result: types.Done}
+		stack, ok := stackMap[setting.StackName]
+		if !ok {
+			result.Result = types.Skipped
+			result.Error = "stack not found in Portainer"
+			return result
+		}
+		if types.CheckWashbImage(stack) {
+			glg.Infof("not modifying stack containing a washboard image")
+			result.Result = types.Skipped
+			result.Error = "stack contains a washboard image"
+			return result
+		}
+		_, status, err := portainer.StartOrStopStack(endpointId, setting.StackId, startOrStop)
+		if status == http.StatusConflict {
+			// already in the requested state
+			result.Result = types.Skipped
+			result.Error = err.Error()
+		} else if err != nil {
+			result.Result = types.Error
+			result.Error = err.Error()
+		} else {
+			glg.Infof("%s %s of group %s", startOrStop, setting.StackName, groupName)
+		}
+		return result
+	})
+}
+
+// UpdateGroup updates the stacks of a group wave by wave in the background, see updateWaves.
+// The results report the wave of every stack and skip stacks with an update already queued.
+func UpdateGroup(endpointId int, groupName string, prune bool, pullImage bool, triggeredBy string) ([]types.GroupStackResult, error) {
+	unlock, err := lockGroup(endpointId, groupName)
+	if err != nil {
+		return nil, err
+	}
+	waves, err := groupWaves(endpointId, groupName)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	results := make([]types.GroupStackResult, 0)
+	updates := make([][]types.StackSettings, 0, len(waves))
+	for i, wave := range waves {
+		queued := make([]types.StackSettings, 0, len(wave))
+		for _, setting := range wave {
+			result := types.GroupStackResult{StackId: setting.StackId, StackName: setting.StackName, Wave: i, Result: types.Queued}
+			if status, ok := portainer.GetUpdateStatus(endpointId, setting.StackId); ok && status.Status != types.Done && status.Status != types.Error {
+				result.Result = types.Skipped
+				result.Error = "an update of the stack is already queued"
+			} else {
+				queued = append(queued, setting)
+			}
+			results = append(results, result)
+		}
+		updates = append(updates, queued)
+	}
+
+	go func() {
+		defer unlock()
+		updateWaves(endpointId, updates, prune, pullImage, triggeredBy, func(setting types.StackSettings, err error) {
+			if err != nil {
+				glg.Errorf("Failed to enqueue update of stack %s of group %s: %s", setting.StackName, groupName, err)
+			}
+		})
+	}()
+	return results, nil
+}
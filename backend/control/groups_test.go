@@ -0,0 +1,34 @@
+package control
+
+import (
+	"fmt"
+	"testing"
+
+	"washboard/types"
+)
+
+func TestOrderStackSettings(t *testing.T) {
+	settings := []types.StackSettings{
+		{StackName: "web", Priority: 3},
+		{StackName: "db", Priority: 0},
+		{StackName: "cache", Priority: 4},
+		{StackName: "proxy", Priority: 1},
+		{StackName: "mail", Priority: 2},
+	}
+	groups := []types.GroupSettings{
+		// ties with the priority of mail, which goes first
+		{GroupName: "backend", GlobalPriority: 2, Stacks: []string{"cache", "db"}},
+		{GroupName: "empty", GlobalPriority: 0},
+	}
+	ordered := orderStackSettings(settings, groups)
+	names := make([]string, 0, len(ordered))
+	for _, setting := range ordered {
+		names = append(names, setting.StackName)
+	}
+	if fmt.Sprint(names) != "[proxy mail db cache web]" {
+		t.Fatalf("unexpected start order %v", names)
+	}
+	if settings[0].StackName != "web" {
+		t.Fatal("the given settings must not be reordered")
+	}
+}
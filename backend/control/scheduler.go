@@ -0,0 +1,224 @@
+package control
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"washboard/audit"
+	"washboard/cron"
+	"washboard/db"
+	"washboard/portainer"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// SchedulerIdentity is recorded as the trigger of updates started by the scheduler
+const SchedulerIdentity = "scheduler"
+
+const scheduledUpdateTimeout = 30 * time.Minute
+
+// maxWindowOpening bounds the openings of update windows, a window that stays open longer, e.g.
+// "* * * * *", opens again after it
+const maxWindowOpening = 24 * time.Hour
+
+// schedulerLocks holds a *sync.Mutex per endpoint, the passes of different endpoints run in parallel
+var schedulerLocks sync.Map
+
+func schedulerLock(endpointId int) *sync.Mutex {
+	lock, _ := schedulerLocks.LoadOrStore(endpointId, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// ValidateUpdatePolicy checks the update policy of stack settings. Stacks with UpdatePolicyAuto
+// need a valid cron window.
+func ValidateUpdatePolicy(settings *types.StackSettings) error {
+	switch settings.UpdatePolicy {
+	case "", types.UpdatePolicyNever, types.UpdatePolicyNotify:
+	case types.UpdatePolicyAuto:
+		if settings.UpdateWindow == "" {
+			return fmt.Errorf("update policy %s requires an update window", types.UpdatePolicyAuto)
+		}
+	default:
+		return fmt.Errorf("unknown update policy %q", settings.UpdatePolicy)
+	}
+	if settings.UpdateWindow != "" {
+		if _, err := cron.Parse(settings.UpdateWindow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartUpdateScheduler checks the given endpoints at the start of every minute for stacks with
+// UpdatePolicyAuto whose window is open and updates those with outdated images. Every endpoint is
+// checked in its own goroutine, so a long update of one endpoint does not hold up the others. An
+// endpoint whose previous pass is still running skips the minute.
+func StartUpdateScheduler(endpointIds []int) {
+	go func() {
+		glg.Infof("Starting update scheduler for endpoints %v...", endpointIds)
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			now = time.Now()
+			for _, endpointId := range endpointIds {
+				lock := schedulerLock(endpointId)
+				if !lock.TryLock() {
+					glg.Infof("scheduled updates of endpoint %d are still running, skipping %s", endpointId, now.Format("15:04"))
+					continue
+				}
+				go func(endpointId int) {
+					defer lock.Unlock()
+					runScheduledUpdates(endpointId, now)
+				}(endpointId)
+			}
+		}
+	}()
+}
+
+// RunScheduledUpdates updates the outdated stacks of an endpoint whose update window contains now.
+// Outdated means at least one container was reported outdated by the last image status check.
+// Stacks are updated wave by wave in start order, see StartWaves, and stacks containing a washboard
+// image are skipped.
+func RunScheduledUpdates(endpointId int, now time.Time) {
+	lock := schedulerLock(endpointId)
+	lock.Lock()
+	defer lock.Unlock()
+	runScheduledUpdates(endpointId, now)
+}
+
+func runScheduledUpdates(endpointId int, now time.Time) {
+	settings, err := StartOrder(endpointId)
+	if err != nil {
+		glg.Errorf("Failed to get stack settings for scheduled updates: %s", err)
+		return
+	}
+
+	due := make([]types.StackSettings, 0)
+	for _, setting := range settings {
+		if setting.UpdatePolicy != types.UpdatePolicyAuto {
+			continue
+		}
+		window, err := cron.Parse(setting.UpdateWindow)
+		if err != nil {
+			glg.Warnf("invalid update window of stack %s: %s", setting.StackName, err)
+			continue
+		}
+		if window.Matches(now) && !attemptedInWindow(window, setting, now) {
+			due = append(due, setting)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	stacks, err := portainer.GetStacks(endpointId, true)
+	if err != nil {
+		glg.Errorf("Failed to get stacks for scheduled updates: %s", err)
+		return
+	}
+	stackMap := make(map[string]types.StackDto)
+	for _, stack := range stacks {
+		stackMap[stack.Name] = stack
+	}
+
+	updates := make([]types.StackSettings, 0, len(due))
+	for _, setting := range due {
+		stack, ok := stackMap[setting.StackName]
+		if !ok || !isOutdated(stack) {
+			continue
+		}
+		if types.CheckWashbImage(stack) {
+			glg.Infof("not modifying stack containing a washboard image")
+			continue
+		}
+		glg.Infof("scheduled update of stack %s in endpoint %d", stack.Name, endpointId)
+		updates = append(updates, setting)
+	}
+	waves, err := dependencyWaves(updates)
+	if err != nil {
+		glg.Errorf("Failed to order scheduled updates: %s", err)
+		return
+	}
+
+	updateWaves(endpointId, waves, false, true, SchedulerIdentity, func(setting types.StackSettings, err error) {
+		entry := &types.AuditEntry{
+			UserName: SchedulerIdentity,
+			Action:   "stack.update",
+			Target:   fmt.Sprintf("stack:%d", setting.StackId),
+			Params:   map[string]interface{}{"endpointId": endpointId, "stackName": setting.StackName, "pullImage": true, "prune": false},
+			Result:   audit.ResultOf(err),
+		}
+		if err != nil {
+			entry.Error = err.Error()
+			glg.Errorf("Failed to enqueue scheduled update of stack %s: %s", setting.StackName, err)
+		}
+		audit.Record(entry)
+	})
+}
+
+// updateWaves updates the stacks wave by wave: the updates of a wave are queued together and the
+// next wave is queued once all of them finished. enqueued is called for every stack after its
+// update was queued or failed to queue.
+func updateWaves(endpointId int, waves [][]types.StackSettings, prune bool, pullImage bool, triggeredBy string, enqueued func(setting types.StackSettings, err error)) {
+	forEachWave(waves, false, func(setting types.StackSettings) {
+		_, err := portainer.EnqueueUpdateStack(endpointId, setting.StackId, prune, pullImage, triggeredBy)
+		enqueued(setting, err)
+		if err == nil {
+			waitForUpdate(endpointId, setting.StackId)
+		}
+	})
+}
+
+func isOutdated(stack types.StackDto) bool {
+	for _, container := range stack.Containers {
+		if container.UpToDate == types.Outdated {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForUpdate blocks until the update of a stack is done or failed, so the next wave is only
+// updated after the stacks it depends on
+func waitForUpdate(endpointId int, stackId int) {
+	deadline := time.Now().Add(scheduledUpdateTimeout)
+	for time.Now().Before(deadline) {
+		if status, ok := portainer.GetUpdateStatus(endpointId, stackId); ok && (status.Status == types.Done || status.Status == types.Error) {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	glg.Warnf("scheduled update of stack %d did not finish within %s", stackId, scheduledUpdateTimeout)
+}
+
+// attemptedInWindow reports whether the scheduler already enqueued an update of the stack during
+// the opening of window that contains now, i.e. every minute from that update until now was inside
+// the window. Stacks are updated at most once per opening, even if the update failed. Openings
+// end after maxWindowOpening. An update queued after now, e.g. by a clock that was ahead, counts
+// as attempted.
+func attemptedInWindow(window *cron.Schedule, setting types.StackSettings, now time.Time) bool {
+	filter := &types.JobFilter{EndpointId: setting.EndpointId, StackName: setting.StackName, TriggeredBy: SchedulerIdentity, Limit: 1}
+	jobs, _, err := db.ListJobs(filter)
+	if err != nil {
+		glg.Errorf("Failed to get update jobs of stack %s: %s", setting.StackName, err)
+		return true
+	}
+	if len(jobs) == 0 {
+		return false
+	}
+	queuedAt := time.Unix(jobs[0].QueuedAt, 0)
+	if queuedAt.After(now) {
+		return true
+	}
+	if now.Sub(queuedAt) >= maxWindowOpening {
+		return false
+	}
+	for t := queuedAt.Truncate(time.Minute); t.Before(now); t = t.Add(time.Minute) {
+		if !window.Matches(t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package control
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"washboard/portainer"
+	"washboard/state"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// stopPollInterval is the pause between two checks of the containers of a stopping stack
+const stopPollInterval = time.Second
+
+const defaultStopGracePeriod = 30 * time.Second
+
+// stopGracePeriod returns how long stopAllStacks waits for the containers of a stack to exit
+// before they are killed
+func stopGracePeriod() time.Duration {
+	if configured := state.Instance().Config.StopGracePeriod; configured > 0 {
+		return time.Duration(configured) * time.Second
+	}
+	return defaultStopGracePeriod
+}
+
+// stopStack stops a stack and waits up to gracePeriod for its containers to exit. Containers still
+// running after that are killed and get another gracePeriod to be reported as exited. The stack
+// is reported as skipped if it was already stopped and as an error if containers are left running
+// or could not be checked.
+func stopStack(endpointId int, setting types.StackSettings, gracePeriod time.Duration) types.GroupStackResult {
+	result := types.GroupStackResult{StackId: setting.StackId, StackName: setting.StackName, Result: types.Done}
+	_, status, stopErr := portainer.StartOrStopStack(endpointId, setting.StackId, "stop")
+	if stopErr != nil && status != http.StatusConflict {
+		glg.Warnf("failed to stop stack %s, waiting for its containers to exit: %s", setting.StackName, stopErr)
+	}
+
+	running, err := waitForStackExited(endpointId, setting.StackName, gracePeriod)
+	if err != nil {
+		result.Result = types.Error
+		result.Error = err.Error()
+		return result
+	}
+	if len(running) == 0 {
+		if status == http.StatusConflict {
+			// already stopped
+			result.Result = types.Skipped
+			result.Error = stopErr.Error()
+		} else if stopErr != nil {
+			result.Error = stopErr.Error()
+		}
+		return result
+	}
+
+	glg.Warnf("%d containers of stack %s did not exit within %s, killing them", len(running), setting.StackName, gracePeriod)
+	killErrors := make([]string, 0)
+	for _, container := range running {
+		if _, err := portainer.ManageContainer(endpointId, container.Id, types.Kill); err != nil {
+			killErrors = append(killErrors, err.Error())
+			continue
+		}
+		result.Killed = append(result.Killed, container.Name)
+	}
+	running, err = waitForStackExited(endpointId, setting.StackName, gracePeriod)
+	if err == nil && len(running) > 0 {
+		names := make([]string, 0, len(running))
+		for _, container := range running {
+			names = append(names, container.Name)
+		}
+		err = fmt.Errorf("containers still running after kill: %s", strings.Join(names, ", "))
+	}
+	if err != nil {
+		result.Result = types.Error
+		result.Error = strings.Join(append(killErrors, err.Error()), "; ")
+	}
+	return result
+}
+
+// waitForStackExited polls the containers of a stack until none of them runs or timeout passed and
+// returns the containers still running
+func waitForStackExited(endpointId int, stackName string, timeout time.Duration) ([]*types.ContainerDto, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		containers, err := portainer.GetContainers(endpointId, stackName)
+		if err != nil {
+			return nil, err
+		}
+		running := make([]*types.ContainerDto, 0)
+		for _, container := range containers {
+			if !containerExited(container) {
+				running = append(running, container)
+			}
+		}
+		if len(running) == 0 || time.Now().After(deadline) {
+			return running, nil
+		}
+		time.Sleep(stopPollInterval)
+	}
+}
+
+// containerExited reports whether a container has no running process
+func containerExited(container *types.ContainerDto) bool {
+	switch container.Status {
+	case "exited", "dead", "created":
+		return true
+	}
+	return false
+}
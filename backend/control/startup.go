@@ -0,0 +1,168 @@
+package control
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"washboard/hub"
+	"washboard/portainer"
+	"washboard/state"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// startPollInterval is the pause between two checks of the containers of a starting stack
+const startPollInterval = time.Second
+
+const defaultStackStartTimeout = 120 * time.Second
+
+// StartupTracker keeps the progress of the autostart sync per endpoint and publishes every change
+// on the startup topic of the hub
+type StartupTracker struct {
+	mu        sync.Mutex
+	endpoints map[int]*types.StartupState
+}
+
+var Startup = &StartupTracker{endpoints: make(map[int]*types.StartupState)}
+
+// begin resets the progress of an endpoint to the autostart stacks of waves, all pending
+func (t *StartupTracker) begin(endpointId int, waves [][]types.StackSettings) {
+	now := time.Now().Unix()
+	startup := &types.StartupState{EndpointId: endpointId, Running: true, StartedAt: now, Stacks: make([]types.StackStartProgress, 0)}
+	for i, wave := range waves {
+		for _, setting := range wave {
+			if setting.AutoStart {
+				startup.Stacks = append(startup.Stacks, types.StackStartProgress{StackId: setting.StackId, StackName: setting.StackName, Wave: i, Status: types.StartPending, UpdatedAt: now})
+			}
+		}
+	}
+	t.mu.Lock()
+	t.endpoints[endpointId] = startup
+	t.mu.Unlock()
+	t.publishState(endpointId)
+}
+
+// report replaces the progress of a stack, keeping its wave. Only changes are published.
+func (t *StartupTracker) report(endpointId int, progress types.StackStartProgress) {
+	changed := false
+	t.mu.Lock()
+	if startup, ok := t.endpoints[endpointId]; ok {
+		for i := range startup.Stacks {
+			if startup.Stacks[i].StackName == progress.StackName {
+				progress.Wave = startup.Stacks[i].Wave
+				progress.UpdatedAt = startup.Stacks[i].UpdatedAt
+				if progress != startup.Stacks[i] {
+					progress.UpdatedAt = time.Now().Unix()
+					startup.Stacks[i] = progress
+					changed = true
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+	if changed {
+		hub.Publish(types.WsTopicStartup, types.WsMsgStartupStack, types.StartupStackEvent{EndpointId: endpointId, StackStartProgress: progress})
+	}
+}
+
+func (t *StartupTracker) finish(endpointId int) {
+	t.mu.Lock()
+	if startup, ok := t.endpoints[endpointId]; ok {
+		startup.Running = false
+		startup.FinishedAt = time.Now().Unix()
+	}
+	t.mu.Unlock()
+	t.publishState(endpointId)
+}
+
+func (t *StartupTracker) publishState(endpointId int) {
+	if startup, ok := t.Get(endpointId); ok {
+		hub.Publish(types.WsTopicStartup, types.WsMsgStartupState, startup)
+	}
+}
+
+// Get returns the progress of the last autostart sync of an endpoint
+func (t *StartupTracker) Get(endpointId int) (types.StartupState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	startup, ok := t.endpoints[endpointId]
+	if !ok {
+		return types.StartupState{}, false
+	}
+	copied := *startup
+	copied.Stacks = append([]types.StackStartProgress(nil), startup.Stacks...)
+	return copied, true
+}
+
+// Snapshot returns the progress of the last autostart sync of every endpoint
+func (t *StartupTracker) Snapshot() []types.StartupState {
+	t.mu.Lock()
+	endpointIds := make([]int, 0, len(t.endpoints))
+	for endpointId := range t.endpoints {
+		endpointIds = append(endpointIds, endpointId)
+	}
+	t.mu.Unlock()
+	sort.Ints(endpointIds)
+	snapshot := make([]types.StartupState, 0, len(endpointIds))
+	for _, endpointId := range endpointIds {
+		if startup, ok := t.Get(endpointId); ok {
+			snapshot = append(snapshot, startup)
+		}
+	}
+	return snapshot
+}
+
+// stackStartTimeout returns how long the autostart sync waits for a stack to become ready
+func stackStartTimeout(setting types.StackSettings) time.Duration {
+	if setting.StartTimeout > 0 {
+		return time.Duration(setting.StartTimeout) * time.Second
+	}
+	if configured := state.Instance().Config.StackStartTimeout; configured > 0 {
+		return time.Duration(configured) * time.Second
+	}
+	return defaultStackStartTimeout
+}
+
+// waitForStackReady blocks until every container of a stack is running and every container with
+// a Docker healthcheck is healthy, or the start timeout of the stack passed. The progress is
+// reported to Startup after every check.
+func waitForStackReady(endpointId int, setting types.StackSettings) error {
+	timeout := stackStartTimeout(setting)
+	deadline := time.Now().Add(timeout)
+	for {
+		progress := types.StackStartProgress{StackId: setting.StackId, StackName: setting.StackName, Status: types.StartWaiting}
+		containers, err := portainer.GetContainers(endpointId, setting.StackName)
+		if err != nil {
+			progress.Error = err.Error()
+		}
+		for _, container := range containers {
+			progress.Containers++
+			if container.Status == types.ContainerRunning {
+				progress.Running++
+			}
+			if container.Health != "" {
+				progress.Healthchecks++
+				if container.Health == types.HealthHealthy {
+					progress.Healthy++
+				}
+			}
+		}
+		if err == nil && progress.Containers > 0 && progress.Running == progress.Containers && progress.Healthy == progress.Healthchecks {
+			progress.Status = types.StartReady
+			Startup.report(endpointId, progress)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			progress.Status = types.StartTimedOut
+			progress.Error = fmt.Sprintf("%d of %d containers running, %d of %d healthy after %s", progress.Running, progress.Containers, progress.Healthy, progress.Healthchecks, timeout)
+			Startup.report(endpointId, progress)
+			glg.Warnf("stack %s did not become ready: %s", setting.StackName, progress.Error)
+			return fmt.Errorf("stack %s did not become ready: %s", setting.StackName, progress.Error)
+		}
+		Startup.report(endpointId, progress)
+		time.Sleep(startPollInterval)
+	}
+}
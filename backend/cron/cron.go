@@ -0,0 +1,147 @@
+// Package cron parses standard five field cron expressions. Washboard uses them to describe
+// time windows rather than single points in time: a window is open during every minute the
+// expression matches, e.g. "* 2-4 * * SUN" is open on Sundays from 02:00 to 04:59.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression
+type Schedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	// restricted day fields are combined with OR like in cron(8)
+	domRestricted bool
+	dowRestricted bool
+}
+
+type field struct {
+	name  string
+	min   int
+	max   int
+	names []string
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// Parse parses an expression of the form "minute hour day-of-month month day-of-week". Every
+// field accepts *, numbers, ranges (1-5), lists (1,3,5) and steps (*/15, 8-18/2). Months and
+// days of the week may be given by their three letter english names; Sunday is 0 or 7.
+func Parse(expr string) (*Schedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("cron expression %q must have %d fields, got %d", expr, len(fields), len(parts))
+	}
+	bits := make([]uint64, len(fields))
+	for i, part := range parts {
+		parsed, err := parseField(part, fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expr, err)
+		}
+		bits[i] = parsed
+	}
+	// 7 is an alias for Sunday
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &Schedule{
+		minute:        bits[0],
+		hour:          bits[1],
+		dayOfMonth:    bits[2],
+		month:         bits[3],
+		dayOfWeek:     bits[4],
+		domRestricted: parts[2] != "*",
+		dowRestricted: parts[4] != "*",
+	}, nil
+}
+
+// Matches reports whether t falls into a minute matched by the schedule
+func (s *Schedule) Matches(t time.Time) bool {
+	if !has(s.minute, t.Minute()) || !has(s.hour, t.Hour()) || !has(s.month, int(t.Month())) {
+		return false
+	}
+	domMatch := has(s.dayOfMonth, t.Day())
+	dowMatch := has(s.dayOfWeek, int(t.Weekday()))
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+func has(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+func parseField(expr string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepExpr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepExpr, f.name)
+			}
+		}
+
+		var low, high int
+		if rangeExpr == "*" {
+			low, high = f.min, f.max
+		} else if lowExpr, highExpr, isRange := strings.Cut(rangeExpr, "-"); isRange {
+			var err error
+			if low, err = parseValue(lowExpr, f); err != nil {
+				return 0, err
+			}
+			if high, err = parseValue(highExpr, f); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangeExpr, f.name)
+			}
+		} else {
+			var err error
+			if low, err = parseValue(rangeExpr, f); err != nil {
+				return 0, err
+			}
+			high = low
+			if hasStep {
+				high = f.max
+			}
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseValue(expr string, f field) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(expr, name) {
+			if f.min == 1 {
+				return i + 1, nil
+			}
+			return i, nil
+		}
+	}
+	value, err := strconv.Atoi(expr)
+	if err != nil || value < f.min || value > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field, expected %d-%d", expr, f.name, f.min, f.max)
+	}
+	return value, nil
+}
@@ -0,0 +1,50 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	// 2024-03-03 is a Sunday
+	sunday := func(hour int, minute int) time.Time {
+		return time.Date(2024, time.March, 3, hour, minute, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		expr  string
+		at    time.Time
+		match bool
+	}{
+		{"* * * * *", sunday(12, 34), true},
+		{"* 2-4 * * SUN", sunday(2, 0), true},
+		{"* 2-4 * * SUN", sunday(4, 59), true},
+		{"* 2-4 * * SUN", sunday(5, 0), false},
+		{"* 2-4 * * 7", sunday(3, 0), true},
+		{"* 2-4 * * mon-fri", sunday(3, 0), false},
+		{"*/15 * * * *", sunday(3, 30), true},
+		{"*/15 * * * *", sunday(3, 31), false},
+		{"0,30 8-18/2 * * *", sunday(10, 30), true},
+		{"0,30 8-18/2 * * *", sunday(11, 30), false},
+		{"* * 1 MAR *", sunday(0, 0), false},
+		// day of month and day of week are combined with OR when both are restricted
+		{"* * 1 * SUN", sunday(0, 0), true},
+		{"* * 3 * MON", sunday(0, 0), true},
+	}
+	for _, c := range cases {
+		schedule, err := Parse(c.expr)
+		if err != nil {
+			t.Fatalf("%q: %s", c.expr, err)
+		}
+		if got := schedule.Matches(c.at); got != c.match {
+			t.Errorf("%q at %s: expected %t, got %t", c.expr, c.at.Format(time.RFC1123), c.match, got)
+		}
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 5-2 * * *", "*/0 * * * *", "* * * FOO *", "* * 0 * *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,662 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/kpango/glg"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is the embedded single-file implementation of Store. Every collection of the
+// MongoDB backend is a bucket holding JSON encoded documents.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var errNotFound = errors.New("no documents in result")
+
+// OpenBolt opens (and creates if necessary) the database file at path
+func OpenBolt(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	glg.Infof("Opening embedded database at %s", path)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{types.DbStackSettingsCollection, types.DbGroupSettingsCollection, types.DbAccountsCollection, types.DbJobsCollection, types.DbNotificationsCollection, types.DbApiTokensCollection, types.DbAuditCollection, types.DbSettingsCollection, types.DbSessionsCollection} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// stackSettingsKey is the bucket key of the stack settings of a stack in an endpoint, also used
+// for the group settings of a group
+func stackSettingsKey(endpointId int, stackName string) string {
+	return fmt.Sprintf("%d/%s", endpointId, stackName)
+}
+
+func (bs *BoltStore) CreateStackSettings(stackSettings *types.StackSettings) error {
+	key := stackSettingsKey(stackSettings.EndpointId, stackSettings.StackName)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbStackSettingsCollection))
+		if bucket.Get([]byte(key)) != nil {
+			return werrors.NewCannotInsertError(errors.New("duplicate key"), fmt.Sprintf("stack settings for %s in endpoint %d already exist", stackSettings.StackName, stackSettings.EndpointId))
+		}
+		return putJson(bucket, key, stackSettings)
+	})
+}
+
+func (bs *BoltStore) GetStackSettings(endpointId int, name string) (*types.StackSettings, error) {
+	var stackSettings types.StackSettings
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbStackSettingsCollection)), stackSettingsKey(endpointId, name), &stackSettings)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, &werrors.DoesNotExistError{
+			Context: "empty response",
+			Err:     err,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &stackSettings, nil
+}
+
+func (bs *BoltStore) GetAllStackSettings() ([]types.StackSettings, error) {
+	var stackSettings []types.StackSettings
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		stackSettings, err = readStackSettings(tx.Bucket([]byte(types.DbStackSettingsCollection)))
+		return err
+	})
+	return stackSettings, err
+}
+
+// readStackSettings returns all stack settings stored in bucket
+func readStackSettings(bucket *bolt.Bucket) ([]types.StackSettings, error) {
+	var stackSettings []types.StackSettings
+	err := bucket.ForEach(func(k, v []byte) error {
+		var settings types.StackSettings
+		if err := json.Unmarshal(v, &settings); err != nil {
+			return err
+		}
+		stackSettings = append(stackSettings, settings)
+		return nil
+	})
+	return stackSettings, err
+}
+
+// UpdateStackPriority reads and reorders the priorities in one transaction, so concurrent updates
+// do not reorder stale priorities
+func (bs *BoltStore) UpdateStackPriority(stackSettings *types.StackSettings) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbStackSettingsCollection))
+		var oldStackSettings types.StackSettings
+		if err := getJson(bucket, stackSettingsKey(stackSettings.EndpointId, stackSettings.StackName), &oldStackSettings); errors.Is(err, errNotFound) {
+			return &werrors.DoesNotExistError{
+				Context: "empty response",
+				Err:     err,
+			}
+		} else if err != nil {
+			return err
+		}
+		allStackSettings, err := readStackSettings(bucket)
+		if err != nil {
+			return err
+		}
+		for _, liveStackSetting := range reorderPriorities(allStackSettings, stackSettings, oldStackSettings.Priority) {
+			if err := putJson(bucket, stackSettingsKey(liveStackSetting.EndpointId, liveStackSetting.StackName), liveStackSetting); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) UpdateStackSettings(stackSettings *types.StackSettings, endpointId int, stackName string) error {
+	oldKey := stackSettingsKey(endpointId, stackName)
+	newKey := stackSettingsKey(stackSettings.EndpointId, stackSettings.StackName)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbStackSettingsCollection))
+		if bucket.Get([]byte(oldKey)) == nil {
+			return fmt.Errorf("No stack settings found with stack name %s in endpoint %d", stackName, endpointId)
+		}
+		if oldKey != newKey {
+			if bucket.Get([]byte(newKey)) != nil {
+				return werrors.NewCannotInsertError(errors.New("duplicate key"), fmt.Sprintf("stack settings for %s in endpoint %d already exist", stackSettings.StackName, stackSettings.EndpointId))
+			}
+			if err := bucket.Delete([]byte(oldKey)); err != nil {
+				return err
+			}
+		}
+		return putJson(bucket, newKey, stackSettings)
+	})
+}
+
+func (bs *BoltStore) DeleteStackSettings(endpointId int, stackName string) error {
+	key := stackSettingsKey(endpointId, stackName)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbStackSettingsCollection))
+		if bucket.Get([]byte(key)) == nil {
+			return fmt.Errorf("No stack settings found with stack name %s in endpoint %d", stackName, endpointId)
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStore) CreateGroupSettings(groupSettings *types.GroupSettings) error {
+	key := stackSettingsKey(groupSettings.EndpointId, groupSettings.GroupName)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbGroupSettingsCollection))
+		if bucket.Get([]byte(key)) != nil {
+			return werrors.NewCannotInsertError(errors.New("duplicate key"), fmt.Sprintf("group %s in endpoint %d already exists", groupSettings.GroupName, groupSettings.EndpointId))
+		}
+		return putJson(bucket, key, groupSettings)
+	})
+}
+
+func (bs *BoltStore) GetGroupSettings(endpointId int, groupName string) (*types.GroupSettings, error) {
+	var groupSettings types.GroupSettings
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbGroupSettingsCollection)), stackSettingsKey(endpointId, groupName), &groupSettings)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("group %s in endpoint %d", groupName, endpointId))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &groupSettings, nil
+}
+
+func (bs *BoltStore) GetAllGroupSettings() ([]types.GroupSettings, error) {
+	groupSettings := make([]types.GroupSettings, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(types.DbGroupSettingsCollection)).ForEach(func(k, v []byte) error {
+			var settings types.GroupSettings
+			if err := json.Unmarshal(v, &settings); err != nil {
+				return err
+			}
+			groupSettings = append(groupSettings, settings)
+			return nil
+		})
+	})
+	return groupSettings, err
+}
+
+func (bs *BoltStore) UpdateGroupSettings(groupSettings *types.GroupSettings, endpointId int, groupName string) error {
+	oldKey := stackSettingsKey(endpointId, groupName)
+	newKey := stackSettingsKey(groupSettings.EndpointId, groupSettings.GroupName)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbGroupSettingsCollection))
+		if bucket.Get([]byte(oldKey)) == nil {
+			return werrors.NewDoesNotExistError(errNotFound, fmt.Sprintf("group %s in endpoint %d", groupName, endpointId))
+		}
+		if oldKey != newKey {
+			if bucket.Get([]byte(newKey)) != nil {
+				return werrors.NewCannotInsertError(errors.New("duplicate key"), fmt.Sprintf("group %s in endpoint %d already exists", groupSettings.GroupName, groupSettings.EndpointId))
+			}
+			if err := bucket.Delete([]byte(oldKey)); err != nil {
+				return err
+			}
+		}
+		return putJson(bucket, newKey, groupSettings)
+	})
+}
+
+func (bs *BoltStore) DeleteGroupSettings(endpointId int, groupName string) error {
+	key := stackSettingsKey(endpointId, groupName)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbGroupSettingsCollection))
+		if bucket.Get([]byte(key)) == nil {
+			return werrors.NewDoesNotExistError(errNotFound, fmt.Sprintf("group %s in endpoint %d", groupName, endpointId))
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+// migrateStackSettingsEndpoint re-keys settings that were stored without an endpoint
+func (bs *BoltStore) migrateStackSettingsEndpoint(defaultEndpointId int) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbStackSettingsCollection))
+		legacy := make(map[string]types.StackSettings)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var settings types.StackSettings
+			if err := json.Unmarshal(v, &settings); err != nil {
+				return err
+			}
+			if settings.EndpointId == 0 {
+				legacy[string(k)] = settings
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, settings := range legacy {
+			if err := bucket.Delete([]byte(key)); err != nil {
+				return err
+			}
+			settings.EndpointId = defaultEndpointId
+			if err := putJson(bucket, stackSettingsKey(settings.EndpointId, settings.StackName), settings); err != nil {
+				return err
+			}
+		}
+		if len(legacy) > 0 {
+			glg.Infof("assigned %d stack settings to endpoint %d", len(legacy), defaultEndpointId)
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) CreateJob(job *types.StackUpdateJob) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket([]byte(types.DbJobsCollection)), job.Id, job)
+	})
+}
+
+func (bs *BoltStore) UpdateJob(job *types.StackUpdateJob) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbJobsCollection))
+		if bucket.Get([]byte(job.Id)) == nil {
+			return fmt.Errorf("No job found with id %s", job.Id)
+		}
+		return putJson(bucket, job.Id, job)
+	})
+}
+
+func (bs *BoltStore) GetJob(id string) (*types.StackUpdateJob, error) {
+	var job types.StackUpdateJob
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbJobsCollection)), id, &job)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, werrors.NewDoesNotExistError(err, "empty response")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs walks the bucket backwards. Job ids are object ids, so the keys sort by creation time.
+func (bs *BoltStore) ListJobs(filter *types.JobFilter) ([]types.StackUpdateJob, int, error) {
+	jobs := make([]types.StackUpdateJob, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(types.DbJobsCollection)).Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var job types.StackUpdateJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			if filter.Matches(&job) {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return paginate(jobs, filter.Offset, filter.Limit), len(jobs), nil
+}
+
+func (bs *BoltStore) RecordNotification(key string) (bool, error) {
+	isNew := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbNotificationsCollection))
+		if bucket.Get([]byte(key)) != nil {
+			return nil
+		}
+		isNew = true
+		return putJson(bucket, key, time.Now().Unix())
+	})
+	return isNew, err
+}
+
+func (bs *BoltStore) ForgetNotification(key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(types.DbNotificationsCollection)).Delete([]byte(key))
+	})
+}
+
+func (bs *BoltStore) CreateAccount(account *types.Account) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbAccountsCollection))
+		if bucket.Get([]byte(account.UserName)) != nil {
+			return werrors.NewCannotInsertError(errors.New("duplicate key"), fmt.Sprintf("account %s already exists", account.UserName))
+		}
+		return putJson(bucket, account.UserName, account)
+	})
+}
+
+func (bs *BoltStore) GetAccount(userName string) (*types.Account, error) {
+	var account types.Account
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbAccountsCollection)), userName, &account)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("account %s", userName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// GetAllAccounts relies on bbolt iterating keys in byte order, i.e. sorted by user name
+func (bs *BoltStore) GetAllAccounts() ([]types.Account, error) {
+	accounts := make([]types.Account, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(types.DbAccountsCollection)).ForEach(func(k, v []byte) error {
+			var account types.Account
+			if err := json.Unmarshal(v, &account); err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+func (bs *BoltStore) UpdateAccount(account *types.Account) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbAccountsCollection))
+		if bucket.Get([]byte(account.UserName)) == nil {
+			return werrors.NewDoesNotExistError(errNotFound, fmt.Sprintf("account %s", account.UserName))
+		}
+		return putJson(bucket, account.UserName, account)
+	})
+}
+
+func (bs *BoltStore) UseTotpStep(userName string, step int64) (bool, error) {
+	used := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbAccountsCollection))
+		var account types.Account
+		if err := getJson(bucket, userName, &account); errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if account.TotpLastStep >= step {
+			return nil
+		}
+		account.TotpLastStep = step
+		used = true
+		return putJson(bucket, userName, &account)
+	})
+	return used, err
+}
+
+func (bs *BoltStore) UseRecoveryCode(userName string, hash string) (bool, error) {
+	used := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbAccountsCollection))
+		var account types.Account
+		if err := getJson(bucket, userName, &account); errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for i, stored := range account.RecoveryCodes {
+			if stored == hash {
+				account.RecoveryCodes = append(account.RecoveryCodes[:i:i], account.RecoveryCodes[i+1:]...)
+				used = true
+				return putJson(bucket, userName, &account)
+			}
+		}
+		return nil
+	})
+	return used, err
+}
+
+func (bs *BoltStore) DeleteAccount(userName string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbAccountsCollection))
+		if bucket.Get([]byte(userName)) == nil {
+			return werrors.NewDoesNotExistError(errNotFound, fmt.Sprintf("account %s", userName))
+		}
+		return bucket.Delete([]byte(userName))
+	})
+}
+
+func (bs *BoltStore) CreateApiToken(token *types.ApiToken) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket([]byte(types.DbApiTokensCollection)), token.Id, token)
+	})
+}
+
+func (bs *BoltStore) GetApiToken(id string) (*types.ApiToken, error) {
+	var token types.ApiToken
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbApiTokensCollection)), id, &token)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("api token %s", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ListApiTokens returns the tokens in key order, token ids are object ids so that is creation order
+func (bs *BoltStore) ListApiTokens(owner string) ([]types.ApiToken, error) {
+	tokens := make([]types.ApiToken, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(types.DbApiTokensCollection)).ForEach(func(k, v []byte) error {
+			var token types.ApiToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if owner == "" || token.Owner == owner {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+func (bs *BoltStore) UpdateApiToken(token *types.ApiToken) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbApiTokensCollection))
+		if bucket.Get([]byte(token.Id)) == nil {
+			return werrors.NewDoesNotExistError(errNotFound, fmt.Sprintf("api token %s", token.Id))
+		}
+		return putJson(bucket, token.Id, token)
+	})
+}
+
+func (bs *BoltStore) CreateSession(session *types.Session) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket([]byte(types.DbSessionsCollection)), session.Id, session)
+	})
+}
+
+func (bs *BoltStore) GetSession(id string) (*types.Session, error) {
+	var session types.Session
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbSessionsCollection)), id, &session)
+	})
+	if errors.Is(err, errNotFound) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("session %s", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ListSessions returns the sessions in key order, session ids are object ids so that is creation order
+func (bs *BoltStore) ListSessions(userName string) ([]types.Session, error) {
+	sessions := make([]types.Session, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(types.DbSessionsCollection)).ForEach(func(k, v []byte) error {
+			var session types.Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if userName == "" || session.UserName == userName {
+				sessions = append(sessions, session)
+			}
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (bs *BoltStore) UpdateSession(session *types.Session) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbSessionsCollection))
+		if bucket.Get([]byte(session.Id)) == nil {
+			return werrors.NewDoesNotExistError(errNotFound, fmt.Sprintf("session %s", session.Id))
+		}
+		return putJson(bucket, session.Id, session)
+	})
+}
+
+func (bs *BoltStore) TouchSession(id string, lastSeenAt int64, expiresAt int64) (bool, error) {
+	touched := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbSessionsCollection))
+		var session types.Session
+		if err := getJson(bucket, id, &session); errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if session.RevokedAt != 0 {
+			return nil
+		}
+		session.LastSeenAt = lastSeenAt
+		if expiresAt != 0 {
+			session.ExpiresAt = expiresAt
+		}
+		touched = true
+		return putJson(bucket, id, &session)
+	})
+	return touched, err
+}
+
+func (bs *BoltStore) DeleteSessionsExpiredBefore(timestamp int64) (int, error) {
+	deleted := 0
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(types.DbSessionsCollection))
+		expired := make([][]byte, 0)
+		err := bucket.ForEach(func(k, v []byte) error {
+			var session types.Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if session.ExpiresAt < timestamp {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// keys must not be deleted while iterating
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, err
+}
+
+func (bs *BoltStore) GetSecurityPolicy() (*types.SecurityPolicy, error) {
+	var policy types.SecurityPolicy
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket([]byte(types.DbSettingsCollection)), types.SecurityPolicyKey, &policy)
+	})
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (bs *BoltStore) UpdateSecurityPolicy(policy *types.SecurityPolicy) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket([]byte(types.DbSettingsCollection)), types.SecurityPolicyKey, policy)
+	})
+}
+
+func (bs *BoltStore) AppendAudit(entry *types.AuditEntry) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putJson(tx.Bucket([]byte(types.DbAuditCollection)), entry.Id, entry)
+	})
+}
+
+// ListAudit walks the bucket backwards like ListJobs, entry ids are object ids as well. Only the
+// entries of the requested page are kept, the audit log can be much larger than a page.
+func (bs *BoltStore) ListAudit(filter *types.AuditFilter) ([]types.AuditEntry, int, error) {
+	entries := make([]types.AuditEntry, 0)
+	total := 0
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(types.DbAuditCollection)).Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var entry types.AuditEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if !filter.Matches(&entry) {
+				continue
+			}
+			if total >= filter.Offset && (filter.Limit <= 0 || total < filter.Offset+filter.Limit) {
+				entries = append(entries, entry)
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+func putJson(bucket *bolt.Bucket, key string, value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), encoded)
+}
+
+func getJson(bucket *bolt.Bucket, key string, out interface{}) error {
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return errNotFound
+	}
+	return json.Unmarshal(value, out)
+}
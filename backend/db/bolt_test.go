@@ -0,0 +1,237 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"washboard/types"
+	"washboard/werrors"
+)
+
+func openTestBolt(t *testing.T) *BoltStore {
+	t.Helper()
+	store, err := OpenBolt(filepath.Join(t.TempDir(), "washboard.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBoltStackSettingsCrud(t *testing.T) {
+	store := openTestBolt(t)
+
+	if err := store.CreateStackSettings(&types.StackSettings{EndpointId: 1, StackName: "web", StackId: 1}); err != nil {
+		t.Fatal(err)
+	}
+	err := store.CreateStackSettings(&types.StackSettings{EndpointId: 1, StackName: "web", StackId: 2})
+	target := &werrors.CannotInsertError{}
+	if !errors.As(err, &target) {
+		t.Fatalf("expected CannotInsertError for duplicate stack name, got %v", err)
+	}
+	if err := store.CreateStackSettings(&types.StackSettings{EndpointId: 2, StackName: "web", StackId: 3}); err != nil {
+		t.Fatalf("equally named stack in another endpoint must not collide: %s", err)
+	}
+
+	if err := store.UpdateStackSettings(&types.StackSettings{EndpointId: 1, StackName: "web", StackId: 1, AutoStart: true}, 1, "web"); err != nil {
+		t.Fatal(err)
+	}
+	// renaming onto the settings of another stack does not overwrite them
+	if err := store.CreateStackSettings(&types.StackSettings{EndpointId: 1, StackName: "api", StackId: 4}); err != nil {
+		t.Fatal(err)
+	}
+	err = store.UpdateStackSettings(&types.StackSettings{EndpointId: 1, StackName: "web", StackId: 4}, 1, "api")
+	if !errors.As(err, &target) {
+		t.Fatalf("expected CannotInsertError for a rename onto another stack, got %v", err)
+	}
+	settings, err := store.GetStackSettings(1, "web")
+	if err != nil || !settings.AutoStart {
+		t.Fatalf("expected updated settings, got %+v, %v", settings, err)
+	}
+	settings, err = store.GetStackSettings(2, "web")
+	if err != nil || settings.AutoStart || settings.StackId != 3 {
+		t.Fatalf("expected untouched settings in endpoint 2, got %+v, %v", settings, err)
+	}
+
+	if err := store.DeleteStackSettings(1, "web"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetStackSettings(1, "web")
+	notFound := &werrors.DoesNotExistError{}
+	if !errors.As(err, &notFound) {
+		t.Fatalf("expected DoesNotExistError, got %v", err)
+	}
+}
+
+func TestBoltGroupSettingsCrud(t *testing.T) {
+	store := openTestBolt(t)
+
+	if err := store.CreateGroupSettings(&types.GroupSettings{EndpointId: 1, GroupName: "media", Stacks: []string{"plex"}}); err != nil {
+		t.Fatal(err)
+	}
+	err := store.CreateGroupSettings(&types.GroupSettings{EndpointId: 1, GroupName: "media"})
+	target := &werrors.CannotInsertError{}
+	if !errors.As(err, &target) {
+		t.Fatalf("expected CannotInsertError for duplicate group name, got %v", err)
+	}
+	if err := store.CreateGroupSettings(&types.GroupSettings{EndpointId: 1, GroupName: "infra"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// renaming onto an existing group must not overwrite it
+	err = store.UpdateGroupSettings(&types.GroupSettings{EndpointId: 1, GroupName: "infra"}, 1, "media")
+	if !errors.As(err, &target) {
+		t.Fatalf("expected CannotInsertError when renaming onto another group, got %v", err)
+	}
+	if err := store.UpdateGroupSettings(&types.GroupSettings{EndpointId: 1, GroupName: "video", GlobalPriority: 3, Stacks: []string{"plex", "jellyfin"}}, 1, "media"); err != nil {
+		t.Fatal(err)
+	}
+	group, err := store.GetGroupSettings(1, "video")
+	if err != nil || group.GlobalPriority != 3 || len(group.Stacks) != 2 {
+		t.Fatalf("expected renamed group, got %+v, %v", group, err)
+	}
+	notFound := &werrors.DoesNotExistError{}
+	if _, err := store.GetGroupSettings(1, "media"); !errors.As(err, &notFound) {
+		t.Fatalf("expected DoesNotExistError for the old name, got %v", err)
+	}
+
+	if err := store.DeleteGroupSettings(1, "video"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteGroupSettings(1, "video"); !errors.As(err, &notFound) {
+		t.Fatalf("expected DoesNotExistError, got %v", err)
+	}
+	groups, err := store.GetAllGroupSettings()
+	if err != nil || len(groups) != 1 || groups[0].GroupName != "infra" {
+		t.Fatalf("expected only infra to be left, got %+v, %v", groups, err)
+	}
+}
+
+func TestBoltUpdateStackPriority(t *testing.T) {
+	store := openTestBolt(t)
+	for i, name := range []string{"a", "b", "c", "d"} {
+		if err := store.CreateStackSettings(&types.StackSettings{EndpointId: 1, StackName: name, Priority: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.CreateStackSettings(&types.StackSettings{EndpointId: 2, StackName: "e", Priority: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UpdateStackPriority(&types.StackSettings{EndpointId: 1, StackName: "d", Priority: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := store.GetAllStackSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all = filterEndpoint(all, 1)
+	sort.Slice(all, func(i, j int) bool { return all[i].Priority < all[j].Priority })
+	order := ""
+	for _, settings := range all {
+		order += settings.StackName
+	}
+	if order != "adbc" {
+		t.Fatalf("expected order adbc, got %s", order)
+	}
+}
+
+func TestBoltMigrateStackSettingsEndpoint(t *testing.T) {
+	store := openTestBolt(t)
+	if err := store.CreateStackSettings(&types.StackSettings{StackName: "legacy"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.migrateStackSettingsEndpoint(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetStackSettings(3, "legacy"); err != nil {
+		t.Fatalf("expected legacy settings in endpoint 3: %s", err)
+	}
+}
+
+func TestBoltListJobs(t *testing.T) {
+	store := openTestBolt(t)
+	SetStore(store)
+	t.Cleanup(func() { SetStore(nil) })
+	for i, name := range []string{"web", "db", "web", "web"} {
+		job := &types.StackUpdateJob{EndpointId: 1, StackName: name, Status: types.Done, QueuedAt: int64(100 + i)}
+		if err := CreateJob(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jobs, total, err := store.ListJobs(&types.JobFilter{StackName: "web", From: 101, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(jobs) != 1 || jobs[0].QueuedAt != 103 {
+		t.Fatalf("expected newest of 2 matching jobs, got %d %+v", total, jobs)
+	}
+
+	jobs, _, err = store.ListJobs(&types.JobFilter{Offset: 1, Limit: 2})
+	if err != nil || len(jobs) != 2 || jobs[0].QueuedAt != 102 || jobs[1].QueuedAt != 101 {
+		t.Fatalf("unexpected second page: %+v, %v", jobs, err)
+	}
+}
+
+func TestBoltTouchSession(t *testing.T) {
+	store := openTestBolt(t)
+	session := &types.Session{Id: "s1", UserName: "olga", CreatedAt: 100, LastSeenAt: 100, ExpiresAt: 1000}
+	if err := store.CreateSession(session); err != nil {
+		t.Fatal(err)
+	}
+	if touched, err := store.TouchSession(session.Id, 200, 2000); err != nil || !touched {
+		t.Fatalf("expected the session to be touched, got %t %v", touched, err)
+	}
+	stored, err := store.GetSession(session.Id)
+	if err != nil || stored.LastSeenAt != 200 || stored.ExpiresAt != 2000 || stored.UserName != "olga" {
+		t.Fatalf("unexpected touched session %+v, %v", stored, err)
+	}
+
+	// a revocation written in the meantime is kept
+	stored.RevokedAt = 300
+	if err := store.UpdateSession(stored); err != nil {
+		t.Fatal(err)
+	}
+	if touched, err := store.TouchSession(session.Id, 400, 0); err != nil || touched {
+		t.Fatalf("expected the revoked session not to be touched, got %t %v", touched, err)
+	}
+	if stored, err = store.GetSession(session.Id); err != nil || stored.RevokedAt != 300 || stored.LastSeenAt != 200 {
+		t.Fatalf("expected the revocation to be kept, got %+v, %v", stored, err)
+	}
+	if touched, err := store.TouchSession("missing", 400, 0); err != nil || touched {
+		t.Fatalf("expected a missing session not to be touched, got %t %v", touched, err)
+	}
+}
+
+func TestBoltUseSecondFactor(t *testing.T) {
+	store := openTestBolt(t)
+	account := &types.Account{UserName: "tara", TotpSecret: "secret", TotpLastStep: 10, RecoveryCodes: []string{"a", "b"}}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := store.UseTotpStep("tara", 11); err != nil || !used {
+		t.Fatalf("expected the next step to be used, got %t %v", used, err)
+	}
+	for _, step := range []int64{11, 10} {
+		if used, err := store.UseTotpStep("tara", step); err != nil || used {
+			t.Fatalf("expected step %d to be rejected, got %t %v", step, used, err)
+		}
+	}
+	if used, err := store.UseRecoveryCode("tara", "a"); err != nil || !used {
+		t.Fatalf("expected the recovery code to be used, got %t %v", used, err)
+	}
+	if used, err := store.UseRecoveryCode("tara", "a"); err != nil || used {
+		t.Fatalf("expected the used recovery code to be rejected, got %t %v", used, err)
+	}
+	stored, err := store.GetAccount("tara")
+	if err != nil || stored.TotpLastStep != 11 || len(stored.RecoveryCodes) != 1 || stored.RecoveryCodes[0] != "b" || stored.TotpSecret != "secret" {
+		t.Fatalf("unexpected account %+v, %v", stored, err)
+	}
+	if used, err := store.UseTotpStep("missing", 20); err != nil || used {
+		t.Fatalf("expected a missing account to be rejected, got %t %v", used, err)
+	}
+}
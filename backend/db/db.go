@@ -1,226 +1,584 @@
 package db
 
 import (
-	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 	"washboard/state"
 	"washboard/types"
-	"washboard/werrors"
 
 	"github.com/kpango/glg"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var instance *DataStore
-var once sync.Once
+const (
+	boltScheme        = "bolt://"
+	defaultBoltDbFile = "washboard.db"
+)
+
+// Store is the persistence backend of washboard. The package level functions delegate to the
+// store selected by the scheme of db_url, see Open.
+type Store interface {
+	CreateStackSettings(stackSettings *types.StackSettings) error
+	GetStackSettings(endpointId int, name string) (*types.StackSettings, error)
+	GetAllStackSettings() ([]types.StackSettings, error)
+	UpdateStackPriority(stackSettings *types.StackSettings) error
+	UpdateStackSettings(stackSettings *types.StackSettings, endpointId int, stackName string) error
+	DeleteStackSettings(endpointId int, stackName string) error
+
+	CreateGroupSettings(groupSettings *types.GroupSettings) error
+	GetGroupSettings(endpointId int, groupName string) (*types.GroupSettings, error)
+	GetAllGroupSettings() ([]types.GroupSettings, error)
+	UpdateGroupSettings(groupSettings *types.GroupSettings, endpointId int, groupName string) error
+	DeleteGroupSettings(endpointId int, groupName string) error
+
+	CreateJob(job *types.StackUpdateJob) error
+	UpdateJob(job *types.StackUpdateJob) error
+	GetJob(id string) (*types.StackUpdateJob, error)
+	// ListJobs returns the jobs matching filter, newest first, and the total number of matches
+	ListJobs(filter *types.JobFilter) ([]types.StackUpdateJob, int, error)
+
+	// RecordNotification stores key and reports whether it was not stored before
+	RecordNotification(key string) (bool, error)
+	// ForgetNotification removes key, it is not an error if key is not stored
+	ForgetNotification(key string) error
+
+	CreateAccount(account *types.Account) error
+	GetAccount(userName string) (*types.Account, error)
+	GetAllAccounts() ([]types.Account, error)
+	UpdateAccount(account *types.Account) error
+	// UseTotpStep sets TotpLastStep of an account to step if it is below step. It reports false if
+	// the step or a later one was used before or the account does not exist.
+	UseTotpStep(userName string, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code hash from an account. It reports false if the
+	// account does not have it (anymore).
+	UseRecoveryCode(userName string, hash string) (bool, error)
+	DeleteAccount(userName string) error
 
-type DataStore struct {
-	db     *mongo.Database
-	client *mongo.Client
+	CreateApiToken(token *types.ApiToken) error
+	GetApiToken(id string) (*types.ApiToken, error)
+	// ListApiTokens returns the tokens of owner, or all tokens if owner is empty, oldest first
+	ListApiTokens(owner string) ([]types.ApiToken, error)
+	UpdateApiToken(token *types.ApiToken) error
+
+	CreateSession(session *types.Session) error
+	GetSession(id string) (*types.Session, error)
+	// ListSessions returns the sessions of userName, or of all users if it is empty, oldest first
+	ListSessions(userName string) ([]types.Session, error)
+	UpdateSession(session *types.Session) error
+	// TouchSession sets LastSeenAt and, unless expiresAt is 0, ExpiresAt of a session that is not
+	// revoked. It reports false if the session is revoked or does not exist.
+	TouchSession(id string, lastSeenAt int64, expiresAt int64) (bool, error)
+	// DeleteSessionsExpiredBefore deletes the sessions that expired before timestamp and returns their number
+	DeleteSessionsExpiredBefore(timestamp int64) (int, error)
+
+	// GetSecurityPolicy returns the stored policy or an empty one if none was stored yet
+	GetSecurityPolicy() (*types.SecurityPolicy, error)
+	UpdateSecurityPolicy(policy *types.SecurityPolicy) error
+
+	// AppendAudit stores an audit entry. Entries are never changed or deleted.
+	AppendAudit(entry *types.AuditEntry) error
+	// ListAudit returns the audit entries matching filter, newest first, and the total number of matches
+	ListAudit(filter *types.AuditFilter) ([]types.AuditEntry, int, error)
+
+	Close() error
 }
 
-func (ds *DataStore) Db() *mongo.Database {
-	return ds.db
+// migrator is implemented by stores that hold stack settings written before settings were keyed
+// by endpoint. Those settings are assigned to defaultEndpointId when the store is opened.
+type migrator interface {
+	migrateStackSettingsEndpoint(defaultEndpointId int) error
 }
 
-func (ds *DataStore) Client() *mongo.Client {
-	return ds.client
+var store Store
+var storeMu sync.Mutex
+
+// Open returns the store for the given connection string:
+//   - mongodb:// and mongodb+srv:// connect to MongoDB
+//   - bolt://<path> opens an embedded single-file database. Relative paths are resolved
+//     against the directory of the executable.
+//   - an empty string opens the embedded database washboard.db next to the executable
+func Open(dbUrl string) (Store, error) {
+	switch {
+	case dbUrl == "":
+		return OpenBolt(filepath.Join(state.ReflectionPath(), defaultBoltDbFile))
+	case strings.HasPrefix(dbUrl, boltScheme):
+		path := strings.TrimPrefix(dbUrl, boltScheme)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(state.ReflectionPath(), path)
+		}
+		return OpenBolt(path)
+	case strings.HasPrefix(dbUrl, "mongodb://"), strings.HasPrefix(dbUrl, "mongodb+srv://"):
+		return OpenMongo(dbUrl)
+	default:
+		return nil, fmt.Errorf("unsupported db_url scheme in %q", dbUrl)
+	}
 }
 
-// Get establishes a connection to the database and returns the db handle
-func GetConnection() (*DataStore, error) {
-	var connectErr error
-	once.Do(func() {
-		instance = new(DataStore)
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		dbUrl := state.Instance().Config.DbUrl
-		glg.Infof("Connecting to database at %s", dbUrl)
-		client, err := mongo.Connect(ctx, options.Client().ApplyURI(dbUrl))
-		if err != nil {
-			connectErr = err
-			return
+// GetStore returns the store configured by db_url, opening it on first use
+func GetStore() (Store, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store != nil {
+		return store, nil
+	}
+	config := state.Instance().Config
+	opened, err := Open(config.DbUrl)
+	if err != nil {
+		glg.Errorf("Failed to open database: %s", err)
+		return nil, err
+	}
+	if m, ok := opened.(migrator); ok {
+		if err := m.migrateStackSettingsEndpoint(config.EndpointIds()[0]); err != nil {
+			glg.Errorf("Failed to migrate stack settings to endpoint %d: %s", config.EndpointIds()[0], err)
 		}
-		instance.client = client
-		instance.db = client.Database(types.DbName)
-	})
-	if connectErr != nil {
-		return nil, connectErr
 	}
-	return instance, nil
+	store = opened
+	return store, nil
+}
+
+// SetStore replaces the store used by the package level functions, e.g. in tests
+func SetStore(s Store) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
 }
 
 // CreateStackSettings creates a new stack settings document in the database
 func CreateStackSettings(stackSettings *types.StackSettings) error {
-	conn, conErr := GetConnection()
-	if conErr != nil {
-		return conErr
-	}
-	collection := conn.db.Collection(types.DbStackSettingsCollection)
-	indexModel := mongo.IndexModel{
-		Keys:    bson.D{primitive.E{Key: "stackName", Value: 1}},
-		Options: options.Index().SetUnique(true),
-	}
-	ctxOp2, cancelOp2 := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancelOp2()
-	_, err := collection.Indexes().CreateOne(ctxOp2, indexModel)
+	s, err := GetStore()
 	if err != nil {
 		return err
 	}
+	return s.CreateStackSettings(stackSettings)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	_, err = collection.InsertOne(ctx, stackSettings)
+// GetStackSettings retrieves the stack settings document of a stack in an endpoint
+func GetStackSettings(endpointId int, name string) (*types.StackSettings, error) {
+	s, err := GetStore()
 	if err != nil {
-		err = werrors.NewCannotInsertError(err, err.(mongo.WriteException).WriteErrors[0].Message) // 🌯 the error
+		return nil, err
 	}
-	return err
+	return s.GetStackSettings(endpointId, name)
 }
 
-// GetStackSettings retrieves a stack settings document from the database by ID
-func GetStackSettings(name string) (*types.StackSettings, error) {
-	conn, conErr := GetConnection()
-	if conErr != nil {
-		return nil, conErr
+// GetAllStackSettings retrieves all stack settings from the database
+func GetAllStackSettings() ([]types.StackSettings, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
 	}
-	collection := conn.db.Collection(types.DbStackSettingsCollection)
-	var stackSettings types.StackSettings
+	return s.GetAllStackSettings()
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	err := collection.FindOne(ctx, bson.M{"stackName": name}).Decode(&stackSettings)
+// GetEndpointStackSettings retrieves the stack settings of all stacks in an endpoint
+func GetEndpointStackSettings(endpointId int) ([]types.StackSettings, error) {
+	allStackSettings, err := GetAllStackSettings()
 	if err != nil {
-		if err.Error() == "mongo: no documents in result" {
-			return nil, &werrors.DoesNotExistError{
-				Context: "empty response",
-				Err:     err,
-			}
-		}
 		return nil, err
 	}
-	return &stackSettings, nil
+	return filterEndpoint(allStackSettings, endpointId), nil
 }
 
-// GetAllStackSettings retrieves all stack settings from the database
-func GetAllStackSettings() ([]types.StackSettings, error) {
-	conn, conErr := GetConnection()
-	if conErr != nil {
-		return nil, conErr
+// UpdateStackPriority moves a stack to the priority of stackSettings and shifts the stacks in between
+func UpdateStackPriority(stackSettings *types.StackSettings) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
 	}
+	return s.UpdateStackPriority(stackSettings)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// UpdateStackSettings updates a stack settings document in the database
+func UpdateStackSettings(stackSettings *types.StackSettings, endpointId int, stackName string) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.UpdateStackSettings(stackSettings, endpointId, stackName)
+}
+
+// DeleteStackSettings deletes the stack settings document of a stack in an endpoint
+func DeleteStackSettings(endpointId int, stackName string) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.DeleteStackSettings(endpointId, stackName)
+}
 
-	collection := conn.db.Collection(types.DbStackSettingsCollection)
-	var stackSettings []types.StackSettings
+// CreateGroupSettings creates a new group settings document in the database
+func CreateGroupSettings(groupSettings *types.GroupSettings) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.CreateGroupSettings(groupSettings)
+}
 
-	cursor, err := collection.Find(ctx, bson.M{})
+// GetGroupSettings retrieves the group settings document of a group in an endpoint
+func GetGroupSettings(endpointId int, groupName string) (*types.GroupSettings, error) {
+	s, err := GetStore()
 	if err != nil {
 		return nil, err
 	}
-	defer cursor.Close(ctx)
+	return s.GetGroupSettings(endpointId, groupName)
+}
 
-	err = cursor.All(ctx, &stackSettings)
+// GetAllGroupSettings retrieves all group settings from the database
+func GetAllGroupSettings() ([]types.GroupSettings, error) {
+	s, err := GetStore()
 	if err != nil {
 		return nil, err
 	}
-	return stackSettings, nil
+	return s.GetAllGroupSettings()
 }
 
-func UpdateStackPriority(stackSettings *types.StackSettings) error {
-	conn, conErr := GetConnection()
-	if conErr != nil {
-		return conErr
+// GetEndpointGroupSettings retrieves the group settings of all groups in an endpoint
+func GetEndpointGroupSettings(endpointId int) ([]types.GroupSettings, error) {
+	allGroupSettings, err := GetAllGroupSettings()
+	if err != nil {
+		return nil, err
 	}
-	collection := conn.db.Collection(types.DbStackSettingsCollection)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	filtered := make([]types.GroupSettings, 0, len(allGroupSettings))
+	for _, groupSettings := range allGroupSettings {
+		if groupSettings.EndpointId == endpointId {
+			filtered = append(filtered, groupSettings)
+		}
+	}
+	return filtered, nil
+}
 
-	// get all stack settings and move the priorities downwards from the inser position and upwards from where it was taken from
-	allStackSettings, err := GetAllStackSettings()
+// UpdateGroupSettings replaces the group settings document of a group in an endpoint
+func UpdateGroupSettings(groupSettings *types.GroupSettings, endpointId int, groupName string) error {
+	s, err := GetStore()
 	if err != nil {
 		return err
 	}
-	oldStackSettings, err := GetStackSettings(stackSettings.StackName)
+	return s.UpdateGroupSettings(groupSettings, endpointId, groupName)
+}
+
+// DeleteGroupSettings deletes the group settings document of a group in an endpoint
+func DeleteGroupSettings(endpointId int, groupName string) error {
+	s, err := GetStore()
 	if err != nil {
 		return err
 	}
+	return s.DeleteGroupSettings(endpointId, groupName)
+}
+
+func filterEndpoint(allStackSettings []types.StackSettings, endpointId int) []types.StackSettings {
+	filtered := make([]types.StackSettings, 0, len(allStackSettings))
+	for _, stackSettings := range allStackSettings {
+		if stackSettings.EndpointId == endpointId {
+			filtered = append(filtered, stackSettings)
+		}
+	}
+	return filtered
+}
+
+// reorderPriorities returns the stack settings of the endpoint of moved with the priorities they have
+// after moving the stack from oldPriority to its new priority. The stacks in between move downwards
+// from the insert position and upwards from where it was taken from.
+func reorderPriorities(allStackSettings []types.StackSettings, moved *types.StackSettings, oldPriority int) []types.StackSettings {
+	allStackSettings = filterEndpoint(allStackSettings, moved.EndpointId)
 
 	moveUp := false
-	if oldStackSettings.Priority > stackSettings.Priority {
+	if oldPriority > moved.Priority {
 		moveUp = true
 	}
 
-	var updates []mongo.WriteModel
+	reordered := make([]types.StackSettings, 0, len(allStackSettings))
 	for _, liveStackSetting := range allStackSettings {
-		if liveStackSetting.StackName == stackSettings.StackName {
-			liveStackSetting.Priority = stackSettings.Priority
+		if liveStackSetting.StackName == moved.StackName {
+			liveStackSetting.Priority = moved.Priority
 		} else if moveUp {
-			if liveStackSetting.Priority >= stackSettings.Priority && liveStackSetting.Priority < oldStackSettings.Priority {
+			if liveStackSetting.Priority >= moved.Priority && liveStackSetting.Priority < oldPriority {
 				liveStackSetting.Priority++
 			}
 		} else {
-			if liveStackSetting.Priority <= stackSettings.Priority && liveStackSetting.Priority > oldStackSettings.Priority {
+			if liveStackSetting.Priority <= moved.Priority && liveStackSetting.Priority > oldPriority {
 				liveStackSetting.Priority--
 			}
 		}
+		reordered = append(reordered, liveStackSetting)
+	}
+	return reordered
+}
 
-		update := mongo.NewUpdateOneModel()
-		update.SetFilter(bson.M{"stackName": liveStackSetting.StackName})
-		update.SetUpdate(bson.M{"$set": bson.M{"priority": liveStackSetting.Priority}})
-		update.SetUpsert(false)
-		updates = append(updates, update)
+// CreateJob persists a new stack update job and assigns its id
+func CreateJob(job *types.StackUpdateJob) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	if job.Id == "" {
+		job.Id = primitive.NewObjectID().Hex()
 	}
+	return s.CreateJob(job)
+}
 
-	_, err = collection.BulkWrite(ctx, updates)
+// UpdateJob replaces a stack update job
+func UpdateJob(job *types.StackUpdateJob) error {
+	s, err := GetStore()
 	if err != nil {
 		return err
 	}
+	return s.UpdateJob(job)
+}
 
-	return nil
+// GetJob retrieves a stack update job by id
+func GetJob(id string) (*types.StackUpdateJob, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetJob(id)
 }
 
-// UpdateStackSettings updates a stack settings document in the database
-func UpdateStackSettings(stackSettings *types.StackSettings, stackName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// ListJobs retrieves a page of stack update jobs, newest first, and the total number of matches
+func ListJobs(filter *types.JobFilter) ([]types.StackUpdateJob, int, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.ListJobs(filter)
+}
 
-	conn, conErr := GetConnection()
-	if conErr != nil {
-		return conErr
+// RecordNotification remembers that the notification identified by key was sent. It returns
+// false if it was sent before.
+func RecordNotification(key string) (bool, error) {
+	s, err := GetStore()
+	if err != nil {
+		return false, err
 	}
-	collection := conn.db.Collection(types.DbStackSettingsCollection)
-	res, err := collection.ReplaceOne(ctx, bson.M{"stackName": stackName}, stackSettings)
+	return s.RecordNotification(key)
+}
+
+// ForgetNotification removes the record of the notification identified by key, e.g. because it
+// could not be delivered, so it is sent again
+func ForgetNotification(key string) error {
+	s, err := GetStore()
 	if err != nil {
 		return err
 	}
-	if res.MatchedCount == 0 {
-		return fmt.Errorf("No stack settings found with stack name %s", stackName)
+	return s.ForgetNotification(key)
+}
+
+// CreateAccount stores a new account, failing with a CannotInsertError if the user name is taken
+func CreateAccount(account *types.Account) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
 	}
-	return err
+	return s.CreateAccount(account)
 }
 
-// DeleteStackSettings deletes a stack settings document from the database by ID
-func DeleteStackSettings(stackName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// GetAccount retrieves an account by user name
+func GetAccount(userName string) (*types.Account, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetAccount(userName)
+}
 
-	conn, conErr := GetConnection()
-	if conErr != nil {
-		return conErr
+// GetAllAccounts retrieves all accounts sorted by user name
+func GetAllAccounts() ([]types.Account, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetAllAccounts()
+}
+
+// UpdateAccount replaces an existing account
+func UpdateAccount(account *types.Account) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.UpdateAccount(account)
+}
+
+// UseTotpStep records the time step of an accepted TOTP code, unless it or a later one was used in
+// the meantime. It reports whether the step was recorded.
+func UseTotpStep(userName string, step int64) (bool, error) {
+	s, err := GetStore()
+	if err != nil {
+		return false, err
+	}
+	return s.UseTotpStep(userName, step)
+}
+
+// UseRecoveryCode removes an accepted recovery code, unless it was used in the meantime. It
+// reports whether the code was removed.
+func UseRecoveryCode(userName string, hash string) (bool, error) {
+	s, err := GetStore()
+	if err != nil {
+		return false, err
+	}
+	return s.UseRecoveryCode(userName, hash)
+}
+
+// DeleteAccount deletes an account by user name
+func DeleteAccount(userName string) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.DeleteAccount(userName)
+}
+
+// CreateApiToken stores a new api token and assigns its id
+func CreateApiToken(token *types.ApiToken) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	if token.Id == "" {
+		token.Id = primitive.NewObjectID().Hex()
+	}
+	return s.CreateApiToken(token)
+}
+
+// GetApiToken retrieves an api token by id
+func GetApiToken(id string) (*types.ApiToken, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
 	}
-	collection := conn.db.Collection(types.DbStackSettingsCollection)
-	res, err := collection.DeleteOne(ctx, bson.M{"stackName": stackName})
+	return s.GetApiToken(id)
+}
+
+// ListApiTokens retrieves the api tokens of owner, or all tokens if owner is empty
+func ListApiTokens(owner string) ([]types.ApiToken, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.ListApiTokens(owner)
+}
+
+// UpdateApiToken replaces an existing api token
+func UpdateApiToken(token *types.ApiToken) error {
+	s, err := GetStore()
 	if err != nil {
 		return err
 	}
-	if res.DeletedCount == 0 {
-		return fmt.Errorf("No stack settings found with stack name %s", stackName)
+	return s.UpdateApiToken(token)
+}
+
+// CreateSession stores a new session and assigns its id
+func CreateSession(session *types.Session) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	if session.Id == "" {
+		session.Id = primitive.NewObjectID().Hex()
+	}
+	return s.CreateSession(session)
+}
+
+// GetSession retrieves a session by id
+func GetSession(id string) (*types.Session, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSession(id)
+}
+
+// ListSessions retrieves the sessions of userName, or of all users if it is empty
+func ListSessions(userName string) ([]types.Session, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.ListSessions(userName)
+}
+
+// UpdateSession replaces an existing session
+func UpdateSession(session *types.Session) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.UpdateSession(session)
+}
+
+// TouchSession records the use of a session and optionally extends it, unless it was revoked in
+// the meantime. It reports whether the session was updated.
+func TouchSession(id string, lastSeenAt int64, expiresAt int64) (bool, error) {
+	s, err := GetStore()
+	if err != nil {
+		return false, err
+	}
+	return s.TouchSession(id, lastSeenAt, expiresAt)
+}
+
+// DeleteSessionsExpiredBefore deletes the sessions that expired before timestamp
+func DeleteSessionsExpiredBefore(timestamp int64) (int, error) {
+	s, err := GetStore()
+	if err != nil {
+		return 0, err
+	}
+	return s.DeleteSessionsExpiredBefore(timestamp)
+}
+
+// GetSecurityPolicy retrieves the security policy, which is empty until an admin changes it
+func GetSecurityPolicy() (*types.SecurityPolicy, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSecurityPolicy()
+}
+
+// UpdateSecurityPolicy stores the security policy
+func UpdateSecurityPolicy(policy *types.SecurityPolicy) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	return s.UpdateSecurityPolicy(policy)
+}
+
+// AppendAudit stores an audit entry and assigns its id and, if it is not set, its timestamp
+func AppendAudit(entry *types.AuditEntry) error {
+	s, err := GetStore()
+	if err != nil {
+		return err
+	}
+	if entry.Id == "" {
+		entry.Id = primitive.NewObjectID().Hex()
+	}
+	if entry.Timestamp == 0 {
+		entry.Timestamp = time.Now().Unix()
+	}
+	return s.AppendAudit(entry)
+}
+
+// ListAudit retrieves a page of audit entries, newest first, and the total number of matches
+func ListAudit(filter *types.AuditFilter) ([]types.AuditEntry, int, error) {
+	s, err := GetStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.ListAudit(filter)
+}
+
+// paginate returns the page of items selected by offset and limit. A limit <= 0 returns everything after offset.
+func paginate[T any](items []T, offset int, limit int) []T {
+	if offset >= len(items) {
+		return []T{}
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
 	}
-	return err
+	return items
 }
@@ -0,0 +1,725 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+	"washboard/types"
+	"washboard/werrors"
+
+	"github.com/kpango/glg"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DataStore is the MongoDB implementation of Store
+type DataStore struct {
+	db     *mongo.Database
+	client *mongo.Client
+}
+
+func (ds *DataStore) Db() *mongo.Database {
+	return ds.db
+}
+
+func (ds *DataStore) Client() *mongo.Client {
+	return ds.client
+}
+
+// OpenMongo establishes a connection to the database and returns the db handle
+func OpenMongo(dbUrl string) (*DataStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	glg.Infof("Connecting to database at %s", dbUrl)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dbUrl))
+	if err != nil {
+		return nil, err
+	}
+	return &DataStore{
+		client: client,
+		db:     client.Database(types.DbName),
+	}, nil
+}
+
+func (ds *DataStore) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return ds.client.Disconnect(ctx)
+}
+
+func (ds *DataStore) CreateStackSettings(stackSettings *types.StackSettings) error {
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "endpointId", Value: 1}, primitive.E{Key: "stackName", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	ctxOp2, cancelOp2 := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelOp2()
+	_, err := collection.Indexes().CreateOne(ctxOp2, indexModel)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = collection.InsertOne(ctx, stackSettings)
+	if err != nil {
+		err = werrors.NewCannotInsertError(err, err.(mongo.WriteException).WriteErrors[0].Message) // 🌯 the error
+	}
+	return err
+}
+
+func stackSettingsFilter(endpointId int, stackName string) bson.M {
+	return bson.M{"endpointId": endpointId, "stackName": stackName}
+}
+
+func (ds *DataStore) GetStackSettings(endpointId int, name string) (*types.StackSettings, error) {
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	var stackSettings types.StackSettings
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := collection.FindOne(ctx, stackSettingsFilter(endpointId, name)).Decode(&stackSettings)
+	if err != nil {
+		if err.Error() == "mongo: no documents in result" {
+			return nil, &werrors.DoesNotExistError{
+				Context: "empty response",
+				Err:     err,
+			}
+		}
+		return nil, err
+	}
+	return &stackSettings, nil
+}
+
+func (ds *DataStore) GetAllStackSettings() ([]types.StackSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	var stackSettings []types.StackSettings
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	err = cursor.All(ctx, &stackSettings)
+	if err != nil {
+		return nil, err
+	}
+	return stackSettings, nil
+}
+
+func (ds *DataStore) UpdateStackPriority(stackSettings *types.StackSettings) error {
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	allStackSettings, err := ds.GetAllStackSettings()
+	if err != nil {
+		return err
+	}
+	oldStackSettings, err := ds.GetStackSettings(stackSettings.EndpointId, stackSettings.StackName)
+	if err != nil {
+		return err
+	}
+
+	var updates []mongo.WriteModel
+	for _, liveStackSetting := range reorderPriorities(allStackSettings, stackSettings, oldStackSettings.Priority) {
+		update := mongo.NewUpdateOneModel()
+		update.SetFilter(stackSettingsFilter(liveStackSetting.EndpointId, liveStackSetting.StackName))
+		update.SetUpdate(bson.M{"$set": bson.M{"priority": liveStackSetting.Priority}})
+		update.SetUpsert(false)
+		updates = append(updates, update)
+	}
+
+	_, err = collection.BulkWrite(ctx, updates)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ds *DataStore) UpdateStackSettings(stackSettings *types.StackSettings, endpointId int, stackName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	res, err := collection.ReplaceOne(ctx, stackSettingsFilter(endpointId, stackName), stackSettings)
+	if mongo.IsDuplicateKeyError(err) {
+		return werrors.NewCannotInsertError(err, fmt.Sprintf("stack settings for %s in endpoint %d already exist", stackSettings.StackName, stackSettings.EndpointId))
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("No stack settings found with stack name %s in endpoint %d", stackName, endpointId)
+	}
+	return err
+}
+
+func (ds *DataStore) DeleteStackSettings(endpointId int, stackName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	res, err := collection.DeleteOne(ctx, stackSettingsFilter(endpointId, stackName))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("No stack settings found with stack name %s in endpoint %d", stackName, endpointId)
+	}
+	return err
+}
+
+func groupSettingsFilter(endpointId int, groupName string) bson.M {
+	return bson.M{"endpointId": endpointId, "groupName": groupName}
+}
+
+func (ds *DataStore) CreateGroupSettings(groupSettings *types.GroupSettings) error {
+	collection := ds.db.Collection(types.DbGroupSettingsCollection)
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "endpointId", Value: 1}, primitive.E{Key: "groupName", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := collection.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return err
+	}
+
+	_, err := collection.InsertOne(ctx, groupSettings)
+	if mongo.IsDuplicateKeyError(err) {
+		return werrors.NewCannotInsertError(err, fmt.Sprintf("group %s in endpoint %d already exists", groupSettings.GroupName, groupSettings.EndpointId))
+	}
+	return err
+}
+
+func (ds *DataStore) GetGroupSettings(endpointId int, groupName string) (*types.GroupSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var groupSettings types.GroupSettings
+	err := ds.db.Collection(types.DbGroupSettingsCollection).FindOne(ctx, groupSettingsFilter(endpointId, groupName)).Decode(&groupSettings)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("group %s in endpoint %d", groupName, endpointId))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &groupSettings, nil
+}
+
+func (ds *DataStore) GetAllGroupSettings() ([]types.GroupSettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := ds.db.Collection(types.DbGroupSettingsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	groupSettings := make([]types.GroupSettings, 0)
+	if err := cursor.All(ctx, &groupSettings); err != nil {
+		return nil, err
+	}
+	return groupSettings, nil
+}
+
+func (ds *DataStore) UpdateGroupSettings(groupSettings *types.GroupSettings, endpointId int, groupName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbGroupSettingsCollection).ReplaceOne(ctx, groupSettingsFilter(endpointId, groupName), groupSettings)
+	if mongo.IsDuplicateKeyError(err) {
+		return werrors.NewCannotInsertError(err, fmt.Sprintf("group %s in endpoint %d already exists", groupSettings.GroupName, groupSettings.EndpointId))
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return werrors.NewDoesNotExistError(mongo.ErrNoDocuments, fmt.Sprintf("group %s in endpoint %d", groupName, endpointId))
+	}
+	return nil
+}
+
+func (ds *DataStore) DeleteGroupSettings(endpointId int, groupName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbGroupSettingsCollection).DeleteOne(ctx, groupSettingsFilter(endpointId, groupName))
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return werrors.NewDoesNotExistError(mongo.ErrNoDocuments, fmt.Sprintf("group %s in endpoint %d", groupName, endpointId))
+	}
+	return nil
+}
+
+// migrateStackSettingsEndpoint assigns settings without an endpoint to defaultEndpointId and drops
+// the unique index on stackName alone, which would prevent equally named stacks in two endpoints
+func (ds *DataStore) migrateStackSettingsEndpoint(defaultEndpointId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := ds.db.Collection(types.DbStackSettingsCollection)
+	if _, err := collection.Indexes().DropOne(ctx, "stackName_1"); err == nil {
+		glg.Infof("dropped legacy unique index on stackName")
+	}
+	res, err := collection.UpdateMany(ctx, bson.M{"endpointId": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"endpointId": defaultEndpointId}})
+	if err != nil {
+		return err
+	}
+	if res.ModifiedCount > 0 {
+		glg.Infof("assigned %d stack settings to endpoint %d", res.ModifiedCount, defaultEndpointId)
+	}
+	return nil
+}
+
+func (ds *DataStore) CreateJob(job *types.StackUpdateJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbJobsCollection).InsertOne(ctx, job)
+	return err
+}
+
+func (ds *DataStore) UpdateJob(job *types.StackUpdateJob) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbJobsCollection).ReplaceOne(ctx, bson.M{"_id": job.Id}, job)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("No job found with id %s", job.Id)
+	}
+	return nil
+}
+
+func (ds *DataStore) GetJob(id string) (*types.StackUpdateJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var job types.StackUpdateJob
+	err := ds.db.Collection(types.DbJobsCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, werrors.NewDoesNotExistError(err, "empty response")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func jobFilterQuery(filter *types.JobFilter) bson.M {
+	query := bson.M{}
+	if filter.EndpointId != 0 {
+		query["endpointId"] = filter.EndpointId
+	}
+	if filter.StackId != 0 {
+		query["stackId"] = filter.StackId
+	}
+	if filter.StackName != "" {
+		query["stackName"] = filter.StackName
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.TriggeredBy != "" {
+		query["triggeredBy"] = filter.TriggeredBy
+	}
+	queuedAt := bson.M{}
+	if filter.From != 0 {
+		queuedAt["$gte"] = filter.From
+	}
+	if filter.To != 0 {
+		queuedAt["$lte"] = filter.To
+	}
+	if len(queuedAt) > 0 {
+		query["queuedAt"] = queuedAt
+	}
+	return query
+}
+
+func (ds *DataStore) ListJobs(filter *types.JobFilter) ([]types.StackUpdateJob, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := ds.db.Collection(types.DbJobsCollection)
+	query := jobFilterQuery(filter)
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	findOptions := options.Find().SetSort(bson.D{primitive.E{Key: "_id", Value: -1}}).SetSkip(int64(filter.Offset))
+	if filter.Limit > 0 {
+		findOptions.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	jobs := make([]types.StackUpdateJob, 0)
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, 0, err
+	}
+	return jobs, int(total), nil
+}
+
+func (ds *DataStore) RecordNotification(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbNotificationsCollection).InsertOne(ctx, bson.M{"_id": key, "sentAt": time.Now().Unix()})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ds *DataStore) ForgetNotification(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbNotificationsCollection).DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+func (ds *DataStore) CreateAccount(account *types.Account) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbAccountsCollection).InsertOne(ctx, account)
+	if mongo.IsDuplicateKeyError(err) {
+		return werrors.NewCannotInsertError(err, fmt.Sprintf("account %s already exists", account.UserName))
+	}
+	return err
+}
+
+func (ds *DataStore) GetAccount(userName string) (*types.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var account types.Account
+	err := ds.db.Collection(types.DbAccountsCollection).FindOne(ctx, bson.M{"_id": userName}).Decode(&account)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("account %s", userName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (ds *DataStore) GetAllAccounts() ([]types.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := ds.db.Collection(types.DbAccountsCollection).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{primitive.E{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	accounts := make([]types.Account, 0)
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (ds *DataStore) UpdateAccount(account *types.Account) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbAccountsCollection).ReplaceOne(ctx, bson.M{"_id": account.UserName}, account)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return werrors.NewDoesNotExistError(mongo.ErrNoDocuments, fmt.Sprintf("account %s", account.UserName))
+	}
+	return nil
+}
+
+// UseTotpStep matches totpLastStep with $not so accounts without a stored step match as well
+func (ds *DataStore) UseTotpStep(userName string, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": userName, "totpLastStep": bson.M{"$not": bson.M{"$gte": step}}}
+	res, err := ds.db.Collection(types.DbAccountsCollection).UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totpLastStep": step}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (ds *DataStore) UseRecoveryCode(userName string, hash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": userName, "recoveryCodes": hash}
+	res, err := ds.db.Collection(types.DbAccountsCollection).UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"recoveryCodes": hash}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (ds *DataStore) DeleteAccount(userName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbAccountsCollection).DeleteOne(ctx, bson.M{"_id": userName})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return werrors.NewDoesNotExistError(mongo.ErrNoDocuments, fmt.Sprintf("account %s", userName))
+	}
+	return nil
+}
+
+func (ds *DataStore) CreateApiToken(token *types.ApiToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbApiTokensCollection).InsertOne(ctx, token)
+	return err
+}
+
+func (ds *DataStore) GetApiToken(id string) (*types.ApiToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var token types.ApiToken
+	err := ds.db.Collection(types.DbApiTokensCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("api token %s", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (ds *DataStore) ListApiTokens(owner string) ([]types.ApiToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if owner != "" {
+		query["owner"] = owner
+	}
+	cursor, err := ds.db.Collection(types.DbApiTokensCollection).Find(ctx, query, options.Find().SetSort(bson.D{primitive.E{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tokens := make([]types.ApiToken, 0)
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (ds *DataStore) UpdateApiToken(token *types.ApiToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbApiTokensCollection).ReplaceOne(ctx, bson.M{"_id": token.Id}, token)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return werrors.NewDoesNotExistError(mongo.ErrNoDocuments, fmt.Sprintf("api token %s", token.Id))
+	}
+	return nil
+}
+
+func (ds *DataStore) CreateSession(session *types.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbSessionsCollection).InsertOne(ctx, session)
+	return err
+}
+
+func (ds *DataStore) GetSession(id string) (*types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var session types.Session
+	err := ds.db.Collection(types.DbSessionsCollection).FindOne(ctx, bson.M{"_id": id}).Decode(&session)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, werrors.NewDoesNotExistError(err, fmt.Sprintf("session %s", id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (ds *DataStore) ListSessions(userName string) ([]types.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if userName != "" {
+		query["userName"] = userName
+	}
+	cursor, err := ds.db.Collection(types.DbSessionsCollection).Find(ctx, query, options.Find().SetSort(bson.D{primitive.E{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := make([]types.Session, 0)
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (ds *DataStore) UpdateSession(session *types.Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbSessionsCollection).ReplaceOne(ctx, bson.M{"_id": session.Id}, session)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return werrors.NewDoesNotExistError(mongo.ErrNoDocuments, fmt.Sprintf("session %s", session.Id))
+	}
+	return nil
+}
+
+func (ds *DataStore) TouchSession(id string, lastSeenAt int64, expiresAt int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	set := bson.M{"lastSeenAt": lastSeenAt}
+	if expiresAt != 0 {
+		set["expiresAt"] = expiresAt
+	}
+	res, err := ds.db.Collection(types.DbSessionsCollection).UpdateOne(ctx, bson.M{"_id": id, "revokedAt": 0}, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+func (ds *DataStore) DeleteSessionsExpiredBefore(timestamp int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := ds.db.Collection(types.DbSessionsCollection).DeleteMany(ctx, bson.M{"expiresAt": bson.M{"$lt": timestamp}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (ds *DataStore) GetSecurityPolicy() (*types.SecurityPolicy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var policy types.SecurityPolicy
+	err := ds.db.Collection(types.DbSettingsCollection).FindOne(ctx, bson.M{"_id": types.SecurityPolicyKey}).Decode(&policy)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (ds *DataStore) UpdateSecurityPolicy(policy *types.SecurityPolicy) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbSettingsCollection).ReplaceOne(ctx, bson.M{"_id": types.SecurityPolicyKey}, policy, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (ds *DataStore) AppendAudit(entry *types.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := ds.db.Collection(types.DbAuditCollection).InsertOne(ctx, entry)
+	return err
+}
+
+func auditFilterQuery(filter *types.AuditFilter) bson.M {
+	query := bson.M{}
+	if filter.UserName != "" {
+		query["userName"] = filter.UserName
+	}
+	if filter.Action != "" {
+		query["action"] = bson.M{"$regex": "^" + regexp.QuoteMeta(filter.Action) + `(\.|$)`}
+	}
+	if filter.Target != "" {
+		query["target"] = filter.Target
+	}
+	if filter.Result != "" {
+		query["result"] = filter.Result
+	}
+	timestamp := bson.M{}
+	if filter.From != 0 {
+		timestamp["$gte"] = filter.From
+	}
+	if filter.To != 0 {
+		timestamp["$lte"] = filter.To
+	}
+	if len(timestamp) > 0 {
+		query["timestamp"] = timestamp
+	}
+	return query
+}
+
+func (ds *DataStore) ListAudit(filter *types.AuditFilter) ([]types.AuditEntry, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := ds.db.Collection(types.DbAuditCollection)
+	query := auditFilterQuery(filter)
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	findOptions := options.Find().SetSort(bson.D{primitive.E{Key: "_id", Value: -1}}).SetSkip(int64(filter.Offset))
+	if filter.Limit > 0 {
+		findOptions.SetLimit(int64(filter.Limit))
+	}
+	cursor, err := collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	entries := make([]types.AuditEntry, 0)
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	return entries, int(total), nil
+}
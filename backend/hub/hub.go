@@ -0,0 +1,144 @@
+// Package hub fans out typed events to websocket clients. Every event is published on a topic and
+// numbered, the last events are kept so reconnecting clients can resume after the last sequence
+// number they received instead of loading a full snapshot. Sequence numbers restart with every hub,
+// the epoch of the hub tells clients whether a sequence number is still meaningful.
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"washboard/types"
+)
+
+// historySize is the number of events kept for resuming clients
+const historySize = 1024
+
+// subscriptionBuffer is the number of events a subscriber may lag behind before it is dropped
+const subscriptionBuffer = 256
+
+type Hub struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	history     []types.WsEnvelope
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the events of its topics on Events. Events is closed when the subscriber
+// lagged too far behind or Close was called.
+type Subscription struct {
+	Events chan types.WsEnvelope
+	topics map[string]bool
+	hub    *Hub
+}
+
+func New() *Hub {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return &Hub{
+		epoch:       hex.EncodeToString(buf),
+		history:     make([]types.WsEnvelope, 0, historySize),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+var defaultHub = New()
+
+// Publish sends an event to the subscribers of topic on the default hub, see Hub.Publish
+func Publish(topic string, msgType string, data interface{}) uint64 {
+	return defaultHub.Publish(topic, msgType, data)
+}
+
+// Subscribe subscribes to the default hub, see Hub.Subscribe
+func Subscribe(topics []string, epoch string, since uint64) (*Subscription, []types.WsEnvelope, uint64, bool) {
+	return defaultHub.Subscribe(topics, epoch, since)
+}
+
+// Epoch returns the epoch of the default hub, see Hub.Epoch
+func Epoch() string {
+	return defaultHub.Epoch()
+}
+
+// Epoch identifies the hub, its sequence numbers are only meaningful together with it
+func (h *Hub) Epoch() string {
+	return h.epoch
+}
+
+// Publish numbers an event, keeps it for resuming clients and sends it to the subscribers of
+// topic. Subscribers that lag behind are dropped so they reconnect and resume. Returns the
+// sequence number of the event.
+func (h *Hub) Publish(topic string, msgType string, data interface{}) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	event := types.WsEnvelope{Epoch: h.epoch, Seq: h.seq, Topic: topic, Type: msgType, Time: time.Now().Unix(), Data: data}
+	if len(h.history) == historySize {
+		copy(h.history, h.history[1:])
+		h.history = h.history[:historySize-1]
+	}
+	h.history = append(h.history, event)
+	for subscription := range h.subscribers {
+		if !subscription.Wants(topic) {
+			continue
+		}
+		select {
+		case subscription.Events <- event:
+		default:
+			h.drop(subscription)
+		}
+	}
+	return h.seq
+}
+
+// Subscribe registers a subscriber for topics, all topics if empty. If since is a sequence
+// number of this hub's epoch still kept, the events after it are returned for replay and resumed
+// is true. Otherwise the caller has to send a snapshot; seq is the sequence number the snapshot is
+// current with.
+func (h *Hub) Subscribe(topics []string, epoch string, since uint64) (subscription *Subscription, replay []types.WsEnvelope, seq uint64, resumed bool) {
+	subscription = &Subscription{Events: make(chan types.WsEnvelope, subscriptionBuffer), topics: make(map[string]bool), hub: h}
+	for _, topic := range topics {
+		subscription.topics[topic] = true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[subscription] = struct{}{}
+
+	// events after since are only complete if the event following since is still kept
+	oldest := h.seq + 1
+	if len(h.history) > 0 {
+		oldest = h.history[0].Seq
+	}
+	if epoch != h.epoch || since == 0 || since > h.seq || since+1 < oldest {
+		return subscription, nil, h.seq, false
+	}
+	replay = make([]types.WsEnvelope, 0)
+	for _, event := range h.history {
+		if event.Seq > since && subscription.Wants(event.Topic) {
+			replay = append(replay, event)
+		}
+	}
+	return subscription, replay, h.seq, true
+}
+
+// Close unsubscribes, Events is closed
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s)
+}
+
+// Wants reports whether the subscription receives the events of topic
+func (s *Subscription) Wants(topic string) bool {
+	return len(s.topics) == 0 || s.topics[topic]
+}
+
+// drop removes a subscriber, the caller holds mu
+func (h *Hub) drop(subscription *Subscription) {
+	if _, ok := h.subscribers[subscription]; ok {
+		delete(h.subscribers, subscription)
+		close(subscription.Events)
+	}
+}
@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"testing"
+)
+
+func TestSubscribeResumesFromHistory(t *testing.T) {
+	h := New()
+	for i := 0; i < historySize+10; i++ {
+		h.Publish("a", "event", i)
+	}
+	h.Publish("b", "event", "b")
+	last := h.Publish("a", "event", "last")
+
+	subscription, replay, seq, resumed := h.Subscribe([]string{"a"}, h.Epoch(), last-3)
+	defer subscription.Close()
+	if !resumed || seq != last || len(replay) != 2 || replay[0].Seq != last-2 || replay[1].Seq != last {
+		t.Fatalf("expected the events of topic a after %d, got %v %+v", last-3, resumed, replay)
+	}
+
+	// the events after 5 were dropped from the history
+	if _, _, _, resumed := h.Subscribe(nil, h.Epoch(), 5); resumed {
+		t.Fatal("expected a snapshot for a sequence number no longer kept")
+	}
+	if _, _, _, resumed := h.Subscribe(nil, h.Epoch(), last+1); resumed {
+		t.Fatal("expected a snapshot for an unknown sequence number")
+	}
+	if _, replay, _, resumed := h.Subscribe(nil, h.Epoch(), last); !resumed || len(replay) != 0 {
+		t.Fatalf("expected nothing to replay for the last event, got %+v", replay)
+	}
+	// sequence numbers restart with every hub, a restarted backend does not know them
+	if _, _, _, resumed := New().Subscribe(nil, h.Epoch(), last); resumed {
+		t.Fatal("expected a snapshot for the epoch of another hub")
+	}
+	if _, _, _, resumed := h.Subscribe(nil, "", last); resumed {
+		t.Fatal("expected a snapshot without an epoch")
+	}
+
+	h.Publish("b", "event", "filtered")
+	next := h.Publish("a", "event", "next")
+	if event := <-subscription.Events; event.Seq != next || event.Data != "next" {
+		t.Fatalf("expected only events of topic a, got %+v", event)
+	}
+}
+
+func TestLaggingSubscriberIsDropped(t *testing.T) {
+	h := New()
+	subscription, _, _, _ := h.Subscribe(nil, h.Epoch(), 0)
+	for i := 0; i <= subscriptionBuffer; i++ {
+		h.Publish("a", "event", i)
+	}
+	received := 0
+	for range subscription.Events {
+		received++
+	}
+	if received != subscriptionBuffer {
+		t.Fatalf("expected the buffered events before the subscription was closed, got %d", received)
+	}
+	// closing a dropped subscription is a no-op
+	subscription.Close()
+}
@@ -0,0 +1,89 @@
+// Package metrics holds the Prometheus collectors washboard exposes on /metrics.
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "washboard"
+
+var (
+	// StackContainers counts the containers of a stack by image status (outdated, updated, error)
+	StackContainers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stack_containers",
+		Help:      "Containers per stack by image status as of the last image status check.",
+	}, []string{"endpoint", "stack", "status"})
+
+	UpdateJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "update_jobs_total",
+		Help:      "Finished stack update and rollback jobs by outcome.",
+	}, []string{"outcome"})
+
+	UpdateJobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "update_job_duration_seconds",
+		Help:      "Duration of stack update and rollback jobs from start to finish by outcome.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"outcome"})
+
+	PortainerRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "portainer_request_duration_seconds",
+		Help:      "Latency of Portainer API requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	PortainerRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "portainer_request_errors_total",
+		Help:      "Failed Portainer API requests by method, route and status code (0 if no response was received).",
+	}, []string{"method", "route", "code"})
+
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Lookups in the image status caches by cache and result (hit, miss).",
+	}, []string{"cache", "result"})
+
+	WebsocketClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_clients",
+		Help:      "Currently connected websocket clients.",
+	})
+)
+
+// SetStackContainers replaces the container counts of all stacks of an endpoint
+func SetStackContainers(endpointId int, counts map[string]map[string]int) {
+	endpoint := strconv.Itoa(endpointId)
+	StackContainers.DeletePartialMatch(prometheus.Labels{"endpoint": endpoint})
+	for stack, statuses := range counts {
+		for status, count := range statuses {
+			StackContainers.WithLabelValues(endpoint, stack, status).Set(float64(count))
+		}
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. If token is not empty, scrapes
+// have to send it as bearer token.
+func Handler(token string) gin.HandlerFunc {
+	handler := promhttp.Handler()
+	return func(c *gin.Context) {
+		if token != "" {
+			expected := "Bearer " + token
+			if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte(expected)) != 1 {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code": "UNAUTHORIZED", "message": "invalid metrics token"})
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
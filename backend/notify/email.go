@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"washboard/state"
+)
+
+// emailNotifier sends the event as plain text mail. STARTTLS is used if the server offers it.
+type emailNotifier struct {
+	name     string
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func newEmailNotifier(name string, config state.NotifierConfig) (*emailNotifier, error) {
+	if config.SmtpHost == "" || config.From == "" || len(config.To) == 0 {
+		return nil, errors.New("email notifier requires smtp_host, from and to")
+	}
+	port := config.SmtpPort
+	if port == 0 {
+		port = 587
+	}
+	return &emailNotifier{
+		name:     name,
+		addr:     net.JoinHostPort(config.SmtpHost, strconv.Itoa(port)),
+		host:     config.SmtpHost,
+		username: config.SmtpUsername,
+		password: config.SmtpPassword,
+		from:     config.From,
+		to:       config.To,
+	}, nil
+}
+
+func (n *emailNotifier) Name() string {
+	return n.name
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, event Event) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	// net/smtp does not take a context, run it so a hanging server can not block past ctx
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(n.addr, auth, n.from, n.to, n.message(event))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *emailNotifier) message(event Event) []byte {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [washboard] %s\r\n", event.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Unix(event.Timestamp, 0).Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(event.Text(), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return []byte(msg.String())
+}
@@ -0,0 +1,224 @@
+// Package notify delivers washboard events like outdated images and failed updates to
+// webhooks, chat services, email and push services configured in secrets.yaml.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"washboard/state"
+
+	"github.com/kpango/glg"
+)
+
+const (
+	EventImageOutdated = "image_outdated"
+	EventUpdateFailed  = "update_failed"
+)
+
+// Event is a single notification. Title and Message are human readable, the remaining
+// fields are for consumers of the generic JSON webhook.
+type Event struct {
+	Kind       string          `json:"kind"`
+	Title      string          `json:"title"`
+	Message    string          `json:"message"`
+	EndpointId int             `json:"endpointId"`
+	StackName  string          `json:"stackName"`
+	JobId      string          `json:"jobId,omitempty"`
+	Images     []OutdatedImage `json:"images,omitempty"`
+	Timestamp  int64           `json:"timestamp"`
+}
+
+// OutdatedImage is an image a stack runs for which a newer version is available. Digest is the
+// digest of the newer version if the registry could be asked for it.
+type OutdatedImage struct {
+	Image      string   `json:"image"`
+	Digest     string   `json:"digest,omitempty"`
+	Containers []string `json:"containers"`
+}
+
+// Notifier delivers events to one target
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event Event) error
+}
+
+const notifyTimeout = 30 * time.Second
+
+var httpClient = &http.Client{Timeout: notifyTimeout}
+
+var notifiers []filteredNotifier
+var notifiersOnce sync.Once
+var notifiersMu sync.RWMutex
+
+// filteredNotifier only passes the event kinds it is configured for
+type filteredNotifier struct {
+	Notifier
+	events []string
+}
+
+func (f filteredNotifier) accepts(kind string) bool {
+	if len(f.events) == 0 {
+		return true
+	}
+	for _, event := range f.events {
+		if event == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// New returns the notifier for a config entry
+func New(config state.NotifierConfig) (Notifier, error) {
+	name := config.Name
+	if name == "" {
+		name = config.Type
+	}
+	switch config.Type {
+	case "webhook":
+		return &webhookNotifier{name: name, url: config.Url, headers: config.Headers}, nil
+	case "discord":
+		return &chatNotifier{name: name, url: config.Url, field: "content"}, nil
+	case "slack":
+		return &chatNotifier{name: name, url: config.Url, field: "text"}, nil
+	case "email":
+		return newEmailNotifier(name, config)
+	case "ntfy":
+		return &ntfyNotifier{name: name, url: config.Url, token: config.Token, priority: config.Priority}, nil
+	case "gotify":
+		return &gotifyNotifier{name: name, url: config.Url, token: config.Token, priority: config.Priority}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q", config.Type)
+	}
+}
+
+func loadNotifiers() {
+	notifiersOnce.Do(func() {
+		configured := make([]filteredNotifier, 0)
+		for _, config := range state.Instance().Config.Notifiers {
+			notifier, err := New(config)
+			if err != nil {
+				glg.Errorf("Skipping notifier: %s", err)
+				continue
+			}
+			configured = append(configured, filteredNotifier{Notifier: notifier, events: config.Events})
+		}
+		if len(configured) > 0 {
+			glg.Infof("%d notifiers configured", len(configured))
+		}
+		notifiersMu.Lock()
+		notifiers = configured
+		notifiersMu.Unlock()
+	})
+}
+
+// SetNotifiers replaces the configured notifiers, e.g. in tests
+func SetNotifiers(replacement ...Notifier) {
+	notifiersOnce.Do(func() {})
+	configured := make([]filteredNotifier, 0, len(replacement))
+	for _, notifier := range replacement {
+		configured = append(configured, filteredNotifier{Notifier: notifier})
+	}
+	notifiersMu.Lock()
+	notifiers = configured
+	notifiersMu.Unlock()
+}
+
+// Accepts reports whether any notifier accepts events of kind
+func Accepts(kind string) bool {
+	loadNotifiers()
+	notifiersMu.RLock()
+	defer notifiersMu.RUnlock()
+	for _, notifier := range notifiers {
+		if notifier.accepts(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatch sends event to every notifier accepting its kind in the background. Failures are logged.
+func Dispatch(event Event) {
+	go Deliver(event)
+}
+
+// Deliver sends event to every notifier accepting its kind in parallel and waits for them. It
+// reports whether at least one notifier delivered the event, failures are logged.
+func Deliver(event Event) bool {
+	loadNotifiers()
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+	notifiersMu.RLock()
+	targets := notifiers
+	notifiersMu.RUnlock()
+	var wg sync.WaitGroup
+	var delivered atomic.Bool
+	for _, notifier := range targets {
+		if !notifier.accepts(event.Kind) {
+			continue
+		}
+		wg.Add(1)
+		go func(notifier Notifier) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, event); err != nil {
+				glg.Errorf("Failed to send %s notification via %s: %s", event.Kind, notifier.Name(), err)
+				return
+			}
+			delivered.Store(true)
+		}(notifier.Notifier)
+	}
+	wg.Wait()
+	return delivered.Load()
+}
+
+// Text renders an event as plain text for chat, email and push notifiers
+func (e Event) Text() string {
+	var text strings.Builder
+	text.WriteString(e.Message)
+	for _, image := range e.Images {
+		fmt.Fprintf(&text, "\n- %s (%s)", image.Image, strings.Join(image.Containers, ", "))
+	}
+	return text.String()
+}
+
+// postJson posts body as JSON and fails on non-2xx answers
+func postJson(ctx context.Context, url string, headers map[string]string, body interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return send(req)
+}
+
+func send(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"washboard/state"
+)
+
+type capturedRequest struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+func TestHttpNotifiers(t *testing.T) {
+	requests := make(chan capturedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- capturedRequest{path: r.URL.Path, headers: r.Header, body: string(body)}
+	}))
+	defer server.Close()
+
+	event := Event{
+		Kind:      EventImageOutdated,
+		Title:     "Updates available for web",
+		Message:   "Stack web in endpoint 1 runs 1 outdated images:",
+		StackName: "web",
+		Images:    []OutdatedImage{{Image: "nginx:latest", Containers: []string{"web-nginx-1"}}},
+	}
+	cases := []struct {
+		config state.NotifierConfig
+		check  func(t *testing.T, request capturedRequest)
+	}{
+		{state.NotifierConfig{Type: "webhook", Url: server.URL, Headers: map[string]string{"X-Secret": "s3cret"}}, func(t *testing.T, request capturedRequest) {
+			var received Event
+			if err := json.Unmarshal([]byte(request.body), &received); err != nil || received.StackName != "web" || request.headers.Get("X-Secret") != "s3cret" {
+				t.Errorf("unexpected webhook request: %+v", request)
+			}
+		}},
+		{state.NotifierConfig{Type: "discord", Url: server.URL}, func(t *testing.T, request capturedRequest) {
+			var message map[string]string
+			if err := json.Unmarshal([]byte(request.body), &message); err != nil || !strings.Contains(message["content"], "- nginx:latest (web-nginx-1)") {
+				t.Errorf("unexpected discord message: %s", request.body)
+			}
+		}},
+		{state.NotifierConfig{Type: "slack", Url: server.URL}, func(t *testing.T, request capturedRequest) {
+			var message map[string]string
+			if err := json.Unmarshal([]byte(request.body), &message); err != nil || !strings.Contains(message["text"], event.Title) {
+				t.Errorf("unexpected slack message: %s", request.body)
+			}
+		}},
+		{state.NotifierConfig{Type: "ntfy", Url: server.URL + "/washboard", Token: "tk", Priority: 4}, func(t *testing.T, request capturedRequest) {
+			if request.path != "/washboard" || request.headers.Get("Title") != event.Title || request.headers.Get("Priority") != "4" || request.headers.Get("Authorization") != "Bearer tk" {
+				t.Errorf("unexpected ntfy request: %+v", request)
+			}
+		}},
+		{state.NotifierConfig{Type: "gotify", Url: server.URL + "/", Token: "app-token"}, func(t *testing.T, request capturedRequest) {
+			if request.path != "/message" || request.headers.Get("X-Gotify-Key") != "app-token" || !strings.Contains(request.body, `"title":"Updates available for web"`) {
+				t.Errorf("unexpected gotify request: %+v", request)
+			}
+		}},
+	}
+	for _, c := range cases {
+		notifier, err := New(c.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := notifier.Notify(context.Background(), event); err != nil {
+			t.Fatalf("%s: %s", c.config.Type, err)
+		}
+		c.check(t, <-requests)
+	}
+}
+
+func TestNewRejectsIncompleteConfig(t *testing.T) {
+	for _, config := range []state.NotifierConfig{{Type: "pager"}, {Type: "email", SmtpHost: "mail.example.com"}} {
+		if _, err := New(config); err == nil {
+			t.Errorf("expected %+v to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// webhookNotifier posts the event as JSON
+type webhookNotifier struct {
+	name    string
+	url     string
+	headers map[string]string
+}
+
+func (n *webhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, event Event) error {
+	return postJson(ctx, n.url, n.headers, event)
+}
+
+// chatNotifier posts the event as a message to a Discord or Slack incoming webhook. Both only
+// differ in the name of the text field.
+type chatNotifier struct {
+	name  string
+	url   string
+	field string
+}
+
+func (n *chatNotifier) Name() string {
+	return n.name
+}
+
+func (n *chatNotifier) Notify(ctx context.Context, event Event) error {
+	return postJson(ctx, n.url, nil, map[string]string{
+		n.field: fmt.Sprintf("**%s**\n%s", event.Title, event.Text()),
+	})
+}
+
+// ntfyNotifier publishes the event to an ntfy topic
+type ntfyNotifier struct {
+	name     string
+	url      string
+	token    string
+	priority int
+}
+
+func (n *ntfyNotifier) Name() string {
+	return n.name
+}
+
+func (n *ntfyNotifier) Notify(ctx context.Context, event Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, strings.NewReader(event.Text()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", event.Title)
+	req.Header.Set("Tags", event.Kind)
+	if n.priority > 0 {
+		req.Header.Set("Priority", strconv.Itoa(n.priority))
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	return send(req)
+}
+
+// gotifyNotifier sends the event as a Gotify message
+type gotifyNotifier struct {
+	name     string
+	url      string
+	token    string
+	priority int
+}
+
+func (n *gotifyNotifier) Name() string {
+	return n.name
+}
+
+func (n *gotifyNotifier) Notify(ctx context.Context, event Event) error {
+	return postJson(ctx, strings.TrimRight(n.url, "/")+"/message", map[string]string{"X-Gotify-Key": n.token}, map[string]interface{}{
+		"title":    event.Title,
+		"message":  event.Text(),
+		"priority": n.priority,
+	})
+}
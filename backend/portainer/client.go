@@ -0,0 +1,456 @@
+package portainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"washboard/metrics"
+	"washboard/types"
+	"washboard/werrors"
+)
+
+// Client is the typed interface to the Portainer API. Every call takes a context so callers
+// can cancel or bound it; non-2xx answers are returned as *werrors.PortainerError.
+type Client interface {
+	GetEndpoints(ctx context.Context) ([]Endpoint, error)
+	GetStacks(ctx context.Context, endpointId int) ([]Stack, error)
+	GetStack(ctx context.Context, stackId int) (*Stack, error)
+	GetStackFile(ctx context.Context, stackId int) (string, error)
+	GetStackImagesStatus(ctx context.Context, stackId int) (*ImageStatus, error)
+	UpdateStack(ctx context.Context, endpointId int, stackId int, request *UpdateStackRequest) (*Stack, error)
+	StartStack(ctx context.Context, endpointId int, stackId int) (*Stack, error)
+	StopStack(ctx context.Context, endpointId int, stackId int) (*Stack, error)
+	GetContainers(ctx context.Context, endpointId int, stackName string) ([]Container, error)
+	GetContainerImageStatus(ctx context.Context, endpointId int, containerId string) (*ImageStatus, error)
+	RecreateContainer(ctx context.Context, endpointId int, containerId string, request *RecreateContainerRequest) (*Container, error)
+	ContainerAction(ctx context.Context, endpointId int, containerId string, action types.ContainerAction) error
+	GetImage(ctx context.Context, endpointId int, imageId string) (*Image, error)
+	GetImageDistribution(ctx context.Context, endpointId int, image string) (*Distribution, error)
+	// StreamEvents follows the docker container events of an endpoint from since on and calls
+	// handle for each of them. It blocks until ctx is cancelled or Portainer ends the stream.
+	StreamEvents(ctx context.Context, endpointId int, since time.Time, handle func(DockerEvent)) error
+	InspectContainer(ctx context.Context, endpointId int, containerId string) (*ContainerDetails, error)
+	// ContainerLogs opens the raw docker log stream of a container, see DemuxLogs. The caller
+	// closes it.
+	ContainerLogs(ctx context.Context, endpointId int, containerId string, options ContainerLogsOptions) (io.ReadCloser, error)
+	CreateExec(ctx context.Context, endpointId int, containerId string, request *ExecCreateRequest) (string, error)
+	// StartExec starts an exec instance with a TTY and returns the hijacked connection to it:
+	// writes go to its stdin, reads return its output. The caller closes it.
+	StartExec(ctx context.Context, endpointId int, execId string) (io.ReadWriteCloser, error)
+	ResizeExec(ctx context.Context, endpointId int, execId string, rows int, cols int) error
+	InspectExec(ctx context.Context, endpointId int, execId string) (*ExecDetails, error)
+	// ContainerStats returns a single stats reading of a container without waiting for a second
+	// one, the CPU usage has to be computed from consecutive readings
+	ContainerStats(ctx context.Context, endpointId int, containerId string) (*ContainerStats, error)
+}
+
+const defaultClientTimeout = 30 * time.Second
+
+// sharedTransport is reused by every client so connections to Portainer are pooled
+var sharedTransport = &http.Transport{
+	Proxy:               http.ProxyFromEnvironment,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 20,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+type httpClient struct {
+	baseUrl string
+	apiKey  string
+	http    *http.Client
+	// streaming has no timeout, it is used for responses that stay open like the event stream
+	streaming *http.Client
+}
+
+// NewClient returns a Client talking to the Portainer API at baseUrl, authenticated with apiKey.
+// A timeout <= 0 falls back to 30 seconds.
+func NewClient(baseUrl string, apiKey string, timeout time.Duration) Client {
+	if timeout <= 0 {
+		timeout = defaultClientTimeout
+	}
+	return &httpClient{
+		baseUrl: strings.TrimRight(baseUrl, "/"),
+		apiKey:  apiKey,
+		http: &http.Client{
+			Transport: sharedTransport,
+			Timeout:   timeout,
+		},
+		streaming: &http.Client{Transport: sharedTransport},
+	}
+}
+
+func (c *httpClient) GetEndpoints(ctx context.Context) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	err := c.do(ctx, http.MethodGet, "/endpoints", nil, nil, &endpoints)
+	return endpoints, err
+}
+
+func (c *httpClient) GetStacks(ctx context.Context, endpointId int) ([]Stack, error) {
+	q := url.Values{}
+	q.Add("filters", fmt.Sprintf(`{"EndpointId":%d}`, endpointId))
+	var stacks []Stack
+	err := c.do(ctx, http.MethodGet, "/stacks", q, nil, &stacks)
+	return stacks, err
+}
+
+func (c *httpClient) GetStack(ctx context.Context, stackId int) (*Stack, error) {
+	var stack Stack
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/stacks/%d", stackId), nil, nil, &stack); err != nil {
+		return nil, err
+	}
+	return &stack, nil
+}
+
+func (c *httpClient) GetStackFile(ctx context.Context, stackId int) (string, error) {
+	var stackFile StackFile
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/stacks/%d/file", stackId), nil, nil, &stackFile); err != nil {
+		return "", err
+	}
+	return stackFile.StackFileContent, nil
+}
+
+func (c *httpClient) GetStackImagesStatus(ctx context.Context, stackId int) (*ImageStatus, error) {
+	var status ImageStatus
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/stacks/%d/images_status", stackId), nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *httpClient) UpdateStack(ctx context.Context, endpointId int, stackId int, request *UpdateStackRequest) (*Stack, error) {
+	q := url.Values{}
+	q.Add("endpointId", fmt.Sprintf("%d", endpointId))
+	var stack Stack
+	if err := c.do(ctx, http.MethodPut, fmt.Sprintf("/stacks/%d", stackId), q, request, &stack); err != nil {
+		return nil, err
+	}
+	return &stack, nil
+}
+
+func (c *httpClient) StartStack(ctx context.Context, endpointId int, stackId int) (*Stack, error) {
+	return c.startOrStopStack(ctx, endpointId, stackId, "start")
+}
+
+func (c *httpClient) StopStack(ctx context.Context, endpointId int, stackId int) (*Stack, error) {
+	return c.startOrStopStack(ctx, endpointId, stackId, "stop")
+}
+
+func (c *httpClient) startOrStopStack(ctx context.Context, endpointId int, stackId int, startOrStop string) (*Stack, error) {
+	q := url.Values{}
+	q.Add("endpointId", fmt.Sprintf("%d", endpointId))
+	reqBody := map[string]interface{}{"endpointId": endpointId, "id": fmt.Sprintf("%d", stackId)}
+	var stack Stack
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/stacks/%d/%s", stackId, startOrStop), q, reqBody, &stack); err != nil {
+		return nil, err
+	}
+	return &stack, nil
+}
+
+func (c *httpClient) GetContainers(ctx context.Context, endpointId int, stackName string) ([]Container, error) {
+	q := url.Values{}
+	q.Add("all", "true")
+	if stackName != "" {
+		filters, err := json.Marshal(map[string][]string{"label": {types.StackLabel + "=" + stackName}})
+		if err != nil {
+			return nil, err
+		}
+		q.Add("filters", string(filters))
+	}
+	var containers []Container
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/containers/json", endpointId), q, nil, &containers)
+	return containers, err
+}
+
+func (c *httpClient) GetContainerImageStatus(ctx context.Context, endpointId int, containerId string) (*ImageStatus, error) {
+	var status ImageStatus
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/docker/%d/containers/%s/image_status", endpointId, containerId), nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (c *httpClient) RecreateContainer(ctx context.Context, endpointId int, containerId string, request *RecreateContainerRequest) (*Container, error) {
+	var container Container
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/docker/%d/containers/%s/recreate", endpointId, containerId), nil, request, &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+func (c *httpClient) ContainerAction(ctx context.Context, endpointId int, containerId string, action types.ContainerAction) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/endpoints/%d/docker/containers/%s/%s", endpointId, containerId, action), nil, struct{}{}, nil)
+}
+
+func (c *httpClient) GetImage(ctx context.Context, endpointId int, imageId string) (*Image, error) {
+	var image Image
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/images/%s/json", endpointId, imageId), nil, nil, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// GetImageDistribution asks the registry of image for the manifest the reference currently points to
+func (c *httpClient) GetImageDistribution(ctx context.Context, endpointId int, image string) (*Distribution, error) {
+	var distribution Distribution
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/distribution/%s/json", endpointId, image), nil, nil, &distribution); err != nil {
+		return nil, err
+	}
+	return &distribution, nil
+}
+
+func (c *httpClient) StreamEvents(ctx context.Context, endpointId int, since time.Time, handle func(DockerEvent)) error {
+	q := url.Values{}
+	q.Add("since", strconv.FormatInt(since.Unix(), 10))
+	q.Add("filters", `{"type":["container"]}`)
+	resp, err := c.stream(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/events", endpointId), q, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event DockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read event: %w", err)
+		}
+		handle(event)
+	}
+}
+
+func (c *httpClient) InspectContainer(ctx context.Context, endpointId int, containerId string) (*ContainerDetails, error) {
+	var container ContainerDetails
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/containers/%s/json", endpointId, containerId), nil, nil, &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+func (c *httpClient) ContainerLogs(ctx context.Context, endpointId int, containerId string, options ContainerLogsOptions) (io.ReadCloser, error) {
+	q := url.Values{}
+	q.Add("follow", strconv.FormatBool(options.Follow))
+	q.Add("stdout", strconv.FormatBool(options.Stdout))
+	q.Add("stderr", strconv.FormatBool(options.Stderr))
+	q.Add("timestamps", strconv.FormatBool(options.Timestamps))
+	if options.Since > 0 {
+		q.Add("since", strconv.FormatInt(options.Since, 10))
+	}
+	if options.Tail != "" {
+		q.Add("tail", options.Tail)
+	}
+	resp, err := c.stream(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/containers/%s/logs", endpointId, containerId), q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *httpClient) CreateExec(ctx context.Context, endpointId int, containerId string, request *ExecCreateRequest) (string, error) {
+	var created ExecCreateResponse
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/endpoints/%d/docker/containers/%s/exec", endpointId, containerId), nil, request, &created); err != nil {
+		return "", err
+	}
+	return created.Id, nil
+}
+
+func (c *httpClient) StartExec(ctx context.Context, endpointId int, execId string) (io.ReadWriteCloser, error) {
+	// docker hands over the connection to the process if the request asks for an upgrade
+	header := http.Header{}
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", "tcp")
+	reqBody := map[string]interface{}{"Detach": false, "Tty": true}
+	resp, err := c.stream(ctx, http.MethodPost, fmt.Sprintf("/endpoints/%d/docker/exec/%s/start", endpointId, execId), nil, reqBody, header)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		resp.Body.Close()
+		return nil, fmt.Errorf("exec %s was not attached, portainer answered %d instead of upgrading", execId, resp.StatusCode)
+	}
+	return conn, nil
+}
+
+func (c *httpClient) ResizeExec(ctx context.Context, endpointId int, execId string, rows int, cols int) error {
+	q := url.Values{}
+	q.Add("h", strconv.Itoa(rows))
+	q.Add("w", strconv.Itoa(cols))
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/endpoints/%d/docker/exec/%s/resize", endpointId, execId), q, nil, nil)
+}
+
+func (c *httpClient) InspectExec(ctx context.Context, endpointId int, execId string) (*ExecDetails, error) {
+	var exec ExecDetails
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/exec/%s/json", endpointId, execId), nil, nil, &exec); err != nil {
+		return nil, err
+	}
+	return &exec, nil
+}
+
+func (c *httpClient) ContainerStats(ctx context.Context, endpointId int, containerId string) (*ContainerStats, error) {
+	q := url.Values{}
+	q.Add("stream", "false")
+	q.Add("one-shot", "true")
+	var stats ContainerStats
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/endpoints/%d/docker/containers/%s/stats", endpointId, containerId), q, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// do performs a request against the Portainer API. reqBody is marshalled to JSON if not nil,
+// and the response is unmarshalled into out if out is not nil. Non-2xx responses are decoded
+// into a *werrors.PortainerError.
+func (c *httpClient) do(ctx context.Context, method string, path string, query url.Values, reqBody interface{}, out interface{}) error {
+	var bodyReader io.Reader
+	if reqBody != nil {
+		encoded, err := json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		bodyReader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, bodyReader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if len(query) > 0 {
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Header.Set("X-API-Key", c.apiKey)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	route := routeTemplate(path)
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		metrics.PortainerRequestErrors.WithLabelValues(method, route, "0").Inc()
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	metrics.PortainerRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.PortainerRequestErrors.WithLabelValues(method, route, "0").Inc()
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		metrics.PortainerRequestErrors.WithLabelValues(method, route, strconv.Itoa(resp.StatusCode)).Inc()
+		return decodeError(resp.StatusCode, respBody)
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
+
+// stream sends a request without the client timeout and returns the response with its body unread,
+// the caller closes it. reqBody is marshalled to JSON if not nil and header is added to the request.
+// Responses other than 2xx and 101 Switching Protocols are decoded into a *werrors.PortainerError.
+func (c *httpClient) stream(ctx context.Context, method string, path string, query url.Values, reqBody interface{}, header http.Header) (*http.Response, error) {
+	var bodyReader io.Reader
+	if reqBody != nil {
+		encoded, err := json.Marshal(reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		bodyReader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if len(query) > 0 {
+		req.URL.RawQuery = query.Encode()
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("X-API-Key", c.apiKey)
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	route := routeTemplate(path)
+	resp, err := c.streaming.Do(req)
+	if err != nil {
+		metrics.PortainerRequestErrors.WithLabelValues(method, route, "0").Inc()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		defer resp.Body.Close()
+		metrics.PortainerRequestErrors.WithLabelValues(method, route, strconv.Itoa(resp.StatusCode)).Inc()
+		respBody, _ := io.ReadAll(resp.Body)
+		return nil, decodeError(resp.StatusCode, respBody)
+	}
+	return resp, nil
+}
+
+// routeTemplate replaces the ids in path with placeholders so metrics are recorded per route,
+// e.g. /endpoints/1/docker/containers/abc/start becomes /endpoints/{id}/docker/containers/{id}/start
+func routeTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i := 0; i < len(segments); i++ {
+		segment := segments[i]
+		if segment == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = "{id}"
+			continue
+		}
+		if i == 0 {
+			continue
+		}
+		switch segments[i-1] {
+		case "containers", "images", "exec":
+			if segment != "json" && segment != "create" {
+				segments[i] = "{id}"
+			}
+		case "distribution":
+			// image references contain slashes, collapse everything up to the trailing /json
+			end := len(segments)
+			if segments[end-1] == "json" {
+				end--
+			}
+			segments = append(append(segments[:i], "{image}"), segments[end:]...)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func decodeError(statusCode int, body []byte) *werrors.PortainerError {
+	var errResp errorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Message == "" {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = http.StatusText(statusCode)
+		}
+		return werrors.NewPortainerError(statusCode, message, "")
+	}
+	return werrors.NewPortainerError(statusCode, errResp.Message, errResp.Details)
+}
@@ -0,0 +1,23 @@
+package portainer
+
+import "testing"
+
+func TestRouteTemplate(t *testing.T) {
+	cases := map[string]string{
+		"/stacks":                                                   "/stacks",
+		"/stacks/12/file":                                           "/stacks/{id}/file",
+		"/endpoints/1/docker/containers/json":                       "/endpoints/{id}/docker/containers/json",
+		"/endpoints/1/docker/containers/abc/start":                  "/endpoints/{id}/docker/containers/{id}/start",
+		"/endpoints/1/docker/events":                                "/endpoints/{id}/docker/events",
+		"/endpoints/1/docker/exec/f00d/resize":                      "/endpoints/{id}/docker/exec/{id}/resize",
+		"/endpoints/1/docker/containers/c0ffee/stats":               "/endpoints/{id}/docker/containers/{id}/stats",
+		"/docker/1/containers/abc/image_status":                     "/docker/{id}/containers/{id}/image_status",
+		"/endpoints/1/docker/images/sha256:ff/json":                 "/endpoints/{id}/docker/images/{id}/json",
+		"/endpoints/1/docker/distribution/ghcr.io/org/app:1.2/json": "/endpoints/{id}/docker/distribution/{image}/json",
+	}
+	for path, expected := range cases {
+		if route := routeTemplate(path); route != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, route)
+		}
+	}
+}
@@ -1,52 +1,35 @@
 package portainer
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"washboard/db"
 	"washboard/helper"
+	"washboard/hub"
+	"washboard/metrics"
 	"washboard/types"
 
 	"github.com/kpango/glg"
 	"github.com/patrickmn/go-cache"
 )
 
+func init() {
+	// clients drop expired update statuses from their queue
+	appState.StackUpdateQueue.OnEvicted(func(key string, value interface{}) {
+		hub.Publish(types.WsTopicStackUpdates, types.WsMsgStackUpdateRemoved, value)
+	})
+}
+
 // GetEndpointId returns the id of the endpoint with the given name, which is also the environment in Portainer
 func GetEndpointId(endpointName string) (int, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/endpoints", appState.Config.PortainerUrl), nil)
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return -1, err
-	}
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return -1, err
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return -1, err
-	}
-
-	var endpoints []types.EndpointDto
-	err = json.Unmarshal(body, &endpoints)
+	endpoints, err := client.GetEndpoints(context.Background())
 	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
+		glg.Errorf("Failed to get endpoints: %s", err)
 		return -1, err
 	}
 
@@ -60,13 +43,13 @@ func GetEndpointId(endpointName string) (int, error) {
 	return -1, nil
 }
 
-// StartBackgroundUpdateCheck starts a background job that checks for updates every 24 hours.
+// StartBackgroundUpdateCheck starts a background job that checks the given endpoints for updates every 24 hours.
 // All refreshes go through Refresh.TriggerRefresh so they are deduplicated against any
 // in-flight refresh started by the API trigger.
-func StartBackgroundUpdateCheck(endpointId int) {
+func StartBackgroundUpdateCheck(endpointIds []int) {
 	go func() {
-		glg.Info("Starting background update check...")
-		Refresh.TriggerRefresh(endpointId)
+		glg.Infof("Starting background update check for endpoints %v...", endpointIds)
+		Refresh.TriggerRefresh(endpointIds...)
 		ticker := time.NewTicker(24 * time.Hour)
 		for range ticker.C {
 			if val, found := fallbackCache.Get(FallbackCacheLastUpdatedKey); found {
@@ -78,13 +61,13 @@ func StartBackgroundUpdateCheck(endpointId int) {
 				}
 			}
 
-			Refresh.TriggerRefresh(endpointId)
+			Refresh.TriggerRefresh(endpointIds...)
 		}
 	}()
 }
 
 func runUpdateCheck(endpointId int) {
-	glg.Info("Running background update check")
+	glg.Infof("Running background update check for endpoint %d", endpointId)
 	stacks, err := GetStacks(endpointId, true)
 	if err != nil {
 		glg.Errorf("Failed to get stacks for background update check: %s", err)
@@ -154,89 +137,48 @@ func runUpdateCheck(endpointId int) {
 		}
 	}
 	fallbackCache.Set(FallbackCacheLastUpdatedKey, time.Now(), cache.NoExpiration)
+	recordStackContainers(endpointId, stacks)
+	notifyOutdated(endpointId, stacks)
 	glg.Info("Background update check finished")
 }
 
 // GetStacks returns the stacks for the given endpoint
 func GetStacks(endpointId int, skeletonOnly bool) ([]types.StackDto, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/stacks", appState.Config.PortainerUrl), nil)
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return nil, err
-	}
-
-	q := req.URL.Query()
-	q.Add("filters", fmt.Sprintf(`{"EndpointId":%d}`, endpointId))
-	req.URL.RawQuery = q.Encode()
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-
-	resp, err := client.Do(req)
+	stacks, err := client.GetStacks(context.Background(), endpointId)
 	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return nil, err
-	}
-
-	var stacks []map[string]interface{}
-	err = json.Unmarshal(body, &stacks)
-	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
+		glg.Errorf("Failed to get stacks: %s", err)
 		return nil, err
 	}
 
 	countCached := 0
 	countUncached := 0
-	var stacksDict = make(map[string]map[string]interface{})
+	stacksDict := make(map[string]Stack)
+	allImagesStatuses := make(map[string]string)
 	for _, stack := range stacks {
-		// TODO: add key to stack with all images status with caching. If the status here is updated, we can skip individual container checks
-		stackId := -1
-		if id, ok := stack["Id"]; !ok {
-			glg.Warnf("stack does not have id key")
+		if stack.Name == "" {
+			glg.Warnf("stack %d does not have a name", stack.Id)
 			continue
-		} else if val, ok := id.(float64); ok {
-			stackId = int(val)
 		}
-		if stackId == -1 {
-			glg.Warnf("stack id is not a number")
-			continue
-		}
-		var allImagesStatus string
 		// skip retrieval if only the stack skeleton is requested
+		var allImagesStatus string
 		if skeletonOnly {
-			stack["allImagesStatus"] = types.NotRequested
+			allImagesStatus = types.NotRequested
 		} else {
-			if val, ok := portainerCache.Get(fmt.Sprintf("stack-%d-images-status", stackId)); ok {
+			if val, ok := portainerCache.Get(fmt.Sprintf("stack-%d-images-status", stack.Id)); ok {
 				allImagesStatus = val.(string)
 				countCached++
 			} else {
-				allImagesStatus, err = GetStackImagesStatus(stackId)
+				allImagesStatus, err = GetStackImagesStatus(stack.Id)
 				if err != nil {
 					glg.Errorf("Failed to get stack images status: %s", err)
 					allImagesStatus = "error"
 				}
-				portainerCache.Set(fmt.Sprintf("stack-%d-images-status", stackId), allImagesStatus, cache.DefaultExpiration)
+				portainerCache.Set(fmt.Sprintf("stack-%d-images-status", stack.Id), allImagesStatus, cache.DefaultExpiration)
 				countUncached++
 			}
-			stack["allImagesStatus"] = allImagesStatus
-		}
-
-		if stackName, ok := stack["Name"]; !ok {
-			glg.Warnf("stack does not have name key")
-			continue
-		} else if stackNameString, ok := stackName.(string); !ok {
-			glg.Warnf("stack name is not a string")
-			continue
-		} else {
-			stacksDict[stackNameString] = stack
 		}
+		stacksDict[stack.Name] = stack
+		allImagesStatuses[stack.Name] = allImagesStatus
 	}
 
 	if skeletonOnly {
@@ -245,46 +187,19 @@ func GetStacks(endpointId int, skeletonOnly bool) ([]types.StackDto, error) {
 		glg.Infof("cached stack images status: %d, uncached stack images status: %d", countCached, countUncached)
 	}
 
-	stacksDto, err := buildStacksDto(stacksDict, endpointId)
+	stacksDto, err := buildStacksDto(stacksDict, allImagesStatuses, endpointId)
+	if err == nil && !skeletonOnly {
+		recordStackContainers(endpointId, stacksDto)
+	}
 
 	return stacksDto, err
 }
 
 // GetContainers returns the containers for the given endpoint. If stackName is provided, only the containers of the stack with the given label are returned, otherwise all containers are returned
 func GetContainers(endpointId int, stackName string) ([]*types.ContainerDto, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/endpoints/%d/docker/containers/json", appState.Config.PortainerUrl, endpointId), nil)
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return nil, err
-	}
-
-	q := req.URL.Query()
-	q.Add("all", "true")
-	if stackName != "" {
-		q.Add("filters", fmt.Sprintf(`{"label":["%s=%s"]}`, types.StackLabel, stackName))
-	}
-	req.URL.RawQuery = q.Encode()
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return nil, err
-	}
-
-	var containers []map[string]interface{}
-	err = json.Unmarshal(body, &containers)
+	containers, err := client.GetContainers(context.Background(), endpointId, stackName)
 	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
+		glg.Errorf("Failed to get containers: %s", err)
 		return nil, err
 	}
 
@@ -293,7 +208,7 @@ func GetContainers(endpointId int, stackName string) ([]*types.ContainerDto, err
 	return containersDto, nil
 }
 
-func buildStacksDto(stacks map[string]map[string]interface{}, endpointId int) ([]types.StackDto, error) {
+func buildStacksDto(stacks map[string]Stack, allImagesStatuses map[string]string, endpointId int) ([]types.StackDto, error) {
 	var stacksDto = make(map[string]*types.StackDto)
 	containers, err := GetContainers(endpointId, "")
 	if err != nil {
@@ -314,15 +229,15 @@ func buildStacksDto(stacks map[string]map[string]interface{}, endpointId int) ([
 		} else {
 			stackName = labelParsed
 		}
-		if val, ok := stacks[stackName]["allImagesStatus"]; ok {
-			if val.(string) == types.NotRequested {
+		if val, ok := allImagesStatuses[stackName]; ok {
+			if val == types.NotRequested {
 				// Check fallback cache
 				if cachedStatus, found := fallbackCache.Get(container.Id); found {
 					container.UpToDate = cachedStatus.(string)
 				} else {
 					container.UpToDate = types.NotRequested
 				}
-			} else if val.(string) != types.Updated {
+			} else if val != types.Updated {
 				queryImageStatusContainers = append(queryImageStatusContainers, container)
 			} else {
 				container.UpToDate = types.Updated
@@ -334,8 +249,9 @@ func buildStacksDto(stacks map[string]map[string]interface{}, endpointId int) ([
 			val.Containers = append(val.Containers, container)
 		} else if val, ok := stacks[stackName]; ok {
 			stacksDto[stackName] = &types.StackDto{
-				Id:         int(val["Id"].(float64)),
-				Name:       val["Name"].(string),
+				Id:         val.Id,
+				EndpointId: endpointId,
+				Name:       val.Name,
 				Containers: []*types.ContainerDto{container},
 			}
 		}
@@ -344,8 +260,9 @@ func buildStacksDto(stacks map[string]map[string]interface{}, endpointId int) ([
 	for key, value := range stacks {
 		if _, ok := stacksDto[key]; !ok {
 			stacksDto[key] = &types.StackDto{
-				Id:         int(value["Id"].(float64)),
-				Name:       value["Name"].(string),
+				Id:         value.Id,
+				EndpointId: endpointId,
+				Name:       value.Name,
 				Containers: make([]*types.ContainerDto, 0),
 			}
 		}
@@ -358,12 +275,26 @@ func buildStacksDto(stacks map[string]map[string]interface{}, endpointId int) ([
 		fallbackCache.Set(FallbackCacheLastUpdatedKey, time.Now(), cache.NoExpiration)
 	}
 
-	stackSettings, err := db.GetAllStackSettings()
+	stackSettings, err := db.GetEndpointStackSettings(endpointId)
 	if err == nil {
 		for _, stackSetting := range stackSettings {
 			if val, ok := stacksDto[stackSetting.StackName]; ok {
 				val.Priority = stackSetting.Priority
 				val.AutoStart = stackSetting.AutoStart
+				val.UpdatePolicy = stackSetting.UpdatePolicy
+				val.UpdateWindow = stackSetting.UpdateWindow
+				val.DependsOn = stackSetting.DependsOn
+				val.StartTimeout = stackSetting.StartTimeout
+			}
+		}
+	}
+
+	if groups, err := db.GetEndpointGroupSettings(endpointId); err == nil {
+		for _, group := range groups {
+			for _, stackName := range group.Stacks {
+				if val, ok := stacksDto[stackName]; ok {
+					val.Group = group.GroupName
+				}
 			}
 		}
 	}
@@ -376,18 +307,14 @@ func buildStacksDto(stacks map[string]map[string]interface{}, endpointId int) ([
 	return stacksDtoList, nil
 }
 
-func buildContainerDto(containers []map[string]interface{}) []*types.ContainerDto {
+func buildContainerDto(containers []Container) []*types.ContainerDto {
 	var containersDto []*types.ContainerDto
 	for _, container := range containers {
-		portsData := container["Ports"].([]interface{})
 		// Get unique public ports
 		uniquePorts := make(map[int]int)
-		for _, portData := range portsData {
-			portMap := portData.(map[string]interface{})
-			if publicPort, ok := portMap["PublicPort"].(float64); ok {
-				if privatePort, ok := portMap["PrivatePort"].(float64); ok {
-					uniquePorts[int(publicPort)] = int(privatePort)
-				}
+		for _, port := range container.Ports {
+			if port.PublicPort != 0 {
+				uniquePorts[port.PublicPort] = port.PrivatePort
 			}
 		}
 		outPorts := make([]string, 0, len(uniquePorts))
@@ -395,40 +322,57 @@ func buildContainerDto(containers []map[string]interface{}) []*types.ContainerDt
 			outPorts = append(outPorts, fmt.Sprintf("%d:%d", public, private))
 		}
 
-		networksData := container["NetworkSettings"].(map[string]interface{})["Networks"].(map[string]interface{})
-		networkNames := make([]string, 0, len(networksData))
-		for networkName := range networksData {
+		networkNames := make([]string, 0, len(container.NetworkSettings.Networks))
+		for networkName := range container.NetworkSettings.Networks {
 			networkNames = append(networkNames, networkName)
 		}
 
-		names, _ := container["Names"].([]interface{})
 		var name string
-		if len(names) > 0 {
-			if n, ok := names[0].(string); ok {
-				name = helper.RemoveFirstIfMatch(n, "/")
-			}
+		if len(container.Names) > 0 {
+			name = helper.RemoveFirstIfMatch(container.Names[0], "/")
 		}
 		if name == "" {
-			if id, ok := container["Id"].(string); ok && len(id) >= 12 {
-				name = id[:12]
+			if len(container.Id) >= 12 {
+				name = container.Id[:12]
 			}
 			glg.Warnf("container has no Names; falling back to id=%q", name)
 		}
+
+		labels := make(map[string]interface{}, len(container.Labels))
+		for key, value := range container.Labels {
+			labels[key] = value
+		}
 		containersDto = append(containersDto, &types.ContainerDto{
-			Id:       container["Id"].(string),
+			Id:       container.Id,
 			Name:     name,
-			Image:    container["Image"].(string),
+			Image:    container.Image,
 			UpToDate: "",
-			Status:   container["State"].(string),
+			Status:   container.State,
 			Ports:    outPorts,
 			Networks: networkNames,
-			Labels:   container["Labels"].(map[string]interface{}),
+			Labels:   labels,
+			Health:   containerHealth(container.Status),
+			Stats:    Stats.Latest(container.Id),
 		})
 	}
 
 	return containersDto
 }
 
+// containerHealth reads the health of a container from its docker status, e.g. "Up 2 minutes
+// (healthy)". Containers without a healthcheck have no health.
+func containerHealth(status string) string {
+	switch {
+	case strings.HasSuffix(status, "(health: starting)"):
+		return types.HealthStarting
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return types.HealthUnhealthy
+	case strings.HasSuffix(status, "(healthy)"):
+		return types.HealthHealthy
+	}
+	return ""
+}
+
 func queryContainerImageStatus(endpointId int, containersDto []*types.ContainerDto) {
 	// Fetch UpToDate status for each container
 	var wg sync.WaitGroup
@@ -489,119 +433,107 @@ func queryContainerImageStatus(endpointId int, containersDto []*types.ContainerD
 }
 
 func GetStackImagesStatus(stackId int) (string, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/stacks/%d/images_status", appState.Config.PortainerUrl, stackId), nil)
 	glg.Debugf("fetching images for stack %d", stackId)
+	imagesStatus, err := client.GetStackImagesStatus(context.Background(), stackId)
 	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return "", err
-	}
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return "", err
-	}
-
-	var imagesStatus map[string]interface{}
-	err = json.Unmarshal(body, &imagesStatus)
-	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
 		return "", err
 	}
-	if _, ok := imagesStatus["message"]; ok {
-		errorMessage := fmt.Sprintf("%s: %s", imagesStatus["message"], imagesStatus["details"])
-		return "", fmt.Errorf(errorMessage)
-	}
-	return imagesStatus["Status"].(string), nil
+	return imagesStatus.Status, nil
 }
 
 func GetImageStatus(endpointId int, containerId string) (string, error) {
 	glg.Debugf("fetching images for container %s in endpoint %d", containerId, endpointId)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/docker/%d/containers/%s/image_status", appState.Config.PortainerUrl, endpointId, containerId), nil)
+	imageStatus, err := client.GetContainerImageStatus(context.Background(), endpointId, containerId)
 	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return "", err
+		return "", fmt.Errorf("%s: %w", containerId, err)
 	}
+	return imageStatus.Status, nil
+}
 
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
+func UpdateContainer(endpointId int, containerId string, pullImage bool) (string, error) {
+	container, err := client.RecreateContainer(context.Background(), endpointId, containerId, &RecreateContainerRequest{PullImage: pullImage})
 	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return "", err
+		errorMessage := fmt.Sprintf("%s: %s", containerId, err)
+		glg.Error(errorMessage)
+		return "", errors.New(errorMessage)
 	}
+	return container.Id, nil
+}
 
-	defer resp.Body.Close()
+func getUpdateOperationId(endpointId int, stackId int) string {
+	return fmt.Sprintf("update-stack-%d-%d", endpointId, stackId)
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return "", err
+// GetUpdateStatus returns the status of the last update of a stack, if it is still known
+func GetUpdateStatus(endpointId int, stackId int) (types.StackUpdateStatus, bool) {
+	if val, ok := appState.StackUpdateQueue.Get(getUpdateOperationId(endpointId, stackId)); ok {
+		return val.(types.StackUpdateStatus), true
 	}
+	return types.StackUpdateStatus{}, false
+}
 
-	var container map[string]interface{}
-	err = json.Unmarshal(body, &container)
-	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
-		return "", err
+// updateClaims holds the operation ids of the stack updates being enqueued, from the queue check
+// until their job is queued
+var (
+	updateClaimsMu sync.Mutex
+	updateClaims   = make(map[string]bool)
+)
+
+// claimUpdate reserves the update of a stack unless one is already queued, running or being
+// enqueued. The returned function releases the claim, the queued job keeps further updates out.
+func claimUpdate(endpointId int, stackId int) (func(), error) {
+	id := getUpdateOperationId(endpointId, stackId)
+	updateClaimsMu.Lock()
+	defer updateClaimsMu.Unlock()
+	if updateClaims[id] {
+		glg.Infof("stack update already being enqueued: %s", id)
+		return nil, errors.New("stack update already queued")
 	}
-	if _, ok := container["message"]; ok {
-		errorMessage := fmt.Sprintf("%s: %s. %s", container["message"], containerId, container["details"])
-		return "", fmt.Errorf(errorMessage)
+	if err := checkNotQueued(endpointId, stackId); err != nil {
+		return nil, err
 	}
-	return container["Status"].(string), nil
+	updateClaims[id] = true
+	return func() {
+		updateClaimsMu.Lock()
+		defer updateClaimsMu.Unlock()
+		delete(updateClaims, id)
+	}, nil
 }
 
-func UpdateContainer(endpointId int, containerId string, pullImage bool) (string, error) {
-	client := &http.Client{}
-	reqBody := []byte(fmt.Sprintf("{\"PullImage\":%t}", pullImage))
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/docker/%d/containers/%s/recreate", appState.Config.PortainerUrl, endpointId, containerId), bytes.NewBuffer(reqBody))
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return "", err
+// checkNotQueued returns an error if an update of the stack is still queued or running
+func checkNotQueued(endpointId int, stackId int) error {
+	if val, ok := appState.StackUpdateQueue.Get(getUpdateOperationId(endpointId, stackId)); ok {
+		data := val.(types.StackUpdateStatus)
+		if data.Status != types.Error && data.Status != types.Done {
+			glg.Infof("stack update already queued: %s", val)
+			return errors.New("stack update already queued")
+		}
 	}
+	return nil
+}
 
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
+// getStackWithFile returns the stack and its compose file, verifying it belongs to endpointId
+func getStackWithFile(endpointId int, stackId int) (*Stack, string, error) {
+	stackData, err := client.GetStack(context.Background(), stackId)
 	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return "", err
+		glg.Errorf("Failed to get stack data: %s", err)
+		return nil, "", err
 	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return "", err
+	if stackData.EndpointId != endpointId {
+		glg.Errorf("stack endpoint id does not match")
+		return nil, "", fmt.Errorf("stack endpoint id does not match")
+	}
+	if stackData.Name == "" {
+		glg.Errorf("stack does not have name data")
+		return nil, "", fmt.Errorf("stack does not have name data")
 	}
 
-	var container map[string]interface{}
-	err = json.Unmarshal(body, &container)
+	stackFileContent, err := client.GetStackFile(context.Background(), stackId)
 	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
-		return "", err
-	}
-	if _, ok := container["message"]; ok {
-		errorMessage := fmt.Sprintf("%s: %s. %s", container["message"], containerId, container["details"])
-		glg.Error(errorMessage)
-		return "", fmt.Errorf(errorMessage)
+		glg.Errorf("Failed to get stack file: %s", err)
+		return nil, "", err
 	}
-	return container["Id"].(string), nil
-}
-
-func getUpdateOperationId(endpointId int, stackId int) string {
-	return fmt.Sprintf("update-stack-%d-%d", endpointId, stackId)
+	return stackData, stackFileContent, nil
 }
 
 // EnqueueUpdateStack enqueues a stack update operation. If the operation is already queued, it is not enqueued again
@@ -613,97 +545,76 @@ func getUpdateOperationId(endpointId int, stackId int) string {
 //   - stackId: the id of the stack to update
 //   - prune: whether to prune the stack
 //   - pullImage: whether to pull the image´
+//   - triggeredBy: the user or component that requested the update, recorded in the job history
 //
 // Creates a StackUpdateStatus object with the following values depending on the result of the operation:
 //   - Status: "queued", "done",
 //     "error"
 //   - Details: the error message if the operation fails
-func EnqueueUpdateStack(endpointId int, stackId int, prune bool, pullImage bool) (float64, error) {
-	id := getUpdateOperationId(endpointId, stackId)
-	if val, ok := appState.StackUpdateQueue.Get(id); ok {
-		data := val.(types.StackUpdateStatus)
-		if data.Status != types.Error && data.Status != types.Done {
-			glg.Infof("stack update already queued: %s", val)
-			retErr := errors.New("stack update already queued")
-			return -2, retErr
-		}
+//
+// Every update is persisted as a types.StackUpdateJob including a snapshot of the stack before the update.
+func EnqueueUpdateStack(endpointId int, stackId int, prune bool, pullImage bool, triggeredBy string) (float64, error) {
+	release, err := claimUpdate(endpointId, stackId)
+	if err != nil {
+		return -2, err
 	}
+	defer release()
 	glg.Infof("enqueueing stack id: %d, prune: %t", stackId, prune)
 
-	stackData, err := getStackRaw(stackId)
+	stackData, stackFileContent, err := getStackWithFile(endpointId, stackId)
 	if err != nil {
-		glg.Errorf("Failed to get stack data: %s", err)
 		return -1, err
 	}
-	if val, ok := stackData["EndpointId"]; !ok {
-		glg.Errorf("stack does not have endpoint id")
-		return -1, fmt.Errorf("stack does not have endpoint id")
-	} else if valInt, ok := val.(float64); !ok {
-		glg.Errorf("stack endpoint id is not a number")
-		return -1, fmt.Errorf("stack endpoint id is not a number")
-	} else if int(valInt) != endpointId {
-		glg.Errorf("stack endpoint id does not match")
-		return -1, fmt.Errorf("stack endpoint id does not match")
-	}
 
-	var stackNameString string
-	if stackName, ok := stackData["Name"]; !ok {
-		glg.Errorf("stack does not have name data")
-		return -1, fmt.Errorf("stack does not have name data")
-	} else if stackNameString, ok = stackName.(string); !ok {
-		glg.Errorf("stack name is not a string")
-		return -1, fmt.Errorf("stack name is not a string")
+	updateRequest := &UpdateStackRequest{
+		Env:              stackData.Env,
+		Id:               stackId,
+		Prune:            prune,
+		PullImage:        pullImage,
+		StackFileContent: unpinRollback(endpointId, stackId, stackFileContent),
+		Webhook:          stackData.Webhook,
 	}
 
-	stackFileContent, err := getStackFile(stackId)
-	if err != nil {
-		glg.Errorf("Failed to get stack file: %s", err)
-		return -1, err
+	job := &types.StackUpdateJob{
+		EndpointId:  endpointId,
+		StackId:     stackId,
+		StackName:   stackData.Name,
+		TriggeredBy: triggeredBy,
+		Prune:       prune,
+		PullImage:   pullImage,
+		StackFile:   stackFileContent,
+		Env:         toJobEnv(stackData.Env),
 	}
+	startUpdateJob(job, updateRequest)
 
-	//
-	//type RequestBody struct {
-	//	Env              interface{} `json:"Env"`
-	//	Id               int         `json:"id"`
-	//	Prune            bool        `json:"Prune"`
-	//	PullImage        bool        `json:"PullImage"`
-	//	StackFileContent string      `json:"StackFileContent"`
-	//	Webhook          string      `json:"Webhook"`
-	//}
-
-	envData, ok := stackData["Env"]
-	if !ok {
-		glg.Errorf("stack does not have env data")
-		return -1, fmt.Errorf("stack does not have env data")
-	}
-	webhook, ok := stackData["Webhook"]
-	if !ok {
-		glg.Errorf("stack does not have webhook data")
-		return -1, fmt.Errorf("stack does not have webhook data")
-	}
-	envDataByte, err := json.Marshal(envData)
-	if err != nil {
-		glg.Errorf("Failed to marshal env data: %s", err)
-		return -1, err
-	}
+	return float64(stackId), nil
+}
 
-	envDataString := string(envDataByte)
-	reqBodyRaw := fmt.Sprintf(`{"Env":%s,"id":%d,"Prune":%t,"PullImage":%t,"StackFileContent":"%s","Webhook":"%s"}`,
-		envDataString, stackId, prune, pullImage, stackFileContent, webhook)
-	//glg.Logf("%+v", reqBodyRaw)
-	reqBodyByte := []byte(reqBodyRaw)
+// startUpdateJob persists job as queued and runs updateRequest in the background. The images of the
+// stack are recorded before and after the update, progress is published on StackUpdateQueue.
+func startUpdateJob(job *types.StackUpdateJob, updateRequest *UpdateStackRequest) {
+	id := getUpdateOperationId(job.EndpointId, job.StackId)
+	job.Status = types.Queued
+	job.QueuedAt = time.Now().Unix()
+	saveJob(job, true)
+
+	updateStatus := types.StackUpdateStatus{
+		JobId:      job.Id,
+		EndpointId: job.EndpointId,
+		StackId:    job.StackId,
+		StackName:  job.StackName,
+		Status:     types.Queued,
+		Timestamp:  int64(time.Now().Unix()),
+		Details:    "",
+	}
+	appState.StackUpdateQueue.Set(id, updateStatus, time.Minute*30)
+	hub.Publish(types.WsTopicStackUpdates, types.WsMsgStackUpdate, updateStatus)
 
 	go func() {
-		updateStatus := types.StackUpdateStatus{
-			EndpointId: endpointId,
-			StackId:    stackId,
-			StackName:  stackNameString,
-			Status:     types.Queued,
-			Timestamp:  int64(time.Now().Unix()),
-			Details:    "",
-		}
-		appState.StackUpdateQueue.Set(id, updateStatus, time.Minute*30)
-		_, err := updateStack(endpointId, stackId, reqBodyByte)
+		job.ImagesBefore = stackImages(job.EndpointId, job.StackName)
+		started := time.Now()
+		job.StartedAt = started.Unix()
+		_, err := updateStack(job.EndpointId, job.StackId, updateRequest)
 		if err != nil {
 			glg.Errorf("No operation performed: %s", err)
 			updateStatus.Status = types.Error
@@ -711,125 +622,32 @@ func EnqueueUpdateStack(endpointId int, stackId int, prune bool, pullImage bool)
 		} else {
 			updateStatus.Status = types.Done
 		}
+		job.ImagesAfter = stackImages(job.EndpointId, job.StackName)
+		job.Status = updateStatus.Status
+		job.Details = updateStatus.Details
+		job.FinishedAt = time.Now().Unix()
+		metrics.UpdateJobs.WithLabelValues(job.Status).Inc()
+		metrics.UpdateJobDuration.WithLabelValues(job.Status).Observe(time.Since(started).Seconds())
+
 		updateStatus.Timestamp = int64(time.Now().Unix())
 		appState.StackUpdateQueue.Set(id, updateStatus, time.Hour*24*7)
+		hub.Publish(types.WsTopicStackUpdates, types.WsMsgStackUpdate, updateStatus)
+		saveJob(job, false)
+		if job.Status == types.Error {
+			notifyUpdateFailed(job)
+		}
 	}()
-
-	return float64(stackId), nil
 }
 
-func updateStack(endpointId int, stackId int, reqBodyByte []byte) (float64, error) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/stacks/%d", appState.Config.PortainerUrl, stackId), bytes.NewBuffer(reqBodyByte))
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return -1, err
-	}
-
-	q := req.URL.Query()
-	q.Add("endpointId", fmt.Sprintf("%d", endpointId))
-	req.URL.RawQuery = q.Encode()
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return -1, err
-	}
-
-	defer resp.Body.Close()
-
-	respBody, err := io.ReadAll(resp.Body)
+func updateStack(endpointId int, stackId int, updateRequest *UpdateStackRequest) (int, error) {
+	stack, err := client.UpdateStack(context.Background(), endpointId, stackId, updateRequest)
 	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return -1, err
-	}
-
-	var stack map[string]interface{}
-	err = json.Unmarshal(respBody, &stack)
-	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
-		return -1, err
-	}
-	if _, ok := stack["message"]; ok {
-		errorMessage := fmt.Sprintf("%s: %d. %s", stack["message"], stackId, stack["details"])
+		errorMessage := fmt.Sprintf("%d: %s", stackId, err)
 		glg.Error(errorMessage)
-		return -1, fmt.Errorf(errorMessage)
+		return -1, errors.New(errorMessage)
 	}
-	glg.Infof("Stack %s updated", stack["Name"])
+	glg.Infof("Stack %s updated", stack.Name)
 	// remove cached images status when an update was performed
 	portainerCache.Delete(fmt.Sprintf("stack-%d-images-status", stackId))
-	return stack["Id"].(float64), nil
-}
-
-func getStackRaw(stackId int) (map[string]interface{}, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/stacks/%d", appState.Config.PortainerUrl, stackId), nil)
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return nil, err
-	}
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return nil, err
-	}
-
-	var stack map[string]interface{}
-	err = json.Unmarshal(body, &stack)
-	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
-		return nil, err
-	}
-	return stack, nil
-}
-
-func getStackFile(stackId int) (string, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/stacks/%d/file", appState.Config.PortainerUrl, stackId), nil)
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return "", err
-	}
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return "", err
-	}
-
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return "", err
-	}
-
-	var stackFileContent map[string]string
-	err = json.Unmarshal(body, &stackFileContent)
-	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
-		return "", err
-	}
-
-	stackFileContentRaw := stackFileContent["StackFileContent"]
-	stackFileContentRaw = strings.ReplaceAll(stackFileContentRaw, "\\", "\\\\")
-	stackFileContentRaw = strings.ReplaceAll(stackFileContentRaw, "\n", "\\n")
-	stackFileContentRaw = strings.ReplaceAll(stackFileContentRaw, "\"", "\\\"")
-
-	return stackFileContentRaw, nil
+	return stack.Id, nil
 }
@@ -0,0 +1,40 @@
+package portainer
+
+import (
+	"testing"
+	"time"
+
+	"washboard/types"
+)
+
+func TestClaimUpdate(t *testing.T) {
+	id := getUpdateOperationId(1, 99)
+	t.Cleanup(func() { appState.StackUpdateQueue.Delete(id) })
+
+	release, err := claimUpdate(1, 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second update is refused while the first one is being enqueued
+	if _, err := claimUpdate(1, 99); err == nil {
+		t.Fatal("expected the second claim to be refused")
+	}
+	if other, err := claimUpdate(2, 99); err != nil {
+		t.Fatalf("expected a claim for another endpoint, got %s", err)
+	} else {
+		other()
+	}
+
+	// the queued job keeps further updates out once the claim is released
+	appState.StackUpdateQueue.Set(id, types.StackUpdateStatus{Status: types.Queued}, time.Minute)
+	release()
+	if _, err := claimUpdate(1, 99); err == nil {
+		t.Fatal("expected a claim to be refused while the update is queued")
+	}
+	appState.StackUpdateQueue.Set(id, types.StackUpdateStatus{Status: types.Done}, time.Minute)
+	release, err = claimUpdate(1, 99)
+	if err != nil {
+		t.Fatalf("expected a claim after the update is done, got %s", err)
+	}
+	release()
+}
@@ -0,0 +1,263 @@
+package portainer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"washboard/hub"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// eventRetryInterval is the pause before a broken event stream is reconnected. It doubles with
+// every failed attempt up to maxEventRetryInterval.
+const eventRetryInterval = time.Second
+const maxEventRetryInterval = time.Minute
+
+// ContainerStateModel keeps the live state of the containers of every watched endpoint. It is
+// loaded from the container list whenever the event stream of an endpoint connects and updated by
+// every docker event afterwards. Changes are published on the containers topic of the hub.
+type ContainerStateModel struct {
+	mu        sync.Mutex
+	endpoints map[int]*endpointContainers
+}
+
+type endpointContainers struct {
+	connected  bool
+	containers map[string]*types.ContainerState
+}
+
+var Live = &ContainerStateModel{endpoints: make(map[int]*endpointContainers)}
+
+// StartEventWatcher follows the docker events of the given endpoints until ctx is cancelled and
+// keeps Live current. Broken streams are reconnected.
+func StartEventWatcher(ctx context.Context, endpointIds []int) {
+	for _, endpointId := range endpointIds {
+		go watchEvents(ctx, endpointId)
+	}
+}
+
+func watchEvents(ctx context.Context, endpointId int) {
+	glg.Infof("Watching docker events of endpoint %d...", endpointId)
+	retry := eventRetryInterval
+	for {
+		connectedAt := time.Now()
+		err := followEvents(ctx, endpointId)
+		Live.disconnect(endpointId)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(connectedAt) > maxEventRetryInterval {
+			retry = eventRetryInterval
+		}
+		if err != nil {
+			glg.Warnf("docker event stream of endpoint %d failed, reconnecting in %s: %s", endpointId, retry, err)
+		} else {
+			glg.Infof("docker event stream of endpoint %d ended, reconnecting in %s", endpointId, retry)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(2*retry, maxEventRetryInterval)
+	}
+}
+
+// followEvents loads the containers of an endpoint and applies the docker events from then on
+// until the stream ends. Events of the second the containers were loaded in are applied again,
+// docker only filters by seconds, so no change is missed.
+func followEvents(ctx context.Context, endpointId int) error {
+	since := time.Now()
+	containers, err := client.GetContainers(ctx, endpointId, "")
+	if err != nil {
+		return err
+	}
+	Live.load(endpointId, containers)
+	return client.StreamEvents(ctx, endpointId, since, func(event DockerEvent) {
+		Live.apply(endpointId, event)
+	})
+}
+
+// load replaces the states of an endpoint with the listed containers and marks it connected
+func (m *ContainerStateModel) load(endpointId int, containers []Container) {
+	now := time.Now().Unix()
+	states := make(map[string]*types.ContainerState, len(containers))
+	for _, container := range buildContainerDto(containers) {
+		stackName, _ := container.Labels[types.StackLabel].(string)
+		states[container.Id] = &types.ContainerState{
+			EndpointId:  endpointId,
+			ContainerId: container.Id,
+			Name:        container.Name,
+			StackName:   stackName,
+			Status:      container.Status,
+			Health:      container.Health,
+			UpdatedAt:   now,
+		}
+	}
+	m.mu.Lock()
+	m.endpoints[endpointId] = &endpointContainers{connected: true, containers: states}
+	m.mu.Unlock()
+	m.publishEndpoint(endpointId)
+}
+
+// reset forgets the states of every endpoint
+func (m *ContainerStateModel) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endpoints = make(map[int]*endpointContainers)
+}
+
+// disconnect marks the states of an endpoint as possibly outdated until its stream reconnects
+func (m *ContainerStateModel) disconnect(endpointId int) {
+	m.mu.Lock()
+	endpoint, ok := m.endpoints[endpointId]
+	wasConnected := ok && endpoint.connected
+	if ok {
+		endpoint.connected = false
+	}
+	m.mu.Unlock()
+	if wasConnected {
+		m.publishEndpoint(endpointId)
+	}
+}
+
+// apply updates the state of the container of a docker event and publishes the change. Events that
+// do not change the state, e.g. a stop following a die, are not published.
+func (m *ContainerStateModel) apply(endpointId int, event DockerEvent) {
+	if event.Type != "container" || event.Actor.ID == "" {
+		return
+	}
+	// health changes are reported as "health_status: healthy"
+	action, argument, _ := strings.Cut(event.Action, ": ")
+
+	m.mu.Lock()
+	endpoint, ok := m.endpoints[endpointId]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	container, known := endpoint.containers[event.Actor.ID]
+	if !known {
+		container = &types.ContainerState{EndpointId: endpointId, ContainerId: event.Actor.ID, Status: "created"}
+	}
+	previous := *container
+	if name := event.Actor.Attributes["name"]; name != "" {
+		container.Name = name
+	}
+	if stackName, ok := event.Actor.Attributes[types.StackLabel]; ok {
+		container.StackName = stackName
+	}
+	switch action {
+	case "create":
+		container.Status = "created"
+	case "start", "restart", "unpause":
+		container.Status = types.ContainerRunning
+	case "pause":
+		container.Status = "paused"
+	case "die", "stop":
+		// like in the container list, stopped containers have no health
+		container.Status = "exited"
+		container.Health = ""
+	case "health_status":
+		container.Health = argument
+	case "destroy":
+	default:
+		m.mu.Unlock()
+		return
+	}
+	if action == "destroy" {
+		delete(endpoint.containers, container.ContainerId)
+	} else if *container == previous && known {
+		m.mu.Unlock()
+		return
+	} else {
+		container.UpdatedAt = time.Now().Unix()
+		endpoint.containers[container.ContainerId] = container
+	}
+	changed := types.ContainerStateEvent{Action: action, Container: *container}
+	if container.StackName != "" {
+		stack := m.stackState(endpoint, endpointId, container.StackName)
+		changed.Stack = &stack
+	}
+	m.mu.Unlock()
+	hub.Publish(types.WsTopicContainers, types.WsMsgContainerState, changed)
+}
+
+// stackState counts the containers of a stack, the caller holds mu
+func (m *ContainerStateModel) stackState(endpoint *endpointContainers, endpointId int, stackName string) types.StackState {
+	stack := types.StackState{EndpointId: endpointId, StackName: stackName}
+	for _, container := range endpoint.containers {
+		if container.StackName != stackName {
+			continue
+		}
+		stack.Containers++
+		if container.Status == types.ContainerRunning {
+			stack.Running++
+		}
+		if container.Health != "" {
+			stack.Healthchecks++
+			if container.Health == types.HealthHealthy {
+				stack.Healthy++
+			}
+		}
+	}
+	return stack
+}
+
+func (m *ContainerStateModel) publishEndpoint(endpointId int) {
+	if states, ok := m.Get(endpointId); ok {
+		hub.Publish(types.WsTopicContainers, types.WsMsgContainerStates, []types.EndpointContainerStates{states})
+	}
+}
+
+// Get returns the live states of the containers of an endpoint sorted by name
+func (m *ContainerStateModel) Get(endpointId int) (types.EndpointContainerStates, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endpoint, ok := m.endpoints[endpointId]
+	if !ok {
+		return types.EndpointContainerStates{}, false
+	}
+	states := types.EndpointContainerStates{EndpointId: endpointId, Connected: endpoint.connected, Containers: make([]types.ContainerState, 0, len(endpoint.containers))}
+	for _, container := range endpoint.containers {
+		states.Containers = append(states.Containers, *container)
+	}
+	sort.Slice(states.Containers, func(i, j int) bool {
+		return states.Containers[i].Name < states.Containers[j].Name
+	})
+	return states, true
+}
+
+// Stack returns the live state of a stack, false if the endpoint is not watched
+func (m *ContainerStateModel) Stack(endpointId int, stackName string) (types.StackState, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endpoint, ok := m.endpoints[endpointId]
+	if !ok {
+		return types.StackState{}, false
+	}
+	return m.stackState(endpoint, endpointId, stackName), true
+}
+
+// Snapshot returns the live states of the containers of every watched endpoint
+func (m *ContainerStateModel) Snapshot() []types.EndpointContainerStates {
+	m.mu.Lock()
+	endpointIds := make([]int, 0, len(m.endpoints))
+	for endpointId := range m.endpoints {
+		endpointIds = append(endpointIds, endpointId)
+	}
+	m.mu.Unlock()
+	sort.Ints(endpointIds)
+	snapshot := make([]types.EndpointContainerStates, 0, len(endpointIds))
+	for _, endpointId := range endpointIds {
+		if states, ok := m.Get(endpointId); ok {
+			snapshot = append(snapshot, states)
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,79 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// execRequestTimeout bounds the requests made for a running exec session, e.g. a resize
+const execRequestTimeout = 10 * time.Second
+
+// ExecSession is an interactive process with a TTY started in a container. Reading returns its
+// output, writing sends to its stdin. Close detaches from the process.
+type ExecSession struct {
+	Id         string
+	endpointId int
+	conn       io.ReadWriteCloser
+}
+
+// StartExecSession creates an exec instance of cmd in a running container and attaches to it.
+// user runs the process if not empty, the user of the container otherwise.
+func StartExecSession(ctx context.Context, endpointId int, containerId string, cmd []string, user string) (*ExecSession, error) {
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("exec requires a command")
+	}
+	execId, err := client.CreateExec(ctx, endpointId, containerId, &ExecCreateRequest{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		Cmd:          cmd,
+		User:         user,
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.StartExec(ctx, endpointId, execId)
+	if err != nil {
+		return nil, err
+	}
+	return &ExecSession{Id: execId, endpointId: endpointId, conn: conn}, nil
+}
+
+func (s *ExecSession) Read(p []byte) (int, error) {
+	return s.conn.Read(p)
+}
+
+func (s *ExecSession) Write(p []byte) (int, error) {
+	return s.conn.Write(p)
+}
+
+func (s *ExecSession) Close() error {
+	return s.conn.Close()
+}
+
+// Resize sets the size of the TTY of the process
+func (s *ExecSession) Resize(rows int, cols int) error {
+	if rows <= 0 || cols <= 0 {
+		return fmt.Errorf("invalid terminal size %dx%d", cols, rows)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execRequestTimeout)
+	defer cancel()
+	return client.ResizeExec(ctx, s.endpointId, s.Id, rows, cols)
+}
+
+// ExitCode returns the exit code of the process once it has ended
+func (s *ExecSession) ExitCode() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execRequestTimeout)
+	defer cancel()
+	exec, err := client.InspectExec(ctx, s.endpointId, s.Id)
+	if err != nil {
+		return 0, err
+	}
+	if exec.Running {
+		return 0, fmt.Errorf("exec %s is still running", s.Id)
+	}
+	return exec.ExitCode, nil
+}
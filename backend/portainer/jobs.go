@@ -0,0 +1,124 @@
+package portainer
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"washboard/db"
+	"washboard/helper"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// stackImages returns the image every container of a stack is currently running, including the
+// repo digest the container can be pinned to
+func stackImages(endpointId int, stackName string) []types.ContainerImage {
+	containers, err := client.GetContainers(context.Background(), endpointId, stackName)
+	if err != nil {
+		glg.Warnf("Failed to get images of stack %s: %s", stackName, err)
+		return nil
+	}
+	digests := make(map[string]string)
+	images := make([]types.ContainerImage, 0, len(containers))
+	for _, container := range containers {
+		var name string
+		if len(container.Names) > 0 {
+			name = helper.RemoveFirstIfMatch(container.Names[0], "/")
+		}
+		digest, ok := digests[container.ImageID]
+		if !ok && container.ImageID != "" {
+			digest = imageDigest(endpointId, container.Image, container.ImageID)
+			digests[container.ImageID] = digest
+		}
+		images = append(images, types.ContainerImage{
+			ContainerName: name,
+			Service:       container.Labels[types.ServiceLabel],
+			Image:         container.Image,
+			ImageId:       container.ImageID,
+			Digest:        digest,
+		})
+	}
+	return images
+}
+
+// imageDigest returns the repo digest of the image with imageId that belongs to the repository
+// of image, or an empty string for images that were never pushed to or pulled from a registry
+func imageDigest(endpointId int, image string, imageId string) string {
+	inspected, err := client.GetImage(context.Background(), endpointId, imageId)
+	if err != nil {
+		glg.Warnf("Failed to inspect image %s: %s", image, err)
+		return ""
+	}
+	repo := imageRepository(image)
+	for _, repoDigest := range inspected.RepoDigests {
+		if strings.HasPrefix(repoDigest, repo+"@") {
+			return repoDigest
+		}
+	}
+	if len(inspected.RepoDigests) == 1 {
+		return inspected.RepoDigests[0]
+	}
+	return ""
+}
+
+// imageRepository strips the tag and digest from an image reference
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func toJobEnv(env []EnvVar) []types.EnvVar {
+	jobEnv := make([]types.EnvVar, 0, len(env))
+	for _, envVar := range env {
+		jobEnv = append(jobEnv, types.EnvVar{Name: envVar.Name, Value: envVar.Value})
+	}
+	return jobEnv
+}
+
+func fromJobEnv(jobEnv []types.EnvVar) []EnvVar {
+	env := make([]EnvVar, 0, len(jobEnv))
+	for _, envVar := range jobEnv {
+		env = append(env, EnvVar{Name: envVar.Name, Value: envVar.Value})
+	}
+	return env
+}
+
+// saveJob persists a job. Failing to record the history must not fail the update itself.
+func saveJob(job *types.StackUpdateJob, create bool) {
+	var err error
+	if create {
+		err = db.CreateJob(job)
+	} else {
+		err = db.UpdateJob(job)
+	}
+	if err != nil {
+		glg.Errorf("Failed to save update job of stack %s: %s", job.StackName, err)
+	}
+}
+
+// RecoverInterruptedJobs marks jobs that were still queued when washboard stopped as failed
+func RecoverInterruptedJobs() error {
+	jobs, _, err := db.ListJobs(&types.JobFilter{Status: types.Queued})
+	if err != nil {
+		return err
+	}
+	for i := range jobs {
+		jobs[i].Status = types.Error
+		jobs[i].Details = "interrupted by a restart of washboard"
+		jobs[i].FinishedAt = time.Now().Unix()
+		if err := db.UpdateJob(&jobs[i]); err != nil {
+			return err
+		}
+	}
+	if len(jobs) > 0 {
+		glg.Warnf("marked %d interrupted update jobs as failed", len(jobs))
+	}
+	return nil
+}
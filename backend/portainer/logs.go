@@ -0,0 +1,142 @@
+package portainer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"washboard/types"
+)
+
+// logFrameHeaderSize is the size of the header docker prefixes every frame of the logs of a
+// container without a TTY with: the stream (1 stdout, 2 stderr), three zero bytes and the big
+// endian size of the payload
+const logFrameHeaderSize = 8
+
+// maxLogLineSize bounds lines without a newline, longer lines are split
+const maxLogLineSize = 64 * 1024
+
+// FollowContainerLogs streams the log lines of an inspected container to handle until ctx is
+// cancelled, the logs end or handle fails. With options.Timestamps the timestamp docker prefixes
+// every line with is split into LogLine.Timestamp. If filter is not nil only the lines matching it
+// are passed.
+func FollowContainerLogs(ctx context.Context, endpointId int, container *ContainerDetails, options ContainerLogsOptions, filter *regexp.Regexp, handle func(types.LogLine) error) error {
+	logs, err := client.ContainerLogs(ctx, endpointId, container.Id, options)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	err = DemuxLogs(logs, container.Config.Tty, func(stream string, text string) error {
+		line := types.LogLine{Stream: stream, Line: text}
+		if options.Timestamps {
+			line.Timestamp, line.Line, _ = strings.Cut(text, " ")
+		}
+		if filter != nil && !filter.MatchString(line.Line) {
+			return nil
+		}
+		return handle(line)
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// DemuxLogs splits a docker log stream into lines and calls handle for each of them with the
+// stream it was written to, types.LogStdout or types.LogStderr. The logs of containers with a TTY
+// are not multiplexed, all their lines are reported as stdout. Returns nil at the end of the
+// stream and the first error of handle. Frames are read in chunks, so the size in their header
+// does not decide how much memory is allocated.
+func DemuxLogs(r io.Reader, tty bool, handle func(stream string, line string) error) error {
+	stdout := &lineBuffer{stream: types.LogStdout, handle: handle}
+	stderr := &lineBuffer{stream: types.LogStderr, handle: handle}
+	buf := make([]byte, 32*1024)
+
+	if tty {
+		for {
+			n, err := r.Read(buf)
+			if writeErr := stdout.write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if errors.Is(err, io.EOF) {
+				return stdout.flush()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read logs: %w", err)
+			}
+		}
+	}
+
+	header := make([]byte, logFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				if err := stdout.flush(); err != nil {
+					return err
+				}
+				return stderr.flush()
+			}
+			return fmt.Errorf("failed to read log frame: %w", err)
+		}
+		var target *lineBuffer
+		switch header[0] {
+		case 1:
+			target = stdout
+		case 2:
+			target = stderr
+		default:
+			return fmt.Errorf("invalid log stream %d", header[0])
+		}
+		for remaining := int(binary.BigEndian.Uint32(header[4:])); remaining > 0; {
+			n, err := io.ReadFull(r, buf[:min(remaining, len(buf))])
+			if err != nil {
+				return fmt.Errorf("failed to read log frame: %w", err)
+			}
+			if err := target.write(buf[:n]); err != nil {
+				return err
+			}
+			remaining -= n
+		}
+	}
+}
+
+// lineBuffer collects the output of a stream until a line is complete
+type lineBuffer struct {
+	stream  string
+	pending []byte
+	handle  func(stream string, line string) error
+}
+
+func (b *lineBuffer) write(p []byte) error {
+	b.pending = append(b.pending, p...)
+	for {
+		i := bytes.IndexByte(b.pending, '\n')
+		if i < 0 {
+			if len(b.pending) >= maxLogLineSize {
+				return b.flush()
+			}
+			return nil
+		}
+		line := strings.TrimSuffix(string(b.pending[:i]), "\r")
+		b.pending = b.pending[i+1:]
+		if err := b.handle(b.stream, line); err != nil {
+			return err
+		}
+	}
+}
+
+// flush passes the incomplete last line, if any
+func (b *lineBuffer) flush() error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	line := string(b.pending)
+	b.pending = nil
+	return b.handle(b.stream, line)
+}
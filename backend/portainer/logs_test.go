@@ -0,0 +1,69 @@
+package portainer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func logFrame(stream byte, payload string) []byte {
+	header := make([]byte, logFrameHeaderSize)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemuxLogs(t *testing.T) {
+	var stream bytes.Buffer
+	// lines may be split across frames and frames may contain several lines
+	stream.Write(logFrame(1, "starting\nlisten"))
+	stream.Write(logFrame(2, "warning: no config\r\n"))
+	stream.Write(logFrame(1, "ing on :80\nready"))
+
+	lines := make([]string, 0)
+	collect := func(stream string, line string) error {
+		lines = append(lines, stream+" "+line)
+		return nil
+	}
+	if err := DemuxLogs(&stream, false, collect); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[stdout starting stderr warning: no config stdout listening on :80 stdout ready]"
+	if fmt.Sprint(lines) != expected {
+		t.Fatalf("expected %s, got %v", expected, lines)
+	}
+
+	lines = lines[:0]
+	if err := DemuxLogs(strings.NewReader("tty output\n\x01 raw"), true, collect); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(lines) != "[stdout tty output stdout \x01 raw]" {
+		t.Fatalf("expected the raw lines of a tty, got %q", lines)
+	}
+
+	if err := DemuxLogs(bytes.NewReader(logFrame(1, "truncated")[:10]), false, collect); err == nil {
+		t.Fatal("expected an error for a truncated frame")
+	}
+	// the size of a frame is not trusted, a huge frame is read in chunks until the stream ends
+	huge := logFrame(2, "short")
+	binary.BigEndian.PutUint32(huge[4:], 0xffffffff)
+	if err := DemuxLogs(bytes.NewReader(huge), false, collect); err == nil {
+		t.Fatal("expected an error for a frame longer than the stream")
+	}
+	lines = lines[:0]
+	if err := DemuxLogs(bytes.NewReader(logFrame(1, strings.Repeat("x", 100*1024)+"\n")), false, collect); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || len(lines[0]) != len("stdout ")+maxLogLineSize {
+		t.Fatalf("expected a long frame to be split at the line size limit, got %d lines", len(lines))
+	}
+
+	failing := func(stream string, line string) error {
+		return fmt.Errorf("client gone")
+	}
+	if err := DemuxLogs(bytes.NewReader(logFrame(1, "line\n")), false, failing); err == nil || err.Error() != "client gone" {
+		t.Fatalf("expected the error of handle, got %v", err)
+	}
+}
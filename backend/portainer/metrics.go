@@ -0,0 +1,27 @@
+package portainer
+
+import (
+	"washboard/metrics"
+	"washboard/types"
+)
+
+// recordStackContainers publishes the image status of every container of the given stacks as
+// known to fallbackCache. Containers without a status failed their last image status check.
+func recordStackContainers(endpointId int, stacks []types.StackDto) {
+	counts := make(map[string]map[string]int, len(stacks))
+	for _, stack := range stacks {
+		statuses := map[string]int{types.Outdated: 0, types.Updated: 0, types.Error: 0}
+		for _, container := range stack.Containers {
+			// bypass the metered Get, this is not a lookup of the update check
+			status := types.Error
+			if val, found := fallbackCache.Cache.Get(container.Id); found {
+				if s, ok := val.(string); ok && (s == types.Outdated || s == types.Updated) {
+					status = s
+				}
+			}
+			statuses[status]++
+		}
+		counts[stack.Name] = statuses
+	}
+	metrics.SetStackContainers(endpointId, counts)
+}
@@ -0,0 +1,197 @@
+package portainer
+
+import "time"
+
+// Typed request and response bodies of the Portainer API. Only the fields washboard
+// actually uses are declared; everything else in Portainer's responses is ignored.
+
+type Endpoint struct {
+	Id   int    `json:"Id"`
+	Name string `json:"Name"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type Stack struct {
+	Id         int      `json:"Id"`
+	Name       string   `json:"Name"`
+	EndpointId int      `json:"EndpointId"`
+	Status     int      `json:"Status"`
+	Env        []EnvVar `json:"Env"`
+	Webhook    string   `json:"Webhook"`
+}
+
+type StackFile struct {
+	StackFileContent string `json:"StackFileContent"`
+}
+
+// UpdateStackRequest is the body of PUT /stacks/{id}
+type UpdateStackRequest struct {
+	Env              []EnvVar `json:"Env"`
+	Id               int      `json:"id"`
+	Prune            bool     `json:"Prune"`
+	PullImage        bool     `json:"PullImage"`
+	StackFileContent string   `json:"StackFileContent"`
+	Webhook          string   `json:"Webhook"`
+}
+
+type ImageStatus struct {
+	Status  string `json:"Status"`
+	Message string `json:"Message"`
+}
+
+type RecreateContainerRequest struct {
+	PullImage bool `json:"PullImage"`
+}
+
+type ContainerPort struct {
+	IP          string `json:"IP"`
+	PrivatePort int    `json:"PrivatePort"`
+	PublicPort  int    `json:"PublicPort"`
+	Type        string `json:"Type"`
+}
+
+type ContainerNetworkSettings struct {
+	Networks map[string]interface{} `json:"Networks"`
+}
+
+// Container is an entry of the docker /containers/json list, proxied by Portainer
+type Container struct {
+	Id              string                   `json:"Id"`
+	Names           []string                 `json:"Names"`
+	Image           string                   `json:"Image"`
+	ImageID         string                   `json:"ImageID"`
+	State           string                   `json:"State"`
+	Status          string                   `json:"Status"`
+	Ports           []ContainerPort          `json:"Ports"`
+	Labels          map[string]string        `json:"Labels"`
+	NetworkSettings ContainerNetworkSettings `json:"NetworkSettings"`
+}
+
+// errorResponse is the body Portainer sends along with non-2xx status codes
+type errorResponse struct {
+	Message string `json:"message"`
+	Details string `json:"details"`
+}
+
+// Image is the answer of the docker image inspect endpoint
+type Image struct {
+	Id          string   `json:"Id"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+}
+
+// Distribution is the answer of the docker distribution inspect endpoint
+type Distribution struct {
+	Descriptor struct {
+		Digest string `json:"digest"`
+	} `json:"Descriptor"`
+}
+
+// DockerEvent is an entry of the docker /events stream, proxied by Portainer. Container events
+// carry the labels of the container and its name in Actor.Attributes.
+type DockerEvent struct {
+	Type     string     `json:"Type"`
+	Action   string     `json:"Action"`
+	Actor    EventActor `json:"Actor"`
+	Time     int64      `json:"time"`
+	TimeNano int64      `json:"timeNano"`
+}
+
+type EventActor struct {
+	ID         string            `json:"ID"`
+	Attributes map[string]string `json:"Attributes"`
+}
+
+// ContainerDetails is the answer of the docker container inspect endpoint
+type ContainerDetails struct {
+	Id     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Tty    bool              `json:"Tty"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Status  string `json:"Status"`
+		Running bool   `json:"Running"`
+	} `json:"State"`
+}
+
+// ContainerLogsOptions are the query parameters of the docker container logs endpoint. Tail is
+// the number of lines from the end or "all", Since a unix timestamp.
+type ContainerLogsOptions struct {
+	Follow     bool
+	Stdout     bool
+	Stderr     bool
+	Timestamps bool
+	Since      int64
+	Tail       string
+}
+
+// ExecCreateRequest is the body of the docker exec create endpoint
+type ExecCreateRequest struct {
+	AttachStdin  bool     `json:"AttachStdin"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+	Tty          bool     `json:"Tty"`
+	Cmd          []string `json:"Cmd"`
+	User         string   `json:"User,omitempty"`
+}
+
+type ExecCreateResponse struct {
+	Id string `json:"Id"`
+}
+
+// ExecDetails is the answer of the docker exec inspect endpoint
+type ExecDetails struct {
+	Id       string `json:"ID"`
+	Running  bool   `json:"Running"`
+	ExitCode int    `json:"ExitCode"`
+}
+
+// ContainerStats is a stats reading of a container. The counters are totals since the container
+// started, Networks is keyed by interface.
+type ContainerStats struct {
+	Read        time.Time               `json:"read"`
+	CpuStats    CpuStats                `json:"cpu_stats"`
+	MemoryStats MemoryStats             `json:"memory_stats"`
+	Networks    map[string]NetworkStats `json:"networks"`
+	BlkioStats  BlkioStats              `json:"blkio_stats"`
+}
+
+type CpuStats struct {
+	CpuUsage struct {
+		TotalUsage uint64 `json:"total_usage"`
+	} `json:"cpu_usage"`
+	SystemCpuUsage uint64 `json:"system_cpu_usage"`
+	OnlineCpus     int    `json:"online_cpus"`
+}
+
+// MemoryStats.Stats holds the cgroup memory counters, e.g. inactive_file (cgroup v2) or
+// total_inactive_file (cgroup v1)
+type MemoryStats struct {
+	Usage uint64            `json:"usage"`
+	Limit uint64            `json:"limit"`
+	Stats map[string]uint64 `json:"stats"`
+}
+
+type NetworkStats struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+type BlkioStats struct {
+	IoServiceBytesRecursive []BlkioStatEntry `json:"io_service_bytes_recursive"`
+}
+
+// BlkioStatEntry is the number of bytes read or written on a device, Op is "read" or "write"
+// (capitalized on cgroup v1)
+type BlkioStatEntry struct {
+	Major uint64 `json:"major"`
+	Minor uint64 `json:"minor"`
+	Op    string `json:"op"`
+	Value uint64 `json:"value"`
+}
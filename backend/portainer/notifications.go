@@ -0,0 +1,122 @@
+package portainer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"washboard/db"
+	"washboard/notify"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// notifyOutdated reports the outdated images of every stack whose update policy allows it. Every
+// image is only reported once per digest available in its registry, so a stack stays quiet until a
+// newer version than the one already reported is pushed. An image counts as reported once a
+// notifier delivered it, the stacks are reported in parallel and waited for.
+func notifyOutdated(endpointId int, stacks []types.StackDto) {
+	if !notify.Accepts(notify.EventImageOutdated) {
+		return
+	}
+	policies := make(map[string]string)
+	if settings, err := db.GetEndpointStackSettings(endpointId); err == nil {
+		for _, setting := range settings {
+			policies[setting.StackName] = setting.UpdatePolicy
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, stack := range stacks {
+		if policies[stack.Name] == types.UpdatePolicyNever {
+			continue
+		}
+		outdated := make(map[string]*notify.OutdatedImage)
+		for _, container := range stack.Containers {
+			if val, found := fallbackCache.Get(container.Id); !found || val.(string) != types.Outdated {
+				continue
+			}
+			if image, ok := outdated[container.Image]; ok {
+				image.Containers = append(image.Containers, container.Name)
+			} else {
+				outdated[container.Image] = &notify.OutdatedImage{Image: container.Image, Containers: []string{container.Name}}
+			}
+		}
+
+		images := make([]notify.OutdatedImage, 0, len(outdated))
+		keys := make([]string, 0, len(outdated))
+		for _, image := range outdated {
+			image.Digest = remoteDigest(endpointId, image.Image)
+			key := fmt.Sprintf("outdated/%d/%s@%s", endpointId, image.Image, image.Digest)
+			if image.Digest == "" {
+				// without a digest a new notification is sent once the containers were recreated
+				key = fmt.Sprintf("outdated/%d/%s/%s", endpointId, image.Image, strings.Join(image.Containers, ","))
+			}
+			isNew, err := db.RecordNotification(key)
+			if err != nil {
+				glg.Errorf("Failed to record notification %s: %s", key, err)
+				continue
+			}
+			if isNew {
+				images = append(images, *image)
+				keys = append(keys, key)
+			}
+		}
+		if len(images) == 0 {
+			continue
+		}
+		sort.Slice(images, func(i, j int) bool { return images[i].Image < images[j].Image })
+
+		event := notify.Event{
+			Kind:       notify.EventImageOutdated,
+			Title:      fmt.Sprintf("Updates available for %s", stack.Name),
+			Message:    fmt.Sprintf("Stack %s in endpoint %d runs %d outdated images:", stack.Name, endpointId, len(images)),
+			EndpointId: endpointId,
+			StackName:  stack.Name,
+			Images:     images,
+		}
+		wg.Add(1)
+		go func(event notify.Event, keys []string) {
+			defer wg.Done()
+			if notify.Deliver(event) {
+				return
+			}
+			// no notifier delivered the images, the next check reports them again
+			for _, key := range keys {
+				if err := db.ForgetNotification(key); err != nil {
+					glg.Errorf("Failed to forget notification %s: %s", key, err)
+				}
+			}
+		}(event, keys)
+	}
+	wg.Wait()
+}
+
+// remoteDigest returns the digest image currently points to in its registry, or an empty string
+func remoteDigest(endpointId int, image string) string {
+	distribution, err := client.GetImageDistribution(context.Background(), endpointId, image)
+	if err != nil {
+		glg.Debugf("Failed to get distribution of image %s: %s", image, err)
+		return ""
+	}
+	return distribution.Descriptor.Digest
+}
+
+// notifyUpdateFailed reports a stack update job that ended in an error
+func notifyUpdateFailed(job *types.StackUpdateJob) {
+	action := "Update"
+	if job.RollbackOf != "" {
+		action = "Rollback"
+	}
+	notify.Dispatch(notify.Event{
+		Kind:       notify.EventUpdateFailed,
+		Title:      fmt.Sprintf("%s of %s failed", action, job.StackName),
+		Message:    fmt.Sprintf("%s of stack %s in endpoint %d triggered by %s failed: %s", action, job.StackName, job.EndpointId, job.TriggeredBy, job.Details),
+		EndpointId: job.EndpointId,
+		StackName:  job.StackName,
+		JobId:      job.Id,
+	})
+}
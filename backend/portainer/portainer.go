@@ -2,17 +2,56 @@ package portainer
 
 import (
 	"time"
+	"washboard/metrics"
 	"washboard/state"
 
 	"github.com/patrickmn/go-cache"
 )
 
 var appState *state.Data = state.Instance()
-var portainerCache = declarePortainerCache()
-var fallbackCache = cache.New(cache.NoExpiration, cache.NoExpiration)
+var portainerCache = &meteredCache{Cache: declarePortainerCache(), name: "portainer"}
+var fallbackCache = &meteredCache{Cache: cache.New(cache.NoExpiration, cache.NoExpiration), name: "fallback"}
+var client Client = NewClient(appState.Config.PortainerUrl, appState.Config.PortainerSecret, time.Duration(appState.Config.PortainerTimeout)*time.Second)
 
 const FallbackCacheLastUpdatedKey = "__fallback_cache_last_updated__"
 
 func declarePortainerCache() (*cache.Cache) {
 	return cache.New(time.Duration(appState.Config.CacheDurationMinutes) * time.Minute, 10*time.Minute)
 }
+
+// meteredCache counts hits and misses of Get in metrics.CacheRequests
+type meteredCache struct {
+	*cache.Cache
+	name string
+}
+
+func (c *meteredCache) Get(key string) (interface{}, bool) {
+	val, found := c.Cache.Get(key)
+	if key != FallbackCacheLastUpdatedKey {
+		result := "miss"
+		if found {
+			result = "hit"
+		}
+		metrics.CacheRequests.WithLabelValues(c.name, result).Inc()
+	}
+	return val, found
+}
+
+// ResetState forgets the cached Portainer data, the live container states and the stats samples,
+// e.g. between tests running against different fakes
+func ResetState() {
+	portainerCache.Flush()
+	fallbackCache.Flush()
+	Live.reset()
+	Stats.reset()
+}
+
+// SetClient replaces the client used by all package level functions, e.g. with a fake in tests
+func SetClient(c Client) {
+	client = c
+}
+
+// GetClient returns the client used by all package level functions
+func GetClient() Client {
+	return client
+}
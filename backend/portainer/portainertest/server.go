@@ -0,0 +1,993 @@
+// Package portainertest provides an in-process fake of the Portainer API for tests.
+// The fake keeps scripted endpoints, stacks and containers in memory, mutates them
+// like Portainer would on start/stop/update/recreate and records every mutating call.
+package portainertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"washboard/portainer"
+	"washboard/types"
+)
+
+const (
+	StackActive   = 1
+	StackInactive = 2
+)
+
+// Call is a mutating request received by the fake
+type Call struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+type scriptedError struct {
+	status  int
+	message string
+	details string
+}
+
+// logEntry is a line a container logged to stream at time
+type logEntry struct {
+	stream string
+	time   time.Time
+	line   string
+}
+
+// endpointEvent is a docker event of a container in an endpoint
+type endpointEvent struct {
+	endpointId int
+	event      portainer.DockerEvent
+}
+
+// Exec is an exec instance created in the fake. Started instances run a shell that echoes its
+// input like a TTY, answers every line with "> line" and ends on "exit [code]".
+type Exec struct {
+	Id          string
+	ContainerId string
+	Cmd         []string
+	User        string
+	Rows        int
+	Cols        int
+	Running     bool
+	ExitCode    int
+}
+
+type Server struct {
+	*httptest.Server
+	ApiKey string
+
+	mu                 sync.Mutex
+	endpoints          []portainer.Endpoint
+	stacks             map[int]*portainer.Stack
+	stackFiles         map[int]string
+	stackImagesStatus  map[int]string
+	containers         map[int][]*portainer.Container
+	containerImgStatus map[string]string
+	containerHealth    map[string]string
+	ignoreStop         map[string]bool
+	images             map[string]*portainer.Image
+	remoteDigests      map[string]string
+	errors             map[string]scriptedError
+	calls              []Call
+	events             []endpointEvent
+	logs               map[string][]logEntry
+	execs              []*Exec
+	stats              map[string]portainer.ContainerStats
+	// changed is closed and replaced whenever an event or a log line is recorded
+	changed   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewServer starts a fake Portainer that only accepts requests carrying apiKey in X-API-Key
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		ApiKey:             apiKey,
+		stacks:             make(map[int]*portainer.Stack),
+		stackFiles:         make(map[int]string),
+		stackImagesStatus:  make(map[int]string),
+		containers:         make(map[int][]*portainer.Container),
+		containerImgStatus: make(map[string]string),
+		containerHealth:    make(map[string]string),
+		ignoreStop:         make(map[string]bool),
+		images:             make(map[string]*portainer.Image),
+		remoteDigests:      make(map[string]string),
+		errors:             make(map[string]scriptedError),
+		logs:               make(map[string][]logEntry),
+		stats:              make(map[string]portainer.ContainerStats),
+		changed:            make(chan struct{}),
+		closed:             make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /endpoints", s.handleEndpoints)
+	mux.HandleFunc("GET /stacks", s.handleStacks)
+	mux.HandleFunc("GET /stacks/{id}", s.handleStack)
+	mux.HandleFunc("PUT /stacks/{id}", s.handleUpdateStack)
+	mux.HandleFunc("GET /stacks/{id}/file", s.handleStackFile)
+	mux.HandleFunc("GET /stacks/{id}/images_status", s.handleStackImagesStatus)
+	mux.HandleFunc("POST /stacks/{id}/{action}", s.handleStackAction)
+	mux.HandleFunc("GET /endpoints/{env}/docker/containers/json", s.handleContainers)
+	mux.HandleFunc("GET /endpoints/{env}/docker/containers/{cid}/json", s.handleInspect)
+	mux.HandleFunc("GET /endpoints/{env}/docker/containers/{cid}/logs", s.handleLogs)
+	mux.HandleFunc("GET /endpoints/{env}/docker/containers/{cid}/stats", s.handleStats)
+	mux.HandleFunc("POST /endpoints/{env}/docker/containers/{cid}/exec", s.handleCreateExec)
+	mux.HandleFunc("POST /endpoints/{env}/docker/containers/{cid}/{action}", s.handleContainerAction)
+	mux.HandleFunc("POST /endpoints/{env}/docker/exec/{eid}/start", s.handleStartExec)
+	mux.HandleFunc("POST /endpoints/{env}/docker/exec/{eid}/resize", s.handleResizeExec)
+	mux.HandleFunc("GET /endpoints/{env}/docker/exec/{eid}/json", s.handleInspectExec)
+	mux.HandleFunc("GET /endpoints/{env}/docker/images/{iid}/json", s.handleImage)
+	mux.HandleFunc("GET /endpoints/{env}/docker/events", s.handleEvents)
+	mux.HandleFunc("GET /endpoints/{env}/docker/distribution/", s.handleDistribution)
+	mux.HandleFunc("GET /docker/{env}/containers/{cid}/image_status", s.handleContainerImageStatus)
+	mux.HandleFunc("POST /docker/{env}/containers/{cid}/recreate", s.handleRecreate)
+
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+// Close ends open event streams and shuts the fake down
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.Server.Close()
+}
+
+// Client returns a portainer.Client pointed at the fake
+func (s *Server) Client() portainer.Client {
+	return portainer.NewClient(s.URL, s.ApiKey, 5*time.Second)
+}
+
+func (s *Server) AddEndpoint(id int, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints = append(s.endpoints, portainer.Endpoint{Id: id, Name: name})
+}
+
+// AddStack registers a stack with its compose file. The stack starts as active.
+func (s *Server) AddStack(endpointId int, stackId int, name string, stackFile string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stacks[stackId] = &portainer.Stack{
+		Id:         stackId,
+		Name:       name,
+		EndpointId: endpointId,
+		Status:     StackActive,
+		Env:        []portainer.EnvVar{},
+	}
+	s.stackFiles[stackId] = stackFile
+	s.stackImagesStatus[stackId] = types.Updated
+}
+
+// SetStackEnv replaces the env of a stack
+func (s *Server) SetStackEnv(stackId int, env ...portainer.EnvVar) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stacks[stackId].Env = env
+}
+
+// AddContainer adds a running container labelled as part of stackName. Like docker compose, a
+// container named <stack>-<service>-<n> is labelled with its service. The image gets a stable
+// id and repo digest derived from its name, see ImageDigest.
+func (s *Server) AddContainer(endpointId int, stackName string, containerId string, name string, image string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels := map[string]string{}
+	if stackName != "" {
+		labels[types.StackLabel] = stackName
+		if service, ok := strings.CutPrefix(name, stackName+"-"); ok {
+			if i := strings.LastIndex(service, "-"); i > 0 {
+				labels[types.ServiceLabel] = service[:i]
+			}
+		}
+	}
+	imageId := "sha256:" + hexDigest("id:"+image)
+	s.images[imageId] = &portainer.Image{
+		Id:          imageId,
+		RepoTags:    []string{image},
+		RepoDigests: []string{ImageDigest(image)},
+	}
+	s.containers[endpointId] = append(s.containers[endpointId], &portainer.Container{
+		Id:      containerId,
+		Names:   []string{"/" + name},
+		Image:   image,
+		ImageID: imageId,
+		State:   types.ContainerRunning,
+		Labels:  labels,
+		NetworkSettings: portainer.ContainerNetworkSettings{
+			Networks: map[string]interface{}{stackName + "_default": map[string]interface{}{}},
+		},
+	})
+	s.containerImgStatus[containerId] = types.Updated
+}
+
+// ImageDigest returns the repo digest the fake reports for image, e.g. nginx@sha256:…
+func ImageDigest(image string) string {
+	repo := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repo = image[:i]
+	}
+	return repo + "@sha256:" + hexDigest("digest:"+image)
+}
+
+func hexDigest(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetRemoteDigest scripts the digest the registry reports for image, e.g. after a new version was
+// pushed. By default the registry reports the digest the image was added with.
+func (s *Server) SetRemoteDigest(image string, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remoteDigests[image] = digest
+}
+
+// SetStackImagesStatus scripts the answer of /stacks/{id}/images_status
+func (s *Server) SetStackImagesStatus(stackId int, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stackImagesStatus[stackId] = status
+}
+
+// SetContainerImageStatus scripts the answer of /docker/{env}/containers/{id}/image_status
+func (s *Server) SetContainerImageStatus(containerId string, status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containerImgStatus[containerId] = status
+}
+
+// SetContainerHealth gives a container a Docker healthcheck reporting health, one of
+// types.HealthStarting, types.HealthHealthy and types.HealthUnhealthy, while it is running
+func (s *Server) SetContainerHealth(containerId string, health string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containerHealth[containerId] = health
+	if container := s.findContainer(containerId); container != nil && container.State == types.ContainerRunning {
+		s.recordEvent(container, "health_status: "+health)
+	}
+}
+
+// IgnoreStop makes a container keep running when it or its stack is stopped, only a kill ends it
+func (s *Server) IgnoreStop(containerId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ignoreStop[containerId] = true
+}
+
+// ContainerState returns the docker state of the container, or "" if it does not exist
+func (s *Server) ContainerState(containerId string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if container := s.findContainer(containerId); container != nil {
+		return container.State
+	}
+	return ""
+}
+
+// AddContainerLogs makes a container log lines to stream, types.LogStdout or types.LogStderr.
+// Clients following the logs of the container receive them right away.
+func (s *Server) AddContainerLogs(containerId string, stream string, lines ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range lines {
+		s.logs[containerId] = append(s.logs[containerId], logEntry{stream: stream, time: time.Now(), line: line})
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// SetContainerStats sets the stats reading returned for a running container. Containers without
+// one report zero usage read at the time of the request.
+func (s *Server) SetContainerStats(containerId string, stats portainer.ContainerStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats[containerId] = stats
+}
+
+// Execs returns the exec instances created so far
+func (s *Server) Execs() []Exec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	execs := make([]Exec, 0, len(s.execs))
+	for _, exec := range s.execs {
+		execs = append(execs, *exec)
+	}
+	return execs
+}
+
+// FailRequests makes every request whose "METHOD path" matches pattern fail with the given
+// Portainer error until ClearFailures is called
+func (s *Server) FailRequests(pattern string, status int, message string, details string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[pattern] = scriptedError{status: status, message: message, details: details}
+}
+
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = make(map[string]scriptedError)
+}
+
+// Calls returns all mutating requests received so far
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != s.ApiKey {
+			writeError(w, http.StatusUnauthorized, "Unauthorized", "A valid authorisation token is missing")
+			return
+		}
+		s.mu.Lock()
+		for pattern, scripted := range s.errors {
+			if matched, _ := regexp.MatchString(pattern, r.Method+" "+r.URL.Path); matched {
+				s.mu.Unlock()
+				writeError(w, scripted.status, scripted.message, scripted.details)
+				return
+			}
+		}
+		if r.Method != http.MethodGet {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			s.calls = append(s.calls, Call{Method: r.Method, Path: r.URL.Path, Body: string(body)})
+		}
+		s.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJson(w, http.StatusOK, s.endpoints)
+}
+
+func (s *Server) handleStacks(w http.ResponseWriter, r *http.Request) {
+	var filters struct {
+		EndpointId int `json:"EndpointId"`
+	}
+	if raw := r.URL.Query().Get("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid query parameter: filters", err.Error())
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stacks := make([]portainer.Stack, 0, len(s.stacks))
+	for _, stack := range s.stacks {
+		if filters.EndpointId == 0 || stack.EndpointId == filters.EndpointId {
+			stacks = append(stacks, *stack)
+		}
+	}
+	writeJson(w, http.StatusOK, stacks)
+}
+
+func (s *Server) handleStack(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.lookupStack(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, stack)
+}
+
+func (s *Server) handleStackFile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.lookupStack(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, portainer.StackFile{StackFileContent: s.stackFiles[stack.Id]})
+}
+
+func (s *Server) handleStackImagesStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.lookupStack(w, r)
+	if !ok {
+		return
+	}
+	writeJson(w, http.StatusOK, portainer.ImageStatus{Status: s.stackImagesStatus[stack.Id]})
+}
+
+func (s *Server) handleUpdateStack(w http.ResponseWriter, r *http.Request) {
+	var request portainer.UpdateStackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.lookupStack(w, r)
+	if !ok {
+		return
+	}
+	s.stackFiles[stack.Id] = request.StackFileContent
+	stack.Env = request.Env
+	stack.Status = StackActive
+	s.stackImagesStatus[stack.Id] = types.Updated
+	for _, container := range s.stackContainers(stack) {
+		s.setContainerState(container, types.ContainerRunning)
+		s.containerImgStatus[container.Id] = types.Updated
+	}
+	writeJson(w, http.StatusOK, stack)
+}
+
+func (s *Server) handleStackAction(w http.ResponseWriter, r *http.Request) {
+	action := r.PathValue("action")
+	if action != "start" && action != "stop" {
+		writeError(w, http.StatusNotFound, "Not found", "")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stack, ok := s.lookupStack(w, r)
+	if !ok {
+		return
+	}
+	if action == "start" && stack.Status == StackActive {
+		writeError(w, http.StatusConflict, "Stack is already active", "")
+		return
+	}
+	if action == "stop" && stack.Status == StackInactive {
+		writeError(w, http.StatusConflict, "Stack is already inactive", "")
+		return
+	}
+	state := "exited"
+	stack.Status = StackInactive
+	if action == "start" {
+		state = types.ContainerRunning
+		stack.Status = StackActive
+	}
+	for _, container := range s.stackContainers(stack) {
+		if action == "stop" && s.ignoreStop[container.Id] {
+			continue
+		}
+		if s.setContainerState(container, state) && action == "stop" {
+			s.recordEvent(container, "stop")
+		}
+	}
+	writeJson(w, http.StatusOK, stack)
+}
+
+func (s *Server) handleContainers(w http.ResponseWriter, r *http.Request) {
+	endpointId, err := strconv.Atoi(r.PathValue("env"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment identifier route variable", err.Error())
+		return
+	}
+	var filters struct {
+		Label []string `json:"label"`
+	}
+	if raw := r.URL.Query().Get("filters"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &filters); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid filters", err.Error())
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	containers := make([]portainer.Container, 0)
+	for _, container := range s.containers[endpointId] {
+		if matchesLabels(container, filters.Label) {
+			listed := *container
+			listed.Status = s.containerStatus(container)
+			containers = append(containers, listed)
+		}
+	}
+	writeJson(w, http.StatusOK, containers)
+}
+
+// containerStatus returns the human readable status docker lists a container with
+func (s *Server) containerStatus(container *portainer.Container) string {
+	if container.State != types.ContainerRunning {
+		return "Exited (0) 1 second ago"
+	}
+	switch s.containerHealth[container.Id] {
+	case types.HealthStarting:
+		return "Up 1 second (health: starting)"
+	case "":
+		return "Up 1 second"
+	default:
+		return fmt.Sprintf("Up 1 second (%s)", s.containerHealth[container.Id])
+	}
+}
+
+func (s *Server) handleContainerAction(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container := s.findContainer(r.PathValue("cid"))
+	if container == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", r.PathValue("cid")), "")
+		return
+	}
+	switch types.ContainerAction(r.PathValue("action")) {
+	case types.Start, types.Restart, types.Resume:
+		s.setContainerState(container, types.ContainerRunning)
+	case types.Stop:
+		if !s.ignoreStop[container.Id] && s.setContainerState(container, "exited") {
+			s.recordEvent(container, "stop")
+		}
+	case types.Kill:
+		s.recordEvent(container, "kill")
+		s.setContainerState(container, "exited")
+	case types.Pause:
+		s.setContainerState(container, "paused")
+	default:
+		writeError(w, http.StatusNotFound, "page not found", "")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image, ok := s.images[r.PathValue("iid")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "No such image", r.PathValue("iid"))
+		return
+	}
+	writeJson(w, http.StatusOK, image)
+}
+
+func (s *Server) handleDistribution(w http.ResponseWriter, r *http.Request) {
+	prefix := "/endpoints/" + r.PathValue("env") + "/docker/distribution/"
+	image, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, prefix), "/json")
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found", "")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	digest, ok := s.remoteDigests[image]
+	if !ok {
+		_, digest, _ = strings.Cut(ImageDigest(image), "@")
+	}
+	var distribution portainer.Distribution
+	distribution.Descriptor.Digest = digest
+	writeJson(w, http.StatusOK, distribution)
+}
+
+func (s *Server) handleContainerImageStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.containerImgStatus[r.PathValue("cid")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unable to find container", r.PathValue("cid"))
+		return
+	}
+	writeJson(w, http.StatusOK, portainer.ImageStatus{Status: status})
+}
+
+func (s *Server) handleRecreate(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container := s.findContainer(r.PathValue("cid"))
+	if container == nil {
+		writeError(w, http.StatusNotFound, "Unable to find container", r.PathValue("cid"))
+		return
+	}
+	s.setContainerState(container, types.ContainerRunning)
+	s.containerImgStatus[container.Id] = types.Updated
+	writeJson(w, http.StatusOK, container)
+}
+
+func (s *Server) handleInspect(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container := s.findContainer(r.PathValue("cid"))
+	if container == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", r.PathValue("cid")), "")
+		return
+	}
+	var details portainer.ContainerDetails
+	details.Id = container.Id
+	if len(container.Names) > 0 {
+		details.Name = container.Names[0]
+	}
+	details.Config.Labels = container.Labels
+	details.State.Status = container.State
+	details.State.Running = container.State == types.ContainerRunning
+	writeJson(w, http.StatusOK, details)
+}
+
+// handleStats answers like docker with ?stream=false: stopped containers report zero usage
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container := s.findContainer(r.PathValue("cid"))
+	if container == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", r.PathValue("cid")), "")
+		return
+	}
+	if container.State != types.ContainerRunning {
+		writeJson(w, http.StatusOK, portainer.ContainerStats{})
+		return
+	}
+	stats, ok := s.stats[container.Id]
+	if !ok {
+		stats.Read = time.Now()
+	}
+	writeJson(w, http.StatusOK, stats)
+}
+
+// handleLogs streams the logs of a container multiplexed like docker does for containers without
+// a TTY. With ?follow=true it keeps streaming new lines while the container is running.
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	containerId := r.PathValue("cid")
+	s.mu.Lock()
+	entries := s.logs[containerId]
+	exists := s.findContainer(containerId) != nil
+	s.mu.Unlock()
+	if !exists {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", containerId), "")
+		return
+	}
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+	streams := map[string]bool{types.LogStdout: query.Get("stdout") == "true", types.LogStderr: query.Get("stderr") == "true"}
+	selected := func(entries []logEntry) []logEntry {
+		matching := make([]logEntry, 0, len(entries))
+		for _, entry := range entries {
+			if streams[entry.stream] && entry.time.Unix() >= since {
+				matching = append(matching, entry)
+			}
+		}
+		return matching
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	write := func(entries []logEntry) error {
+		for _, entry := range entries {
+			payload := entry.line + "\n"
+			if query.Get("timestamps") == "true" {
+				payload = entry.time.UTC().Format(time.RFC3339Nano) + " " + payload
+			}
+			header := make([]byte, 8)
+			header[0] = 1
+			if entry.stream == types.LogStderr {
+				header[0] = 2
+			}
+			binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+			if _, err := w.Write(append(header, payload...)); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	initial := selected(entries)
+	if tail, err := strconv.Atoi(query.Get("tail")); err == nil && tail < len(initial) {
+		initial = initial[len(initial)-tail:]
+	}
+	if write(initial) != nil || query.Get("follow") != "true" {
+		return
+	}
+	sent := len(entries)
+	for {
+		s.mu.Lock()
+		pending := s.logs[containerId][sent:]
+		changed := s.changed
+		s.mu.Unlock()
+		// docker ends the logs of a container that stopped
+		if write(selected(pending)) != nil || s.ContainerState(containerId) != types.ContainerRunning {
+			return
+		}
+		sent += len(pending)
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Server) handleCreateExec(w http.ResponseWriter, r *http.Request) {
+	var request portainer.ExecCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request payload", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	container := s.findContainer(r.PathValue("cid"))
+	if container == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such container: %s", r.PathValue("cid")), "")
+		return
+	}
+	if container.State != types.ContainerRunning {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Container %s is not running", container.Id), "")
+		return
+	}
+	exec := &Exec{
+		Id:          hexDigest(fmt.Sprintf("exec-%s-%d", container.Id, len(s.execs))),
+		ContainerId: container.Id,
+		Cmd:         request.Cmd,
+		User:        request.User,
+	}
+	s.execs = append(s.execs, exec)
+	writeJson(w, http.StatusCreated, portainer.ExecCreateResponse{Id: exec.Id})
+}
+
+// handleStartExec hijacks the connection like docker does when asked for an upgrade and runs the
+// shell of Exec on it
+func (s *Server) handleStartExec(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	exec := s.findExec(r.PathValue("eid"))
+	if exec == nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such exec instance: %s", r.PathValue("eid")), "")
+		return
+	}
+	if exec.Running {
+		s.mu.Unlock()
+		writeError(w, http.StatusConflict, "Exec is already running", "")
+		return
+	}
+	exec.Running = true
+	s.mu.Unlock()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Connection can not be hijacked", "")
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buffered.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n$ ")
+	buffered.Flush()
+	go func() {
+		// unblock the shell when the fake shuts down
+		<-s.closed
+		conn.Close()
+	}()
+
+	exitCode := 0
+	line := []byte{}
+	input := make([]byte, 1024)
+shell:
+	for {
+		n, err := buffered.Read(input)
+		for _, b := range input[:n] {
+			if b != '\r' && b != '\n' {
+				line = append(line, b)
+				conn.Write([]byte{b})
+				continue
+			}
+			conn.Write([]byte("\r\n"))
+			if command, code, _ := strings.Cut(string(line), " "); command == "exit" {
+				exitCode, _ = strconv.Atoi(code)
+				break shell
+			}
+			if len(line) > 0 {
+				conn.Write([]byte("> " + string(line) + "\r\n"))
+			}
+			conn.Write([]byte("$ "))
+			line = line[:0]
+		}
+		if err != nil {
+			break
+		}
+	}
+	s.mu.Lock()
+	exec.Running = false
+	exec.ExitCode = exitCode
+	s.mu.Unlock()
+}
+
+func (s *Server) handleResizeExec(w http.ResponseWriter, r *http.Request) {
+	rows, rowsErr := strconv.Atoi(r.URL.Query().Get("h"))
+	cols, colsErr := strconv.Atoi(r.URL.Query().Get("w"))
+	if rowsErr != nil || colsErr != nil {
+		writeError(w, http.StatusBadRequest, "Invalid terminal size", "")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exec := s.findExec(r.PathValue("eid"))
+	if exec == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such exec instance: %s", r.PathValue("eid")), "")
+		return
+	}
+	exec.Rows, exec.Cols = rows, cols
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleInspectExec(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exec := s.findExec(r.PathValue("eid"))
+	if exec == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("No such exec instance: %s", r.PathValue("eid")), "")
+		return
+	}
+	writeJson(w, http.StatusOK, portainer.ExecDetails{Id: exec.Id, Running: exec.Running, ExitCode: exec.ExitCode})
+}
+
+// handleEvents streams the recorded events of an endpoint from ?since= on, one JSON object per
+// line like docker, until the client disconnects or the fake is closed
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	endpointId, err := strconv.Atoi(r.PathValue("env"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid environment identifier route variable", err.Error())
+		return
+	}
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	sent := 0
+	for {
+		s.mu.Lock()
+		pending := s.events[sent:]
+		changed := s.changed
+		s.mu.Unlock()
+		for _, recorded := range pending {
+			if recorded.endpointId == endpointId && recorded.event.Time >= since {
+				if err := encoder.Encode(recorded.event); err != nil {
+					return
+				}
+			}
+		}
+		sent += len(pending)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// setContainerState changes the state of a container and records the docker event of the change.
+// Returns false if the container already was in state.
+func (s *Server) setContainerState(container *portainer.Container, state string) bool {
+	previous := container.State
+	if previous == state {
+		return false
+	}
+	container.State = state
+	switch {
+	case state == types.ContainerRunning && previous == "paused":
+		s.recordEvent(container, "unpause")
+	case state == types.ContainerRunning:
+		s.recordEvent(container, "start")
+	case state == "paused":
+		s.recordEvent(container, "pause")
+	default:
+		s.recordEvent(container, "die")
+	}
+	return true
+}
+
+// recordEvent records a docker event of a container, the caller holds mu
+func (s *Server) recordEvent(container *portainer.Container, action string) {
+	attributes := map[string]string{"image": container.Image}
+	if len(container.Names) > 0 {
+		attributes["name"] = strings.TrimPrefix(container.Names[0], "/")
+	}
+	for key, value := range container.Labels {
+		attributes[key] = value
+	}
+	endpointId := 0
+	for id, containers := range s.containers {
+		for _, candidate := range containers {
+			if candidate == container {
+				endpointId = id
+			}
+		}
+	}
+	now := time.Now()
+	s.events = append(s.events, endpointEvent{endpointId: endpointId, event: portainer.DockerEvent{
+		Type:     "container",
+		Action:   action,
+		Actor:    portainer.EventActor{ID: container.Id, Attributes: attributes},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) lookupStack(w http.ResponseWriter, r *http.Request) (*portainer.Stack, bool) {
+	stackId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid stack identifier route variable", err.Error())
+		return nil, false
+	}
+	stack, ok := s.stacks[stackId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Unable to find a stack with the specified identifier inside the database", "Object not found inside the database")
+		return nil, false
+	}
+	return stack, true
+}
+
+func (s *Server) stackContainers(stack *portainer.Stack) []*portainer.Container {
+	var containers []*portainer.Container
+	for _, container := range s.containers[stack.EndpointId] {
+		if container.Labels[types.StackLabel] == stack.Name {
+			containers = append(containers, container)
+		}
+	}
+	return containers
+}
+
+func (s *Server) findContainer(containerId string) *portainer.Container {
+	for _, containers := range s.containers {
+		for _, container := range containers {
+			if container.Id == containerId {
+				return container
+			}
+		}
+	}
+	return nil
+}
+
+// findExec looks up an exec instance, the caller holds mu
+func (s *Server) findExec(execId string) *Exec {
+	for _, exec := range s.execs {
+		if exec.Id == execId {
+			return exec
+		}
+	}
+	return nil
+}
+
+func matchesLabels(container *portainer.Container, labels []string) bool {
+	for _, label := range labels {
+		key, value, _ := strings.Cut(label, "=")
+		if container.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string, details string) {
+	writeJson(w, status, map[string]string{"message": message, "details": details})
+}
@@ -5,15 +5,17 @@ import (
 	"sync/atomic"
 	"time"
 
+	"washboard/hub"
 	"washboard/types"
 
 	"github.com/kpango/glg"
 )
 
 type ImageRefreshController struct {
-	mu         sync.Mutex
-	running    bool
-	startedAt  int64
+	mu          sync.Mutex
+	running     bool
+	endpointIds []int
+	startedAt   int64
 	finishedAt int64
 	lastError  string
 	version    atomic.Uint64
@@ -21,9 +23,9 @@ type ImageRefreshController struct {
 
 var Refresh = &ImageRefreshController{}
 
-// TriggerRefresh kicks off runUpdateCheck in a goroutine if no refresh is in flight.
+// TriggerRefresh kicks off runUpdateCheck for each endpoint in a goroutine if no refresh is in flight.
 // Returns true if a new run was started, false if a run was already in progress.
-func (c *ImageRefreshController) TriggerRefresh(endpointId int) bool {
+func (c *ImageRefreshController) TriggerRefresh(endpointIds ...int) bool {
 	c.mu.Lock()
 	if c.running {
 		c.mu.Unlock()
@@ -31,10 +33,12 @@ func (c *ImageRefreshController) TriggerRefresh(endpointId int) bool {
 		return false
 	}
 	c.running = true
+	c.endpointIds = endpointIds
 	c.startedAt = time.Now().Unix()
 	c.lastError = ""
 	c.mu.Unlock()
 	c.version.Add(1)
+	hub.Publish(types.WsTopicImageRefresh, types.WsMsgImageRefreshState, c.Snapshot())
 
 	go func() {
 		defer func() {
@@ -45,7 +49,9 @@ func (c *ImageRefreshController) TriggerRefresh(endpointId int) bool {
 			}
 			c.finish("")
 		}()
-		runUpdateCheck(endpointId)
+		for _, endpointId := range endpointIds {
+			runUpdateCheck(endpointId)
+		}
 	}()
 	return true
 }
@@ -57,16 +63,18 @@ func (c *ImageRefreshController) finish(errMsg string) {
 	c.lastError = errMsg
 	c.mu.Unlock()
 	c.version.Add(1)
+	hub.Publish(types.WsTopicImageRefresh, types.WsMsgImageRefreshState, c.Snapshot())
 }
 
 func (c *ImageRefreshController) Snapshot() types.ImageRefreshState {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	return types.ImageRefreshState{
-		Running:    c.running,
-		StartedAt:  c.startedAt,
-		FinishedAt: c.finishedAt,
-		Error:      c.lastError,
+		Running:     c.running,
+		EndpointIds: c.endpointIds,
+		StartedAt:   c.startedAt,
+		FinishedAt:  c.finishedAt,
+		Error:       c.lastError,
 	}
 }
 
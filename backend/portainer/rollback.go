@@ -0,0 +1,177 @@
+package portainer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"washboard/db"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+	"gopkg.in/yaml.v3"
+)
+
+// EnqueueRollbackStack redeploys the snapshot taken before an earlier update of the stack. The
+// compose file and env of the snapshot are restored and every service is pinned to the repo digest
+// its container was running, so the rollback does not pull whatever the tag points to today.
+//
+// Parameters:
+//   - jobId: the update job whose snapshot is redeployed. If empty, the latest successful update
+//     that was not a rollback itself is used.
+//   - triggeredBy: the user or component that requested the rollback, recorded in the job history
+//
+// The rollback is enqueued like an update and returns the same values as EnqueueUpdateStack.
+func EnqueueRollbackStack(endpointId int, stackId int, jobId string, triggeredBy string) (float64, error) {
+	release, err := claimUpdate(endpointId, stackId)
+	if err != nil {
+		return -2, err
+	}
+	defer release()
+
+	source, err := rollbackSource(endpointId, stackId, jobId)
+	if err != nil {
+		glg.Errorf("No snapshot to roll back stack %d to: %s", stackId, err)
+		return -1, err
+	}
+	glg.Infof("enqueueing rollback of stack id: %d to job %s", stackId, source.Id)
+
+	stackData, stackFileContent, err := getStackWithFile(endpointId, stackId)
+	if err != nil {
+		return -1, err
+	}
+	pinned, err := pinImages(source.StackFile, source.ImagesBefore)
+	if err != nil {
+		glg.Errorf("Failed to pin images of stack %d: %s", stackId, err)
+		return -1, err
+	}
+
+	updateRequest := &UpdateStackRequest{
+		Env:              fromJobEnv(source.Env),
+		Id:               stackId,
+		Prune:            false,
+		PullImage:        true,
+		StackFileContent: pinned,
+		Webhook:          stackData.Webhook,
+	}
+
+	job := &types.StackUpdateJob{
+		EndpointId:  endpointId,
+		StackId:     stackId,
+		StackName:   stackData.Name,
+		TriggeredBy: triggeredBy,
+		PullImage:   true,
+		RollbackOf:  source.Id,
+		StackFile:   stackFileContent,
+		Env:         toJobEnv(stackData.Env),
+	}
+	startUpdateJob(job, updateRequest)
+
+	return float64(stackId), nil
+}
+
+// rollbackSource returns the job with the snapshot to roll back to
+func rollbackSource(endpointId int, stackId int, jobId string) (*types.StackUpdateJob, error) {
+	if jobId != "" {
+		job, err := db.GetJob(jobId)
+		if err != nil {
+			return nil, err
+		}
+		if job.EndpointId != endpointId || job.StackId != stackId {
+			return nil, fmt.Errorf("job %s is not an update of stack %d in endpoint %d", jobId, stackId, endpointId)
+		}
+		if job.StackFile == "" {
+			return nil, fmt.Errorf("job %s has no snapshot", jobId)
+		}
+		return job, nil
+	}
+
+	jobs, _, err := db.ListJobs(&types.JobFilter{EndpointId: endpointId, StackId: stackId, Status: types.Done})
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if jobs[i].RollbackOf == "" && jobs[i].StackFile != "" {
+			return &jobs[i], nil
+		}
+	}
+	return nil, errors.New("no successful update with a snapshot found")
+}
+
+// unpinRollback returns the compose file a stack was rolled back from if stackFileContent is still
+// exactly what the last rollback deployed. Otherwise updates after a rollback would keep pulling
+// the pinned digests.
+func unpinRollback(endpointId int, stackId int, stackFileContent string) string {
+	jobs, _, err := db.ListJobs(&types.JobFilter{EndpointId: endpointId, StackId: stackId, Limit: 1})
+	if err != nil || len(jobs) == 0 || jobs[0].RollbackOf == "" || jobs[0].Status != types.Done {
+		return stackFileContent
+	}
+	source, err := db.GetJob(jobs[0].RollbackOf)
+	if err != nil {
+		return stackFileContent
+	}
+	if pinned, err := pinImages(source.StackFile, source.ImagesBefore); err == nil && pinned == stackFileContent {
+		glg.Infof("unpinning images of stack %d that were pinned by rollback %s", stackId, jobs[0].Id)
+		return source.StackFile
+	}
+	return stackFileContent
+}
+
+// pinImages sets the image of every service in a compose file to the repo digest recorded in
+// images. Services without a recorded digest, e.g. locally built images, are left untouched.
+func pinImages(stackFileContent string, images []types.ContainerImage) (string, error) {
+	digests := make(map[string]string)
+	for _, image := range images {
+		if image.Service != "" && image.Digest != "" {
+			digests[image.Service] = image.Digest
+		}
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(stackFileContent), &document); err != nil {
+		return "", err
+	}
+	if len(document.Content) == 0 {
+		return "", errors.New("stack file is empty")
+	}
+	services := mappingValue(document.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return "", errors.New("stack file has no services")
+	}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		service := services.Content[i].Value
+		digest, ok := digests[service]
+		if !ok {
+			glg.Warnf("no digest recorded for service %s, keeping its image", service)
+			continue
+		}
+		if image := mappingValue(services.Content[i+1], "image"); image != nil {
+			image.Value = digest
+			image.Style = 0
+		}
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// mappingValue returns the value of key in a yaml mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -1,118 +1,72 @@
 package portainer
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"sort"
 	"washboard/db"
 	"washboard/types"
+	"washboard/werrors"
 
 	"github.com/kpango/glg"
 )
 
 func StartOrStopStack(endpointId int, stackId int, starOrStop string) (string, int, error) {
-	client := &http.Client{}
-	reqBody := []byte(fmt.Sprintf(`{"endpointId":%d,"id":"%d"}`, endpointId, stackId))
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/stacks/%d/%s", appState.Config.PortainerUrl, stackId, starOrStop), bytes.NewBuffer(reqBody))
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return "", 500, err
-	}
-
-	q := req.URL.Query()
-	q.Add("endpointId", fmt.Sprintf("%d", endpointId))
-	req.URL.RawQuery = q.Encode()
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-	resp, err := client.Do(req)
-	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return "", 500, err
+	ctx := context.Background()
+	var stack *Stack
+	var err error
+	if starOrStop == "start" {
+		stack, err = client.StartStack(ctx, endpointId, stackId)
+	} else {
+		stack, err = client.StopStack(ctx, endpointId, stackId)
 	}
 
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		glg.Errorf("Failed to read response: %s", err)
-		return "", 500, err
-	}
-
-	var responseStack map[string]interface{}
-	err = json.Unmarshal(body, &responseStack)
 	if err != nil {
-		glg.Errorf("Failed to unmarshal JSON: %s", err)
-		return "", 500, err
-	}
-
-
-	switch resp.StatusCode {
-	case 200:
-		if responseName, ok := responseStack["Name"].(string); ok {
-			return responseName, resp.StatusCode, nil
+		var portainerErr *werrors.PortainerError
+		if !errors.As(err, &portainerErr) {
+			glg.Errorf("Failed to %s stack %d: %s", starOrStop, stackId, err)
+			return "", 500, err
+		}
+		if portainerErr.StatusCode == 409 {
+			return "", portainerErr.StatusCode, fmt.Errorf("%s: %d", portainerErr.Message, stackId)
 		}
-		return "", 500, fmt.Errorf("response id from portainer is not a number")
-	case 409:
-		return "", resp.StatusCode, fmt.Errorf("%s: %d", responseStack["message"], stackId)
-	default:
-		errorMessage := fmt.Sprintf("%s: %d. %s", responseStack["message"], stackId, responseStack["details"])
+		errorMessage := fmt.Sprintf("%s: %d. %s", portainerErr.Message, stackId, portainerErr.Details)
 		glg.Error(errorMessage)
-		return "", resp.StatusCode, fmt.Errorf(errorMessage)
+		return "", portainerErr.StatusCode, errors.New(errorMessage)
 	}
+	return stack.Name, 200, nil
 }
 
-
 func ManageContainer(endpointId int, containerId string, action types.ContainerAction) (string, error) {
-	client := &http.Client{}
-    reqBody := bytes.NewBuffer([]byte("{}"))
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/endpoints/%d/docker/containers/%s/%s", appState.Config.PortainerUrl, endpointId, containerId, action), reqBody)
-	if err != nil {
-		glg.Errorf("Failed to create request: %s", err)
-		return "", err
-	}
-
-	req.Header.Add("X-API-Key", appState.Config.PortainerSecret)
-
-	// print req body
-	glg.Infof("Request body: %+v", req.Body)
-	resp, err := client.Do(req)
+	err := client.ContainerAction(context.Background(), endpointId, containerId, action)
 	if err != nil {
-		glg.Errorf("Failed to send request: %s", err)
-		return "", err
-	}
-
-	defer resp.Body.Close()
-
-	// get status code
-	if resp.StatusCode != 204 {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			glg.Errorf("Failed to read response: %s", err)
-			return "", err
-		}
-		return "", fmt.Errorf("Failed to %s container: %s", action, body)
+		glg.Errorf("Failed to %s container %s: %s", action, containerId, err)
+		return "", fmt.Errorf("Failed to %s container: %w", action, err)
 	}
 	return "success", nil
 }
 
+// PerformSync creates stack settings for new stacks and removes settings of stacks that no longer
+// exist, for every endpoint in syncOptions. Settings of other endpoints are left untouched.
 func PerformSync(syncOptions *types.SyncOptions) error {
-	var stacks []types.StackDto
-
-	for _, endpoint := range syncOptions.EndpointIds {
-		tmp, err := GetStacks(endpoint, true)
-		if err != nil {
-			return fmt.Errorf("failed to get containers for endpoint %d: %w", endpoint, err)
+	for _, endpointId := range syncOptions.EndpointIds {
+		if err := syncEndpoint(endpointId); err != nil {
+			return err
 		}
-		stacks = append(stacks, tmp...)
+	}
+	return nil
+}
+
+func syncEndpoint(endpointId int) error {
+	stacks, err := GetStacks(endpointId, true)
+	if err != nil {
+		return fmt.Errorf("failed to get containers for endpoint %d: %w", endpointId, err)
 	}
 
 	collectedStackMap := make(map[string]*types.StackSettings)
 
-	allStackSettings, err := db.GetAllStackSettings()
+	allStackSettings, err := db.GetEndpointStackSettings(endpointId)
 	if err != nil {
 		return fmt.Errorf("failed to get all stack settings: %w", err)
 	}
@@ -123,24 +77,26 @@ func PerformSync(syncOptions *types.SyncOptions) error {
 
 	newStackCount := 0
 	stackSettingsToAdd := make([]*types.StackSettings, 0)
+	liveStacks := make(map[string]bool)
 
 	for _, stack := range stacks {
-		if stackSetting, ok := collectedStackMap[stack.Name]; !ok {
+		liveStacks[stack.Name] = true
+		if _, ok := collectedStackMap[stack.Name]; !ok {
 			autoStart := false
 			if len(stack.Containers) > 0 {
 				autoStart = true
 			}
-			stackSetting = &types.StackSettings{
-				StackName: stack.Name,
-				AutoStart: autoStart,
-				Priority:  -1,
-				StackId:   stack.Id,
+			stackSetting := &types.StackSettings{
+				EndpointId: endpointId,
+				StackName:  stack.Name,
+				AutoStart:  autoStart,
+				Priority:   -1,
+				StackId:    stack.Id,
+				DependsOn:  []string{},
 			}
 			stackSettingsToAdd = append(stackSettingsToAdd, stackSetting)
 			newStackCount++
 			collectedStackMap[stack.Name] = stackSetting
-		} else {
-			collectedStackMap[stack.Name] = stackSetting
 		}
 	}
 
@@ -149,11 +105,11 @@ func PerformSync(syncOptions *types.SyncOptions) error {
 	})
 
 	for _, stackSetting := range stackSettingsToAdd {
-		glg.Infof("adding missing stack %s", stackSetting.StackName)
+		glg.Infof("adding missing stack %s in endpoint %d", stackSetting.StackName, endpointId)
 		db.CreateStackSettings(stackSetting)
 	}
 
-	allStackSettings, err = db.GetAllStackSettings()
+	allStackSettings, err = db.GetEndpointStackSettings(endpointId)
 	if err != nil {
 		return fmt.Errorf("failed to get all stack settings: %w", err)
 	}
@@ -161,20 +117,24 @@ func PerformSync(syncOptions *types.SyncOptions) error {
 	stacksToRemove := make([]string, 0)
 
 	for _, stackSettings := range allStackSettings {
-		if _, ok := collectedStackMap[stackSettings.StackName]; !ok {
+		if !liveStacks[stackSettings.StackName] {
 			stacksToRemove = append(stacksToRemove, stackSettings.StackName)
 		}
 	}
 
 	for _, stack := range stacksToRemove {
-		glg.Infof("removing orphaned stack %s", stack)
-		err := db.DeleteStackSettings(stack)
+		glg.Infof("removing orphaned stack %s in endpoint %d", stack, endpointId)
+		err := db.DeleteStackSettings(endpointId, stack)
 		if err != nil {
 			glg.Errorf("failed to delete orphaned stack %s", stack)
 		}
 	}
 
-	allStackSettings, err = db.GetAllStackSettings()
+	if len(stacksToRemove) > 0 {
+		removeOrphanReferences(endpointId, liveStacks)
+	}
+
+	allStackSettings, err = db.GetEndpointStackSettings(endpointId)
 	if err != nil {
 		return fmt.Errorf("failed to get all stack settings: %w", err)
 	}
@@ -189,10 +149,57 @@ func PerformSync(syncOptions *types.SyncOptions) error {
 			} else {
 				settings.Priority += newStackCount
 			}
-			db.UpdateStackSettings(&settings, settings.StackName)
+			db.UpdateStackSettings(&settings, settings.EndpointId, settings.StackName)
 		}
 	}
 
 	return nil
 }
 
+// removeOrphanReferences drops the stacks that no longer exist from the dependencies of the stacks
+// and from the groups of an endpoint
+func removeOrphanReferences(endpointId int, liveStacks map[string]bool) {
+	allStackSettings, err := db.GetEndpointStackSettings(endpointId)
+	if err != nil {
+		glg.Errorf("failed to get stack settings of endpoint %d: %s", endpointId, err)
+		return
+	}
+	for _, settings := range allStackSettings {
+		dependencies := make([]string, 0, len(settings.DependsOn))
+		for _, dependency := range settings.DependsOn {
+			if liveStacks[dependency] {
+				dependencies = append(dependencies, dependency)
+			}
+		}
+		if len(dependencies) == len(settings.DependsOn) {
+			continue
+		}
+		glg.Infof("removing %d orphaned dependencies of stack %s in endpoint %d", len(settings.DependsOn)-len(dependencies), settings.StackName, endpointId)
+		settings.DependsOn = dependencies
+		if err := db.UpdateStackSettings(&settings, endpointId, settings.StackName); err != nil {
+			glg.Errorf("failed to update stack settings of %s: %s", settings.StackName, err)
+		}
+	}
+
+	groups, err := db.GetEndpointGroupSettings(endpointId)
+	if err != nil {
+		glg.Errorf("failed to get groups of endpoint %d: %s", endpointId, err)
+		return
+	}
+	for _, group := range groups {
+		members := make([]string, 0, len(group.Stacks))
+		for _, stackName := range group.Stacks {
+			if liveStacks[stackName] {
+				members = append(members, stackName)
+			}
+		}
+		if len(members) == len(group.Stacks) {
+			continue
+		}
+		glg.Infof("removing %d orphaned stacks from group %s in endpoint %d", len(group.Stacks)-len(members), group.GroupName, endpointId)
+		group.Stacks = members
+		if err := db.UpdateGroupSettings(&group, endpointId, group.GroupName); err != nil {
+			glg.Errorf("failed to update group %s: %s", group.GroupName, err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package portainer
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"washboard/hub"
+	"washboard/types"
+
+	"github.com/kpango/glg"
+)
+
+// statsConcurrency limits the stats requests running at the same time for an endpoint
+const statsConcurrency = 8
+
+// StatsHistory keeps the resource usage samples of the running containers of every sampled
+// endpoint and their sums per stack. Each history is a ring buffer covering the retention,
+// containers and stacks without samples for as long are forgotten.
+type StatsHistory struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	retention time.Duration
+	endpoints map[int]*endpointStats
+}
+
+type endpointStats struct {
+	containers map[string]*containerStats
+	stacks     map[string]*statsRing
+}
+
+// containerStats is the history of a container and its last reading, the CPU usage and the rates
+// of the next sample are computed from it
+type containerStats struct {
+	name      string
+	stackName string
+	samples   *statsRing
+	last      *ContainerStats
+}
+
+var Stats = NewStatsHistory(15*time.Second, 6*time.Hour)
+
+func NewStatsHistory(interval time.Duration, retention time.Duration) *StatsHistory {
+	return &StatsHistory{interval: interval, retention: retention, endpoints: make(map[int]*endpointStats)}
+}
+
+// Configure sets the sampling interval and the retention and forgets the samples taken so far
+func (h *StatsHistory) Configure(interval time.Duration, retention time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.interval = interval
+	h.retention = retention
+	h.endpoints = make(map[int]*endpointStats)
+}
+
+// reset forgets the samples of every endpoint
+func (h *StatsHistory) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.endpoints = make(map[int]*endpointStats)
+}
+
+// StartStatsSampler samples the running containers of the given endpoints every interval until ctx
+// is cancelled and keeps their samples for retention. An interval of 0 disables sampling.
+func StartStatsSampler(ctx context.Context, endpointIds []int, interval time.Duration, retention time.Duration) {
+	if interval <= 0 {
+		glg.Infof("Container stats sampling is disabled")
+		return
+	}
+	Stats.Configure(interval, retention)
+	glg.Infof("Sampling container stats every %s, keeping %s...", interval, retention)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, endpointId := range endpointIds {
+				if err := Stats.Sample(ctx, endpointId); err != nil && ctx.Err() == nil {
+					glg.Warnf("failed to sample the container stats of endpoint %d: %s", endpointId, err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sample reads the stats of the running containers of an endpoint, records them and publishes the
+// latest samples of its stacks. Containers whose stats can not be read are skipped.
+func (h *StatsHistory) Sample(ctx context.Context, endpointId int) error {
+	containers, err := client.GetContainers(ctx, endpointId, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	readings := make([]*ContainerStats, len(containers))
+	limit := make(chan struct{}, statsConcurrency)
+	var wg sync.WaitGroup
+	for i, container := range containers {
+		if container.State != types.ContainerRunning {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, containerId string) {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			stats, err := client.ContainerStats(ctx, endpointId, containerId)
+			if err != nil {
+				glg.Debugf("failed to get the stats of container %s: %s", containerId, err)
+				return
+			}
+			readings[i] = stats
+		}(i, container.Id)
+	}
+	wg.Wait()
+
+	h.record(endpointId, now, containers, readings)
+	hub.Publish(types.WsTopicStats, types.WsMsgStackStats, h.latest(endpointId))
+	return nil
+}
+
+// record adds the samples of the read containers and the sums of their stacks
+func (h *StatsHistory) record(endpointId int, now time.Time, containers []Container, readings []*ContainerStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	endpoint, ok := h.endpoints[endpointId]
+	if !ok {
+		endpoint = &endpointStats{containers: make(map[string]*containerStats), stacks: make(map[string]*statsRing)}
+		h.endpoints[endpointId] = endpoint
+	}
+
+	sums := make(map[string]*types.StatsSample)
+	for i, container := range containers {
+		reading := readings[i]
+		if reading == nil {
+			continue
+		}
+		if reading.Read.IsZero() {
+			reading.Read = now
+		}
+		entry, ok := endpoint.containers[container.Id]
+		if !ok {
+			entry = &containerStats{samples: newStatsRing(h.capacity())}
+			endpoint.containers[container.Id] = entry
+		}
+		if len(container.Names) > 0 {
+			entry.name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		entry.stackName = container.Labels[types.StackLabel]
+		sample := statsSample(now, entry.last, reading)
+		entry.last = reading
+		entry.samples.add(sample)
+
+		if entry.stackName == "" {
+			continue
+		}
+		sum, ok := sums[entry.stackName]
+		if !ok {
+			sum = &types.StatsSample{Time: sample.Time}
+			sums[entry.stackName] = sum
+		}
+		sum.CpuPercent += sample.CpuPercent
+		sum.MemoryUsage += sample.MemoryUsage
+		sum.NetworkRx += sample.NetworkRx
+		sum.NetworkTx += sample.NetworkTx
+		sum.BlockRead += sample.BlockRead
+		sum.BlockWrite += sample.BlockWrite
+		sum.Containers++
+	}
+	for stackName, sum := range sums {
+		ring, ok := endpoint.stacks[stackName]
+		if !ok {
+			ring = newStatsRing(h.capacity())
+			endpoint.stacks[stackName] = ring
+		}
+		ring.add(*sum)
+	}
+
+	cutoff := now.Add(-h.retention).Unix()
+	for containerId, entry := range endpoint.containers {
+		if last, ok := entry.samples.last(); !ok || last.Time < cutoff {
+			delete(endpoint.containers, containerId)
+		}
+	}
+	for stackName, ring := range endpoint.stacks {
+		if last, ok := ring.last(); !ok || last.Time < cutoff {
+			delete(endpoint.stacks, stackName)
+		}
+	}
+}
+
+// capacity is the number of samples covering the retention
+func (h *StatsHistory) capacity() int {
+	return max(int(h.retention/h.interval), 0) + 1
+}
+
+// Stack returns the samples of a stack and its containers taken since from, oldest first
+func (h *StatsHistory) Stack(endpointId int, stackName string, from time.Time) types.StackStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := types.StackStats{
+		EndpointId: endpointId,
+		StackName:  stackName,
+		Interval:   int(h.interval.Seconds()),
+		Samples:    make([]types.StatsSample, 0),
+		Containers: make([]types.ContainerStatsHistory, 0),
+	}
+	endpoint, ok := h.endpoints[endpointId]
+	if !ok {
+		return stats
+	}
+	if ring, ok := endpoint.stacks[stackName]; ok {
+		stats.Samples = ring.since(from.Unix())
+	}
+	for containerId, entry := range endpoint.containers {
+		if entry.stackName != stackName {
+			continue
+		}
+		if samples := entry.samples.since(from.Unix()); len(samples) > 0 {
+			stats.Containers = append(stats.Containers, types.ContainerStatsHistory{ContainerId: containerId, Name: entry.name, Samples: samples})
+		}
+	}
+	sort.Slice(stats.Containers, func(i, j int) bool {
+		return stats.Containers[i].Name < stats.Containers[j].Name
+	})
+	return stats
+}
+
+// latest returns the last sample of every stack of an endpoint along with the samples its
+// containers contributed to it
+func (h *StatsHistory) latest(endpointId int) []types.StackStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	latest := make([]types.StackStats, 0)
+	endpoint, ok := h.endpoints[endpointId]
+	if !ok {
+		return latest
+	}
+	for stackName, ring := range endpoint.stacks {
+		sum, _ := ring.last()
+		stats := types.StackStats{
+			EndpointId: endpointId,
+			StackName:  stackName,
+			Interval:   int(h.interval.Seconds()),
+			Samples:    []types.StatsSample{sum},
+			Containers: make([]types.ContainerStatsHistory, 0),
+		}
+		for containerId, entry := range endpoint.containers {
+			if last, ok := entry.samples.last(); ok && entry.stackName == stackName && last.Time == sum.Time {
+				stats.Containers = append(stats.Containers, types.ContainerStatsHistory{ContainerId: containerId, Name: entry.name, Samples: []types.StatsSample{last}})
+			}
+		}
+		sort.Slice(stats.Containers, func(i, j int) bool {
+			return stats.Containers[i].Name < stats.Containers[j].Name
+		})
+		latest = append(latest, stats)
+	}
+	sort.Slice(latest, func(i, j int) bool {
+		return latest[i].StackName < latest[j].StackName
+	})
+	return latest
+}
+
+// Snapshot returns the latest samples of the stacks of every sampled endpoint
+func (h *StatsHistory) Snapshot() []types.StackStats {
+	h.mu.Lock()
+	endpointIds := make([]int, 0, len(h.endpoints))
+	for endpointId := range h.endpoints {
+		endpointIds = append(endpointIds, endpointId)
+	}
+	h.mu.Unlock()
+	sort.Ints(endpointIds)
+	snapshot := make([]types.StackStats, 0)
+	for _, endpointId := range endpointIds {
+		snapshot = append(snapshot, h.latest(endpointId)...)
+	}
+	return snapshot
+}
+
+// Latest returns the last sample of a container if it was taken by one of the last two samplings,
+// nil for containers that stopped or were never sampled
+func (h *StatsHistory) Latest(containerId string) *types.StatsSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recent := time.Now().Add(-2 * h.interval).Unix()
+	for _, endpoint := range h.endpoints {
+		if entry, ok := endpoint.containers[containerId]; ok {
+			if last, ok := entry.samples.last(); ok && last.Time >= recent {
+				return &last
+			}
+		}
+	}
+	return nil
+}
+
+// statsSample computes the sample of a reading. The CPU usage and the rates are relative to the
+// previous reading of the container and zero for its first one or after a restart reset the
+// counters.
+func statsSample(now time.Time, previous *ContainerStats, current *ContainerStats) types.StatsSample {
+	sample := types.StatsSample{
+		Time:        now.Unix(),
+		MemoryUsage: memoryUsage(current.MemoryStats),
+		MemoryLimit: current.MemoryStats.Limit,
+	}
+	if previous == nil {
+		return sample
+	}
+	cpuDelta := counterDelta(previous.CpuStats.CpuUsage.TotalUsage, current.CpuStats.CpuUsage.TotalUsage)
+	systemDelta := counterDelta(previous.CpuStats.SystemCpuUsage, current.CpuStats.SystemCpuUsage)
+	if systemDelta > 0 {
+		cpus := max(current.CpuStats.OnlineCpus, 1)
+		sample.CpuPercent = cpuDelta / systemDelta * float64(cpus) * 100
+	}
+	seconds := current.Read.Sub(previous.Read).Seconds()
+	if seconds <= 0 {
+		return sample
+	}
+	previousRx, previousTx := networkBytes(previous)
+	rx, tx := networkBytes(current)
+	sample.NetworkRx = counterDelta(previousRx, rx) / seconds
+	sample.NetworkTx = counterDelta(previousTx, tx) / seconds
+	previousRead, previousWrite := blockBytes(previous)
+	read, write := blockBytes(current)
+	sample.BlockRead = counterDelta(previousRead, read) / seconds
+	sample.BlockWrite = counterDelta(previousWrite, write) / seconds
+	return sample
+}
+
+// counterDelta is the increase of a counter, 0 if it was reset
+func counterDelta(previous uint64, current uint64) float64 {
+	if current < previous {
+		return 0
+	}
+	return float64(current - previous)
+}
+
+// memoryUsage is the usage without the inactive page cache, like docker stats reports it
+func memoryUsage(memory MemoryStats) uint64 {
+	inactive, ok := memory.Stats["inactive_file"]
+	if !ok {
+		inactive = memory.Stats["total_inactive_file"]
+	}
+	if inactive < memory.Usage {
+		return memory.Usage - inactive
+	}
+	return memory.Usage
+}
+
+func networkBytes(stats *ContainerStats) (rx uint64, tx uint64) {
+	for _, network := range stats.Networks {
+		rx += network.RxBytes
+		tx += network.TxBytes
+	}
+	return rx, tx
+}
+
+func blockBytes(stats *ContainerStats) (read uint64, write uint64) {
+	for _, entry := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += entry.Value
+		case "write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
+// statsRing keeps the last samples up to its capacity, the oldest are overwritten
+type statsRing struct {
+	samples  []types.StatsSample
+	capacity int
+	start    int
+}
+
+func newStatsRing(capacity int) *statsRing {
+	return &statsRing{capacity: capacity}
+}
+
+func (r *statsRing) add(sample types.StatsSample) {
+	if len(r.samples) < r.capacity {
+		r.samples = append(r.samples, sample)
+		return
+	}
+	r.samples[r.start] = sample
+	r.start = (r.start + 1) % r.capacity
+}
+
+// since returns the samples taken at from or later, oldest first
+func (r *statsRing) since(from int64) []types.StatsSample {
+	samples := make([]types.StatsSample, 0, len(r.samples))
+	for i := range r.samples {
+		if sample := r.samples[(r.start+i)%len(r.samples)]; sample.Time >= from {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func (r *statsRing) last() (types.StatsSample, bool) {
+	if len(r.samples) == 0 {
+		return types.StatsSample{}, false
+	}
+	return r.samples[(r.start+len(r.samples)-1)%len(r.samples)], true
+}
@@ -0,0 +1,63 @@
+package portainer
+
+import (
+	"testing"
+	"time"
+
+	"washboard/types"
+)
+
+func statsReading(read time.Time, cpu uint64, system uint64, rx uint64, written uint64) *ContainerStats {
+	stats := &ContainerStats{
+		Read:        read,
+		MemoryStats: MemoryStats{Usage: 300 << 20, Limit: 1 << 30, Stats: map[string]uint64{"inactive_file": 100 << 20}},
+		Networks:    map[string]NetworkStats{"eth0": {RxBytes: rx}, "eth1": {RxBytes: rx}},
+		BlkioStats:  BlkioStats{IoServiceBytesRecursive: []BlkioStatEntry{{Op: "Write", Value: written}, {Op: "Read", Value: 1 << 20}}},
+	}
+	stats.CpuStats.CpuUsage.TotalUsage = cpu
+	stats.CpuStats.SystemCpuUsage = system
+	stats.CpuStats.OnlineCpus = 4
+	return stats
+}
+
+func TestStatsSample(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	first := statsReading(now, 1e9, 100e9, 1000, 0)
+	sample := statsSample(now, nil, first)
+	if sample.MemoryUsage != 200<<20 || sample.MemoryLimit != 1<<30 || sample.CpuPercent != 0 || sample.NetworkRx != 0 {
+		t.Fatalf("expected only the memory usage without the page cache for the first reading, got %+v", sample)
+	}
+
+	// a quarter of the system time on four cpus is one full cpu
+	second := statsReading(now.Add(10*time.Second), 3e9, 108e9, 6000, 40960)
+	sample = statsSample(now.Add(10*time.Second), first, second)
+	if sample.CpuPercent != 100 || sample.NetworkRx != 1000 || sample.BlockWrite != 4096 || sample.BlockRead != 0 {
+		t.Fatalf("unexpected sample %+v", sample)
+	}
+
+	// a restart resets the counters
+	restarted := statsReading(now.Add(20*time.Second), 1e8, 116e9, 10, 0)
+	if sample = statsSample(now.Add(20*time.Second), second, restarted); sample.NetworkRx != 0 || sample.BlockWrite != 0 {
+		t.Fatalf("expected no rates after a restart, got %+v", sample)
+	}
+}
+
+func TestStatsRing(t *testing.T) {
+	ring := newStatsRing(3)
+	if _, ok := ring.last(); ok || len(ring.since(0)) != 0 {
+		t.Fatal("expected an empty ring")
+	}
+	for i := int64(1); i <= 5; i++ {
+		ring.add(types.StatsSample{Time: i})
+	}
+	samples := ring.since(0)
+	if len(samples) != 3 || samples[0].Time != 3 || samples[2].Time != 5 {
+		t.Fatalf("expected the last three samples oldest first, got %+v", samples)
+	}
+	if samples = ring.since(4); len(samples) != 2 || samples[0].Time != 4 {
+		t.Fatalf("expected the samples since 4, got %+v", samples)
+	}
+	if last, ok := ring.last(); !ok || last.Time != 5 {
+		t.Fatalf("expected the newest sample, got %+v", last)
+	}
+}
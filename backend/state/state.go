@@ -25,7 +25,7 @@ func Instance() *Data {
 			glg.Fatal(err)
 		}
 		instance = new(Data)
-		instance.Config = Config{CacheDurationMinutes: 1, StartStacksOnLaunch: false, StartEndpointId: 1}
+		instance.Config = Config{CacheDurationMinutes: 1, StartStacksOnLaunch: false, StartEndpointId: 1, PortainerTimeout: 30, StackStartTimeout: 120, StopGracePeriod: 30, StatsInterval: 15, StatsRetention: 6, AuditExportLimit: 10000}
 		instance.StackUpdateQueue = cache.New(5*time.Minute, 10*time.Minute)
 		instance.StateQueue = cache.New(1*time.Minute, 1*time.Minute)
 		reflectionPath = filepath.Dir(ex)
@@ -78,16 +78,95 @@ func ReflectionPath() string {
 
 type Config struct {
 	// secrets
-	PortainerSecret      string   `yaml:"portainer_secret"`
-	PortainerUrl         string   `yaml:"portainer_url"`
-	DbUrl                string   `yaml:"db_url"`
-	User                 string   `yaml:"user"`
-	Password             string   `yaml:"password"`
-	JwtSecret            string   `yaml:"jwt_secret"`
-	CacheDurationMinutes int      `yaml:"cache_duration_minutes"`
-	Cors                 []string `yaml:"cors"`
-	StartStacksOnLaunch  bool     `yaml:"start_stacks_on_launch"`
-	StartEndpointId      int      `yaml:"start_endpoint_id"`
+	PortainerSecret      string              `yaml:"portainer_secret"`
+	PortainerUrl         string              `yaml:"portainer_url"`
+	DbUrl                string              `yaml:"db_url"`
+	User                 string              `yaml:"user"`
+	Password             string              `yaml:"password"`
+	JwtSecret            string              `yaml:"jwt_secret"`
+	CacheDurationMinutes int                 `yaml:"cache_duration_minutes"`
+	Cors                 []string            `yaml:"cors"`
+	StartStacksOnLaunch  bool                `yaml:"start_stacks_on_launch"`
+	StartEndpointId      int                 `yaml:"start_endpoint_id"`
+	ManagedEndpointIds   []int               `yaml:"endpoint_ids"`
+	PortainerTimeout     int                 `yaml:"portainer_timeout_seconds"`
+	StackStartTimeout    int                 `yaml:"stack_start_timeout_seconds"`
+	StopGracePeriod      int                 `yaml:"stop_grace_period_seconds"`
+	StatsInterval        int                 `yaml:"stats_interval_seconds"`
+	StatsRetention       int                 `yaml:"stats_retention_hours"`
+	AuditExportLimit     int                 `yaml:"audit_export_limit"`
+	Notifiers            []NotifierConfig    `yaml:"notifiers"`
+	MetricsToken         string              `yaml:"metrics_token"`
+	Oidc                 OidcConfig          `yaml:"oidc"`
+	LoginThrottle        LoginThrottleConfig `yaml:"login_throttle"`
+}
+
+// OidcConfig enables single sign-on with an OpenID Connect provider if Issuer is set. RedirectUrl
+// is the public url of /api/auth/oidc/callback. Users get the highest role of the groups listed
+// in GroupsClaim of their ID token, or DefaultRole if none of them is mapped. Users without a
+// role are rejected.
+type OidcConfig struct {
+	Issuer         string   `yaml:"issuer"`
+	ClientId       string   `yaml:"client_id"`
+	ClientSecret   string   `yaml:"client_secret"`
+	RedirectUrl    string   `yaml:"redirect_url"`
+	Scopes         []string `yaml:"scopes,omitempty"`
+	UsernameClaim  string   `yaml:"username_claim,omitempty"`
+	GroupsClaim    string   `yaml:"groups_claim,omitempty"`
+	AdminGroups    []string `yaml:"admin_groups,omitempty"`
+	OperatorGroups []string `yaml:"operator_groups,omitempty"`
+	ViewerGroups   []string `yaml:"viewer_groups,omitempty"`
+	DefaultRole    string   `yaml:"default_role,omitempty"`
+	SuccessUrl     string   `yaml:"success_url,omitempty"`
+}
+
+// LoginThrottleConfig limits password login attempts per user name and per client ip. After
+// FreeAttempts failures every further attempt has to wait BaseDelaySeconds, doubling with each
+// failure up to MaxDelaySeconds. After LockoutAttempts failures of a user name, or
+// IpLockoutAttempts failures from an ip, logins are locked for LockoutMinutes. Failures are
+// forgotten ResetMinutes after the last one. Zero values use the defaults of auth.NewLoginThrottle.
+type LoginThrottleConfig struct {
+	Disabled          bool `yaml:"disabled"`
+	FreeAttempts      int  `yaml:"free_attempts,omitempty"`
+	BaseDelaySeconds  int  `yaml:"base_delay_seconds,omitempty"`
+	MaxDelaySeconds   int  `yaml:"max_delay_seconds,omitempty"`
+	LockoutAttempts   int  `yaml:"lockout_attempts,omitempty"`
+	IpLockoutAttempts int  `yaml:"ip_lockout_attempts,omitempty"`
+	LockoutMinutes    int  `yaml:"lockout_minutes,omitempty"`
+	ResetMinutes      int  `yaml:"reset_minutes,omitempty"`
+}
+
+// NotifierConfig configures one notification target. Which fields are used depends on Type:
+//   - webhook: Url, Headers. Posts every event as JSON.
+//   - discord, slack: Url of the incoming webhook
+//   - email: SmtpHost, SmtpPort, SmtpUsername, SmtpPassword, From, To
+//   - ntfy: Url including the topic, optional Token and Priority
+//   - gotify: Url of the server, Token of the application, optional Priority
+//
+// Events limits the notifier to the given event kinds, all events are sent if it is empty.
+type NotifierConfig struct {
+	Type         string            `yaml:"type"`
+	Name         string            `yaml:"name,omitempty"`
+	Url          string            `yaml:"url,omitempty"`
+	Token        string            `yaml:"token,omitempty"`
+	Headers      map[string]string `yaml:"headers,omitempty"`
+	Priority     int               `yaml:"priority,omitempty"`
+	SmtpHost     string            `yaml:"smtp_host,omitempty"`
+	SmtpPort     int               `yaml:"smtp_port,omitempty"`
+	SmtpUsername string            `yaml:"smtp_username,omitempty"`
+	SmtpPassword string            `yaml:"smtp_password,omitempty"`
+	From         string            `yaml:"from,omitempty"`
+	To           []string          `yaml:"to,omitempty"`
+	Events       []string          `yaml:"events,omitempty"`
+}
+
+// EndpointIds returns the Portainer endpoints washboard syncs, refreshes and autostarts.
+// Falls back to StartEndpointId if no endpoint_ids are configured.
+func (c *Config) EndpointIds() []int {
+	if len(c.ManagedEndpointIds) > 0 {
+		return c.ManagedEndpointIds
+	}
+	return []int{c.StartEndpointId}
 }
 
 type Data struct {
@@ -144,4 +223,81 @@ func overwriteConfigWithEnv(config *Config) {
 			glg.Warn("invalid START_ENDPOINT_ID value, using default")
 		}
 	}
+
+	if value, exists := os.LookupEnv("ENDPOINT_IDS"); exists {
+		endpointIds := make([]int, 0)
+		for _, raw := range strings.Split(value, ",") {
+			if intValue, err := strconv.Atoi(strings.TrimSpace(raw)); err == nil {
+				endpointIds = append(endpointIds, intValue)
+			} else {
+				glg.Warnf("invalid endpoint id %q in ENDPOINT_IDS, skipping", raw)
+			}
+		}
+		config.ManagedEndpointIds = endpointIds
+	}
+
+	if value, exists := os.LookupEnv("OIDC_ISSUER"); exists {
+		config.Oidc.Issuer = value
+	}
+	if value, exists := os.LookupEnv("OIDC_CLIENT_ID"); exists {
+		config.Oidc.ClientId = value
+	}
+	if value, exists := os.LookupEnv("OIDC_CLIENT_SECRET"); exists {
+		config.Oidc.ClientSecret = value
+	}
+	if value, exists := os.LookupEnv("OIDC_REDIRECT_URL"); exists {
+		config.Oidc.RedirectUrl = value
+	}
+
+	if value, exists := os.LookupEnv("METRICS_TOKEN"); exists {
+		config.MetricsToken = value
+	}
+
+	if value, exists := os.LookupEnv("PORTAINER_TIMEOUT_SECONDS"); exists {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			config.PortainerTimeout = intValue
+		} else {
+			glg.Warn("invalid PORTAINER_TIMEOUT_SECONDS value, using default")
+		}
+	}
+
+	if value, exists := os.LookupEnv("STACK_START_TIMEOUT_SECONDS"); exists {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			config.StackStartTimeout = intValue
+		} else {
+			glg.Warn("invalid STACK_START_TIMEOUT_SECONDS value, using default")
+		}
+	}
+
+	if value, exists := os.LookupEnv("STOP_GRACE_PERIOD_SECONDS"); exists {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			config.StopGracePeriod = intValue
+		} else {
+			glg.Warn("invalid STOP_GRACE_PERIOD_SECONDS value, using default")
+		}
+	}
+
+	if value, exists := os.LookupEnv("STATS_INTERVAL_SECONDS"); exists {
+		if intValue, err := strconv.Atoi(value); err == nil {
+			config.StatsInterval = intValue
+		} else {
+			glg.Warn("invalid STATS_INTERVAL_SECONDS value, using default")
+		}
+	}
+
+	if value, exists := os.LookupEnv("STATS_RETENTION_HOURS"); exists {
+		if intValue, err := strconv.Atoi(value); err == nil && intValue > 0 {
+			config.StatsRetention = intValue
+		} else {
+			glg.Warn("invalid STATS_RETENTION_HOURS value, using default")
+		}
+	}
+
+	if value, exists := os.LookupEnv("AUDIT_EXPORT_LIMIT"); exists {
+		if intValue, err := strconv.Atoi(value); err == nil && intValue > 0 {
+			config.AuditExportLimit = intValue
+		} else {
+			glg.Warn("invalid AUDIT_EXPORT_LIMIT value, using default")
+		}
+	}
 }
@@ -22,17 +22,29 @@ type ContainerDto struct {
 	Networks []string               `json:"networks"`
 	Ports    []string               `json:"ports"`
 	Labels   map[string]interface{} `json:"labels"`
+	// Health is one of HealthStarting, HealthHealthy and HealthUnhealthy, empty for containers
+	// without a Docker healthcheck
+	Health string `json:"health"`
+	// Stats is the latest resource usage sample of a running container, if it was sampled
+	Stats *StatsSample `json:"stats,omitempty"`
 }
 
 type StackDto struct {
-	Id         int             `json:"id"`
-	Name       string          `json:"name"`
-	Containers []*ContainerDto `json:"containers"`
-	Priority   int             `json:"priority"`
-	AutoStart  bool            `json:"autoStart"`
+	Id           int             `json:"id"`
+	EndpointId   int             `json:"endpointId"`
+	Name         string          `json:"name"`
+	Containers   []*ContainerDto `json:"containers"`
+	Priority     int             `json:"priority"`
+	AutoStart    bool            `json:"autoStart"`
+	UpdatePolicy string          `json:"updatePolicy"`
+	UpdateWindow string          `json:"updateWindow"`
+	Group        string          `json:"group"`
+	DependsOn    []string        `json:"dependsOn"`
+	StartTimeout int             `json:"startTimeout"`
 }
 
 type StackUpdateStatus struct {
+	JobId      string `json:"jobId"`
 	EndpointId int    `json:"endpointId"`
 	StackId    int    `json:"stackId"`
 	StackName  string `json:"stackName"`
@@ -41,23 +53,377 @@ type StackUpdateStatus struct {
 	Timestamp  int64  `json:"timestamp"`
 }
 
+// ContainerImage is the image a container of a stack was running at a point in time. Digest is
+// the repo digest (e.g. nginx@sha256:…) the stack can be pinned to, empty for local images.
+type ContainerImage struct {
+	ContainerName string `bson:"containerName" json:"containerName"`
+	Service       string `bson:"service" json:"service"`
+	Image         string `bson:"image" json:"image"`
+	ImageId       string `bson:"imageId" json:"imageId"`
+	Digest        string `bson:"digest" json:"digest"`
+}
+
+type EnvVar struct {
+	Name  string `bson:"name" json:"name"`
+	Value string `bson:"value" json:"value"`
+}
+
+// StackUpdateJob is the persisted record of a single stack update. StackFile, Env and ImagesBefore
+// are the snapshot of the stack before the update that a rollback redeploys. RollbackOf is set on
+// rollbacks to the id of the job whose snapshot was redeployed.
+type StackUpdateJob struct {
+	Id           string           `bson:"_id" json:"id"`
+	EndpointId   int              `bson:"endpointId" json:"endpointId"`
+	StackId      int              `bson:"stackId" json:"stackId"`
+	StackName    string           `bson:"stackName" json:"stackName"`
+	TriggeredBy  string           `bson:"triggeredBy" json:"triggeredBy"`
+	Prune        bool             `bson:"prune" json:"prune"`
+	PullImage    bool             `bson:"pullImage" json:"pullImage"`
+	RollbackOf   string           `bson:"rollbackOf" json:"rollbackOf"`
+	Status       string           `bson:"status" json:"status"`
+	Details      string           `bson:"details" json:"details"`
+	QueuedAt     int64            `bson:"queuedAt" json:"queuedAt"`
+	StartedAt    int64            `bson:"startedAt" json:"startedAt"`
+	FinishedAt   int64            `bson:"finishedAt" json:"finishedAt"`
+	ImagesBefore []ContainerImage `bson:"imagesBefore" json:"imagesBefore"`
+	ImagesAfter  []ContainerImage `bson:"imagesAfter" json:"imagesAfter"`
+	StackFile    string           `bson:"stackFile" json:"stackFile"`
+	Env          []EnvVar         `bson:"env" json:"env"`
+}
+
+// StackUpdateJobDto is a StackUpdateJob as returned by the api. The compose file and env of the
+// snapshot may hold secrets and stay internal to rollbacks.
+type StackUpdateJobDto struct {
+	Id           string           `json:"id"`
+	EndpointId   int              `json:"endpointId"`
+	StackId      int              `json:"stackId"`
+	StackName    string           `json:"stackName"`
+	TriggeredBy  string           `json:"triggeredBy"`
+	Prune        bool             `json:"prune"`
+	PullImage    bool             `json:"pullImage"`
+	RollbackOf   string           `json:"rollbackOf"`
+	Status       string           `json:"status"`
+	Details      string           `json:"details"`
+	QueuedAt     int64            `json:"queuedAt"`
+	StartedAt    int64            `json:"startedAt"`
+	FinishedAt   int64            `json:"finishedAt"`
+	ImagesBefore []ContainerImage `json:"imagesBefore"`
+	ImagesAfter  []ContainerImage `json:"imagesAfter"`
+}
+
+func (j *StackUpdateJob) Dto() StackUpdateJobDto {
+	return StackUpdateJobDto{
+		Id:           j.Id,
+		EndpointId:   j.EndpointId,
+		StackId:      j.StackId,
+		StackName:    j.StackName,
+		TriggeredBy:  j.TriggeredBy,
+		Prune:        j.Prune,
+		PullImage:    j.PullImage,
+		RollbackOf:   j.RollbackOf,
+		Status:       j.Status,
+		Details:      j.Details,
+		QueuedAt:     j.QueuedAt,
+		StartedAt:    j.StartedAt,
+		FinishedAt:   j.FinishedAt,
+		ImagesBefore: j.ImagesBefore,
+		ImagesAfter:  j.ImagesAfter,
+	}
+}
+
+// JobFilter selects stack update jobs. Zero values match everything. From and To are unix
+// timestamps compared against QueuedAt.
+type JobFilter struct {
+	EndpointId  int
+	StackId     int
+	StackName   string
+	Status      string
+	TriggeredBy string
+	From        int64
+	To          int64
+	Offset      int
+	Limit       int
+}
+
+func (f *JobFilter) Matches(job *StackUpdateJob) bool {
+	if f.EndpointId != 0 && job.EndpointId != f.EndpointId {
+		return false
+	}
+	if f.StackId != 0 && job.StackId != f.StackId {
+		return false
+	}
+	if f.StackName != "" && job.StackName != f.StackName {
+		return false
+	}
+	if f.Status != "" && job.Status != f.Status {
+		return false
+	}
+	if f.TriggeredBy != "" && job.TriggeredBy != f.TriggeredBy {
+		return false
+	}
+	if f.From != 0 && job.QueuedAt < f.From {
+		return false
+	}
+	if f.To != 0 && job.QueuedAt > f.To {
+		return false
+	}
+	return true
+}
+
+// AuditEntry records one mutating action. UserName is the identity that performed it, ApiTokenId
+// is set if it used an api token. Target names the stack, container or account acted on, Params
+// holds the request parameters with secrets removed. Result is AuditSuccess or AuditFailure.
+type AuditEntry struct {
+	Id         string                 `bson:"_id" json:"id"`
+	Timestamp  int64                  `bson:"timestamp" json:"timestamp"`
+	UserName   string                 `bson:"userName" json:"userName"`
+	ApiTokenId string                 `bson:"apiTokenId,omitempty" json:"apiTokenId,omitempty"`
+	Action     string                 `bson:"action" json:"action"`
+	Target     string                 `bson:"target" json:"target"`
+	Params     map[string]interface{} `bson:"params,omitempty" json:"params,omitempty"`
+	Result     string                 `bson:"result" json:"result"`
+	StatusCode int                    `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Error      string                 `bson:"error,omitempty" json:"error,omitempty"`
+	ClientIp   string                 `bson:"clientIp" json:"clientIp"`
+}
+
+// AuditFilter selects audit entries. Zero values match everything, Action also matches every
+// action starting with it followed by a dot. From and To are unix timestamps.
+type AuditFilter struct {
+	UserName string
+	Action   string
+	Target   string
+	Result   string
+	From     int64
+	To       int64
+	Offset   int
+	Limit    int
+}
+
+func (f *AuditFilter) Matches(entry *AuditEntry) bool {
+	if f.UserName != "" && entry.UserName != f.UserName {
+		return false
+	}
+	if f.Action != "" && entry.Action != f.Action && !strings.HasPrefix(entry.Action, f.Action+".") {
+		return false
+	}
+	if f.Target != "" && entry.Target != f.Target {
+		return false
+	}
+	if f.Result != "" && entry.Result != f.Result {
+		return false
+	}
+	if f.From != 0 && entry.Timestamp < f.From {
+		return false
+	}
+	if f.To != 0 && entry.Timestamp > f.To {
+		return false
+	}
+	return true
+}
+
 type ImageRefreshState struct {
-	Running    bool   `json:"running"`
-	StartedAt  int64  `json:"startedAt"`
-	FinishedAt int64  `json:"finishedAt"`
-	Error      string `json:"error"`
+	Running     bool   `json:"running"`
+	EndpointIds []int  `json:"endpointIds"`
+	StartedAt   int64  `json:"startedAt"`
+	FinishedAt  int64  `json:"finishedAt"`
+	Error       string `json:"error"`
+}
+
+// StartupState is the progress of the autostart sync of an endpoint
+type StartupState struct {
+	EndpointId int                  `json:"endpointId"`
+	Running    bool                 `json:"running"`
+	StartedAt  int64                `json:"startedAt"`
+	FinishedAt int64                `json:"finishedAt"`
+	Stacks     []StackStartProgress `json:"stacks"`
+}
+
+// StackStartProgress is the startup of one autostart stack. Status is one of StartPending,
+// StartWaiting, StartReady, StartTimedOut, Skipped and Error. Containers counts the containers of
+// the stack, Running the running ones, Healthchecks the ones with a Docker healthcheck and Healthy
+// the healthy ones among them.
+type StackStartProgress struct {
+	StackId      int    `json:"stackId"`
+	StackName    string `json:"stackName"`
+	Wave         int    `json:"wave"`
+	Status       string `json:"status"`
+	Containers   int    `json:"containers"`
+	Running      int    `json:"running"`
+	Healthchecks int    `json:"healthchecks"`
+	Healthy      int    `json:"healthy"`
+	Error        string `json:"error,omitempty"`
+	UpdatedAt    int64  `json:"updatedAt"`
 }
 
+// states of a stack during the autostart sync
+const (
+	StartPending  = "pending"
+	StartWaiting  = "waiting"
+	StartReady    = "ready"
+	StartTimedOut = "timeout"
+)
+
+// health of a container with a Docker healthcheck
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// WsEnvelope is a websocket message. Seq numbers the events of the hub, snapshots carry the
+// sequence number they are current with. Epoch identifies the hub, sequence numbers restart when
+// the backend does. Clients reconnect with the last Epoch and Seq they received to resume, see
+// hub.Subscribe.
 type WsEnvelope struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
+	Epoch string      `json:"epoch"`
+	Seq   uint64      `json:"seq"`
+	Topic string      `json:"topic"`
+	Type  string      `json:"type"`
+	Time  int64       `json:"time"`
+	Data  interface{} `json:"data"`
 }
 
+// websocket topics, clients subscribe to a subset with ?topics=
 const (
-	WsMsgStackUpdateQueue  = "stack-update-queue"
+	WsTopicStackUpdates = "stack-updates"
+	WsTopicImageRefresh = "image-refresh"
+	WsTopicStartup      = "startup"
+	WsTopicContainers   = "containers"
+	WsTopicStats        = "stats"
+)
+
+// websocket message types. Snapshots are sent on connect, the other types are deltas.
+const (
+	// snapshot of all update statuses grouped by status and stack name
+	WsMsgStackUpdateQueue = "stack-update-queue"
+	// a StackUpdateStatus that was added or changed
+	WsMsgStackUpdate = "stack-update"
+	// a StackUpdateStatus that expired and was removed from the queue
+	WsMsgStackUpdateRemoved = "stack-update-removed"
+	// the ImageRefreshState, snapshot and delta
 	WsMsgImageRefreshState = "image-refresh-state"
+	// snapshot of the StartupState of every endpoint
+	WsMsgStartupProgress = "startup-progress"
+	// the StartupState of an endpoint whose autostart sync started or finished
+	WsMsgStartupState = "startup-state"
+	// a StartupStackEvent for a stack that made progress
+	WsMsgStartupStack = "startup-stack"
+	// snapshot of the EndpointContainerStates of every endpoint, also sent for a single endpoint
+	// whenever its event stream connected or disconnected
+	WsMsgContainerStates = "container-states"
+	// a ContainerStateEvent for a container whose state changed
+	WsMsgContainerState = "container-state"
+	// the StackStats of every sampled stack with the latest sample only, snapshot and, after
+	// every sampling of an endpoint, delta for its stacks
+	WsMsgStackStats = "stack-stats"
+)
+
+// StartupStackEvent is the progress of one stack during the autostart sync of an endpoint
+type StartupStackEvent struct {
+	EndpointId int `json:"endpointId"`
+	StackStartProgress
+}
+
+// ContainerState is the live state of a container, kept current by the Docker event stream of its
+// endpoint. Status is the docker state like in ContainerDto, Health one of HealthStarting,
+// HealthHealthy and HealthUnhealthy or empty.
+type ContainerState struct {
+	EndpointId  int    `json:"endpointId"`
+	ContainerId string `json:"containerId"`
+	Name        string `json:"name"`
+	StackName   string `json:"stackName"`
+	Status      string `json:"status"`
+	Health      string `json:"health"`
+	UpdatedAt   int64  `json:"updatedAt"`
+}
+
+// StackState counts the live states of the containers of a stack, see StackStartProgress
+type StackState struct {
+	EndpointId   int    `json:"endpointId"`
+	StackName    string `json:"stackName"`
+	Containers   int    `json:"containers"`
+	Running      int    `json:"running"`
+	Healthchecks int    `json:"healthchecks"`
+	Healthy      int    `json:"healthy"`
+}
+
+// EndpointContainerStates are the live states of the containers of an endpoint. Connected is
+// false while the event stream of the endpoint is down and the states may be outdated.
+type EndpointContainerStates struct {
+	EndpointId int              `json:"endpointId"`
+	Connected  bool             `json:"connected"`
+	Containers []ContainerState `json:"containers"`
+}
+
+// ContainerStateEvent is a container whose state changed by the docker event Action, e.g. start,
+// die or health_status, and the state of its stack afterwards. Containers removed by a destroy
+// event keep their last state.
+type ContainerStateEvent struct {
+	Action    string         `json:"action"`
+	Container ContainerState `json:"container"`
+	Stack     *StackState    `json:"stack,omitempty"`
+}
+
+// LogLine is a line of the logs of a container. Stream is LogStdout or LogStderr, Timestamp the
+// RFC 3339 time docker logged the line at if requested.
+type LogLine struct {
+	Stream    string `json:"stream"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Line      string `json:"line"`
+}
+
+const (
+	LogStdout = "stdout"
+	LogStderr = "stderr"
+)
+
+// ExecMessage is a message of the client of an exec terminal. ExecInput sends Data to the stdin of
+// the process, ExecResize sets the size of its TTY to Rows and Cols.
+type ExecMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+}
+
+const (
+	ExecInput  = "input"
+	ExecResize = "resize"
 )
 
+// StatsSample is the resource usage of a container, or the sum over the containers of a stack, at
+// Time. CpuPercent is relative to one CPU, network and block I/O are in bytes per second since the
+// previous sample. MemoryLimit is only set for containers, Containers only for stacks.
+type StatsSample struct {
+	Time        int64   `json:"time"`
+	CpuPercent  float64 `json:"cpuPercent"`
+	MemoryUsage uint64  `json:"memoryUsage"`
+	MemoryLimit uint64  `json:"memoryLimit,omitempty"`
+	NetworkRx   float64 `json:"networkRx"`
+	NetworkTx   float64 `json:"networkTx"`
+	BlockRead   float64 `json:"blockRead"`
+	BlockWrite  float64 `json:"blockWrite"`
+	Containers  int     `json:"containers,omitempty"`
+}
+
+type ContainerStatsHistory struct {
+	ContainerId string        `json:"containerId"`
+	Name        string        `json:"name"`
+	Samples     []StatsSample `json:"samples"`
+}
+
+// StackStats is the resource usage history of a stack and its containers, oldest sample first.
+// Interval is the sampling interval in seconds.
+type StackStats struct {
+	EndpointId int                     `json:"endpointId"`
+	StackId    int                     `json:"stackId,omitempty"`
+	StackName  string                  `json:"stackName"`
+	Interval   int                     `json:"interval"`
+	Samples    []StatsSample           `json:"samples"`
+	Containers []ContainerStatsHistory `json:"containers"`
+}
+
 type ContainerAction string
 
 // We could make an ActionType type and use that instead of string but that would require some annoying refactoring
@@ -74,9 +440,26 @@ const (
 	DbGroupSettingsCollection string          = "group_settings"
 	DbStackSettingsCollection string          = "stack_settings"
 	DbAccountsCollection      string          = "accounts"
+	DbJobsCollection          string          = "stack_update_jobs"
+	DbNotificationsCollection string          = "notifications"
+	DbApiTokensCollection     string          = "api_tokens"
+	DbAuditCollection         string          = "audit_log"
+	DbSettingsCollection      string          = "settings"
+	DbSessionsCollection      string          = "sessions"
+	SecurityPolicyKey         string          = "security"
+	AuditSuccess              string          = "success"
+	AuditFailure              string          = "failure"
+	UpdatePolicyNever         string          = "never"
+	UpdatePolicyNotify        string          = "notify"
+	UpdatePolicyAuto          string          = "auto"
+	RoleViewer                string          = "viewer"
+	RoleOperator              string          = "operator"
+	RoleAdmin                 string          = "admin"
+	AccountProviderOidc       string          = "oidc"
 	StackGroupLabel           string          = "org.walzen.washb.webui"
 	WebUIMachineAddressKey    string          = "${ADDRESS}"
 	StackLabel                string          = "com.docker.compose.project"
+	ServiceLabel              string          = "com.docker.compose.service"
 	IdentityKey               string          = "id"
 	Start                     ContainerAction = "start"
 	Stop                      ContainerAction = "stop"
@@ -90,16 +473,188 @@ const (
 type Login struct {
 	Username string `form:"username" json:"username" binding:"required"`
 	Password string `form:"password" json:"password" binding:"required"`
+	// Otp is the TOTP or a recovery code, required for accounts with two-factor authentication
+	Otp string `form:"otp" json:"otp"`
 }
 
+// User is the identity of a request. ApiTokenId is set if it authenticated with an api token
+// of the account UserName.
 type User struct {
-	UserName string
+	UserName   string
+	Role       string
+	ApiTokenId string
+	SessionId  string
+}
+
+// Session is a login of UserName, stored in the sessions collection. Its Id is the jti claim of
+// every token issued for it, including refreshed ones. Tokens of sessions that are revoked or
+// past ExpiresAt are rejected.
+type Session struct {
+	Id         string `bson:"_id" json:"id"`
+	UserName   string `bson:"userName" json:"userName"`
+	Provider   string `bson:"provider" json:"provider"`
+	ClientIp   string `bson:"clientIp" json:"clientIp"`
+	UserAgent  string `bson:"userAgent" json:"userAgent"`
+	CreatedAt  int64  `bson:"createdAt" json:"createdAt"`
+	LastSeenAt int64  `bson:"lastSeenAt" json:"lastSeenAt"`
+	ExpiresAt  int64  `bson:"expiresAt" json:"expiresAt"`
+	RevokedAt  int64  `bson:"revokedAt" json:"revokedAt"`
 }
+
+// Active reports whether tokens of the session are accepted at now
+func (s *Session) Active(now int64) bool {
+	return s.RevokedAt == 0 && s.ExpiresAt > now
+}
+
+// SessionDto is a Session as returned by the api, Current marks the session of the request
+type SessionDto struct {
+	Session
+	Current bool `json:"current"`
+}
+
+// ApiToken is a long-lived credential of an account for automation. Only the SHA-256 Hash of its
+// secret is stored. It may only be used for Scopes on stacks whose name matches one of Stacks
+// (path.Match patterns), and never grants more than the role of Owner. ExpiresAt and RevokedAt
+// are 0 if not set.
+type ApiToken struct {
+	Id         string   `bson:"_id" json:"id"`
+	Name       string   `bson:"name" json:"name"`
+	Owner      string   `bson:"owner" json:"owner"`
+	Hash       string   `bson:"hash" json:"hash"`
+	Scopes     []string `bson:"scopes" json:"scopes"`
+	Stacks     []string `bson:"stacks" json:"stacks"`
+	CreatedAt  int64    `bson:"createdAt" json:"createdAt"`
+	ExpiresAt  int64    `bson:"expiresAt" json:"expiresAt"`
+	LastUsedAt int64    `bson:"lastUsedAt" json:"lastUsedAt"`
+	RevokedAt  int64    `bson:"revokedAt" json:"revokedAt"`
+}
+
+// ApiTokenDto is an ApiToken as returned by the api, without its hash
+type ApiTokenDto struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Scopes     []string `json:"scopes"`
+	Stacks     []string `json:"stacks"`
+	CreatedAt  int64    `json:"createdAt"`
+	ExpiresAt  int64    `json:"expiresAt"`
+	LastUsedAt int64    `json:"lastUsedAt"`
+	RevokedAt  int64    `json:"revokedAt"`
+}
+
+func (t *ApiToken) Dto() ApiTokenDto {
+	return ApiTokenDto{
+		Id:         t.Id,
+		Name:       t.Name,
+		Owner:      t.Owner,
+		Scopes:     t.Scopes,
+		Stacks:     t.Stacks,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		RevokedAt:  t.RevokedAt,
+	}
+}
+
+// Account is a user of washboard stored in the accounts collection, keyed by UserName.
+// Role is one of RoleViewer, RoleOperator and RoleAdmin. Provider is empty for accounts logging
+// in with a password and AccountProviderOidc for accounts created by single sign-on, which have
+// no password. Single sign-on accounts are keyed by the issuer and subject of the user, the name
+// the provider reports is kept in DisplayName.
+//
+// TotpSecret is set once two-factor authentication is enabled, TotpPendingSecret while it is
+// being enrolled. TotpLastStep is the time step of the last accepted code, codes can not be
+// reused. RecoveryCodes holds the SHA-256 hashes of the unused recovery codes.
+type Account struct {
+	UserName          string   `bson:"_id" json:"userName"`
+	DisplayName       string   `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	PasswordHash      string   `bson:"passwordHash" json:"passwordHash"`
+	Role              string   `bson:"role" json:"role"`
+	Provider          string   `bson:"provider" json:"provider"`
+	CreatedAt         int64    `bson:"createdAt" json:"createdAt"`
+	UpdatedAt         int64    `bson:"updatedAt" json:"updatedAt"`
+	TotpSecret        string   `bson:"totpSecret,omitempty" json:"totpSecret,omitempty"`
+	TotpPendingSecret string   `bson:"totpPendingSecret,omitempty" json:"totpPendingSecret,omitempty"`
+	TotpLastStep      int64    `bson:"totpLastStep,omitempty" json:"totpLastStep,omitempty"`
+	RecoveryCodes     []string `bson:"recoveryCodes,omitempty" json:"recoveryCodes,omitempty"`
+}
+
+// AccountDto is an Account as returned by the api, without credentials
+type AccountDto struct {
+	UserName          string `json:"userName"`
+	DisplayName       string `json:"displayName,omitempty"`
+	Role              string `json:"role"`
+	Provider          string `json:"provider"`
+	CreatedAt         int64  `json:"createdAt"`
+	UpdatedAt         int64  `json:"updatedAt"`
+	TwoFactorEnabled  bool   `json:"twoFactorEnabled"`
+	RecoveryCodesLeft int    `json:"recoveryCodesLeft"`
+}
+
+func (a *Account) Dto() AccountDto {
+	return AccountDto{
+		UserName:          a.UserName,
+		DisplayName:       a.DisplayName,
+		Role:              a.Role,
+		Provider:          a.Provider,
+		CreatedAt:         a.CreatedAt,
+		UpdatedAt:         a.UpdatedAt,
+		TwoFactorEnabled:  a.TotpSecret != "",
+		RecoveryCodesLeft: len(a.RecoveryCodes),
+	}
+}
+
+// SecurityPolicy holds the security settings admins change at runtime, stored in the settings
+// collection under SecurityPolicyKey. Accounts with one of RequireTwoFactorRoles can only use
+// washboard after enrolling two-factor authentication.
+type SecurityPolicy struct {
+	RequireTwoFactorRoles []string `bson:"requireTwoFactorRoles" json:"requireTwoFactorRoles"`
+	UpdatedBy             string   `bson:"updatedBy" json:"updatedBy"`
+	UpdatedAt             int64    `bson:"updatedAt" json:"updatedAt"`
+}
+
+// StackSettings are keyed by (EndpointId, StackName). Priorities are ordered per endpoint.
 type StackSettings struct {
-	StackName string `bson:"stackName" json:"stackName"`
-	StackId   int    `bson:"stackId" json:"stackId"`
-	Priority  int    `bson:"priority" json:"priority"`
-	AutoStart bool   `bson:"autoStart" json:"autoStart"`
+	EndpointId int    `bson:"endpointId" json:"endpointId"`
+	StackName  string `bson:"stackName" json:"stackName"`
+	StackId    int    `bson:"stackId" json:"stackId"`
+	Priority   int    `bson:"priority" json:"priority"`
+	AutoStart  bool   `bson:"autoStart" json:"autoStart"`
+	// UpdatePolicy is one of UpdatePolicyNever, UpdatePolicyNotify and UpdatePolicyAuto. Empty
+	// means UpdatePolicyNotify. UpdateWindow is the cron expression of the minutes in which
+	// UpdatePolicyAuto may update the stack.
+	UpdatePolicy string `bson:"updatePolicy" json:"updatePolicy"`
+	UpdateWindow string `bson:"updateWindow" json:"updateWindow"`
+	// DependsOn names the stacks of the endpoint that are started before and stopped after this one
+	DependsOn []string `bson:"dependsOn" json:"dependsOn"`
+	// StartTimeout is the number of seconds the autostart sync waits for the containers of the
+	// stack to be running and healthy, 0 uses the configured default
+	StartTimeout int `bson:"startTimeout" json:"startTimeout"`
+}
+
+// GroupSettings are keyed by (EndpointId, GroupName). A group bundles Stacks of the endpoint that
+// are started, stopped and updated together. GlobalPriority orders the group among the ungrouped
+// stacks of the endpoint, whose priorities share the same range; the stacks of a group keep the
+// order of their own priorities. A stack belongs to at most one group.
+type GroupSettings struct {
+	EndpointId     int      `bson:"endpointId" json:"endpointId"`
+	GroupName      string   `bson:"groupName" json:"groupName"`
+	GlobalPriority int      `bson:"globalPriority" json:"globalPriority"`
+	Stacks         []string `bson:"stacks" json:"stacks"`
+}
+
+// GroupStackResult is the outcome of a group action or of stopping all stacks for one stack.
+// Result is one of Done, Queued, Skipped and Error. Wave is the start wave of the stack, see
+// StartWaves, stacks of the same wave are processed in parallel and stops run the waves in
+// reverse. Killed names the containers that did not exit within the grace period of a stop and
+// were killed.
+type GroupStackResult struct {
+	StackId   int      `json:"stackId"`
+	StackName string   `json:"stackName"`
+	Wave      int      `json:"wave"`
+	Result    string   `json:"result"`
+	Killed    []string `json:"killed,omitempty"`
+	Error     string   `json:"error,omitempty"`
 }
 
 type SyncOptions struct {
@@ -65,3 +65,26 @@ func NewAlreadyInProgressError(err error, info string) *AlreadyInProgressError {
 		Err:     err,
 	}
 }
+
+// PortainerError is returned by the portainer client when the Portainer API answers with a
+// non-2xx status code. Message and Details are decoded from Portainer's {message, details} body.
+type PortainerError struct {
+	StatusCode int
+	Message    string
+	Details    string
+}
+
+func (w *PortainerError) Error() string {
+	if w.Details == "" {
+		return fmt.Sprintf("portainer returned %d: %s", w.StatusCode, w.Message)
+	}
+	return fmt.Sprintf("portainer returned %d: %s. %s", w.StatusCode, w.Message, w.Details)
+}
+
+func NewPortainerError(statusCode int, message string, details string) *PortainerError {
+	return &PortainerError{
+		StatusCode: statusCode,
+		Message:    message,
+		Details:    details,
+	}
+}
@@ -1,10 +1,12 @@
 import axios, { AxiosError } from "axios";
-import { Stack, StackInternal, Action, Container, UpdateQueue, QueueItem, QueueStatus, WsEnvelope, WsMessageType, ImageRefreshState } from "@/types/types";
+import { Stack, StackInternal, Action, Container, UpdateQueue, QueueItem, QueueStatus, WsEnvelope, WsMessageType, ImageRefreshState, EndpointContainerStates, ContainerStateEvent, LogLine, ExecMessage, StackStats } from "@/types/types";
 import { Store, storeToRefs } from "pinia";
 import { useLocalStore } from "@/store/local";
 import { useSnackbarStore } from "@/store/snackbar";
 import { useUpdateQuelelelStore } from "@/store/updateQuelelel";
 import { useImageRefreshStore } from "@/store/imageRefresh";
+import { useContainerStateStore } from "@/store/containerState";
+import { useStatsStore } from "@/store/stats";
 import { useAppStore } from "@/store/app";
 
 const webUILabel = "org.walzen.washb.webui";
@@ -46,6 +48,16 @@ async function getContainers(stackName: string, endpointId: number = 1) {
     return response;
 }
 
+// resource usage history of a stack and its containers, range is a duration like "1h"
+async function getStackStats(stackId: number, range: string = "1h") {
+    const response = await axios.get(`/api/portainer/stacks/${stackId}/stats`, {
+        params: {
+            range: range,
+        },
+    });
+    return response.data as StackStats;
+}
+
 async function isAuthorized() {
     try {
         await axios.get("/api");
@@ -148,10 +160,17 @@ function getFirstContainerIcon(containers: Container[]): string | undefined {
     }
 }
 
+// epoch and seq of the last websocket event, reconnects resume after it instead of loading a
+// snapshot. seq restarts with the backend, it is only meaningful within its epoch.
+let lastWsEpoch = "";
+let lastWsSeq = 0;
+
 function connectWebSocket() {
     const updateQuelelelStore = useUpdateQuelelelStore();
     const { queue: stackQueue } = storeToRefs(updateQuelelelStore);
     const imageRefreshStore = useImageRefreshStore();
+    const containerStateStore = useContainerStateStore();
+    const statsStore = useStatsStore();
     const snackbarsStore = useSnackbarStore();
     const appStore = useAppStore();
     const { webSocketStacksUpdate } = storeToRefs(appStore);
@@ -160,8 +179,46 @@ function connectWebSocket() {
     let wsAddr = `${axios.defaults.baseURL}/api/ws/stacks-update`
         .replace("http://", "ws://")
         .replace("https://", "wss://");
+    if (lastWsEpoch && lastWsSeq > 0) {
+        wsAddr += `?epoch=${encodeURIComponent(lastWsEpoch)}&since=${lastWsSeq}`;
+    }
     let socket = new WebSocket(wsAddr);
     webSocketStacksUpdate.value = socket;
+
+    // notifies about an update that finished since the last status of the stack
+    function notifyQueueChange(queueItem: QueueItem, newStatus: QueueStatus) {
+        let previousBucket: string | undefined = undefined;
+        for (let [oldStatus, oldItems] of Object.entries(stackQueue.value) as [QueueStatus, Record<string, QueueItem>][]) {
+            if (queueItem.stackName in oldItems) {
+                previousBucket = oldStatus;
+                break;
+            }
+        }
+
+        switch (newStatus) {
+            case QueueStatus.Queued:
+                break;
+            case QueueStatus.Done:
+                if (previousBucket && previousBucket != newStatus) {
+                    snackbarsStore.addSnackbar(
+                        `${queueItem.stackId}_update`,
+                        `Stack ${queueItem.stackName} updated successfully`,
+                        "success"
+                    );
+                }
+                break;
+            case QueueStatus.Error:
+                if (previousBucket && previousBucket != newStatus) {
+                    snackbarsStore.addSnackbar(
+                        `${queueItem.stackId}_update`,
+                        `Stack ${queueItem.stackName} update failed`,
+                        "error"
+                    );
+                }
+                break;
+        }
+    }
+
     socket.onmessage = function (event) {
         let envelope: WsEnvelope;
         try {
@@ -170,53 +227,57 @@ function connectWebSocket() {
             console.error("failed to parse ws envelope", e);
             return;
         }
+        if (envelope.epoch !== lastWsEpoch) {
+            // the backend restarted, its sequence started over
+            lastWsEpoch = envelope.epoch;
+            lastWsSeq = envelope.seq;
+        } else {
+            lastWsSeq = Math.max(lastWsSeq, envelope.seq);
+        }
 
         switch (envelope.type) {
             case WsMessageType.StackUpdateQueue: {
                 const data = envelope.data as UpdateQueue;
                 for (let [newStatus, newItems] of Object.entries(data) as [QueueStatus, Record<string, QueueItem>][]) {
                     for (let stackName in newItems) {
-                        const queueItem = newItems[stackName];
-
-                        let previousBucket: string | undefined = undefined;
-                        for (let [oldStatus, oldItems] of Object.entries(stackQueue.value) as [QueueStatus, Record<string, QueueItem>][]) {
-                            if (queueItem.stackName in oldItems) {
-                                previousBucket = oldStatus;
-                                break;
-                            }
-                        }
-
-                        switch (newStatus) {
-                            case QueueStatus.Queued:
-                                break;
-                            case QueueStatus.Done:
-                                if (previousBucket && previousBucket != newStatus) {
-                                    snackbarsStore.addSnackbar(
-                                        `${queueItem.stackId}_update`,
-                                        `Stack ${queueItem.stackName} updated successfully`,
-                                        "success"
-                                    );
-                                }
-                                break;
-                            case QueueStatus.Error:
-                                if (previousBucket && previousBucket != newStatus) {
-                                    snackbarsStore.addSnackbar(
-                                        `${queueItem.stackId}_update`,
-                                        `Stack ${queueItem.stackName} update failed`,
-                                        "error"
-                                    );
-                                }
-                                break;
-                        }
+                        notifyQueueChange(newItems[stackName], newStatus);
                     }
                 }
                 updateQuelelelStore.update(data);
                 break;
             }
+            case WsMessageType.StackUpdate: {
+                const queueItem = envelope.data as QueueItem;
+                notifyQueueChange(queueItem, queueItem.status);
+                updateQuelelelStore.dequeue(queueItem.stackName);
+                updateQuelelelStore.enqueue(queueItem);
+                break;
+            }
+            case WsMessageType.StackUpdateRemoved: {
+                updateQuelelelStore.dequeue((envelope.data as QueueItem).stackName);
+                break;
+            }
             case WsMessageType.ImageRefreshState: {
                 imageRefreshStore.update(envelope.data as ImageRefreshState);
                 break;
             }
+            case WsMessageType.ContainerStates: {
+                containerStateStore.replace(envelope.data as EndpointContainerStates[]);
+                break;
+            }
+            case WsMessageType.ContainerState: {
+                containerStateStore.apply(envelope.data as ContainerStateEvent);
+                break;
+            }
+            case WsMessageType.StackStats: {
+                statsStore.update(envelope.data as StackStats[]);
+                break;
+            }
+            case WsMessageType.StartupProgress:
+            case WsMessageType.StartupState:
+            case WsMessageType.StartupStack:
+                // not shown yet
+                break;
             default:
                 console.warn("unknown ws envelope type", envelope.type);
         }
@@ -235,6 +296,72 @@ function connectWebSocket() {
     };
 }
 
+// follows the logs of a container, the socket is closed once the logs end
+function connectContainerLogs(
+    containerId: string,
+    onLine: (line: LogLine) => void,
+    options: { endpointId?: number; tail?: number | "all"; filter?: string; timestamps?: boolean; follow?: boolean } = {}
+) {
+    const params = new URLSearchParams({
+        endpointId: String(options.endpointId ?? defaultEndpointId),
+        tail: String(options.tail ?? 100),
+        timestamps: String(options.timestamps ?? false),
+        follow: String(options.follow ?? true),
+    });
+    if (options.filter) {
+        params.set("filter", options.filter);
+    }
+    const wsAddr = `${axios.defaults.baseURL}/api/ws/containers/${containerId}/logs?${params}`
+        .replace("http://", "ws://")
+        .replace("https://", "wss://");
+    const socket = new WebSocket(wsAddr);
+    socket.onmessage = function (event) {
+        try {
+            onLine(JSON.parse(event.data) as LogLine);
+        } catch (e) {
+            console.error("failed to parse log line", e);
+        }
+    };
+    return socket;
+}
+
+// opens a terminal in a container (admins only), the socket is closed with the exit code once the command ends
+function connectContainerExec(
+    containerId: string,
+    onOutput: (data: ArrayBuffer) => void,
+    options: { endpointId?: number; cmd?: string; user?: string; rows?: number; cols?: number } = {}
+) {
+    const params = new URLSearchParams({
+        endpointId: String(options.endpointId ?? defaultEndpointId),
+        cmd: options.cmd ?? "/bin/sh",
+    });
+    if (options.user) {
+        params.set("user", options.user);
+    }
+    if (options.rows && options.cols) {
+        params.set("rows", String(options.rows));
+        params.set("cols", String(options.cols));
+    }
+    const wsAddr = `${axios.defaults.baseURL}/api/ws/containers/${containerId}/exec?${params}`
+        .replace("http://", "ws://")
+        .replace("https://", "wss://");
+    const socket = new WebSocket(wsAddr);
+    socket.binaryType = "arraybuffer";
+    socket.onmessage = function (event) {
+        onOutput(event.data as ArrayBuffer);
+    };
+    const send = (message: ExecMessage) => {
+        if (socket.readyState === WebSocket.OPEN) {
+            socket.send(JSON.stringify(message));
+        }
+    };
+    return {
+        socket,
+        input: (data: string) => send({ type: "input", data }),
+        resize: (rows: number, cols: number) => send({ type: "resize", rows, cols }),
+    };
+}
+
 async function triggerImageRefresh(endpointId: number = 1) {
     // Fire and forget. Backend dedupes; completion arrives via websocket.
     return axios.post("/api/portainer/refresh-image-status", null, {
@@ -252,6 +379,7 @@ export {
     stopStack,
     startStack,
     getContainers,
+    getStackStats,
     isAuthorized,
     callRefreshTokenRoute,
     webUILabel,
@@ -261,6 +389,8 @@ export {
     getPortainerUrl,
     getContainerStatusCircleColor,
     connectWebSocket,
+    connectContainerLogs,
+    connectContainerExec,
     triggerImageRefresh,
     awaitTimeout,
 };
@@ -0,0 +1,46 @@
+import { Container, ContainerState, ContainerStateEvent, EndpointContainerStates } from "@/types/types";
+import { defineStore } from "pinia";
+import { ref, Ref } from "vue";
+
+const STORE_NAME = "containerState";
+
+// live container states pushed by the backend from the docker event stream, keyed by container id
+export const useContainerStateStore = defineStore(STORE_NAME, () => {
+    const containers: Ref<Record<string, ContainerState>> = ref({});
+    const connected: Ref<Record<number, boolean>> = ref({});
+
+    function replace(endpoints: EndpointContainerStates[]) {
+        for (const endpoint of endpoints) {
+            for (const id in containers.value) {
+                if (containers.value[id].endpointId === endpoint.endpointId) {
+                    delete containers.value[id];
+                }
+            }
+            for (const container of endpoint.containers) {
+                containers.value[container.containerId] = container;
+            }
+            connected.value[endpoint.endpointId] = endpoint.connected;
+        }
+    }
+
+    function apply(event: ContainerStateEvent) {
+        if (event.action === "destroy") {
+            delete containers.value[event.container.containerId];
+        } else {
+            containers.value[event.container.containerId] = event.container;
+        }
+    }
+
+    // the live status of a container, the listed one until an event arrived
+    function statusOf(container: Container): string {
+        return containers.value[container.id]?.status ?? container.status;
+    }
+
+    return {
+        containers,
+        connected,
+        replace,
+        apply,
+        statusOf,
+    };
+});
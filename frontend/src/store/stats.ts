@@ -0,0 +1,26 @@
+import { StackStats, StatsSample } from "@/types/types";
+import { defineStore } from "pinia";
+import { ref, Ref } from "vue";
+
+const STORE_NAME = "stats";
+
+// latest resource usage of every stack pushed by the backend after each sampling, keyed by endpoint and stack name
+export const useStatsStore = defineStore(STORE_NAME, () => {
+    const stacks: Ref<Record<string, StackStats>> = ref({});
+
+    function update(latest: StackStats[]) {
+        for (const stack of latest) {
+            stacks.value[`${stack.endpointId}/${stack.stackName}`] = stack;
+        }
+    }
+
+    function latestOf(endpointId: number, stackName: string): StatsSample | undefined {
+        return stacks.value[`${endpointId}/${stackName}`]?.samples[0];
+    }
+
+    return {
+        stacks,
+        update,
+        latestOf,
+    };
+});
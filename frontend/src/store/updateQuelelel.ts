@@ -30,7 +30,7 @@ export const useUpdateQuelelelStore = defineStore(STORE_NAME, () => {
         }
     }
 
-    function dequeue(stackName: number) {
+    function dequeue(stackName: string) {
         for (const status in queue.value) {
             if (status in QueueStatus) {
                 const queueStatusKey = status as QueueStatus;
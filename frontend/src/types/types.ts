@@ -8,6 +8,7 @@ interface Container {
   networks: string[];
   ports: string[];
   labels: Record<string, string>;
+  stats?: StatsSample;
 }
 
 interface StackInternal extends Stack {
@@ -17,21 +18,29 @@ interface StackInternal extends Stack {
 
 interface Stack extends StackSettings {
   id: number;
+  endpointId: number;
   name: string;
   containers: Container[];
   updateStatus: Object[];
 }
 
+type UpdatePolicy = "" | "never" | "notify" | "auto";
+
 interface StackSettings {
   priority: number;
   autoStart: boolean;
+  updatePolicy?: UpdatePolicy;
+  updateWindow?: string;
 }
 
 interface StackSettingsDto {
+  endpointId?: number;
   stackName: string;
   stackId: number;
   priority: number;
   autoStart: boolean;
+  updatePolicy?: UpdatePolicy;
+  updateWindow?: string;
 }
 
 interface Group extends GroupSettings {
@@ -85,11 +94,23 @@ interface ImageRefreshState {
 
 enum WsMessageType {
   StackUpdateQueue = "stack-update-queue",
+  StackUpdate = "stack-update",
+  StackUpdateRemoved = "stack-update-removed",
   ImageRefreshState = "image-refresh-state",
+  StartupProgress = "startup-progress",
+  StartupState = "startup-state",
+  StartupStack = "startup-stack",
+  ContainerStates = "container-states",
+  ContainerState = "container-state",
+  StackStats = "stack-stats",
 }
 
 interface WsEnvelope<T = unknown> {
+  epoch: string;
+  seq: number;
+  topic: string;
   type: WsMessageType;
+  time: number;
   data: T;
 }
 
@@ -119,6 +140,73 @@ enum Action {
   Stop = "stop",
   Restart = "restart",
 }
+interface ContainerState {
+  endpointId: number;
+  containerId: string;
+  name: string;
+  stackName: string;
+  status: string;
+  health: string;
+  updatedAt: number;
+}
+
+interface EndpointContainerStates {
+  endpointId: number;
+  connected: boolean;
+  containers: ContainerState[];
+}
+
+interface ContainerStateEvent {
+  action: string;
+  container: ContainerState;
+  stack?: {
+    endpointId: number;
+    stackName: string;
+    containers: number;
+    running: number;
+    healthchecks: number;
+    healthy: number;
+  };
+}
+
+// resource usage of a container or the sum of a stack, network and block I/O in bytes per second
+interface StatsSample {
+  time: number;
+  cpuPercent: number;
+  memoryUsage: number;
+  memoryLimit?: number;
+  networkRx: number;
+  networkTx: number;
+  blockRead: number;
+  blockWrite: number;
+  containers?: number;
+}
+
+interface StackStats {
+  endpointId: number;
+  stackId?: number;
+  stackName: string;
+  interval: number;
+  samples: StatsSample[];
+  containers: {
+    containerId: string;
+    name: string;
+    samples: StatsSample[];
+  }[];
+}
+
+interface LogLine {
+  stream: "stdout" | "stderr";
+  timestamp?: string;
+  line: string;
+}
+
+interface ExecMessage {
+  type: "input" | "resize";
+  data?: string;
+  rows?: number;
+  cols?: number;
+}
 
 interface QueueItem {
   details: string;
@@ -153,5 +241,13 @@ export type {
   SidebarSettings,
   URLConfig,
   ImageRefreshState,
-  WsEnvelope
+  ContainerState,
+  EndpointContainerStates,
+  ContainerStateEvent,
+  LogLine,
+  ExecMessage,
+  StatsSample,
+  StackStats,
+  WsEnvelope,
+  UpdatePolicy
 };